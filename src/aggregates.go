@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ErrorNoValues is shown when an aggregate has no numeric results to work on
+const ErrorNoValues = "No values to aggregate"
+
+// aggregateRegex matches aggregate calls over the preceding results like "product()"
+var aggregateRegex = regexp.MustCompile(`\b(total|avg|product|gmean)\(\s*\)`)
+
+// aggregateFunctions computes each aggregate from the collected values,
+// reporting false when the aggregate is undefined for them
+var aggregateFunctions = map[string]func(values []float64) (float64, bool){
+	"total": func(values []float64) (float64, bool) {
+		sum := 0.0
+		for _, value := range values {
+			sum += value
+		}
+		return sum, true
+	},
+	"avg": func(values []float64) (float64, bool) {
+		if len(values) == 0 {
+			return 0, false
+		}
+		sum := 0.0
+		for _, value := range values {
+			sum += value
+		}
+		return sum / float64(len(values)), true
+	},
+	"product": func(values []float64) (float64, bool) {
+		// The empty product is 1
+		product := 1.0
+		for _, value := range values {
+			product *= value
+		}
+		return product, true
+	},
+	"gmean": func(values []float64) (float64, bool) {
+		if len(values) == 0 {
+			return 0, false
+		}
+		// Sum logarithms to avoid overflowing on long lists
+		logSum := 0.0
+		for _, value := range values {
+			if value < 0 {
+				return 0, false
+			}
+			if value == 0 {
+				return 0, true
+			}
+			logSum += math.Log(value)
+		}
+		return math.Exp(logSum / float64(len(values))), true
+	},
+}
+
+// superscriptValues maps superscript characters from prettyPrint back to ASCII
+var superscriptValues = strings.NewReplacer(
+	"⁰", "0", "¹", "1", "²", "2", "³", "3", "⁴", "4",
+	"⁵", "5", "⁶", "6", "⁷", "7", "⁸", "8", "⁹", "9", "⁻", "-",
+)
+
+// parseResultNumber parses a plain numeric result like "-1.5" or "1.2 × 10⁻⁴".
+// Results with units, currencies or text are not numeric.
+func parseResultNumber(result string) (float64, bool) {
+	text := strings.TrimSpace(result)
+	if text == "" {
+		return 0, false
+	}
+
+	// libqalculate prints a unicode minus sign
+	text = strings.ReplaceAll(text, "−", "-")
+	text = normalizeNumbers(text)
+
+	// Undo prettyPrint's scientific notation
+	if base, exponent, found := strings.Cut(text, " × 10"); found {
+		text = base + "E" + superscriptValues.Replace(exponent)
+	}
+
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, false
+	}
+	return value, true
+}
+
+// precedingValues collects the numeric results of the lines before currentIndex
+func precedingValues(results []string, currentIndex int) []float64 {
+	var values []float64
+	for i := 0; i < currentIndex && i < len(results); i++ {
+		if value, ok := parseResultNumber(results[i]); ok {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// replaceAggregates substitutes aggregate calls like "product()" with their value
+// over the numeric results of the preceding lines
+func replaceAggregates(expr string, results []string, currentIndex int) (string, error) {
+	if !aggregateRegex.MatchString(expr) {
+		return expr, nil
+	}
+
+	values := precedingValues(results, currentIndex)
+	var aggregateErr error
+	replaced := aggregateRegex.ReplaceAllStringFunc(expr, func(match string) string {
+		name := aggregateRegex.FindStringSubmatch(match)[1]
+		value, ok := aggregateFunctions[name](values)
+		if !ok {
+			if len(values) == 0 {
+				aggregateErr = errors.New(ErrorNoValues)
+			} else {
+				aggregateErr = fmt.Errorf("%s() is undefined for the preceding values", name)
+			}
+			return match
+		}
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	})
+	return replaced, aggregateErr
+}
+
+// parseResultAmount parses a plain numeric result or a currency amount like
+// "12.5 €" or "-$3", returning the currency symbol, empty for plain numbers
+func parseResultAmount(result string) (float64, string, bool) {
+	if value, ok := parseResultNumber(result); ok {
+		return value, "", true
+	}
+
+	text := strings.ReplaceAll(strings.TrimSpace(result), "−", "-")
+	sign := 1.0
+	if rest, found := strings.CutPrefix(text, "-"); found {
+		sign, text = -1, strings.TrimSpace(rest)
+	}
+	for _, currency := range inputCurrencies() {
+		number, found := strings.CutSuffix(text, currency.symbol)
+		if !found {
+			number, found = strings.CutPrefix(text, currency.symbol)
+		}
+		if !found {
+			continue
+		}
+		if value, ok := parseResultNumber(number); ok {
+			return sign * value, currency.symbol, true
+		}
+	}
+	return 0, "", false
+}
+
+// resultTotals sums the numeric results and the currency amounts per currency,
+// plain numbers first and currencies in order of appearance. Results with
+// other units are left out.
+func resultTotals(results []string) []string {
+	sums := make(map[string]float64)
+	var symbols []string
+	for _, result := range results {
+		value, symbol, ok := parseResultAmount(result)
+		if !ok {
+			continue
+		}
+		if _, exists := sums[symbol]; !exists {
+			symbols = append(symbols, symbol)
+		}
+		sums[symbol] += value
+	}
+	if _, exists := sums[""]; exists {
+		symbols = append([]string{""}, slices.DeleteFunc(symbols, func(symbol string) bool { return symbol == "" })...)
+	}
+
+	totals := make([]string, 0, len(symbols))
+	for _, symbol := range symbols {
+		// Round away float noise like 0.30000000000000004
+		sum := sums[symbol]
+		if rounded := math.Round(sum*1e9) / 1e9; !math.IsInf(rounded, 0) {
+			sum = rounded
+		}
+		total := groupThousands(localizeDecimal(strconv.FormatFloat(sum, 'f', -1, 64)))
+		if symbol != "" {
+			total += " " + symbol
+		}
+		totals = append(totals, total)
+	}
+	return totals
+}
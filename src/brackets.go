@@ -0,0 +1,166 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// closingBrackets maps opening brackets to the brackets closing them
+var closingBrackets = map[rune]rune{'(': ')', '[': ']', '{': '}'}
+
+// isClosingBracket reports whether r closes a bracket
+func isClosingBracket(r rune) bool {
+	return r == ')' || r == ']' || r == '}'
+}
+
+// matchBrackets pairs up the brackets of value, mapping the index of each
+// bracket to the index of its partner, or to -1 for an unbalanced bracket
+func matchBrackets(value []rune) map[int]int {
+	matches := make(map[int]int)
+	var open []int
+	for i, r := range value {
+		if _, exists := closingBrackets[r]; exists {
+			open = append(open, i)
+			continue
+		}
+		if !isClosingBracket(r) {
+			continue
+		}
+		if len(open) == 0 || closingBrackets[value[open[len(open)-1]]] != r {
+			// A closing bracket without its opening one, like the ] of "(]"
+			matches[i] = -1
+			continue
+		}
+		matches[open[len(open)-1]] = i
+		matches[i] = open[len(open)-1]
+		open = open[:len(open)-1]
+	}
+	for _, i := range open {
+		matches[i] = -1
+	}
+	return matches
+}
+
+// hasUnbalancedBrackets reports whether expr has a bracket without its
+// partner, like the unclosed ( of "sqrt(2" or the ] of "(1 + 2]"
+func hasUnbalancedBrackets(expr string) bool {
+	for _, partner := range matchBrackets([]rune(expr)) {
+		if partner < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// bracketHighlights returns the brackets of value to highlight with the cursor
+// at pos: the bracket under the cursor, or else right before it, with its
+// match, and every unbalanced bracket
+func bracketHighlights(value []rune, pos int) (matched, unbalanced []int) {
+	matches := matchBrackets(value)
+	for i, partner := range matches {
+		if partner < 0 {
+			unbalanced = append(unbalanced, i)
+		}
+	}
+
+	for _, i := range []int{pos, pos - 1} {
+		if partner, exists := matches[i]; exists {
+			if partner >= 0 {
+				matched = []int{min(i, partner), max(i, partner)}
+			}
+			break
+		}
+	}
+	return matched, unbalanced
+}
+
+// enclosingBrackets returns the indexes of the innermost matched brackets of
+// value around the cursor at pos, counting a cursor right before the opening
+// or right after the closing bracket as inside
+func enclosingBrackets(value []rune, pos int) (int, int, bool) {
+	first, last := -1, -1
+	for open, close := range matchBrackets(value) {
+		if close < open || open > pos || pos > close+1 {
+			continue
+		}
+		if first < 0 || close-open < last-first {
+			first, last = open, close
+		}
+	}
+	return first, last, first >= 0
+}
+
+// inputOffset returns the index of the first rune of the value shown in the
+// view of input. textinput scrolls long values horizontally as the cursor
+// moves, keeping how far in its unexported offset, so it is read from there
+// rather than guessed from the rendered text.
+func inputOffset(input textinput.Model) int {
+	offset := reflect.ValueOf(input).FieldByName("offset")
+	if offset.Kind() != reflect.Int {
+		return 0
+	}
+	return min(int(offset.Int()), len([]rune(input.Value())))
+}
+
+// highlightBrackets colors the bracket at the cursor of the focused input and
+// its match, and unbalanced brackets in the error color, in its rendered view
+func (m Model) highlightBrackets(view string, input textinput.Model) string {
+	matched, unbalanced := bracketHighlights([]rune(input.Value()), input.Position())
+	if len(matched) == 0 && len(unbalanced) == 0 {
+		return view
+	}
+
+	offset := inputOffset(input)
+	styles := make(map[int]lipgloss.Style)
+	for _, i := range matched {
+		styles[i-offset] = lipgloss.NewStyle().Foreground(m.Theme.bracketColor).Bold(true)
+	}
+	for _, i := range unbalanced {
+		styles[i-offset] = lipgloss.NewStyle().Foreground(m.Theme.errorColor).Bold(true)
+	}
+	return styleRunes(view, styles, true)
+}
+
+// styleRunes renders the shown runes of text with the style of their index,
+// copying escape codes unchanged. Runes already styled, like the cursor, are
+// only restyled if overStyled is set.
+func styleRunes(text string, styles map[int]lipgloss.Style, overStyled bool) string {
+	var builder strings.Builder
+	index := 0
+	styled := false
+	for i := 0; i < len(text); {
+		if escape := ansiEscapeAt(text, i); escape != "" {
+			builder.WriteString(escape)
+			styled = escape != "\x1b[0m" && escape != "\x1b[m"
+			i += len(escape)
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(text[i:])
+		if style, exists := styles[index]; exists && (overStyled || !styled) {
+			builder.WriteString(style.Render(string(r)))
+		} else {
+			builder.WriteString(text[i : i+size])
+		}
+		index++
+		i += size
+	}
+	return builder.String()
+}
+
+// ansiEscapeAt returns the escape code starting at text[i:], if any
+func ansiEscapeAt(text string, i int) string {
+	if !strings.HasPrefix(text[i:], "\x1b[") {
+		return ""
+	}
+	end := strings.IndexFunc(text[i+2:], func(r rune) bool {
+		return r >= '@' && r <= '~'
+	})
+	if end < 0 {
+		return text[i:]
+	}
+	return text[i : i+2+end+1]
+}
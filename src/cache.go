@@ -0,0 +1,118 @@
+package main
+
+import (
+	"container/list"
+	"regexp"
+	"sync"
+)
+
+// resultCacheSize is the number of libqalculate results kept for reuse
+const resultCacheSize = 512
+
+// resultCache keeps the latest libqalculate outputs by the expression they
+// were calculated from, so recalculating a line whose ans values didn't change
+// skips the cgo call. It is cleared whenever a setting changes how
+// libqalculate calculates or prints.
+var resultCache = newLRUCache(resultCacheSize)
+
+// approximateResults keeps whether libqalculate approximated a result, by the
+// line and the result, so the result pane marks it with approximateMark
+// wherever the line moves. Values are approximateMark or empty for exact ones.
+var approximateResults = newLRUCache(resultCacheSize)
+
+// approximationKey identifies the result of a line, which holds no newlines
+func approximationKey(line, result string) string {
+	return line + "\n" + result
+}
+
+// recordApproximation remembers whether result of line was approximated
+func recordApproximation(line, result string, approximate bool) {
+	if result == "" {
+		return
+	}
+	mark := ""
+	if approximate {
+		mark = approximateMark
+	}
+	approximateResults.Put(approximationKey(line, result), mark)
+}
+
+// isApproximateResult reports whether result of line was approximated
+func isApproximateResult(line, result string) bool {
+	mark, _ := approximateResults.Get(approximationKey(line, result))
+	return mark != ""
+}
+
+// volatileRegex matches expressions whose value changes over time
+var volatileRegex = regexp.MustCompile(`(?i)\b(?:now|today|tomorrow|yesterday|time|rand\w*)\b`)
+
+// lruCache maps keys to values, evicting the least recently used entry
+// when full. It is safe for concurrent use.
+type lruCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List // Most recently used first
+	entries  map[string]*list.Element
+}
+
+// lruEntry is the key and value stored in an element of the order list
+type lruEntry struct {
+	key   string
+	value string
+}
+
+// newLRUCache creates a cache holding up to capacity entries
+func newLRUCache(capacity int) *lruCache {
+	return &lruCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// Get returns the value cached for key, marking it as recently used
+func (c *lruCache) Get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, exists := c.entries[key]
+	if !exists {
+		return "", false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*lruEntry).value, true
+}
+
+// Put caches value for key, evicting the least recently used entry when full
+func (c *lruCache) Put(key, value string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, exists := c.entries[key]; exists {
+		element.Value.(*lruEntry).value = value
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key, value})
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+// Clear removes all entries
+func (c *lruCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order.Init()
+	clear(c.entries)
+}
+
+// Len returns the number of cached entries
+func (c *lruCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
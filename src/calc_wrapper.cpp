@@ -8,12 +8,35 @@
 #include <locale.h>
 #include <mutex>
 #include <algorithm>
+#include <set>
 
 using namespace std;
 
 static bool calculator_initialized = false;
 static std::mutex calculator_mutex;
 
+// Session settings, changed by worksheet directives
+static AngleUnit session_angle_unit = ANGLE_UNIT_RADIANS;
+static int session_precision = 9;
+static bool exact_mode = false;
+static bool fraction_mode = false;
+static int output_base = BASE_DECIMAL;
+
+// Decimal separator of printed results, set from the config
+static std::string decimal_sign = ".";
+
+// Names of the functions defined by worksheet lines
+static std::set<std::string> user_functions;
+
+// Removes a function defined by a worksheet line, the mutex must be held
+static void remove_user_function(const std::string& name) {
+    if (user_functions.erase(name) == 0) return;
+    MathFunction* function = calculator->getActiveFunction(name);
+    if (function) {
+        function->destroy();
+    }
+}
+
 // Helper function to check if string ends with suffix
 static bool hasEnding(const std::string& fullString, const std::string& ending) {
     if (fullString.length() >= ending.length()) {
@@ -28,6 +51,16 @@ static void load_currencies() {
     }
 }
 
+static bool fetch_exchange_rates(int rates_used) {
+    // Fetch new exchange rates (15 second timeout)
+    bool success = calculator->fetchExchangeRates(15, rates_used);
+    if (success) {
+        calculator->loadExchangeRates();
+    }
+    
+    return success;
+}
+
 static bool update_exchange_rates() {
     if (!calculator) return false;
     
@@ -40,13 +73,7 @@ static bool update_exchange_rates() {
         return false; // Rates are recent enough
     }
     
-    // Fetch new exchange rates (15 second timeout)
-    bool success = calculator->fetchExchangeRates(15, rates_used);
-    if (success) {
-        calculator->loadExchangeRates();
-    }
-    
-    return success;
+    return fetch_exchange_rates(rates_used);
 }
 
 static void initialize_calculator() {
@@ -73,17 +100,46 @@ static void initialize_calculator() {
     calculator_initialized = true;
 }
 
+// Evaluation options of the session, configured exactly like Nasc
+static EvaluationOptions getEvaluationOptions() {
+    EvaluationOptions evalops;
+    evalops.parse_options.unknowns_enabled = false;
+    evalops.allow_complex = false;
+    evalops.structuring = STRUCTURING_SIMPLIFY;
+    evalops.keep_zero_units = false;
+    evalops.parse_options.angle_unit = session_angle_unit;
+    if (exact_mode) {
+        evalops.approximation = APPROXIMATION_EXACT;
+    }
+    return evalops;
+}
+
+// Forms of an expression explain_expression returns, matching ExpressionForm in Go
+enum ExpressionForm {
+    FORM_PARSED,
+    FORM_EXACT,
+    FORM_APPROXIMATE,
+    FORM_FACTORED
+};
+
   // Enhanced print options with conversion support
 static PrintOptions getPrintOptions(const std::string& input) {
     PrintOptions printops;
     printops.multiplication_sign = MULTIPLICATION_SIGN_ASTERISK;
-    printops.number_fraction_format = FRACTION_DECIMAL;
-    printops.max_decimals = 9;
+    printops.number_fraction_format = exact_mode || fraction_mode ? FRACTION_FRACTIONAL : FRACTION_DECIMAL;
+    printops.max_decimals = session_precision;
     printops.use_max_decimals = true;
     printops.use_unicode_signs = true;
     printops.use_unit_prefixes = false;
-    struct lconv * lc  = localeconv();
-    printops.decimalpoint_sign = lc->decimal_point;
+    printops.decimalpoint_sign = decimal_sign;
+    printops.comma_sign = decimal_sign == "," ? ";" : ",";
+
+    // Results of the session's output base carry a prefix like 0x so they
+    // read back correctly through ans references
+    if (output_base != BASE_DECIMAL) {
+        printops.base = output_base;
+        printops.base_display = BASE_DISPLAY_ALTERNATIVE;
+    }
 
     // Number base conversions
     if (hasEnding(input, "to hex")) {
@@ -130,7 +186,8 @@ static PrintOptions getPrintOptions(const std::string& input) {
 
 extern "C" {
     void abort_calculation() {
-        std::lock_guard<std::mutex> lock(calculator_mutex);
+        // No lock: the calculation to abort holds calculator_mutex while it runs,
+        // and libqalculate expects abort() from another thread
         if (calculator_initialized && calculator) {
             calculator->abort();
         }
@@ -146,8 +203,30 @@ extern "C" {
         return update_exchange_rates();
     }
 
-    char* calculate_expression(const char* expression) {
+    bool force_exchange_rates_update() {
         initialize_calculator();
+        std::lock_guard<std::mutex> lock(calculator_mutex);
+        if (!calculator_initialized || !calculator) {
+            return false;
+        }
+        
+        // Fetch all rates regardless of their age
+        return fetch_exchange_rates(-1);
+    }
+
+    long long exchange_rates_time() {
+        initialize_calculator();
+        std::lock_guard<std::mutex> lock(calculator_mutex);
+        if (!calculator_initialized || !calculator) {
+            return 0;
+        }
+
+        return (long long)calculator->getExchangeRatesTime();
+    }
+
+    char* calculate_expression(const char* expression, int timeout_ms, bool* approximate) {
+        initialize_calculator();
+        *approximate = false;
         
         std::lock_guard<std::mutex> lock(calculator_mutex);
         if (!calculator_initialized || !calculator) {
@@ -156,12 +235,7 @@ extern "C" {
             return c_result;
         }
         
-        // Configure evaluation options exactly like Nasc
-        EvaluationOptions evalops;
-        evalops.parse_options.unknowns_enabled = false;
-        evalops.allow_complex = false;
-        evalops.structuring = STRUCTURING_SIMPLIFY;
-        evalops.keep_zero_units = false;
+        EvaluationOptions evalops = getEvaluationOptions();
         
         // Calculate the expression (preprocessing/postprocessing done in Go)
         string expr_str(expression);
@@ -171,13 +245,117 @@ extern "C" {
         // Get enhanced print options with conversion support
         PrintOptions printops = getPrintOptions(unlocalized_expr);
 
-        string result = calculator->calculateAndPrint(unlocalized_expr, 2000, evalops, printops);
+        // Printing reports whether the result was approximated, like 1/3 as 0.333
+        bool is_approximate = false;
+        printops.is_approximate = &is_approximate;
+
+        string result = calculator->calculateAndPrint(unlocalized_expr, timeout_ms, evalops, printops);
+        *approximate = is_approximate;
+
+        char* c_result = (char*)malloc(result.length() + 1);
+        strcpy(c_result, result.c_str());
+        return c_result;
+    }
+
+    char* explain_expression(const char* expression, int form, int timeout_ms) {
+        initialize_calculator();
+
+        std::lock_guard<std::mutex> lock(calculator_mutex);
+        if (!calculator_initialized || !calculator) {
+            return nullptr;
+        }
+
+        EvaluationOptions evalops = getEvaluationOptions();
+        string unlocalized_expr = calculator->unlocalizeExpression(expression, evalops.parse_options);
+        PrintOptions printops = getPrintOptions(unlocalized_expr);
+
+        string result;
+        if (form == FORM_PARSED) {
+            // Show the conversion after the parsed value like libqalculate reads it
+            string to_str;
+            calculator->separateToExpression(unlocalized_expr, to_str, evalops);
+            MathStructure parsed = calculator->parse(unlocalized_expr, evalops.parse_options);
+            parsed.format(printops);
+            result = parsed.print(printops);
+            if (!to_str.empty()) {
+                result += " to " + to_str;
+            }
+        } else {
+            if (form == FORM_EXACT) {
+                evalops.approximation = APPROXIMATION_EXACT;
+                printops.number_fraction_format = FRACTION_FRACTIONAL;
+            } else if (form == FORM_APPROXIMATE) {
+                evalops.approximation = APPROXIMATION_APPROXIMATE;
+                printops.number_fraction_format = FRACTION_DECIMAL;
+            } else if (form == FORM_FACTORED) {
+                evalops.structuring = STRUCTURING_FACTORIZE;
+            }
+
+            MathStructure mstruct;
+            if (calculator->calculate(&mstruct, unlocalized_expr, timeout_ms, evalops)) {
+                mstruct.format(printops);
+                result = mstruct.print(printops);
+            } else {
+                result = "timed out";
+            }
+        }
 
         char* c_result = (char*)malloc(result.length() + 1);
         strcpy(c_result, result.c_str());
         return c_result;
     }
 
+    void set_angle_unit(int unit) {
+        std::lock_guard<std::mutex> lock(calculator_mutex);
+        session_angle_unit = (AngleUnit) unit;
+    }
+
+    void set_precision(int precision) {
+        std::lock_guard<std::mutex> lock(calculator_mutex);
+        session_precision = precision;
+    }
+
+    void set_exact_mode(bool exact) {
+        std::lock_guard<std::mutex> lock(calculator_mutex);
+        exact_mode = exact;
+    }
+
+    void set_fraction_mode(bool fractions) {
+        std::lock_guard<std::mutex> lock(calculator_mutex);
+        fraction_mode = fractions;
+    }
+
+    void set_output_base(int base) {
+        std::lock_guard<std::mutex> lock(calculator_mutex);
+        output_base = base;
+    }
+
+    void set_decimal_separator(const char* sign) {
+        std::lock_guard<std::mutex> lock(calculator_mutex);
+        decimal_sign = sign;
+    }
+
+    bool define_function(const char* name, const char* formula) {
+        initialize_calculator();
+        std::lock_guard<std::mutex> lock(calculator_mutex);
+        if (!calculator_initialized || !calculator) return false;
+
+        // Replace an earlier definition, but never a function libqalculate provides
+        remove_user_function(name);
+        if (calculator->getActiveFunction(name)) return false;
+
+        calculator->addFunction(new UserFunction("", name, formula));
+        user_functions.insert(name);
+        return true;
+    }
+
+    void undefine_function(const char* name) {
+        initialize_calculator();
+        std::lock_guard<std::mutex> lock(calculator_mutex);
+        if (!calculator_initialized || !calculator) return;
+        remove_user_function(name);
+    }
+
     void free_result(char* result) {
         free(result);
     }
@@ -5,25 +5,43 @@ package main
 #cgo CXXFLAGS: -std=c++11
 #cgo LDFLAGS: -lstdc++
 #include <stdlib.h>
+#include <stdbool.h>
 
-char* calculate_expression(const char* expression);
+char* calculate_expression(const char* expression, int timeout_ms, bool* approximate);
+char* explain_expression(const char* expression, int form, int timeout_ms);
 void free_result(char* result);
 void abort_calculation();
 bool update_exchange_rates_if_needed();
+bool force_exchange_rates_update();
+long long exchange_rates_time();
 int get_function_count();
 char* get_function_name(int index);
 char* get_function_category(int index);
 int get_variable_count();
 char* get_variable_name(int index);
 char* get_variable_category(int index);
+void set_angle_unit(int unit);
+void set_precision(int precision);
+void set_exact_mode(bool exact);
+void set_decimal_separator(const char* sign);
+void set_output_base(int base);
+void set_fraction_mode(bool fractions);
+bool define_function(const char* name, const char* formula);
+void undefine_function(const char* name);
 */
 import "C"
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"maps"
+	"math"
+	"path"
 	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -34,25 +52,33 @@ import (
 
 // Constants for configuration values
 const (
-	CalculationTimeout     = 5 * time.Second  // Timeout for calculations
-	MinVariableNameLength  = 3                // Minimum length for variable name matching
-	ErrorCalculationFailed = "Calculation failed"
-	ErrorExpressionInvalid = "Invalid expression"
-	ErrorTimeout          = "Calculation timeout"
+	DefaultCalculationTimeout = 5 * time.Second // Timeout for calculations unless configured
+	MinVariableNameLength     = 3               // Minimum length for variable name matching
+	ErrorCalculationFailed    = "Calculation failed"
+	ErrorExpressionInvalid    = "Invalid expression"
+	ErrorTimeout              = "Calculation timeout"
+	ErrorUnbalancedBrackets   = "Unbalanced parentheses"
 )
 
 var operators = []string{"+", "-", "*", "/", "=", "(", ")"}
 
+// completionEntry is a libqalculate function or variable offered for completion
+type completionEntry struct {
+	name     string
+	category string
+	advanced bool // Completed after the basic entries whatever the config, like variables
+}
+
 // Cache for libqalculate completions to avoid expensive C calls on every request
 var completionsCache struct {
-	initialized       bool
-	basicFunctions    []string
-	advancedFunctions []string
+	initialized bool
+	entries     []completionEntry
 }
 
 type CalculationMsg struct {
 	Index  int
 	Result string
+	Tab    int // ID of the tab the calculated line belongs to
 }
 
 type OpenCompletionsMsg struct {
@@ -68,17 +94,27 @@ type FilterCompletionsMsg struct {
 // CalculationManager handles calculation state and cancellation
 type CalculationManager struct {
 	mu         sync.RWMutex
-	running    map[int]context.CancelFunc  // index -> cancel function
+	running    map[int]runningCalculation // index -> calculation in flight
 	results    []string
 	calculating []bool
+	evaluating int        // Index of the line libqalculate is evaluating, -1 for none
+	evaluation sync.Mutex // Lets one line at a time be evaluated
+}
+
+// runningCalculation is the context of a calculation in flight with its cancel function
+type runningCalculation struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	started time.Time
 }
 
 // NewCalculationManager creates a new calculation manager
 func NewCalculationManager(size int) *CalculationManager {
 	return &CalculationManager{
-		running:     make(map[int]context.CancelFunc),
+		running:     make(map[int]runningCalculation),
 		results:     make([]string, size),
 		calculating: make([]bool, size),
+		evaluating:  -1,
 	}
 }
 
@@ -86,11 +122,14 @@ func NewCalculationManager(size int) *CalculationManager {
 func (cm *CalculationManager) Resize(newSize int) {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
-	
+	cm.resize(newSize)
+}
+
+func (cm *CalculationManager) resize(newSize int) {
 	// Cancel all running calculations beyond new size
 	for i := newSize; i < len(cm.results); i++ {
-		if cancel, exists := cm.running[i]; exists {
-			cancel()
+		if calculation, exists := cm.running[i]; exists {
+			calculation.cancel()
 			delete(cm.running, i)
 		}
 	}
@@ -114,32 +153,66 @@ func (cm *CalculationManager) StartCalculation(index int, expr string) context.C
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 	
+	if index >= len(cm.results) {
+		cm.resize(index + 1)
+	}
+
 	// Cancel existing calculation if any
-	if cancel, exists := cm.running[index]; exists {
-		cancel()
+	if calculation, exists := cm.running[index]; exists {
+		calculation.cancel()
 		delete(cm.running, index)
-		// Only abort libqalculate if we're cancelling an existing calculation
-		C.abort_calculation()
+		// Only abort libqalculate if it is evaluating the superseded calculation
+		if cm.evaluating == index {
+			C.abort_calculation()
+		}
 	}
 	
 	// Create new context for this calculation
-	ctx, cancel := context.WithTimeout(context.Background(), CalculationTimeout)
-	cm.running[index] = cancel
+	ctx, cancel := context.WithTimeout(context.Background(), calculationTimeout())
+	cm.running[index] = runningCalculation{ctx: ctx, cancel: cancel, started: time.Now()}
 	cm.calculating[index] = true
 	
 	return ctx
 }
 
-// CompleteCalculation marks a calculation as complete and stores the result
-func (cm *CalculationManager) CompleteCalculation(index int, result string) {
+// Run evaluates a calculation started with StartCalculation, reporting false
+// when it was superseded before or while it ran. Lines are evaluated one at a
+// time, so a superseded line waiting for its turn is skipped without
+// evaluating it.
+func (cm *CalculationManager) Run(ctx context.Context, index int, calculate func(ctx context.Context) string) (string, bool) {
+	cm.evaluation.Lock()
+	defer cm.evaluation.Unlock()
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return "", false
+	}
+
+	cm.mu.Lock()
+	cm.evaluating = index
+	cm.mu.Unlock()
+	result := calculate(ctx)
+	cm.mu.Lock()
+	cm.evaluating = -1
+	cm.mu.Unlock()
+
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return "", false
+	}
+	cm.CompleteCalculation(ctx, index, result)
+	return result, true
+}
+
+// CompleteCalculation marks a calculation as complete and stores the result,
+// unless a newer calculation of the index was started meanwhile
+func (cm *CalculationManager) CompleteCalculation(ctx context.Context, index int, result string) {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 	
-	// Remove from running map
-	if cancel, exists := cm.running[index]; exists {
-		cancel()
-		delete(cm.running, index)
+	calculation, exists := cm.running[index]
+	if !exists || calculation.ctx != ctx {
+		return
 	}
+	calculation.cancel()
+	delete(cm.running, index)
 	
 	cm.results[index] = result
 	cm.calculating[index] = false
@@ -150,12 +223,14 @@ func (cm *CalculationManager) CancelCalculation(index int) {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 	
-	if cancel, exists := cm.running[index]; exists {
-		cancel()
+	if calculation, exists := cm.running[index]; exists {
+		calculation.cancel()
 		delete(cm.running, index)
 	}
 	
-	cm.calculating[index] = false
+	if index >= 0 && index < len(cm.calculating) {
+		cm.calculating[index] = false
+	}
 }
 
 // GetState returns the current state (thread-safe)
@@ -183,14 +258,30 @@ func (cm *CalculationManager) IsCalculating(index int) bool {
 	return false
 }
 
+// RunningFor returns how long the calculation of an index has been running,
+// or 0 if none is
+func (cm *CalculationManager) RunningFor(index int) time.Duration {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	calculation, exists := cm.running[index]
+	if !exists {
+		return 0
+	}
+	return time.Since(calculation.started)
+}
+
 func CheckForCalculation(input string) bool {
+	// Judge natural-language queries by the math they contain
+	input = stripQueryPhrase(input)
+
 	// Check for null or empty input (after removing spaces)
 	if input == "" || strings.ReplaceAll(input, " ", "") == "" {
 		return false
 	}
 	
-	// Check for URLs
-	if strings.Contains(input, "http://") {
+	// Check for URLs, which may still be mentioned in a comment
+	if strings.Contains(stripComment(input), "://") {
 		return false
 	}
 	
@@ -232,35 +323,241 @@ func CheckForCalculation(input string) bool {
 	}
 	
 	// Check for defined variables (ans references)
-	if strings.HasPrefix(input, "ans") {
+	if strings.HasPrefix(input, ansKeyword()) {
+		return true
+	}
+
+	// Check for the current date and time
+	if containsDateVariable(input) {
 		return true
 	}
 	
-	// User functions check would go here if we had user-defined functions
+	// Check for functions defined on worksheet lines
+	for _, name := range userFunctionNames() {
+		if strings.Contains(input, name+"(") {
+			return true
+		}
+	}
 	
 	return false
 }
 
+// ambiguousUnits maps unit tokens with several common meanings to the
+// libqalculate unit name preferred by each unit system
+var ambiguousUnits = map[string]map[string]string{
+	"t": {
+		UnitSystemMetric:   "tonne",
+		UnitSystemUS:       "short_ton",
+		UnitSystemImperial: "long_ton",
+	},
+}
+
+// unitTokenRegex matches identifier-like tokens that may name a unit
+var unitTokenRegex = regexp.MustCompile(`[\p{L}_]+\d*`)
+
+// parseLineDirectives extracts key=value settings from a "//!" directive comment
+func parseLineDirectives(input string) map[string]string {
+	directives := make(map[string]string)
+	directivePos := strings.Index(input, "//!")
+	if directivePos == -1 {
+		return directives
+	}
+	for _, field := range strings.Fields(input[directivePos+3:]) {
+		if key, value, ok := strings.Cut(field, "="); ok {
+			directives[strings.ToLower(key)] = strings.ToLower(value)
+		}
+	}
+	return directives
+}
+
+// isConversionIn reports whether an "in" token between before and after is the
+// conversion keyword ("5 m in ft") rather than the inch unit ("5 in to cm")
+func isConversionIn(before, after string) bool {
+	before = strings.TrimRight(before, " ")
+	after = strings.TrimLeft(after, " ")
+	if before == "" || after == "" {
+		return false
+	}
+
+	// A number directly before "in" makes it a quantity in inches, unless its
+	// digits end a name like ans1
+	number := strings.TrimRightFunc(before, func(r rune) bool {
+		return unicode.IsDigit(r) || r == '.' || r == ','
+	})
+	if len(number) < len(before) {
+		prev, _ := utf8.DecodeLastRuneInString(number)
+		if !unicode.IsLetter(prev) && prev != '_' {
+			return false
+		}
+	}
+
+	// The conversion target has to start like a unit
+	next, _ := utf8.DecodeRuneInString(after)
+	return unicode.IsLetter(next) || next == '°'
+}
+
+// resolveAmbiguousUnits rewrites ambiguous unit tokens to the unit preferred by
+// unitSystem and disambiguates "in" between inch and the conversion keyword
+func resolveAmbiguousUnits(expr string, unitSystem string) string {
+	var builder strings.Builder
+	last := 0
+	for _, loc := range unitTokenRegex.FindAllStringIndex(expr, -1) {
+		token := expr[loc[0]:loc[1]]
+		replacement := token
+		if token == "in" {
+			if isConversionIn(expr[:loc[0]], expr[loc[1]:]) {
+				replacement = "to"
+			} else {
+				replacement = "inch"
+			}
+		} else if units, exists := ambiguousUnits[token]; exists {
+			if unit, exists := units[unitSystem]; exists {
+				replacement = unit
+			}
+		}
+		builder.WriteString(expr[last:loc[0]])
+		builder.WriteString(replacement)
+		last = loc[1]
+	}
+	builder.WriteString(expr[last:])
+	return builder.String()
+}
+
+// temperatureScales maps scale letters to the libqalculate temperature unit,
+// as C and F otherwise name coulomb and farad
+var temperatureScales = map[string]string{
+	"C": "°C",
+	"F": "°F",
+	"K": "K",
+}
+
+// temperatureConversionRegex matches a conversion of a number with a scale
+// letter like "100 C to F", capturing the scale and the conversion target
+var temperatureConversionRegex = regexp.MustCompile(`^(\s*-?\d+(?:\.\d+)?\s*)([CFK])(\s+(?:to|in)\s+)(\S+)(\s*)$`)
+
+// resolveTemperatureScales reads C, F and K in conversions like "100 C to F"
+// as temperature scales, the target too if it is a scale letter
+func resolveTemperatureScales(expr string) string {
+	parts := temperatureConversionRegex.FindStringSubmatch(expr)
+	if parts == nil {
+		return expr
+	}
+
+	target := parts[4]
+	if scale, exists := temperatureScales[target]; exists {
+		target = scale
+	}
+	return parts[1] + temperatureScales[parts[2]] + parts[3] + target + parts[5]
+}
+
+// queryPrefixRegex matches the filler words leading a natural-language query
+var queryPrefixRegex = regexp.MustCompile(`(?i)^\s*(?:what\s+is|what's|how\s+much\s+is|convert|calculate)\s+`)
+
+// percentOfRegex matches the "of" in phrases like "15% of 200"
+var percentOfRegex = regexp.MustCompile(`%\s*of\s+`)
+
+// asPercentOfRegex matches phrases like "30 as % of 120"
+var asPercentOfRegex = regexp.MustCompile(`(?i)^\s*(.+?)\s+as\s+%\s*of\s+(.+?)\s*$`)
+
+// percentOffRegex matches discounts like "20% off 50"
+var percentOffRegex = regexp.MustCompile(`(?i)^\s*(\d[\d.,']*)\s*%\s*off\s+(.+?)\s*$`)
+
+// percentChangeRegex matches a percentage added to or subtracted from what
+// precedes it, like "120 + 15%"
+var percentChangeRegex = regexp.MustCompile(`^(.*[\p{L}\d)\]])\s*([+-])\s*(\d[\d.,']*)\s*%\s*$`)
+
+// stripQueryPhrase reduces queries like "what is 15% of 200?" to the math they contain
+func stripQueryPhrase(input string) string {
+	result := queryPrefixRegex.ReplaceAllString(input, "")
+	if trimmed := strings.TrimRight(result, " "); strings.HasSuffix(trimmed, "?") {
+		result = strings.TrimSuffix(trimmed, "?")
+	}
+	return resolvePercentages(result)
+}
+
+// resolvePercentages rewrites percentages the way they're meant rather than
+// as hundredths: "120 + 15%" adds 15% of 120, "20% off 50" takes 20% off 50
+// and "30 as % of 120" gives the share of 30 in 120 as a percentage
+func resolvePercentages(expr string) string {
+	if parts := asPercentOfRegex.FindStringSubmatch(expr); parts != nil {
+		return "(" + resolvePercentages(parts[1]) + ") / (" + resolvePercentages(parts[2]) + ") to %"
+	}
+	expr = percentOfRegex.ReplaceAllString(expr, "% * ")
+	if parts := percentOffRegex.FindStringSubmatch(expr); parts != nil {
+		return "(" + parts[2] + ") * (1 - " + parts[1] + " / 100)"
+	}
+	if parts := percentChangeRegex.FindStringSubmatch(expr); parts != nil {
+		return "(" + parts[1] + ") * (1 " + parts[2] + " " + parts[3] + " / 100)"
+	}
+	return expr
+}
+
 func prepareString(input string) string {
 	result := input
 
+	// A "//! units=..." directive overrides the configured unit system for this line
+	directives := parseLineDirectives(result)
+	unitSystem := config.UnitSystem
+	if system, exists := directives["units"]; exists {
+		unitSystem = system
+	}
+
 	// Remove comments after "//" or "#"
-	if commentPos := strings.Index(result, "//"); commentPos != -1 {
+	if commentPos := commentIndex(result); commentPos != -1 {
 		result = result[:commentPos]
 	}
-	if commentPos := strings.Index(result, "#"); commentPos != -1 {
-		result = result[:commentPos]
+	// "#" only starts a comment while it is not the answer keyword
+	if !strings.Contains(ansKeyword(), "#") {
+		if commentPos := strings.Index(result, "#"); commentPos != -1 {
+			result = result[:commentPos]
+		}
 	}
 
+	// Strip natural-language filler like "what is" or "convert"
+	result = stripQueryPhrase(result)
+
 	// Replace currency symbols with currency codes
-	result = strings.ReplaceAll(result, "€", "EUR")
-	result = strings.ReplaceAll(result, "$", "USD")
-	result = strings.ReplaceAll(result, "£", "GBP")
-	result = strings.ReplaceAll(result, "¥", "JPY")
+	result = replaceCurrencySymbols(result)
+
+	// Read "100 C to F" as temperatures unless "//! scales=electric" asks for coulomb and farad
+	if directives["scales"] != "electric" {
+		result = resolveTemperatureScales(result)
+	}
+
+	// Resolve tokens like "t" and "in" that mean different units
+	result = resolveAmbiguousUnits(result, unitSystem)
+
+	// Read numbers like "1.234,5" with the configured separators
+	result = normalizeNumbers(result)
+
+	// libqalculate reads base prefixes in lower case only, like 0x in 0xFF
+	result = basePrefixRegex.ReplaceAllStringFunc(result, func(literal string) string {
+		return strings.ToLower(literal[:2]) + literal[2:]
+	})
 
 	return result
 }
 
+// hexLiteralRegex matches hexadecimal results like 0x1E5
+var hexLiteralRegex = regexp.MustCompile(`0x[0-9A-Fa-f]+`)
+
+// basePrefixRegex matches the upper case prefix of a hexadecimal, binary or
+// octal literal like 0XFF, 0B1010 or 0O17
+var basePrefixRegex = regexp.MustCompile(`\b0[XBO][0-9A-Fa-f]+`)
+
+// replaceOutsideMatches applies replace to the parts of text not matched by skip
+func replaceOutsideMatches(text string, skip *regexp.Regexp, replace func(string) string) string {
+	var builder strings.Builder
+	last := 0
+	for _, loc := range skip.FindAllStringIndex(text, -1) {
+		builder.WriteString(replace(text[last:loc[0]]))
+		builder.WriteString(text[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	builder.WriteString(replace(text[last:]))
+	return builder.String()
+}
+
 func prettyPrint(output string) string {
 	result := output
 	
@@ -270,9 +567,10 @@ func prettyPrint(output string) string {
 		'5': "⁵", '6': "⁶", '7': "⁷", '8': "⁸", '9': "⁹",
 	}
 	
-	// Convert scientific notation like "1.23E-4" to "1.23 × 10⁻⁴"
-	eRegex := regexp.MustCompile(`(\d+\.?\d*)E([+-]?\d+)`)
-	result = eRegex.ReplaceAllStringFunc(result, func(match string) string {
+	// Convert scientific notation like "1.23E-4" to "1.23 × 10⁻⁴", leaving hex
+	// numbers like 0x1E5 alone as their digits only look like an exponent
+	eRegex := regexp.MustCompile(`(\d+` + regexp.QuoteMeta(separators.decimal()) + `?\d*)E([+-]?\d+)`)
+	toSuperscript := func(match string) string {
 		parts := eRegex.FindStringSubmatch(match)
 		if len(parts) != 3 {
 			return match
@@ -297,6 +595,9 @@ func prettyPrint(output string) string {
 		}
 		
 		return base + " × 10" + superscriptExp
+	}
+	result = replaceOutsideMatches(result, hexLiteralRegex, func(text string) string {
+		return eRegex.ReplaceAllStringFunc(text, toSuperscript)
 	})
 	
 	// Convert ^ exponent notation to superscript
@@ -329,63 +630,352 @@ func prettyPrint(output string) string {
 	return result
 }
 
+// superscriptRegex matches the exponents prettyPrint writes, with the
+// "× 10" of scientific notation
+var superscriptRegex = regexp.MustCompile(`( × 10)?(⁻?[⁰¹²³⁴⁵⁶⁷⁸⁹]+)`)
+
+// plainResult undoes prettyPrint, writing a result like "1.23 × 10⁻⁴" as
+// "1.23E-4" and "x²" as "x^2"
+func plainResult(result string) string {
+	return superscriptRegex.ReplaceAllStringFunc(result, func(match string) string {
+		parts := superscriptRegex.FindStringSubmatch(match)
+		if parts[1] != "" {
+			return "E" + superscriptValues.Replace(parts[2])
+		}
+		return "^" + superscriptValues.Replace(parts[2])
+	})
+}
+
 func postString(output string) string {
 	result := output
 	
 	// Replace currency codes back to symbols
-	result = strings.ReplaceAll(result, "EUR", "€")
-	result = strings.ReplaceAll(result, "USD", "$")
-	result = strings.ReplaceAll(result, "GBP", "£")
-	result = strings.ReplaceAll(result, "JPY", "¥")
+	result = replaceCurrencyCodes(result)
 	
 	// Remove space before degree symbol
 	result = strings.ReplaceAll(result, " °", "°")
 	
 	// Apply pretty printing
-	result = prettyPrint(result)
+	if prettyPrinting {
+		result = prettyPrint(result)
+	}
+
+	// Money is counted in decimals, also when other results show fractions
+	if fractionMode {
+		result = decimalCurrency(result)
+	}
+
+	// Show dates and times like 2024-05-01 14:30:00
+	result = formatDates(result)
+
+	// Group the digits of large numbers with the thousands separator
+	result = groupThousands(result)
 	
 	return result
 }
 
+// currencyRegex matches a currency symbol or code in a result
+func currencyRegex() *regexp.Regexp {
+	return regexp.MustCompile(currencySymbolPattern() + `|\b[A-Z]{3}\b`)
+}
+
+// fractionRegex matches a fraction like 1/3 in a result
+var fractionRegex = regexp.MustCompile(`(\d+)/(\d+)`)
+
+// decimalCurrency writes the fractions of a currency result like "1/3 $" as
+// amounts rounded to cents like "0.33 $"
+func decimalCurrency(result string) string {
+	if !currencyRegex().MatchString(result) {
+		return result
+	}
+	return fractionRegex.ReplaceAllStringFunc(result, func(match string) string {
+		parts := fractionRegex.FindStringSubmatch(match)
+		numerator, err1 := strconv.ParseFloat(parts[1], 64)
+		denominator, err2 := strconv.ParseFloat(parts[2], 64)
+		if err1 != nil || err2 != nil || denominator == 0 {
+			return match
+		}
+		return localizeDecimal(strconv.FormatFloat(numerator/denominator, 'f', 2, 64))
+	})
+}
+
+// trailingOperatorRegex matches an expression ending in a binary operator or conversion keyword
+var trailingOperatorRegex = regexp.MustCompile(`(?:[-+*/^×÷=]|\bto)\s*$`)
+
+// hasTrailingOperator reports whether expr ends in an operator still waiting for its operand
+func hasTrailingOperator(expr string) bool {
+	return trailingOperatorRegex.MatchString(expr)
+}
+
+// compactSuffixes lists the abbreviations used for compact currency values
+var compactSuffixes = []struct {
+	threshold float64
+	suffix    string
+}{
+	{1e12, "T"},
+	{1e9, "B"},
+	{1e6, "M"},
+	{1e3, "K"},
+}
+
+// currencyAmountRegex matches a plain currency amount with the symbol before or
+// after the number, negative with an ASCII or Unicode minus
+func currencyAmountRegex() *regexp.Regexp {
+	symbol := "(" + currencySymbolPattern() + ")"
+	return regexp.MustCompile(`^([−-]?)\s*(?:` + symbol + `\s*(\d+(?:\.\d+)?)|(\d+(?:\.\d+)?)\s*` + symbol + `)$`)
+}
+
+// compactCurrency abbreviates large currency amounts like "1234567.89 $" as "$1.2M"
+func compactCurrency(result string) string {
+	parts := currencyAmountRegex().FindStringSubmatch(normalizeNumbers(strings.TrimSpace(result)))
+	if parts == nil {
+		return result
+	}
+
+	sign, symbol, number := parts[1], parts[2], parts[3]
+	if symbol == "" {
+		symbol, number = parts[5], parts[4]
+	}
+
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return result
+	}
+
+	for i, unit := range compactSuffixes {
+		if value < unit.threshold {
+			continue
+		}
+		scaled := math.Round(value/unit.threshold*10) / 10
+		// Rounding up may reach the next unit, e.g. 999,950 becomes 1M rather than 1000K
+		if scaled >= 1000 && i > 0 {
+			unit = compactSuffixes[i-1]
+			scaled = math.Round(value/unit.threshold*10) / 10
+		}
+		return sign + symbol + localizeDecimal(strconv.FormatFloat(scaled, 'f', -1, 64)) + unit.suffix
+	}
+
+	return result
+}
+
+// ansKeyword returns the configured keyword referencing previous results
+func ansKeyword() string {
+	if config.AnsKeyword == "" {
+		return DefaultAnsKeyword
+	}
+	return config.AnsKeyword
+}
+
+// ansReference returns the reference to the result of the given 1-based line, like "ans2"
+func ansReference(line int) string {
+	return fmt.Sprintf("%s%d", ansKeyword(), line)
+}
+
+// isWordRune reports whether r can be part of an identifier
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// ansKeywordPattern returns the quoted ans keyword, preceded by a word boundary
+// if the keyword starts with a word character
+func ansKeywordPattern() string {
+	keyword := ansKeyword()
+	pattern := regexp.QuoteMeta(keyword)
+	if first, _ := utf8.DecodeRuneInString(keyword); isWordRune(first) {
+		pattern = `\b` + pattern
+	}
+	return pattern
+}
+
+// ansKeywordRegex matches the standalone ans keyword. Word boundaries only
+// apply at ends made of word characters so keywords like "#" still match.
+func ansKeywordRegex() *regexp.Regexp {
+	pattern := ansKeywordPattern()
+	if last, _ := utf8.DecodeLastRuneInString(ansKeyword()); isWordRune(last) {
+		pattern += `\b`
+	}
+	return regexp.MustCompile(pattern)
+}
+
+// ansReferenceRegex matches numbered references like "ans2", capturing the line number
+func ansReferenceRegex() *regexp.Regexp {
+	return regexp.MustCompile(ansKeywordPattern() + `(\d+)\b`)
+}
+
+// replaceAnsReferences replaces the numbered references in text for which
+// replace returns a value, given the reference and its 0-based line. Whole
+// references are matched, so ans1 never replaces the start of ans10.
+func replaceAnsReferences(text string, replace func(ref string, line int) (string, bool)) string {
+	regex := ansReferenceRegex()
+	return regex.ReplaceAllStringFunc(text, func(ref string) string {
+		line, err := strconv.Atoi(regex.FindStringSubmatch(ref)[1])
+		if err != nil || line < 1 {
+			return ref
+		}
+		if value, ok := replace(ref, line-1); ok {
+			return value
+		}
+		return ref
+	})
+}
+
+// formatNumber applies the configured number format to a plain numeric
+// result. Results with units, currencies or text are returned unchanged.
+func formatNumber(result string) string {
+	value, ok := parseResultNumber(result)
+	if !ok {
+		return result
+	}
+	return localizeDecimal(fmt.Sprintf(config.NumberFormat, value))
+}
+
+// engineeringPrefixes are the SI prefixes of the exponents engineering
+// notation uses
+var engineeringPrefixes = map[int]string{
+	-30: "q", -27: "r", -24: "y", -21: "z", -18: "a", -15: "f", -12: "p", -9: "n", -6: "µ", -3: "m",
+	0: "", 3: "k", 6: "M", 9: "G", 12: "T", 15: "P", 18: "E", 21: "Z", 24: "Y", 27: "R", 30: "Q",
+}
+
+// engineeringMode shows plain numeric results in engineering notation
+var engineeringMode bool
+
+// formatEngineering writes a plain numeric result with an exponent that is a
+// multiple of 3 as an SI prefix, like 4.7k for 4700. Results with units keep
+// the prefixes libqalculate chose, and numbers beyond the prefixes are kept.
+func formatEngineering(result string) string {
+	value, ok := parseResultNumber(result)
+	if !ok || value == 0 {
+		return result
+	}
+
+	// Shift the decimal point of the shortest digits, so 0.0047 doesn't
+	// pick up float noise like 4.699999
+	mantissa, exponentText, _ := strings.Cut(strconv.FormatFloat(math.Abs(value), 'e', -1, 64), "e")
+	exponent, err := strconv.Atoi(exponentText)
+	if err != nil {
+		return result
+	}
+	engineering := exponent - ((exponent%3)+3)%3
+	prefix, exists := engineeringPrefixes[engineering]
+	if !exists {
+		return result
+	}
+
+	digits := strings.Replace(mantissa, ".", "", 1)
+	shift := exponent - engineering
+	for len(digits) <= shift {
+		digits += "0"
+	}
+	number := digits[:shift+1]
+	if fraction := digits[shift+1:]; fraction != "" {
+		number += "." + fraction
+	}
+	if value < 0 {
+		number = "−" + number
+	}
+	return localizeDecimal(number) + prefix
+}
+
+// displayString applies display-only formatting to a result. Results keep the
+// full postString value so ans references always chain on the exact number.
+func displayString(result string) string {
+	if engineeringMode {
+		result = formatEngineering(result)
+	} else if config.NumberFormat != "" {
+		result = formatNumber(result)
+	}
+	if config.CompactCurrency {
+		result = compactCurrency(result)
+	}
+	return result
+}
+
 func CalculateExpression(expr string, results []string, currentIndex int) string {
+	result, _ := calculateExpression(expr, results, currentIndex, false)
+	return result
+}
+
+// calculateExpression is CalculateExpression also reporting whether
+// libqalculate approximated the result. With bypassCache set, a cached
+// result is ignored and calculated anew.
+func calculateExpression(expr string, results []string, currentIndex int, bypassCache bool) (string, bool) {
 	if expr == "" {
-		return ""
+		return "", false
 	}
 
+	// A leading label like "subtotal:" only names the line's result
+	expr = stripLabel(expr)
+
 	// Easter egg: detect "0/0" or "infinity"
 	trimmedExpr := strings.TrimSpace(strings.ToLower(expr))
 	if trimmedExpr == "0/0" {
-		return "¯\\_(ツ)_/¯"
+		return "¯\\_(ツ)_/¯", false
 	}
 	if trimmedExpr == "infinity" || trimmedExpr == "inf" {
-		return "∞ The void stares back ∞"
+		return "∞ The void stares back ∞", false
+	}
+
+	// plot(...) is drawn in a popup when entered instead of calculated
+	if isPlotCall(expr) {
+		return "", false
+	}
+
+	processedExpr, err := expandExpression(expr, results, currentIndex)
+	if err != nil {
+		return err.Error(), false
+	}
+	if processedExpr == "" {
+		return "", false
 	}
+	return evaluateExpression(processedExpr, bypassCache)
+}
 
+// expandExpression returns the expression libqalculate calculates for a line,
+// after preprocessing and replacing ans references, date variables and
+// aggregates. Lines without a calculation give "".
+func expandExpression(expr string, results []string, currentIndex int) (string, error) {
 	// Check if this input should be calculated
 	if !CheckForCalculation(expr) {
-		return ""
+		return "", nil
 	}
 	
 	// Preprocess the input
 	processedExpr := prepareString(expr)
+
+	// A line holding only a comment or directive has no result
+	if strings.TrimSpace(processedExpr) == "" {
+		return "", nil
+	}
+
+	// An expression still being typed like "2 +" is pending rather than an error
+	if config.PendingTrailingOperator && hasTrailingOperator(processedExpr) {
+		return "", nil
+	}
+
+	// Catch "(1 + 2))" before libqalculate guesses what it means. Brackets of
+	// a comment are already stripped.
+	if hasUnbalancedBrackets(processedExpr) {
+		return "", errors.New(ErrorUnbalancedBrackets)
+	}
 	
 	// First replace numbered ans (ans1, ans2, etc.) - only from previous lines
-	for i := 0; i < currentIndex && i < len(results); i++ {
-		ansPattern := fmt.Sprintf("ans%d", i+1)
-		if results[i] != "" {
-			processedExpr = strings.ReplaceAll(processedExpr, ansPattern, results[i])
-		} else {
-			processedExpr = strings.ReplaceAll(processedExpr, ansPattern, "0")
+	processedExpr = replaceAnsReferences(processedExpr, func(ref string, line int) (string, bool) {
+		if line >= currentIndex || line >= len(results) {
+			return "", false
 		}
-	}
+		if results[line] == "" {
+			return "0", true
+		}
+		return ansValue(results[line]), true
+	})
 	
 	// Then replace standalone 'ans' with last non-empty result from previous lines
-	ansRegex := regexp.MustCompile(`\bans\b`)
+	ansRegex := ansKeywordRegex()
 	if ansRegex.MatchString(processedExpr) {
 		replaced := false
 		for i := currentIndex - 1; i >= 0; i-- {
 			if results[i] != "" {
-				processedExpr = ansRegex.ReplaceAllString(processedExpr, results[i])
+				processedExpr = ansRegex.ReplaceAllString(processedExpr, ansValue(results[i]))
 				replaced = true
 				break
 			}
@@ -395,13 +985,56 @@ func CalculateExpression(expr string, results []string, currentIndex int) string
 			processedExpr = ansRegex.ReplaceAllString(processedExpr, "0")
 		}
 	}
+
+	// Replace now and today with the current date and time
+	processedExpr = replaceDateVariables(processedExpr, time.Now())
+
+	// Replace aggregates like product() with their value over the preceding results
+	processedExpr, err := replaceAggregates(processedExpr, results, currentIndex)
+	if err != nil {
+		return "", err
+	}
 	
+	// Convert chains like "5 cups to mL to L" straight to the final unit
+	if parts := splitConversionChain(processedExpr); len(parts) > 2 {
+		processedExpr = parts[0] + " to " + parts[len(parts)-1]
+	}
+
+	return processedExpr, nil
+}
+
+// isErrorResult reports whether a result is an error message rather than a value
+func isErrorResult(result string) bool {
+	switch result {
+	case ErrorCalculationFailed, ErrorExpressionInvalid, ErrorTimeout, ErrorNoValues, ErrorUnbalancedBrackets:
+		return true
+	}
+	lower := strings.ToLower(result)
+	return strings.Contains(lower, "error") ||
+		strings.Contains(lower, "undefined") ||
+		strings.Contains(lower, "invalid")
+}
+
+// approximateMark marks approximate results in the result pane, and the
+// cached outputs of libqalculate that were approximated
+const approximateMark = "≈"
+
+// evaluateExpression calculates a preprocessed expression with libqalculate,
+// reporting whether the result was approximated, like 1/3 as 0.333. With
+// bypassCache set, it is calculated even if a result is cached.
+func evaluateExpression(processedExpr string, bypassCache bool) (string, bool) {
+	if cached, exists := resultCache.Get(processedExpr); exists && !bypassCache {
+		raw, approximate := strings.CutPrefix(cached, approximateMark)
+		return postString(raw), approximate
+	}
+
 	cExpr := C.CString(processedExpr)
 	defer C.free(unsafe.Pointer(cExpr))
 	
-	cResult := C.calculate_expression(cExpr)
+	var cApproximate C.bool
+	cResult := C.calculate_expression(cExpr, C.int(calculationTimeout().Milliseconds()), &cApproximate)
 	if cResult == nil {
-		return ErrorCalculationFailed
+		return ErrorCalculationFailed, false
 	}
 	defer C.free_result(cResult)
 	
@@ -409,53 +1042,276 @@ func CalculateExpression(expr string, results []string, currentIndex int) string
 	
 	// Check for common error patterns in the result
 	if rawResult == "" {
-		return ErrorExpressionInvalid
+		return ErrorExpressionInvalid, false
 	}
 	
 	trimmedResult := strings.TrimSpace(rawResult)
+
+	// libqalculate stops at the timeout, or when a newer calculation of the
+	// line supersedes it and drops its result
+	if isAbortedResult(trimmedResult) {
+		return ErrorTimeout, false
+	}
 	
 	// Check for libqalculate error indicators
-	if strings.Contains(strings.ToLower(trimmedResult), "error") ||
-	   strings.Contains(strings.ToLower(trimmedResult), "undefined") ||
-	   strings.Contains(strings.ToLower(trimmedResult), "invalid") {
-		return trimmedResult // Return the actual error message from libqalculate
+	if isErrorResult(trimmedResult) {
+		return trimmedResult, false // Return the actual error message from libqalculate
 	}
 	
+	// Values changing over time are calculated anew
+	approximate := bool(cApproximate)
+	if !volatileRegex.MatchString(processedExpr) {
+		cached := trimmedResult
+		if approximate {
+			cached = approximateMark + cached
+		}
+		resultCache.Put(processedExpr, cached)
+	}
+
 	// Postprocess the result
 	result := postString(trimmedResult)
-	return result
+	return result, approximate
+}
+
+// ExpressionForm selects the form of an expression ExplainExpression returns
+type ExpressionForm int
+
+const (
+	FormParsed      ExpressionForm = iota // The expression as libqalculate reads it
+	FormExact                             // The result kept exact, like √2
+	FormApproximate                       // The result as a decimal
+	FormFactored                          // The result factored, like (x + 1)(x − 1)
+)
+
+// ExplainExpression returns a preprocessed expression in the given form
+func ExplainExpression(processedExpr string, form ExpressionForm) string {
+	cExpr := C.CString(processedExpr)
+	defer C.free(unsafe.Pointer(cExpr))
+
+	cResult := C.explain_expression(cExpr, C.int(form), C.int(calculationTimeout().Milliseconds()))
+	if cResult == nil {
+		return ErrorCalculationFailed
+	}
+	defer C.free_result(cResult)
+
+	result := strings.TrimSpace(C.GoString(cResult))
+	switch {
+	case result == "":
+		return ErrorExpressionInvalid
+	case isAbortedResult(result):
+		return ErrorTimeout
+	case isErrorResult(result):
+		return result
+	}
+	return postString(result)
+}
+
+// isAbortedResult reports whether libqalculate stopped calculating before the
+// result was complete
+func isAbortedResult(result string) bool {
+	lower := strings.ToLower(result)
+	return strings.Contains(lower, "aborted") || strings.Contains(lower, "timed out")
+}
+
+// calculationTimeout returns how long a line may calculate, as configured
+func calculationTimeout() time.Duration {
+	return time.Duration(config.CalculationTimeout * float64(time.Second))
 }
 
 func CalculateExpressionWithContext(ctx context.Context, expr string, results []string, currentIndex int) string {
+	result, _ := calculateExpressionWithContext(ctx, expr, results, currentIndex, false)
+	return result
+}
+
+// calculateExpressionWithContext is CalculateExpressionWithContext also
+// reporting whether libqalculate approximated the result
+func calculateExpressionWithContext(ctx context.Context, expr string, results []string, currentIndex int, bypassCache bool) (string, bool) {
 	// Check if context was cancelled before starting
 	select {
 	case <-ctx.Done():
 		if ctx.Err() == context.DeadlineExceeded {
-			return ErrorTimeout
+			return ErrorTimeout, false
 		}
-		return ""
+		return "", false
 	default:
 	}
 	
-	// For now, just use the regular calculation function
-	// The cancellation will be handled at a higher level through the CalculationManager
-	return CalculateExpression(expr, results, currentIndex)
+	// A calculation superseded while it runs is interrupted in libqalculate
+	// by the CalculationManager
+	return calculateExpression(expr, results, currentIndex, bypassCache)
 }
 
 func UpdateExchangeRates() bool {
 	// Update exchange rates if they're older than 7 days
-	return bool(C.update_exchange_rates_if_needed())
+	updated := bool(C.update_exchange_rates_if_needed())
+	if updated {
+		// Currency conversions cached with the old rates are outdated
+		resultCache.Clear()
+	}
+	return updated
 }
 
-func getLibqalculateCompletions() ([]string, []string) {
+// RefreshExchangeRates fetches the exchange rates however recent they are,
+// reporting whether they were updated
+func RefreshExchangeRates() bool {
+	updated := bool(C.force_exchange_rates_update())
+	if updated {
+		resultCache.Clear()
+	}
+	return updated
+}
+
+// ExchangeRatesTime returns when the loaded exchange rates were published,
+// or the zero time if none are loaded
+func ExchangeRatesTime() time.Time {
+	seconds := int64(C.exchange_rates_time())
+	if seconds <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(seconds, 0)
+}
+
+// SetAngleUnit sets the angle unit libqalculate assumes for trigonometric functions
+func SetAngleUnit(unit AngleUnit) {
+	resultCache.Clear()
+	C.set_angle_unit(C.int(unit))
+}
+
+// SetPrecision sets the maximum number of decimals shown in results
+func SetPrecision(precision int) {
+	resultCache.Clear()
+	C.set_precision(C.int(precision))
+}
+
+// exactMode mirrors the mode set with SetExactMode for ans substitution
+var exactMode bool
+
+// SetExactMode makes libqalculate keep results exact like 1/3 and √2 instead
+// of approximating them as decimals
+func SetExactMode(exact bool) {
+	exactMode = exact
+	resultCache.Clear()
+	C.set_exact_mode(C.bool(exact))
+}
+
+// fractionMode mirrors the mode set with SetFractionMode
+var fractionMode bool
+
+// SetFractionMode makes libqalculate show rational results as fractions like
+// 1/3 instead of decimals, while still approximating irrational ones like √2
+func SetFractionMode(fractions bool) {
+	fractionMode = fractions
+	resultCache.Clear()
+	C.set_fraction_mode(C.bool(fractions))
+}
+
+// prettyPrinting mirrors the mode set with SetPrettyPrint
+var prettyPrinting = true
+
+// SetPrettyPrint makes results show exponents as superscripts like
+// 1.23 × 10⁻⁴ and x², or keeps them ASCII like 1.23E-4 and x^2
+func SetPrettyPrint(pretty bool) {
+	prettyPrinting = pretty
+}
+
+// SetOutputBase sets the base numeric results are printed in, like 16 for
+// hexadecimal. A line converting to a base like "255 to bin" overrides it.
+func SetOutputBase(base int) {
+	resultCache.Clear()
+	C.set_output_base(C.int(base))
+}
+
+// SetSeparators sets the separators inputs are read with and results are
+// printed with, libqalculate printing the decimal separator
+func SetSeparators(sep NumberSeparators) {
+	separators = sep
+	resultCache.Clear()
+	cSign := C.CString(sep.Decimal)
+	defer C.free(unsafe.Pointer(cSign))
+	C.set_decimal_separator(cSign)
+}
+
+// userFunctions holds the formulas of the functions defined by worksheet
+// lines, as registered with libqalculate
+var userFunctions = struct {
+	sync.Mutex
+	formulas map[string]string
+}{formulas: make(map[string]string)}
+
+// DefineFunction registers a function for the session, its argument written
+// as \x in formula. Names of functions libqalculate provides can't be used.
+func DefineFunction(name, formula string) bool {
+	userFunctions.Lock()
+	defer userFunctions.Unlock()
+
+	cName, cFormula := C.CString(name), C.CString(formula)
+	defer C.free(unsafe.Pointer(cName))
+	defer C.free(unsafe.Pointer(cFormula))
+	resultCache.Clear()
+	if !bool(C.define_function(cName, cFormula)) {
+		delete(userFunctions.formulas, name)
+		return false
+	}
+	userFunctions.formulas[name] = formula
+	return true
+}
+
+// UndefineFunction removes a function registered with DefineFunction
+func UndefineFunction(name string) {
+	userFunctions.Lock()
+	defer userFunctions.Unlock()
+
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+	C.undefine_function(cName)
+	delete(userFunctions.formulas, name)
+	resultCache.Clear()
+}
+
+// userFunctionNames returns the names of the functions defined by worksheet lines
+func userFunctionNames() []string {
+	userFunctions.Lock()
+	defer userFunctions.Unlock()
+	return slices.Sorted(maps.Keys(userFunctions.formulas))
+}
+
+// userFunctionFormula returns the registered formula of a function
+func userFunctionFormula(name string) (string, bool) {
+	userFunctions.Lock()
+	defer userFunctions.Unlock()
+	formula, exists := userFunctions.formulas[name]
+	return formula, exists
+}
+
+// ansValue returns a result as substituted for an ans reference. Numbers are
+// substituted with a dot decimal separator, and exact or fraction results like
+// 1/3 are parenthesized so "ans^2" squares the whole value.
+func ansValue(result string) string {
+	result = normalizeNumbers(result)
+	if exactMode || fractionMode {
+		return "(" + result + ")"
+	}
+	return result
+}
+
+// isAdvancedFunction reports whether a libqalculate function belongs to the
+// advanced completion group, by its name or a pattern of its category
+func isAdvancedFunction(funcName string, category string) bool {
+	return slices.Contains(config.CompletionAdvancedFunctions, funcName) ||
+		slices.ContainsFunc(config.CompletionAdvancedCategories, func(pattern string) bool {
+			return matchesCategoryPattern(category, pattern)
+		})
+}
+
+// loadLibqalculateEntries loads all named functions and variables with their categories from libqalculate
+func loadLibqalculateEntries() []completionEntry {
 	// Return cached results if already initialized
 	if completionsCache.initialized {
-		return completionsCache.basicFunctions, completionsCache.advancedFunctions
+		return completionsCache.entries
 	}
-	
-	var basicFunctions []string
-	var advancedFunctions []string
-	
+
+	var entries []completionEntry
+
 	// Get functions from libqalculate with categories
 	functionCount := int(C.get_function_count())
 	for i := 0; i < functionCount; i++ {
@@ -463,43 +1319,20 @@ func getLibqalculateCompletions() ([]string, []string) {
 		cCategory := C.get_function_category(C.int(i))
 		if cName != nil {
 			defer C.free_result(cName)
-			func_name := C.GoString(cName)
+			funcName := C.GoString(cName)
 			category := ""
 			if cCategory != nil {
 				defer C.free_result(cCategory)
 				category = C.GoString(cCategory)
 			}
-			if  func_name == "" || category == "" {
-                continue;
-    		}
-
-            if category == "Utilities" || category == "Step Functions" || strings.Contains(category, "Utilities/") ||
-                strings.Contains(category, "Statistics/") || strings.Contains(category, "Economics/") || strings.Contains(category, "Geometry/") ||
-                strings.Contains(category, "Special Functions/") || category == "Combinatorics" || category == "Logical" || category == "Date & Time" ||
-                category == "Miscellaneous" || category == "Number Theory/Arithmetics" || category == "Number Theory/Integers" ||
-                category == "Number Theory/Number Bases" || category == "Number Theory/Polynomials" || category == "Number Theory/Prime Numbers" ||
-                category == "Calculus/Named Integrals" || category == "Economics" || category == "Special Functions"|| 
-				category == "Complex Numbers"{
-                advancedFunctions = append(advancedFunctions, func_name)
-                continue
-            } else if category == "Exponents & Logarithms" {
-                if func_name == "lambertw" || func_name == "cis" || func_name == "sqrtpi" || func_name == "pow" ||
-                    func_name == "exp10" || func_name == "exp2" {
-                    advancedFunctions = append(advancedFunctions, func_name)
-                    continue
-                }
-            } else if category == "Matrices & Vectors" {
-                if func_name == "export" || func_name == "genvector" || func_name == "load" || func_name == "permanent" ||
-                    func_name == "area" || func_name == "matrix2vector" {
-                    advancedFunctions = append(advancedFunctions, func_name)
-                    continue
-                }
+			if funcName == "" || category == "" {
+				continue
 			}
-			basicFunctions = append(basicFunctions, func_name)
+			entries = append(entries, completionEntry{name: funcName, category: category})
 		}
 	}
-	
-	// Get variables from libqalculate with categories
+
+	// Get variables from libqalculate with categories, variables always count as advanced
 	variableCount := int(C.get_variable_count())
 	for i := 0; i < variableCount; i++ {
 		cName := C.get_variable_name(C.int(i))
@@ -512,23 +1345,95 @@ func getLibqalculateCompletions() ([]string, []string) {
 				defer C.free_result(cCategory)
 				category = C.GoString(cCategory)
 			}
-			
-			if name == "" || category == "" || category == "Temporary" || category == "Unknowns" || category == "Large Numbers" ||
-                category == "Small Numbers" {
-                continue
-            }
-			advancedFunctions = append(advancedFunctions, name)
+			if name == "" || category == "" {
+				continue
+			}
+			entries = append(entries, completionEntry{name: name, category: category, advanced: true})
 		}
 	}
-	
+
 	// Cache the results before returning
-	completionsCache.basicFunctions = basicFunctions
-	completionsCache.advancedFunctions = advancedFunctions
+	completionsCache.entries = entries
 	completionsCache.initialized = true
-	
+
+	return entries
+}
+
+// matchesCategoryPattern reports whether a category matches a configured pattern.
+// Patterns are glob patterns, and a plain category also matches its subcategories.
+func matchesCategoryPattern(category string, pattern string) bool {
+	if category == pattern || strings.HasPrefix(category, pattern+"/") {
+		return true
+	}
+	matched, err := path.Match(pattern, category)
+	return err == nil && matched
+}
+
+// filterCompletionEntries keeps the entries allowed by the include and exclude category patterns
+func filterCompletionEntries(entries []completionEntry, include []string, exclude []string) []completionEntry {
+	var filtered []completionEntry
+	for _, entry := range entries {
+		if len(include) > 0 && !slices.ContainsFunc(include, func(pattern string) bool {
+			return matchesCategoryPattern(entry.category, pattern)
+		}) {
+			continue
+		}
+		if slices.ContainsFunc(exclude, func(pattern string) bool {
+			return matchesCategoryPattern(entry.category, pattern)
+		}) {
+			continue
+		}
+		filtered = append(filtered, entry)
+	}
+	return filtered
+}
+
+// getLibqalculateCompletions returns the basic and advanced completion names allowed by the config
+func getLibqalculateCompletions() ([]string, []string) {
+	var basicFunctions []string
+	var advancedFunctions []string
+
+	entries := filterCompletionEntries(loadLibqalculateEntries(),
+		config.CompletionIncludeCategories, config.CompletionExcludeCategories)
+	for _, entry := range entries {
+		if entry.advanced || isAdvancedFunction(entry.name, entry.category) {
+			advancedFunctions = append(advancedFunctions, entry.name)
+		} else {
+			basicFunctions = append(basicFunctions, entry.name)
+		}
+	}
+
+	// Functions defined on worksheet lines change during the session, so they aren't cached
+	basicFunctions = append(basicFunctions, userFunctionNames()...)
+
+	// now and today may be missing from libqalculate's categories
+	for _, name := range dateVariableNames {
+		if !slices.Contains(basicFunctions, name) && !slices.Contains(advancedFunctions, name) {
+			basicFunctions = append(basicFunctions, name)
+		}
+	}
+
 	return basicFunctions, advancedFunctions
 }
 
+// Inputs after which percentage phrases are offered for completion
+var (
+	afterPercentRegex = regexp.MustCompile(`\d\s*%\s+\p{L}*$`)
+	afterNumberRegex  = regexp.MustCompile(`\d\s+\p{L}*$`)
+)
+
+// percentHints returns the percentage phrases continuing currentInput, like
+// "of" after "15% "
+func percentHints(currentInput string) []string {
+	if afterPercentRegex.MatchString(currentInput) {
+		return []string{"of", "off"}
+	}
+	if afterNumberRegex.MatchString(currentInput) {
+		return []string{"as % of"}
+	}
+	return nil
+}
+
 func GetCompletions(currentInput string, results []string) []string {
 	// Get completions from libqalculate with proper categorization
 	basicFunctions, advancedFunctions := getLibqalculateCompletions()
@@ -542,38 +1447,81 @@ func GetCompletions(currentInput string, results []string) []string {
 	})
 	
 	// Add answer references at the beginning (they're most commonly used)
-	ansRefs := []string{"ans"}
-	if len(results) == 1 {
-		ansRefs = []string{}
+	ansRefs := percentHints(currentInput)
+	if len(results) != 1 {
+		ansRefs = append(ansRefs, ansKeyword())
 	}
 	for i, result := range results {
 		if result != "" && i != (len(results)-1) {
-			ansRefs = append(ansRefs, fmt.Sprintf("ans%d", i+1))
+			ansRefs = append(ansRefs, ansReference(i+1))
 		}
 	}
 	
-	// Combine: ans refs, then basic, then advanced
-	completions := make([]string, 0, len(ansRefs)+len(basicFunctions)+len(advancedFunctions))
-	completions = append(completions, ansRefs...)
-	completions = append(completions, basicFunctions...)
-	completions = append(completions, advancedFunctions...)
+	// Combine: basic, then advanced
+	functions := make([]string, 0, len(basicFunctions)+len(advancedFunctions))
+	functions = append(functions, basicFunctions...)
+	functions = append(functions, advancedFunctions...)
 	
 	// Filter completions based on current input
-	var filtered []string
 	r, _ := utf8.DecodeLastRuneInString(currentInput)
 	if currentInput == "" || (!unicode.IsLetter(r)) {
-		filtered = completions
-	} else {
-		lastWordStartIndex := strings.LastIndexFunc(currentInput, func(r rune) bool {
-			return !(unicode.IsLetter(r) || unicode.IsNumber(r))
-		}) + 1
-		prefix := currentInput[lastWordStartIndex:]
-		for _, comp := range completions {
-			if strings.HasPrefix(strings.ToLower(comp), strings.ToLower(prefix)) {
-				filtered = append(filtered, comp)
+		return append(ansRefs, functions...)
+	}
+	lastWordStartIndex := strings.LastIndexFunc(currentInput, func(r rune) bool {
+		return !(unicode.IsLetter(r) || unicode.IsNumber(r))
+	}) + 1
+	query := currentInput[lastWordStartIndex:]
+
+	// ans references stay at the top, the functions are ranked by relevance
+	return append(rankCompletions(ansRefs, query), rankCompletions(functions, query)...)
+}
+
+// fuzzyScore reports whether the letters of query appear in candidate in
+// order, ignoring case, and scores how scattered they are. Lower scores are
+// better, a prefix scoring 0.
+func fuzzyScore(candidate, query string) (int, bool) {
+	target := []rune(strings.ToLower(candidate))
+	score, next := 0, 0
+	for _, r := range strings.ToLower(query) {
+		found := false
+		for ; next < len(target); next++ {
+			if target[next] == r {
+				found = true
+				next++
+				break
 			}
+			// Skipped letters make the match less relevant
+			score++
+		}
+		if !found {
+			return 0, false
 		}
 	}
-	
-	return filtered
+	return score, true
+}
+
+// rankCompletions keeps the completions matching query, exact prefixes
+// first in their original order, then fuzzy matches by score. A single
+// letter only matches prefixes, as it would fuzzy match nearly everything.
+func rankCompletions(completions []string, query string) []string {
+	type match struct {
+		completion string
+		score      int
+	}
+	var prefixes []string
+	var fuzzy []match
+	for _, completion := range completions {
+		if strings.HasPrefix(strings.ToLower(completion), strings.ToLower(query)) {
+			prefixes = append(prefixes, completion)
+		} else if score, ok := fuzzyScore(completion, query); ok && utf8.RuneCountInString(query) > 1 {
+			fuzzy = append(fuzzy, match{completion, score})
+		}
+	}
+	sort.SliceStable(fuzzy, func(i, j int) bool {
+		return fuzzy[i].score < fuzzy[j].score
+	})
+	for _, match := range fuzzy {
+		prefixes = append(prefixes, match.completion)
+	}
+	return prefixes
 }
\ No newline at end of file
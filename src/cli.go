@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// expressionFlags collects the expressions of repeated -e flags
+type expressionFlags []string
+
+func (e *expressionFlags) String() string {
+	return strings.Join(*e, "; ")
+}
+
+func (e *expressionFlags) Set(value string) error {
+	*e = append(*e, value)
+	return nil
+}
+
+// jsonResult is the JSON form of a calculated expression
+type jsonResult struct {
+	Expression string `json:"expression"`
+	Result     string `json:"result,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// calculateExpressions calculates expressions in order like the lines of a
+// worksheet, so later ones can use earlier results through ans references and
+// variables. A session header on the first line applies to all of them.
+func calculateExpressions(expressions []string) []string {
+	if len(expressions) > 0 {
+		if settings, ok := parseSessionHeader(expressions[0]); ok {
+			SetAngleUnit(settings.AngleUnit)
+			SetPrecision(settings.Precision)
+		}
+	}
+
+	syncUserFunctions(expressions)
+	defer syncUserFunctions(nil)
+
+	results := make([]string, len(expressions))
+	for i, expr := range expressions {
+		variables := assignedVariables(expressions, results, i)
+		results[i] = CalculateVariableExpression(expr, results, i, variables)
+	}
+	return results
+}
+
+// evaluateExpressions writes the results of expressions to stdout, one per
+// line, and errors to stderr. The returned exit code is 1 if any calculation
+// failed.
+func evaluateExpressions(expressions []string, stdout, stderr io.Writer) int {
+	exitCode := 0
+	for i, result := range calculateExpressions(expressions) {
+		if isErrorResult(result) {
+			fmt.Fprintf(stderr, "nasc: %s: %s\n", expressions[i], result)
+			exitCode = 1
+			continue
+		}
+		fmt.Fprintln(stdout, displayString(result))
+	}
+	return exitCode
+}
+
+// evaluateExpressionsJSON writes the results of expressions to stdout as a
+// JSON array, failed calculations carrying an error instead of a result. The
+// returned exit code is 1 if any calculation failed.
+func evaluateExpressionsJSON(expressions []string, stdout, stderr io.Writer) int {
+	exitCode := 0
+	entries := make([]jsonResult, len(expressions))
+	for i, result := range calculateExpressions(expressions) {
+		entries[i].Expression = expressions[i]
+		if isErrorResult(result) {
+			entries[i].Error = result
+			exitCode = 1
+		} else {
+			entries[i].Result = displayString(result)
+		}
+	}
+
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(entries); err != nil {
+		fmt.Fprintf(stderr, "nasc: %v\n", err)
+		return 1
+	}
+	return exitCode
+}
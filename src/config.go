@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Unit systems used to resolve ambiguous unit tokens
+const (
+	UnitSystemMetric   = "metric"
+	UnitSystemUS       = "us"
+	UnitSystemImperial = "imperial"
+)
+
+// Escape key behaviors when no popup or mode is open
+const (
+	EscapeQuit       = "quit"   // Esc quits immediately
+	EscapeDoubleQuit = "double" // Esc quits when pressed twice in a row
+	EscapeNone       = "none"   // Esc never quits, use Ctrl+C
+)
+
+// Actions of a left click on a result cell
+const (
+	ResultClickInsert        = "insert"        // Insert an ans reference to the line at the cursor
+	ResultClickCopy          = "copy"          // Copy the full result value
+	ResultClickCopyFormatted = "copyFormatted" // Copy the result as displayed
+	ResultClickPopup         = "popup"         // Show the full result in a popup
+)
+
+// DefaultAnsKeyword references previous results unless configured otherwise
+const DefaultAnsKeyword = "ans"
+
+// DefaultPaneRatio is the share of the width taken by the input pane
+const DefaultPaneRatio = 0.7
+
+// Config holds user settings loaded from the config file
+type Config struct {
+	UnitSystem              string `json:"unitSystem"`              // Preferred unit system for ambiguous tokens like "t"
+	CompactCurrency         bool   `json:"compactCurrency"`         // Abbreviate large currency results as $1.2M
+	PendingTrailingOperator bool   `json:"pendingTrailingOperator"` // Show no result instead of an error for "2 +"
+	AnsKeyword              string `json:"ansKeyword"`              // Keyword referencing previous results, like ans and ans2
+	PasteKeepsFocus         bool   `json:"pasteKeepsFocus"`         // Stay on the current line after a multi-line paste
+	PasteAppends            bool   `json:"pasteAppends"`            // Add pasted lines after the last line instead of at the cursor
+	EscapeBehavior          string `json:"escapeBehavior"`          // Whether Esc quits, see EscapeQuit
+	NumberFormat            string `json:"numberFormat"`            // printf template for numeric results, like "%+10.2f"
+	ResultClickAction       string `json:"resultClickAction"`       // What clicking a result does, see ResultClickInsert
+	StartupTemplate         string `json:"startupTemplate"`         // Worksheet file loaded into a session started without input
+	DecimalSeparator        string `json:"decimalSeparator"`        // Decimal separator of inputs and results, "." or ","
+	DefaultCurrency         string `json:"defaultCurrency"`         // Currency code Alt+$ converts to, like "EUR"
+	ThousandsSeparator      string `json:"thousandsSeparator"`      // Digit grouping separator, empty for none
+	WrapResults             bool   `json:"wrapResults"`             // Wrap long results over several rows instead of truncating them
+	AngleUnit               string `json:"angleUnit"`               // Angle unit of trigonometric functions, "rad", "deg" or "gra"
+	ShowTotal               bool   `json:"showTotal"`               // Show the sum of all numeric results below the result pane
+	VimMode                 bool   `json:"vimMode"`                 // Esc enters a vim-like normal mode instead of quitting
+	StdinTrailingLine       bool   `json:"stdinTrailingLine"`       // Start typing on a new line after the piped lines
+	PlainResults            bool   `json:"plainResults"`            // Keep results ASCII like 1.23E-4 and x^2 instead of superscripts
+	CopyPlainResults        bool   `json:"copyPlainResults"`        // Copy results without superscripts even when they are shown
+	InlineResults           bool   `json:"inlineResults"`           // Show results below their inputs instead of in a separate pane
+
+	CompletionIncludeCategories  []string `json:"completionIncludeCategories"`  // Only complete these categories when set
+	CompletionExcludeCategories  []string `json:"completionExcludeCategories"`  // Never complete these categories
+	CompletionAdvancedCategories []string `json:"completionAdvancedCategories"` // Complete these categories after the others
+	CompletionAdvancedFunctions  []string `json:"completionAdvancedFunctions"`  // Complete these functions after the others
+	StartupLines                 []string `json:"startupLines"`                 // Lines loaded after the startup template
+	PaneRatio                    float64  `json:"paneRatio"`                    // Share of the width taken by the input pane, like 0.7
+	CalculationTimeout           float64  `json:"calculationTimeout"`           // Seconds a line may calculate before showing a timeout
+	UndoLimit                    int      `json:"undoLimit"`                    // Number of states kept for undo
+	Keys                         Keymap   `json:"keys"`                         // Keys of the remappable actions
+
+	CurrencySymbols map[string]string `json:"currencySymbols"` // Codes of extra currency symbols, like {"¥": "CNY"}
+}
+
+// config is the active configuration, loaded once at startup
+var config = DefaultConfig()
+
+// DefaultConfig returns the settings used when no config file is present
+func DefaultConfig() Config {
+	return Config{
+		UnitSystem:         UnitSystemMetric,
+		AnsKeyword:         DefaultAnsKeyword,
+		EscapeBehavior:     EscapeQuit,
+		ResultClickAction:  ResultClickInsert,
+		DecimalSeparator:   ".",
+		PaneRatio:          DefaultPaneRatio,
+		CalculationTimeout: DefaultCalculationTimeout.Seconds(),
+		UndoLimit:          DefaultUndoLimit,
+		Keys:               DefaultKeymap(),
+		AngleUnit:          "rad",
+		CompletionExcludeCategories: []string{
+			"Temporary", "Unknowns", "Large Numbers", "Small Numbers",
+		},
+		CompletionAdvancedCategories: []string{
+			"Utilities", "Step Functions", "Statistics/*", "Economics", "Geometry/*", "Special Functions",
+			"Combinatorics", "Logical", "Date & Time", "Miscellaneous", "Complex Numbers",
+			"Number Theory/Arithmetics", "Number Theory/Integers", "Number Theory/Number Bases",
+			"Number Theory/Polynomials", "Number Theory/Prime Numbers", "Calculus/Named Integrals",
+		},
+		CompletionAdvancedFunctions: []string{
+			"lambertw", "cis", "sqrtpi", "pow", "exp10", "exp2",
+			"export", "genvector", "load", "permanent", "area", "matrix2vector",
+		},
+	}
+}
+
+// configDir returns the directory holding nasc configuration files
+func configDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "nasc")
+}
+
+// expandHome replaces a leading "~/" in path with the home directory
+func expandHome(path string) string {
+	if strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, path[2:])
+		}
+	}
+	return path
+}
+
+// configPath returns the path of the main config file
+func configPath() string {
+	dir := configDir()
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, "config.json")
+}
+
+// LoadConfig reads the config file at path, falling back to defaults for
+// a missing file or absent fields
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+
+	// Unmarshal over the defaults so missing fields keep their default values
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return DefaultConfig(), err
+	}
+
+	// Drop unusable settings but keep the other ones
+	var errs []error
+	if err := validateNumberFormat(cfg.NumberFormat); err != nil {
+		cfg.NumberFormat = ""
+		errs = append(errs, err)
+	}
+	if err := validateSeparators(cfg.DecimalSeparator, cfg.ThousandsSeparator); err != nil {
+		cfg.DecimalSeparator, cfg.ThousandsSeparator = ".", ""
+		errs = append(errs, err)
+	}
+	if _, exists := angleUnitNames[cfg.AngleUnit]; !exists {
+		errs = append(errs, fmt.Errorf("invalid angle unit %q: use \"rad\", \"deg\" or \"gra\"", cfg.AngleUnit))
+		cfg.AngleUnit = "rad"
+	}
+	if cfg.PaneRatio < minPaneRatio || cfg.PaneRatio > maxPaneRatio {
+		errs = append(errs, fmt.Errorf("invalid pane ratio %g: use a value from %g to %g", cfg.PaneRatio, minPaneRatio, maxPaneRatio))
+		cfg.PaneRatio = DefaultPaneRatio
+	}
+	if cfg.CalculationTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("invalid calculation timeout %g: use a positive number of seconds", cfg.CalculationTimeout))
+		cfg.CalculationTimeout = DefaultCalculationTimeout.Seconds()
+	}
+	if cfg.UndoLimit < 1 {
+		errs = append(errs, fmt.Errorf("invalid undo limit %d: keep at least 1 state", cfg.UndoLimit))
+		cfg.UndoLimit = DefaultUndoLimit
+	}
+	if err := cfg.Keys.validate(); err != nil {
+		cfg.Keys = DefaultKeymap()
+		errs = append(errs, err)
+	}
+	if err := validateCurrencySymbols(cfg.CurrencySymbols); err != nil {
+		cfg.CurrencySymbols = nil
+		errs = append(errs, err)
+	}
+	if cfg.DefaultCurrency != "" && !currencyCodeRegex.MatchString(cfg.DefaultCurrency) {
+		errs = append(errs, fmt.Errorf("invalid default currency %q: use a code like \"EUR\"", cfg.DefaultCurrency))
+		cfg.DefaultCurrency = ""
+	}
+	return cfg, errors.Join(errs...)
+}
+
+// Limits of the pane ratio leaving both panes usable
+const (
+	minPaneRatio = 0.2
+	maxPaneRatio = 0.9
+)
+
+// thousandsSeparators lists the accepted digit grouping separators
+var thousandsSeparators = []string{"", ",", ".", " ", "'", "_"}
+
+// validateSeparators checks that numbers can be read unambiguously with the separators
+func validateSeparators(decimal, thousands string) error {
+	if decimal != "." && decimal != "," {
+		return fmt.Errorf("invalid decimal separator %q: use \".\" or \",\"", decimal)
+	}
+	if !slices.Contains(thousandsSeparators, thousands) {
+		return fmt.Errorf("invalid thousands separator %q", thousands)
+	}
+	if thousands == decimal {
+		return fmt.Errorf("thousands separator %q is also the decimal separator", thousands)
+	}
+	return nil
+}
+
+// Separators returns the configured number separators
+func (c Config) Separators() NumberSeparators {
+	return NumberSeparators{Decimal: c.DecimalSeparator, Thousands: c.ThousandsSeparator}
+}
+
+// numberFormatRegex matches a template with exactly one float verb, allowing
+// flags, width and precision, and literal text with escaped percent signs
+var numberFormatRegex = regexp.MustCompile(`^(?:[^%]|%%)*%[-+ 0#]*\d*(?:\.\d+)?[eEfFgG](?:[^%]|%%)*$`)
+
+// validateNumberFormat checks that format can format a single float
+func validateNumberFormat(format string) error {
+	if format == "" || numberFormatRegex.MatchString(format) {
+		return nil
+	}
+	return fmt.Errorf("invalid number format %q: needs exactly one float verb like %%.2f", format)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// conversionKeywordRegex matches the keywords separating a value from its conversion targets
+var conversionKeywordRegex = regexp.MustCompile(`\s+(?:to|->|→)\s+`)
+
+// splitConversionChain splits "5 cups to mL to L" into the value and each
+// conversion target. Expressions without a conversion yield a single part.
+func splitConversionChain(expr string) []string {
+	parts := conversionKeywordRegex.Split(strings.TrimSpace(expr), -1)
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	return parts
+}
+
+// buildConversionChain appends a conversion to each of the space separated units
+// to expr, keeping its trailing comment and directives
+func buildConversionChain(expr string, units string) string {
+	chain := strings.TrimSpace(stripComment(expr))
+	for _, unit := range strings.Fields(units) {
+		chain += " to " + unit
+	}
+	if comment := expr[len(stripComment(expr)):]; comment != "" {
+		chain += " " + comment
+	}
+	return chain
+}
+
+// conversionChainSteps converts the value of a chain to each target in turn.
+// Every step converts the original value so rounding doesn't accumulate.
+func conversionChainSteps(input string, results []string, currentIndex int) []string {
+	parts := splitConversionChain(stripComment(input))
+	if len(parts) < 2 {
+		return nil
+	}
+
+	steps := make([]string, 0, len(parts)-1)
+	for _, target := range parts[1:] {
+		steps = append(steps, CalculateExpression(parts[0]+" to "+target, results, currentIndex))
+	}
+	return steps
+}
+
+// renderConversionSteps lists the result of each step of a conversion chain
+func renderConversionSteps(input string, steps []string) string {
+	lines := []string{splitConversionChain(stripComment(input))[0]}
+	for _, step := range steps {
+		lines = append(lines, "  → "+step)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// unitDimensions groups common units of a dimension by the symbol results show
+// them with, in the order their conversions are listed
+var unitDimensions = [][]string{
+	{"m", "km", "cm", "mm", "mi", "yd", "ft", "in", "nmi"},
+	{"kg", "g", "mg", "t", "lb", "oz", "st"},
+	{"L", "mL", "m³", "gal", "qt", "pt", "cup"},
+	{"s", "min", "h", "d"},
+	{"°C", "°F", "K"},
+	{"m/s", "km/h", "mph", "kn"},
+	{"m²", "km²", "ha", "acre", "ft²"},
+	{"J", "kJ", "cal", "kcal", "kWh"},
+	{"B", "kB", "MB", "GB", "KiB", "MiB", "GiB"},
+}
+
+// resultUnit returns the unit of a result like "5000 m" or "1.2 × 10⁴ km/h",
+// the part following its number
+func resultUnit(result string) string {
+	fields := strings.Fields(result)
+	for len(fields) > 0 && (fields[0] == "×" || strings.ContainsAny(fields[0], "0123456789")) {
+		fields = fields[1:]
+	}
+	return strings.Join(fields, " ")
+}
+
+// compatibleUnits returns the common units of the dimension of unit, or nil
+// for units outside the built-in table
+func compatibleUnits(unit string) []string {
+	for _, units := range unitDimensions {
+		if slices.Contains(units, unit) {
+			return units
+		}
+	}
+	return nil
+}
+
+// unitConversions converts the value of a line to each common unit of its
+// dimension other than the one of its result
+func unitConversions(input string, results []string, currentIndex int) []string {
+	expr := strings.TrimSpace(stripComment(input))
+	unit := resultUnit(results[currentIndex])
+	var conversions []string
+	for _, target := range compatibleUnits(unit) {
+		if target == unit {
+			continue
+		}
+		conversions = append(conversions, CalculateExpression(expr+" to "+target, results, currentIndex))
+	}
+	return conversions
+}
+
+// renderUnitConversions lists a result followed by its conversions
+func renderUnitConversions(result string, conversions []string) string {
+	lines := []string{result}
+	for _, conversion := range conversions {
+		lines = append(lines, "  = "+conversion)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// parseCSVNumber reports whether a CSV field holds a number written with the
+// configured separators, returning it with a decimal point. A comma is read as
+// decimal comma unless it groups thousands.
+func parseCSVNumber(field string) (string, bool) {
+	value := normalizeNumbers(strings.TrimSpace(field))
+	if separators.Thousands != "," {
+		value = strings.ReplaceAll(value, ",", ".")
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return "", false
+	}
+	return strconv.FormatFloat(number, 'f', -1, 64), true
+}
+
+// csvDelimiter returns the field delimiter of imported CSV files, a semicolon
+// where numbers are written with a decimal comma
+func csvDelimiter() rune {
+	if separators.decimal() == "," {
+		return ';'
+	}
+	return ','
+}
+
+// readCSVColumn reads the numeric values of a column, given by its 1-based
+// number or header name. A non-numeric first row is taken as header, later
+// rows that are malformed or not numeric are skipped and returned by their
+// 1-based number.
+func readCSVColumn(r io.Reader, column string) ([]string, []int, error) {
+	reader := csv.NewReader(r)
+	reader.Comma = csvDelimiter()
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	reader.TrimLeadingSpace = true
+
+	index := 0
+	if column != "" {
+		if number, err := strconv.Atoi(column); err == nil {
+			index = number - 1
+		} else {
+			index = -1
+		}
+	}
+
+	var values []string
+	var skipped []int
+	for row := 0; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			skipped = append(skipped, row+1)
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Resolve a column name against the header row
+		if index == -1 {
+			for i, field := range record {
+				if strings.EqualFold(strings.TrimSpace(field), column) {
+					index = i
+				}
+			}
+			if index == -1 {
+				return nil, nil, fmt.Errorf("column %q not found", column)
+			}
+			continue
+		}
+
+		if index >= 0 && index < len(record) {
+			if value, ok := parseCSVNumber(record[index]); ok {
+				values = append(values, value)
+				continue
+			}
+		}
+		if row > 0 {
+			skipped = append(skipped, row+1)
+		}
+	}
+	return values, skipped, nil
+}
+
+// parseCSVImportSpec splits "path [column]" into the file path and the column
+func parseCSVImportSpec(spec string) (string, string) {
+	spec = expandHome(spec)
+
+	// Paths may contain spaces, so only split off a column if the whole spec isn't a file
+	if _, err := os.Stat(spec); err == nil {
+		return spec, ""
+	}
+	if pos := strings.LastIndex(spec, " "); pos != -1 {
+		return strings.TrimSpace(spec[:pos]), spec[pos+1:]
+	}
+	return spec, ""
+}
+
+// importCSV inserts each numeric value of a CSV column as a line, written with
+// the configured decimal separator, and returns the rows it skipped
+func (m *Model) importCSV(path string, column string) ([]int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	values, skipped, err := readCSVColumn(file, column)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return skipped, errors.New("no numeric values found")
+	}
+	for i, value := range values {
+		values[i] = localizeDecimal(value)
+	}
+
+	// addMultipleInputs saves a single undo state for all values
+	m.addMultipleInputs(strings.Join(values, "\n"))
+	return skipped, nil
+}
+
+// skippedRowsText lists the rows of a CSV import that weren't numbers
+func skippedRowsText(skipped []int) string {
+	rows := make([]string, len(skipped))
+	for i, row := range skipped {
+		rows[i] = strconv.Itoa(row)
+	}
+	return "Skipped rows without a number: " + strings.Join(rows, ", ")
+}
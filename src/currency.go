@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// currencySymbol maps a symbol to the code libqalculate knows the currency by
+type currencySymbol struct {
+	symbol string
+	code   string
+}
+
+// defaultCurrencySymbols lists the symbols known without configuration
+var defaultCurrencySymbols = []currencySymbol{
+	{"€", "EUR"},
+	{"$", "USD"},
+	{"£", "GBP"},
+	{"¥", "JPY"},
+	{"₹", "INR"},
+	{"₩", "KRW"},
+	{"₽", "RUB"},
+	{"₺", "TRY"},
+	{"R$", "BRL"},
+}
+
+// currencyCodeRegex matches a currency code like "CNY"
+var currencyCodeRegex = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// validateCurrencySymbols checks the configured symbols, which map to codes
+// like {"¥": "CNY"}
+func validateCurrencySymbols(symbols map[string]string) error {
+	for symbol, code := range symbols {
+		if strings.TrimSpace(symbol) != symbol || symbol == "" || strings.ContainsAny(symbol, "0123456789") {
+			return fmt.Errorf("invalid currency symbol %q: can't be empty or contain digits or spaces", symbol)
+		}
+		if !currencyCodeRegex.MatchString(code) {
+			return fmt.Errorf("invalid currency code %q for %q: use a code like \"EUR\"", code, symbol)
+		}
+	}
+	return nil
+}
+
+// currencies returns the configured currency symbols followed by the default
+// ones they don't replace. Configured symbols come first so a code is shown
+// with the symbol of the config, like ¥ for CNY.
+func (c Config) currencies() []currencySymbol {
+	symbols := make([]string, 0, len(c.CurrencySymbols))
+	for symbol := range c.CurrencySymbols {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+
+	var currencies []currencySymbol
+	for _, symbol := range symbols {
+		currencies = append(currencies, currencySymbol{symbol, c.CurrencySymbols[symbol]})
+	}
+	for _, currency := range defaultCurrencySymbols {
+		if _, exists := c.CurrencySymbols[currency.symbol]; !exists {
+			currencies = append(currencies, currency)
+		}
+	}
+	return currencies
+}
+
+// inputCurrencies returns the currency symbols with longer ones first, so
+// "R$" is read as a whole before "$"
+func inputCurrencies() []currencySymbol {
+	currencies := config.currencies()
+	sort.SliceStable(currencies, func(i, j int) bool {
+		return len(currencies[i].symbol) > len(currencies[j].symbol)
+	})
+	return currencies
+}
+
+// currencySymbolPattern returns an alternation matching any currency symbol
+func currencySymbolPattern() string {
+	var symbols []string
+	for _, currency := range inputCurrencies() {
+		symbols = append(symbols, regexp.QuoteMeta(currency.symbol))
+	}
+	return "(?:" + strings.Join(symbols, "|") + ")"
+}
+
+// symbolAt returns the currency symbol starting at input[i:]. Symbols
+// starting or ending in a letter like "kr" must not be part of a longer word.
+func symbolAt(input string, i int, currencies []currencySymbol) (currencySymbol, bool) {
+	for _, currency := range currencies {
+		if !strings.HasPrefix(input[i:], currency.symbol) {
+			continue
+		}
+		first, _ := utf8.DecodeRuneInString(currency.symbol)
+		if before, _ := utf8.DecodeLastRuneInString(input[:i]); isWordRune(first) && i > 0 && isWordRune(before) {
+			continue
+		}
+		last, _ := utf8.DecodeLastRuneInString(currency.symbol)
+		end := i + len(currency.symbol)
+		if after, _ := utf8.DecodeRuneInString(input[end:]); isWordRune(last) && end < len(input) && isWordRune(after) {
+			continue
+		}
+		return currency, true
+	}
+	return currencySymbol{}, false
+}
+
+// replaceCurrencySymbols replaces currency symbols with their codes, keeping
+// the code apart from neighbouring names so "$rate" doesn't become "USDrate"
+func replaceCurrencySymbols(input string) string {
+	currencies := inputCurrencies()
+	var builder strings.Builder
+	for i := 0; i < len(input); {
+		currency, ok := symbolAt(input, i, currencies)
+		if !ok {
+			_, size := utf8.DecodeRuneInString(input[i:])
+			builder.WriteString(input[i : i+size])
+			i += size
+			continue
+		}
+
+		if before, _ := utf8.DecodeLastRuneInString(input[:i]); i > 0 && isWordRune(before) && !unicode.IsDigit(before) {
+			builder.WriteByte(' ')
+		}
+		builder.WriteString(currency.code)
+		i += len(currency.symbol)
+		if after, _ := utf8.DecodeRuneInString(input[i:]); i < len(input) && isWordRune(after) && !unicode.IsDigit(after) {
+			builder.WriteByte(' ')
+		}
+	}
+	return builder.String()
+}
+
+// replaceCurrencyCodes replaces standalone currency codes in a result with
+// their symbols, leaving names that merely contain a code like "USDT" alone
+func replaceCurrencyCodes(result string) string {
+	currencies := config.currencies()
+	return replaceIdentifiers(result, func(name string) (string, bool) {
+		for _, currency := range currencies {
+			if currency.code == name {
+				return currency.symbol, true
+			}
+		}
+		return "", false
+	})
+}
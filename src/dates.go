@@ -0,0 +1,51 @@
+package main
+
+import (
+	"regexp"
+	"slices"
+	"time"
+)
+
+// dateVariableNames are the variables holding the current date and time,
+// offered in completions
+var dateVariableNames = []string{"now", "today"}
+
+// dateVariableValue returns the date literal a date variable stands for at t,
+// which libqalculate reads as a local time
+func dateVariableValue(name string, t time.Time) string {
+	if name == "today" {
+		return `"` + t.Format(time.DateOnly) + `"`
+	}
+	return `"` + t.Format("2006-01-02T15:04:05") + `"`
+}
+
+// containsDateVariable reports whether input uses now or today
+func containsDateVariable(input string) bool {
+	for _, name := range identifierRegex.FindAllString(stripComment(input), -1) {
+		if slices.Contains(dateVariableNames, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// replaceDateVariables replaces now and today in expr with the date and time
+// of t, so "now + 3 days" is calculated from the timezone set by TZ
+func replaceDateVariables(expr string, t time.Time) string {
+	return replaceIdentifiers(expr, func(name string) (string, bool) {
+		if !slices.Contains(dateVariableNames, name) {
+			return "", false
+		}
+		return dateVariableValue(name, t), true
+	})
+}
+
+// dateTimeRegex matches an ISO date and time like 2024-05-01T14:30:00,
+// capturing the date and the time without fractions of a second
+var dateTimeRegex = regexp.MustCompile(`(\d{4}-\d{2}-\d{2})T(\d{2}:\d{2}(?::\d{2})?)(?:\.\d+)?`)
+
+// formatDates writes the dates and times of a result like
+// "2024-05-01T14:30:00" as "2024-05-01 14:30:00"
+func formatDates(result string) string {
+	return dateTimeRegex.ReplaceAllString(result, "$1 $2")
+}
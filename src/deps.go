@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// commentIndex returns the position of the "//" starting a comment in input,
+// or -1 if there is none. The "//" of a URL scheme like "https://" doesn't
+// start a comment.
+func commentIndex(input string) int {
+	for i := 0; i+1 < len(input); i++ {
+		if input[i] == '/' && input[i+1] == '/' && (i == 0 || input[i-1] != ':') {
+			return i
+		}
+	}
+	return -1
+}
+
+// stripComment removes a trailing "//" comment from an input line
+func stripComment(input string) string {
+	if commentPos := commentIndex(input); commentPos != -1 {
+		return input[:commentPos]
+	}
+	return input
+}
+
+// lineDependencies lists for each line the lines it references, as 0-based
+// indices. A bare ans refers to the closest preceding line with a result, and
+// a variable or label to the latest preceding line assigning it.
+func lineDependencies(inputs []string, results []string) [][]int {
+	referenceRegex := ansReferenceRegex()
+	keywordRegex := ansKeywordRegex()
+	assigned := make(map[string]int)
+
+	deps := make([][]int, len(inputs))
+	for i, input := range inputs {
+		expr := stripComment(stripLabel(input))
+		seen := make(map[int]bool)
+		add := func(line int) {
+			if !seen[line] {
+				seen[line] = true
+				deps[i] = append(deps[i], line)
+			}
+		}
+
+		for _, match := range referenceRegex.FindAllStringSubmatch(expr, -1) {
+			line, err := strconv.Atoi(match[1])
+			if err == nil && line >= 1 && line <= len(inputs) {
+				add(line - 1)
+			}
+		}
+
+		if keywordRegex.MatchString(expr) {
+			for j := i - 1; j >= 0; j-- {
+				if j < len(results) && results[j] != "" {
+					add(j)
+					break
+				}
+			}
+		}
+
+		for _, name := range identifierRegex.FindAllString(expr, -1) {
+			if line, exists := assigned[name]; exists {
+				add(line)
+			}
+		}
+		if name, _, ok := parseAssignment(input); ok {
+			assigned[name] = i
+		} else if label, _, ok := parseLabel(input); ok {
+			assigned[label] = i
+		}
+	}
+	return deps
+}
+
+// definedName returns the variable, label or function a line defines, if any
+func definedName(input string) string {
+	if name, _, _, ok := parseFunctionDefinition(input); ok {
+		return name
+	}
+	if name, _, ok := parseAssignment(input); ok {
+		return name
+	}
+	if label, _, ok := parseLabel(input); ok {
+		return label
+	}
+	return ""
+}
+
+// lineDependents returns the lines after index that directly use its result,
+// given the references of each line from lineDependencies. Lines calling a
+// function the line defines and lines aggregating the preceding results are
+// dependents too. Recalculated lines trigger their own dependents once they
+// complete, so a change reaches the transitive dependents in topological order.
+func lineDependents(inputs []string, deps [][]int, index int) []int {
+	function, _, _, defines := parseFunctionDefinition(inputs[index])
+
+	var dependents []int
+	for i := index + 1; i < len(inputs) && i < len(deps); i++ {
+		expr := stripComment(inputs[i])
+		if slices.Contains(deps[i], index) || aggregateRegex.MatchString(expr) ||
+			defines && slices.Contains(identifierRegex.FindAllString(expr, -1), function) {
+			dependents = append(dependents, i)
+		}
+	}
+	return dependents
+}
+
+// findDependencyCycles reports for each line whether it can reach itself
+// through its references, e.g. line 1 using ans2 while line 2 uses ans1
+func findDependencyCycles(deps [][]int) []bool {
+	inCycle := make([]bool, len(deps))
+	for start := range deps {
+		visited := make([]bool, len(deps))
+		stack := append([]int(nil), deps[start]...)
+		for len(stack) > 0 {
+			line := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if line == start {
+				inCycle[start] = true
+				break
+			}
+			if visited[line] {
+				continue
+			}
+			visited[line] = true
+			stack = append(stack, deps[line]...)
+		}
+	}
+	return inCycle
+}
+
+// renderDependencyGraph lists each line's references, flagging cycles
+func renderDependencyGraph(inputs []string, deps [][]int, cycles []bool) string {
+	var lines []string
+	for i, lineDeps := range deps {
+		if len(lineDeps) == 0 {
+			continue
+		}
+		refs := make([]string, len(lineDeps))
+		for j, dep := range lineDeps {
+			refs[j] = strconv.Itoa(dep + 1)
+		}
+		line := fmt.Sprintf("%3d│ %s", i+1, strings.TrimSpace(stripComment(inputs[i])))
+		line += "\n   │   ← " + strings.Join(refs, ", ")
+		if cycles[i] {
+			line += "  ⟳ cycle"
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		return "No line references another line"
+	}
+	return strings.Join(lines, "\n")
+}
@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"slices"
 	"strings"
+	"time"
+	"unicode/utf8"
 
+	"github.com/charmbracelet/bubbles/textinput"
 	"github.com/charmbracelet/bubbletea"
 )
 
@@ -14,21 +17,21 @@ func (m *Model) handlePasteMessage(content string) (tea.Model, tea.Cmd) {
 
 	if strings.Contains(content, "\n") {
 		// Multi-line content - add to existing inputs
-		m.addMultipleInputs(content)
+		cmds = append(cmds, m.pasteMultipleInputs(content))
 		m.updateViewports()
 		m.scrollToFocused()
 	} else if content != "" {
-		// Single-line content - insert into current input
-		currentValue := m.Inputs[m.Focused].Value()
+		// Single-line content - insert into current input by rune position
+		currentValue := []rune(m.Inputs[m.Focused].Value())
 		cursorPos := m.Inputs[m.Focused].Position()
-		newValue := currentValue[:cursorPos] + content + currentValue[cursorPos:]
+		newValue := string(currentValue[:cursorPos]) + content + string(currentValue[cursorPos:])
 		m.Inputs[m.Focused].SetValue(newValue)
-		m.Inputs[m.Focused].SetCursor(cursorPos + len(content))
+		m.Inputs[m.Focused].SetCursor(cursorPos + utf8.RuneCountInString(content))
 
 		// Trigger calculation if non-empty
-		if !m.Calculating[m.Focused] && newValue != "" {
+		if newValue != "" {
 			m.Calculating[m.Focused] = true
-			cmds = append(cmds, CalculateCmd(newValue, m.Results, m.Focused))
+			cmds = append(cmds, m.calculateLineCmd(newValue, m.Focused))
 		}
 	}
 	return *m, tea.Batch(cmds...)
@@ -38,30 +41,70 @@ func (m *Model) handlePasteMessage(content string) (tea.Model, tea.Cmd) {
 func (m *Model) handleCalculationMessage(msg CalculationMsg) (tea.Model, tea.Cmd) {
 	var cmds []tea.Cmd
 
-	if msg.Index >= 0 && msg.Index < len(m.Results) {
-		// Update model state (calculation manager is already updated in AsyncCalculateCmd)
+	if msg.Tab == m.TabID && msg.Index >= 0 && msg.Index < len(m.Results) {
+		// Update model state (the calculation manager was updated when the calculation ran)
+		previous := m.Results[msg.Index]
 		m.Results[msg.Index] = msg.Result
 		m.Calculating[msg.Index] = false
+		m.recordResult(msg.Index, msg.Result)
 		m.updateViewports()
 
-		// Trigger recalculation of dependent lines
-		for i := msg.Index + 1; i < len(m.Inputs); i++ {
+		// Trigger recalculation of dependent lines, superseding calculations
+		// that used the previous result
+		for _, i := range m.changedDependents(msg.Index, previous) {
 			expr := m.Inputs[i].Value()
-			if expr != "" && !m.Calculating[i] {
+			if expr != "" {
 				m.Calculating[i] = true
-				cmds = append(cmds, CalculateCmd(expr, m.Results, i))
+				cmds = append(cmds, m.calculateLineCmd(expr, i))
 			}
 		}
 	}
 	return *m, tea.Batch(cmds...)
 }
 
+// changedDependents returns the lines after index to recalculate now that its
+// result changed from previous. When the name the line defines changed, lines
+// may have used the old name, so all following lines are recalculated.
+func (m *Model) changedDependents(index int, previous string) []int {
+	inputs := m.inputValues()
+	name := definedName(inputs[index])
+	renamed := m.DefinedNames[index] != name
+	if m.DefinedNames == nil {
+		m.DefinedNames = make(map[int]string)
+	}
+	m.DefinedNames[index] = name
+
+	if renamed {
+		var following []int
+		for i := index + 1; i < len(inputs); i++ {
+			following = append(following, i)
+		}
+		return following
+	}
+	if _, _, _, ok := parseFunctionDefinition(inputs[index]); !ok && previous == m.Results[index] {
+		return nil
+	}
+
+	// A bare ans may have referred past the line while it had no result
+	previousResults := slices.Clone(m.Results)
+	previousResults[index] = previous
+	dependents := lineDependents(inputs, lineDependencies(inputs, m.Results), index)
+	for _, i := range lineDependents(inputs, lineDependencies(inputs, previousResults), index) {
+		if !slices.Contains(dependents, i) {
+			dependents = append(dependents, i)
+		}
+	}
+	slices.Sort(dependents)
+	return dependents
+}
+
 // handleOpenCompletionsMessage handles opening the completions popup
 func (m *Model) handleOpenCompletionsMessage(msg OpenCompletionsMsg) (tea.Model, tea.Cmd) {
 	var cmds []tea.Cmd
 
 	m.Completions = msg.Completions
 	m.LastCompletionQuery = msg.Query
+	m.ActiveMenu = MenuCompletions
 
 	if len(m.Completions) == 1 {
 		// Auto-insert single completion
@@ -102,6 +145,82 @@ func (m *Model) handleFilterCompletionsMessage(msg FilterCompletionsMsg) (tea.Mo
 	return *m, tea.Batch(cmds...)
 }
 
+// clickResult runs the configured action for a click on the result of line i
+func (m *Model) clickResult(i int) []tea.Cmd {
+	var cmds []tea.Cmd
+
+	switch config.ResultClickAction {
+	case ResultClickCopy:
+		// Silently ignore clipboard errors
+		_ = writeClipboard(m.Results[i])
+
+	case ResultClickCopyFormatted:
+		_ = writeClipboard(displayString(m.Results[i]))
+
+	case ResultClickPopup:
+		m.openPopup(fmt.Sprintf("Result of line %d", i+1), m.Results[i])
+
+	default:
+		// Insert ans reference at current cursor position
+		cmds = m.insertClickedResult(ansReference(i + 1))
+	}
+	return cmds
+}
+
+// insertClickedResult inserts a reference to or the value of a clicked result
+// at the cursor and recalculates the focused line
+func (m *Model) insertClickedResult(text string) []tea.Cmd {
+	var cmds []tea.Cmd
+	m.insertAtCursor(text)
+
+	// Trigger async recalculation for current and dependent lines
+	currentExpr := m.Inputs[m.Focused].Value()
+	if currentExpr != "" {
+		m.Calculating[m.Focused] = true
+		cmds = append(cmds, m.calculateLineCmd(currentExpr, m.Focused))
+	}
+	m.updateViewports()
+	return cmds
+}
+
+// resultLineAt returns the line whose result is shown at x, y on the screen,
+// or -1 if no result is there. Inline results are in the rows below the
+// first row of their line.
+func (m *Model) resultLineAt(x, y int) int {
+	if y < 1 || y > m.Height-3 {
+		return -1
+	}
+
+	var clickedLine int
+	if m.InlineResults {
+		if !m.inResultRow(y) {
+			return -1
+		}
+		clickedLine = m.lineAtRow(y - 1 + m.InputViewport.YOffset)
+	} else {
+		if x < m.inputPaneWidth() {
+			return -1
+		}
+		// Account for the viewport offset
+		clickedLine = m.lineAtRow(y - 1 + m.ResultViewport.YOffset)
+	}
+	if clickedLine < 0 || clickedLine >= len(m.Results) || m.Results[clickedLine] == "" {
+		return -1
+	}
+	return clickedLine
+}
+
+// inResultRow reports whether row y of the screen shows an inline result
+// rather than an input
+func (m *Model) inResultRow(y int) bool {
+	if !m.InlineResults {
+		return false
+	}
+	row := y - 1 + m.InputViewport.YOffset
+	line := m.lineAtRow(row)
+	return line >= 0 && row > m.lineRow(line)
+}
+
 // handleMouseMessage handles mouse interactions
 func (m *Model) handleMouseMessage(msg tea.MouseMsg) (tea.Model, tea.Cmd) {
 	var cmds []tea.Cmd
@@ -118,45 +237,53 @@ func (m *Model) handleMouseMessage(msg tea.MouseMsg) (tea.Model, tea.Cmd) {
 		}
 	}
 
+	// Handle mouse scroll in info popup
+	if m.ShowPopup {
+		switch msg.Type {
+		case tea.MouseWheelUp:
+			m.PopupViewport.LineUp(3)
+		case tea.MouseWheelDown:
+			m.PopupViewport.LineDown(3)
+		}
+		return *m, nil
+	}
+
+	// Scroll both panes together, leaving the focus where it is
+	switch msg.Type {
+	case tea.MouseWheelUp:
+		m.scrollViewports(-3)
+		return *m, nil
+	case tea.MouseWheelDown:
+		m.scrollViewports(3)
+		return *m, nil
+	}
+
+	// A right or Shift click inserts the value of a result instead of
+	// running the configured click action
+	if msg.Type == tea.MouseRight || (msg.Type == tea.MouseLeft && msg.Shift) {
+		if clickedLine := m.resultLineAt(msg.X, msg.Y); clickedLine >= 0 && !isErrorResult(m.Results[clickedLine]) {
+			cmds = append(cmds, m.insertClickedResult(m.Results[clickedLine])...)
+		}
+		return *m, tea.Batch(cmds...)
+	}
+
 	if msg.Type == tea.MouseLeft {
-		// Check if click is in result pane area
-		resultPaneStart := int(float64(m.Width) * 0.7)
-		if msg.X >= resultPaneStart && msg.Y >= 1 && msg.Y <= m.Height-2 {
-			// Calculate which result line was clicked (accounting for viewport offset)
-			clickedLine := msg.Y - 1 + m.ResultViewport.YOffset
-			if clickedLine >= 0 && clickedLine < len(m.Results) && m.Results[clickedLine] != "" {
-				// Save state before inserting ans reference
-				m.saveState()
-				
-				// Insert ans reference at current cursor position
-				ansRef := fmt.Sprintf("ans%d", clickedLine+1)
-
-				currentValue := m.Inputs[m.Focused].Value()
-				cursorPos := m.Inputs[m.Focused].Position()
-				newValue := currentValue[:cursorPos] + ansRef + currentValue[cursorPos:]
-				m.Inputs[m.Focused].SetValue(newValue)
-				m.Inputs[m.Focused].SetCursor(cursorPos + len(ansRef))
-
-				// Trigger async recalculation for current and dependent lines
-				currentExpr := m.Inputs[m.Focused].Value()
-				if !m.Calculating[m.Focused] && currentExpr != "" {
-					m.Calculating[m.Focused] = true
-					cmds = append(cmds, CalculateCmd(currentExpr, m.Results, m.Focused))
-				}
-				m.updateViewports()
-			}
-		} else if msg.X < resultPaneStart && msg.Y >= 1 && msg.Y <= m.Height-2 {
+		resultPaneStart := m.inputPaneWidth()
+		if clickedLine := m.resultLineAt(msg.X, msg.Y); clickedLine >= 0 {
+			cmds = append(cmds, m.clickResult(clickedLine)...)
+		} else if msg.X < resultPaneStart && msg.Y >= 1 && msg.Y <= m.Height-3 && !m.inResultRow(msg.Y) {
 			// Check if click is in input pane area
-			clickedLine := msg.Y - 1 + m.InputViewport.YOffset
+			clickedLine := m.lineAtRow(msg.Y - 1 + m.InputViewport.YOffset)
 			if clickedLine >= 0 && clickedLine < len(m.Inputs) {
 				// Change focus to clicked line
+				m.Selecting = false
 				m.Inputs[m.Focused].Blur()
 				m.Focused = clickedLine
 				m.Inputs[m.Focused].Focus()
 				
 				// Calculate cursor position based on click location
-				// The gutter has: line number (2 chars) + "│" (1 char) + " " (1 char) = 4 base chars
-				gutterWidth := 4
+				// The gutter has: line number (2+ chars) + "│" (1 char) + " " (1 char)
+				gutterWidth := m.gutterWidth()
 				inputValue := m.Inputs[m.Focused].Value()
 				
 				if msg.X >= gutterWidth {
@@ -165,19 +292,17 @@ func (m *Model) handleMouseMessage(msg tea.MouseMsg) (tea.Model, tea.Cmd) {
 					clickPos := msg.X - gutterWidth - 2
 					
 					// Clamp to valid cursor positions (0 to length of input)
-					if clickPos >= len(inputValue) {
-						// Click beyond input text, place cursor at end
-						m.Inputs[m.Focused].SetCursor(len(inputValue))
-					} else if clickPos < 0 {
+					if clickPos < 0 {
 						// Safety check, place cursor at start
 						m.Inputs[m.Focused].SetCursor(0)
 					} else {
-						// Click within input text, place cursor at click position
-						m.Inputs[m.Focused].SetCursor(clickPos)
+						// Click within input text, place cursor at the rune shown
+						// there, or at the end when beyond the text
+						m.Inputs[m.Focused].SetCursor(runeAtCell(inputValue, clickPos))
 					}
 				} else {
 					// Click in gutter area, place cursor at end of line
-					m.Inputs[m.Focused].SetCursor(len(inputValue))
+					m.Inputs[m.Focused].SetCursor(utf8.RuneCountInString(inputValue))
 				}
 				
 				m.updateViewports()
@@ -203,53 +328,61 @@ func (m *Model) handleKeyMessage(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 		return m.handleHelpKeys(msg)
 	}
 
+	// Handle info popup
+	if m.ShowPopup {
+		return m.handlePopupKeys(msg)
+	}
+
 	// Handle go-to-line dialog
 	if m.ShowGoToLine {
 		return m.handleGoToLineKeys(msg)
 	}
 
-	switch msg.Type {
-	case tea.KeyEsc, tea.KeyCtrlC:
-		return *m, tea.Quit
-
-	case tea.KeyCtrlH:
-		return m.openHelp()
-
-	case tea.KeyCtrlR:
-		return m.insertSymbol("√")
+	// Handle search dialog
+	if m.ShowSearch {
+		return m.handleSearchKeys(msg)
+	}
 
-	case tea.KeyCtrlA:
-		return m.insertSymbol("ans")
+	// Handle prompt dialog
+	if m.ActivePrompt != PromptNone {
+		return m.handlePromptKeys(msg)
+	}
 
-	case tea.KeyCtrlT:
-		return m.pasteInputTemplate()
+	switch msg.Type {
+	case tea.KeyCtrlC:
+		return *m, tea.Quit
 
-	case tea.KeyCtrlD:
-		return m.deleteLine()
+	case tea.KeyEsc:
+		if config.VimMode {
+			return m.enterNormalMode()
+		}
+		return m.handleEscape()
+	}
 
-	case tea.KeyCtrlN:
-		return m.clearAll()
-		
-	case tea.KeyCtrlL:
-		return m.openGoToLine()
-		
-	case tea.KeyCtrlZ:
-		// Undo
-		if m.undo() {
-			return *m, nil
+	// Shift+↑/↓ select lines, which the next key acts on or deselects
+	switch msg.String() {
+	case "shift+up":
+		return m.extendSelection(-1)
+	case "shift+down":
+		return m.extendSelection(1)
+	}
+	if m.Selecting {
+		if result, cmd, handled := m.handleSelectionKeys(msg); handled {
+			return result, cmd
 		}
-		return *m, nil
-		
-	case tea.KeyCtrlY:
-		// Redo (Ctrl+Y)
-		if m.redo() {
-			return *m, nil
+	}
+
+	// In normal mode typed keys navigate and edit lines instead
+	if m.Mode == ModeNormal {
+		if result, cmd := m.handleNormalKeys(msg); cmd != nil {
+			return result, cmd
 		}
-		return *m, nil
-		
-	case tea.KeyCtrlS:
-		// Copy result of focused line (Ctrl+S)
-		return m.copyFocusedResult()
+	}
+
+	// Keys of the config's keymap, like Ctrl+H for help or Alt+Enter for a
+	// line above by default
+	if action, bound := config.Keys.bindings()[msg.String()]; bound {
+		return m.runKeyAction(action)
 	}
 
 	// Handle Ctrl+P for π symbol
@@ -272,6 +405,9 @@ func (m *Model) handleKeyMessage(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 		}
 
 	case tea.KeyEnter:
+		if isPlotCall(m.Inputs[m.Focused].Value()) {
+			return m.enterPlotCall()
+		}
 		return m.createNewLine()
 
 	case tea.KeyUp:
@@ -297,14 +433,29 @@ func (m *Model) handleCompletionKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	switch msg.Type {
 	case tea.KeyEsc:
 		m.ShowCompletions = false
+		m.ActiveMenu = MenuCompletions
 		m.updateViewports()
 		return *m, nil
 
 	case tea.KeyEnter, tea.KeyTab, tea.KeyCtrlY:
 		if len(m.Completions) > 0 && m.SelectedCompletion < len(m.Completions) {
-			// Insert selected completion
-			m.insertCompletion(m.Completions[m.SelectedCompletion])
+			// Insert selected completion or menu entry
+			switch m.ActiveMenu {
+			case MenuConditional:
+				m.insertConditional(m.SelectedCompletion)
+			case MenuClipboardTransform:
+				if err := m.insertClipboardTransform(m.SelectedCompletion); err != nil {
+					m.openPopup("Clipboard", "Could not insert: "+err.Error())
+				}
+			case MenuResultHistory:
+				m.insertHistoryResult(m.Completions[m.SelectedCompletion])
+			case MenuSymbols:
+				m.insertPaletteSymbol(m.SelectedCompletion)
+			default:
+				m.insertCompletion(m.Completions[m.SelectedCompletion])
+			}
 			m.ShowCompletions = false
+			m.ActiveMenu = MenuCompletions
 			m.LastCompletionQuery = ""
 			m.updateViewports()
 			cmds = m.triggerCalculationIfNeeded()
@@ -326,6 +477,14 @@ func (m *Model) handleCompletionKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 		return *m, nil
 
 	default:
+		// Menus other than completions can't be filtered, close them and keep typing
+		if m.ActiveMenu != MenuCompletions {
+			m.ShowCompletions = false
+			m.ActiveMenu = MenuCompletions
+			m.updateViewports()
+			return *m, nil
+		}
+
 		// Filter completions on any other key press while showing completions
 		var cmd tea.Cmd
 		m.Inputs[m.Focused], cmd = m.Inputs[m.Focused].Update(msg)
@@ -349,9 +508,9 @@ func (m *Model) handleCompletionKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 
 		// Trigger calculation
 		currentExpr := m.Inputs[m.Focused].Value()
-		if !m.Calculating[m.Focused] && currentExpr != "" {
+		if currentExpr != "" {
 			m.Calculating[m.Focused] = true
-			cmds = append(cmds, CalculateCmd(currentExpr, m.Results, m.Focused))
+			cmds = append(cmds, m.calculateLineCmd(currentExpr, m.Focused))
 		} else if currentExpr == "" {
 			// Clear result when input is empty
 			m.Results[m.Focused] = ""
@@ -364,6 +523,10 @@ func (m *Model) handleCompletionKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 
 // handleHelpKeys handles keyboard input when help is showing
 func (m *Model) handleHelpKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	if m.HelpSearching {
+		return m.handleHelpSearchKeys(msg)
+	}
+
 	switch msg.Type {
 	case tea.KeyCtrlC:
 		return *m, tea.Quit
@@ -400,12 +563,62 @@ func (m *Model) handleHelpKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	case "q":
 		m.ShowHelp = false
 		return *m, func() tea.Msg { return nil }
+	case "/":
+		m.HelpSearching, m.HelpQuery, m.HelpMatch = true, "", 0
+		m.updateHelpSearch()
+		return *m, func() tea.Msg { return nil }
+	case "n":
+		m.stepHelpMatch(1)
+		return *m, func() tea.Msg { return nil }
+	case "N":
+		m.stepHelpMatch(-1)
+		return *m, func() tea.Msg { return nil }
 	}
 
 	// Don't pass any other keys to prevent them from affecting the main application
 	return *m, func() tea.Msg { return nil }
 }
 
+// handlePopupKeys handles keyboard input when the info popup is showing
+func (m *Model) handlePopupKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.Type {
+	case tea.KeyCtrlC:
+		return *m, tea.Quit
+
+	case tea.KeyEsc, tea.KeyEnter:
+		return m.closePopup()
+
+	case tea.KeyUp:
+		m.PopupViewport.LineUp(1)
+
+	case tea.KeyDown:
+		m.PopupViewport.LineDown(1)
+
+	case tea.KeyPgUp:
+		m.PopupViewport.HalfViewUp()
+
+	case tea.KeyPgDown:
+		m.PopupViewport.HalfViewDown()
+	}
+
+	switch msg.String() {
+	case "j":
+		m.PopupViewport.LineDown(1)
+	case "k":
+		m.PopupViewport.LineUp(1)
+	case "q":
+		return m.closePopup()
+	case "r":
+		if m.PopupGraph {
+			m.closePopup()
+			return m.openGraphPrompt()
+		}
+	}
+
+	// Don't pass any other keys to the main application
+	return *m, func() tea.Msg { return nil }
+}
+
 // handleGoToLineKeys handles keyboard input when go-to-line dialog is showing
 func (m *Model) handleGoToLineKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	switch msg.Type {
@@ -421,4 +634,44 @@ func (m *Model) handleGoToLineKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 		m.GoToLineInput, cmd = m.GoToLineInput.Update(msg)
 		return *m, cmd
 	}
-}
\ No newline at end of file
+}
+
+// doubleEscapeWindow is how quickly a second Esc has to follow to quit
+const doubleEscapeWindow = 500 * time.Millisecond
+
+// handleEscape quits on Esc according to the configured escape behavior
+func (m *Model) handleEscape() (tea.Model, tea.Cmd) {
+	switch config.EscapeBehavior {
+	case EscapeDoubleQuit:
+		if time.Since(m.LastEscape) < doubleEscapeWindow {
+			return *m, tea.Quit
+		}
+		m.LastEscape = time.Now()
+		return *m, textinput.Blink
+	case EscapeNone:
+		return *m, textinput.Blink
+	default:
+		return *m, tea.Quit
+	}
+}
+
+// handlePromptKeys handles keyboard input when a prompt dialog is showing
+func (m *Model) handlePromptKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.Type {
+	case tea.KeyEsc:
+		return m.cancelPrompt()
+
+	case tea.KeyEnter:
+		return m.submitPrompt()
+
+	default:
+		// Update the prompt input with the key
+		var cmd tea.Cmd
+		m.PromptInput, cmd = m.PromptInput.Update(msg)
+		if cmd == nil {
+			// Don't let the key fall through to the focused input
+			cmd = func() tea.Msg { return nil }
+		}
+		return *m, cmd
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/charmbracelet/bubbletea"
+)
+
+// explanationStep is one row of the explanation of a line, like the exact
+// form of its result
+type explanationStep struct {
+	label string
+	value string
+}
+
+// explanationForms label the forms of a line shown by its explanation
+var explanationForms = []struct {
+	label string
+	form  ExpressionForm
+}{
+	{"Parsed", FormParsed},
+	{"Exact", FormExact},
+	{"Decimal", FormApproximate},
+	{"Factored", FormFactored},
+}
+
+// explainLine returns how the line at index is calculated: the expression
+// libqalculate gets after preprocessing and ans substitution, how it parses
+// it and alternate forms of the result. Lines without a calculation give nil.
+func explainLine(input string, results []string, index int) []explanationStep {
+	expr := stripLabel(input)
+	if isPlotCall(expr) {
+		return nil
+	}
+	typed := strings.TrimSpace(stripComment(expr))
+
+	expanded, err := expandExpression(expr, results, index)
+	if err != nil {
+		return []explanationStep{{"Input", typed}, {"Error", err.Error()}}
+	}
+	if expanded == "" {
+		return nil
+	}
+
+	steps := []explanationStep{{"Input", typed}}
+	if expanded = strings.TrimSpace(expanded); expanded != typed {
+		steps = append(steps, explanationStep{"Calculated", expanded})
+	}
+	for _, f := range explanationForms {
+		steps = append(steps, explanationStep{f.label, ExplainExpression(expanded, f.form)})
+	}
+	return steps
+}
+
+// renderExplanation lines up the labels and values of an explanation
+func renderExplanation(steps []explanationStep) string {
+	width := 0
+	for _, step := range steps {
+		width = max(width, len(step.label))
+	}
+	lines := make([]string, len(steps))
+	for i, step := range steps {
+		lines[i] = fmt.Sprintf("%-*s  %s", width, step.label, step.value)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// openExplanation shows how the focused line is calculated
+func (m *Model) openExplanation() (tea.Model, tea.Cmd) {
+	title := fmt.Sprintf("Steps of line %d", m.Focused+1)
+	steps := explainLine(m.Inputs[m.Focused].Value(), m.Results, m.Focused)
+	if len(steps) == 0 {
+		return m.openPopup(title, "Nothing is calculated on this line")
+	}
+	return m.openPopup(title, renderExplanation(steps))
+}
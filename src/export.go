@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+// defaultPageHeight is the number of rows of an exported page, fitting a printed page
+const defaultPageHeight = 60
+
+// exportTitle heads every exported page
+const exportTitle = "nasc worksheet"
+
+// pageLayout describes the rows framing the lines of an exported page
+type pageLayout struct {
+	header    func(page, pages int) []string
+	footer    func(page, pages int) []string
+	separator string // Placed between pages
+}
+
+// textLayout frames plain text pages, separated by form feeds for printing
+var textLayout = pageLayout{
+	header: func(page, pages int) []string {
+		return []string{exportTitle, strings.Repeat("=", len(exportTitle))}
+	},
+	footer: func(page, pages int) []string {
+		return []string{"", fmt.Sprintf("Page %d of %d", page, pages)}
+	},
+	separator: "\n\f",
+}
+
+// markdownLayout frames Markdown pages, each holding a table of its lines
+var markdownLayout = pageLayout{
+	header: func(page, pages int) []string {
+		return []string{
+			fmt.Sprintf("## %s, page %d of %d", exportTitle, page, pages),
+			"",
+			"| # | Input | Result | Note |",
+			"|--:|-------|--------|------|",
+		}
+	},
+	footer: func(page, pages int) []string {
+		return []string{"", "---"}
+	},
+	separator: "\n\n",
+}
+
+// exportResult returns the result of line i as shown in the result pane
+func (m *Model) exportResult(i int) string {
+	if i >= len(m.Results) || m.isResultHidden(i) {
+		return ""
+	}
+	return displayString(m.Results[i])
+}
+
+// textBlocks serializes each line like worksheetText, followed by its numbered
+// result. A line's note and input form one block that is never split.
+func (m *Model) textBlocks() [][]string {
+	numberWidth := len(strconv.Itoa(len(m.Inputs)))
+	inputWidth := 0
+	for _, input := range m.Inputs {
+		inputWidth = max(inputWidth, lipgloss.Width(input.Value()))
+	}
+
+	blocks := make([][]string, len(m.Inputs))
+	for i, input := range m.Inputs {
+		if note := m.lineNote(i); note != "" {
+			blocks[i] = append(blocks[i], strings.Repeat(" ", numberWidth+2)+noteMarker+" "+note)
+		}
+		row := fmt.Sprintf("%*d  %s", numberWidth, i+1, input.Value())
+		if result := m.exportResult(i); result != "" {
+			row += strings.Repeat(" ", inputWidth-lipgloss.Width(input.Value())) + "  = " + result
+		}
+		blocks[i] = append(blocks[i], row)
+	}
+	return blocks
+}
+
+// markdownBlocks serializes each line as a table row
+func (m *Model) markdownBlocks() [][]string {
+	escape := strings.NewReplacer("|", `\|`)
+	blocks := make([][]string, len(m.Inputs))
+	for i, input := range m.Inputs {
+		blocks[i] = []string{fmt.Sprintf("| %d | %s | %s | %s |", i+1,
+			escape.Replace(input.Value()), escape.Replace(m.exportResult(i)), escape.Replace(m.lineNote(i)))}
+	}
+	return blocks
+}
+
+// paginate fills pages of at most rows rows with whole blocks. Only a block
+// taller than a page is split, as it cannot be kept together.
+func paginate(blocks [][]string, rows int) [][]string {
+	var pages [][]string
+	var page []string
+	for _, block := range blocks {
+		if len(page) > 0 && len(page)+len(block) > rows {
+			pages = append(pages, page)
+			page = nil
+		}
+		for len(block) > rows {
+			pages = append(pages, block[:rows])
+			block = block[rows:]
+		}
+		page = append(page, block...)
+	}
+	if len(page) > 0 || len(pages) == 0 {
+		pages = append(pages, page)
+	}
+	return pages
+}
+
+// exportPages lays out the worksheet on pages of pageHeight rows, including
+// each page's header and footer
+func (m *Model) exportPages(markdown bool, pageHeight int) []string {
+	layout, blocks := textLayout, m.textBlocks()
+	if markdown {
+		layout, blocks = markdownLayout, m.markdownBlocks()
+	}
+
+	// Header and footer rows are the same on every page
+	rows := max(1, pageHeight-len(layout.header(1, 1))-len(layout.footer(1, 1)))
+	bodies := paginate(blocks, rows)
+
+	pages := make([]string, len(bodies))
+	for i, body := range bodies {
+		var lines []string
+		lines = append(lines, layout.header(i+1, len(bodies))...)
+		lines = append(lines, body...)
+		lines = append(lines, layout.footer(i+1, len(bodies))...)
+		pages[i] = strings.Join(lines, "\n")
+	}
+	return pages
+}
+
+// parseExportSpec splits "path [lines per page]" into the file path and the page height
+func parseExportSpec(spec string) (string, int) {
+	spec = expandHome(spec)
+
+	if pos := strings.LastIndex(spec, " "); pos != -1 {
+		if height, err := strconv.Atoi(spec[pos+1:]); err == nil && height > 0 {
+			return strings.TrimSpace(spec[:pos]), height
+		}
+	}
+	return spec, defaultPageHeight
+}
+
+// worksheetCSV serializes the non-empty lines as CSV rows of expression and result
+func (m *Model) worksheetCSV() (string, error) {
+	var builder strings.Builder
+	writer := csv.NewWriter(&builder)
+	if err := writer.Write([]string{"expression", "result"}); err != nil {
+		return "", err
+	}
+	for _, p := range m.worksheetPairs() {
+		if err := writer.Write([]string{p.expr, p.result}); err != nil {
+			return "", err
+		}
+	}
+	writer.Flush()
+	return builder.String(), writer.Error()
+}
+
+// exportWorksheet writes the lines with their results to path: a Markdown
+// table for .md files, CSV for .csv files and aligned "expression = result"
+// lines otherwise. Files are UTF-8 so currency symbols like € are kept.
+func (m *Model) exportWorksheet(path string) error {
+	var content string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".md", ".markdown":
+		content = m.pairsText(true) + "\n"
+	case ".csv":
+		csvContent, err := m.worksheetCSV()
+		if err != nil {
+			return err
+		}
+		content = csvContent
+	default:
+		content = m.pairsText(false) + "\n"
+	}
+	return os.WriteFile(path, []byte(content), 0o644)
+}
+
+// exportPaged writes the paginated worksheet to path, as Markdown for .md files
+// and as plain text otherwise
+func (m *Model) exportPaged(path string, pageHeight int) error {
+	ext := strings.ToLower(filepath.Ext(path))
+	markdown := ext == ".md" || ext == ".markdown"
+	layout := textLayout
+	if markdown {
+		layout = markdownLayout
+	}
+
+	content := strings.Join(m.exportPages(markdown, pageHeight), layout.separator) + "\n"
+	return os.WriteFile(path, []byte(content), 0o644)
+}
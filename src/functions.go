@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+)
+
+// parseFunctionDefinition splits a definition like "f(x) = x^2 + 1" into the
+// function name, its variable and the expression
+func parseFunctionDefinition(input string) (string, string, string, bool) {
+	parts := functionDefinitionRegex.FindStringSubmatch(strings.TrimSpace(stripComment(input)))
+	if parts == nil {
+		return "", "", "", false
+	}
+	return parts[1], parts[2], strings.TrimSpace(parts[3]), true
+}
+
+// functionFormula prepares the expression of a definition for libqalculate,
+// which refers to the argument of a function as \x
+func functionFormula(variable, body string) string {
+	return prepareString(replaceIdentifiers(body, func(name string) (string, bool) {
+		return `\x`, name == variable
+	}))
+}
+
+// syncUserFunctions registers the functions defined on lines with libqalculate,
+// a later definition of a name replacing earlier ones, and removes functions
+// whose definition is gone
+func syncUserFunctions(inputs []string) {
+	formulas := make(map[string]string)
+	for _, input := range inputs {
+		if name, variable, body, ok := parseFunctionDefinition(input); ok {
+			formulas[name] = functionFormula(variable, body)
+		}
+	}
+
+	for _, name := range userFunctionNames() {
+		if _, exists := formulas[name]; !exists {
+			UndefineFunction(name)
+		}
+	}
+	for name, formula := range formulas {
+		if current, exists := userFunctionFormula(name); !exists || current != formula {
+			DefineFunction(name, formula)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// helpSearchRegex matches the help search query anywhere, ignoring case
+func helpSearchRegex(query string) *regexp.Regexp {
+	return regexp.MustCompile(`(?i)` + regexp.QuoteMeta(query))
+}
+
+// helpMatchLines returns the lines of text containing query
+func helpMatchLines(text, query string) []int {
+	if query == "" {
+		return nil
+	}
+	regex := helpSearchRegex(query)
+	var lines []int
+	for i, line := range strings.Split(text, "\n") {
+		if regex.MatchString(line) {
+			lines = append(lines, i)
+		}
+	}
+	return lines
+}
+
+// highlightHelp highlights the matches of query in the help text, those on
+// the line of the current match with the focused style
+func (m Model) highlightHelp(text, query string, current int) string {
+	if query == "" {
+		return text
+	}
+	regex := helpSearchRegex(query)
+	matchStyle := lipgloss.NewStyle().Reverse(true)
+	currentStyle := lipgloss.NewStyle().Background(m.Theme.focusedColor).Foreground(lipgloss.Color("0"))
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		style := matchStyle
+		if i == current {
+			style = currentStyle
+		}
+		lines[i] = regex.ReplaceAllStringFunc(line, func(match string) string {
+			return style.Render(match)
+		})
+	}
+	return strings.Join(lines, "\n")
+}
+
+// updateHelpSearch finds the matches of the help query, highlights them and
+// scrolls to the current one
+func (m *Model) updateHelpSearch() {
+	m.HelpMatches = helpMatchLines(helpText, m.HelpQuery)
+	m.HelpMatch = min(m.HelpMatch, max(0, len(m.HelpMatches)-1))
+
+	current := -1
+	if len(m.HelpMatches) > 0 {
+		current = m.HelpMatches[m.HelpMatch]
+	}
+	m.HelpViewport.SetContent(m.highlightHelp(helpText, m.HelpQuery, current))
+	if current >= 0 {
+		m.HelpViewport.SetYOffset(current)
+	}
+}
+
+// stepHelpMatch moves to the next or, for a negative delta, previous match
+func (m *Model) stepHelpMatch(delta int) {
+	if len(m.HelpMatches) == 0 {
+		return
+	}
+	m.HelpMatch = (m.HelpMatch + delta + len(m.HelpMatches)) % len(m.HelpMatches)
+	m.updateHelpSearch()
+}
+
+// handleHelpSearchKeys edits the help search query as it is typed. Enter keeps
+// the matches for n and N, Esc drops the search.
+func (m *Model) handleHelpSearchKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.Type {
+	case tea.KeyCtrlC:
+		return *m, tea.Quit
+
+	case tea.KeyEnter:
+		m.HelpSearching = false
+
+	case tea.KeyEsc:
+		m.HelpSearching = false
+		m.HelpQuery = ""
+		m.updateHelpSearch()
+
+	case tea.KeyBackspace:
+		if m.HelpQuery != "" {
+			runes := []rune(m.HelpQuery)
+			m.HelpQuery = string(runes[:len(runes)-1])
+			m.updateHelpSearch()
+		}
+
+	case tea.KeyRunes, tea.KeySpace:
+		m.HelpQuery += string(msg.Runes)
+		// Start from the first match of the longer query
+		m.HelpMatch = 0
+		m.updateHelpSearch()
+	}
+	return *m, func() tea.Msg { return nil }
+}
+
+// helpTitle returns the title of the help popup, showing the search if any
+func (m Model) helpTitle() string {
+	if !m.HelpSearching && m.HelpQuery == "" {
+		return "NaSC (↑↓ to scroll, / to search, Esc to close)"
+	}
+
+	title := "/" + m.HelpQuery
+	if m.HelpSearching {
+		title += "▏"
+	}
+	if len(m.HelpMatches) == 0 {
+		return title + " (no matches)"
+	}
+	return title + fmt.Sprintf(" (%d/%d, n/N to jump)", m.HelpMatch+1, len(m.HelpMatches))
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+// tokenKind is the class of a highlighted input token
+type tokenKind int
+
+const (
+	tokenNumber tokenKind = iota
+	tokenOperator
+	tokenFunction
+)
+
+// inputToken is a highlighted span of an input, by rune index
+type inputToken struct {
+	start, end int
+	kind       tokenKind
+}
+
+// tokenRegex matches numbers, names and operators. Names take their digits
+// along, so the 1 of "ans1" isn't a number.
+var tokenRegex = regexp.MustCompile(`(0x[0-9A-Fa-f]+|\d+(?:[.,]\d+)*(?:[eE][+-]?\d+)?)|` +
+	`(` + identifierRegex.String() + `)|` +
+	`(` + operatorPattern() + `)`)
+
+// operatorPattern returns an alternation matching the operators
+func operatorPattern() string {
+	var quoted []string
+	for _, op := range operators {
+		quoted = append(quoted, regexp.QuoteMeta(op))
+	}
+	return strings.Join(quoted, "|")
+}
+
+// functionNames returns the function names offered in completions, which are
+// highlighted in inputs
+func functionNames() map[string]bool {
+	basicFunctions, advancedFunctions := getLibqalculateCompletions()
+	names := make(map[string]bool, len(basicFunctions)+len(advancedFunctions))
+	for _, name := range basicFunctions {
+		names[name] = true
+	}
+	for _, name := range advancedFunctions {
+		names[name] = true
+	}
+	return names
+}
+
+// tokenizeInput returns the numbers, operators and known function names of
+// text, leaving out its comment
+func tokenizeInput(text string, functions map[string]bool) []inputToken {
+	text = stripComment(text)
+
+	var tokens []inputToken
+	for _, loc := range tokenRegex.FindAllStringSubmatchIndex(text, -1) {
+		var kind tokenKind
+		switch {
+		case loc[2] >= 0:
+			kind = tokenNumber
+		case loc[4] >= 0:
+			if !functions[text[loc[4]:loc[5]]] {
+				continue
+			}
+			kind = tokenFunction
+		default:
+			kind = tokenOperator
+		}
+		start := utf8.RuneCountInString(text[:loc[0]])
+		tokens = append(tokens, inputToken{start, start + utf8.RuneCountInString(text[loc[0]:loc[1]]), kind})
+	}
+	return tokens
+}
+
+// highlightSyntax colors the numbers, operators and function names of a
+// rendered input, leaving spans styled before like ans values alone
+func (m Model) highlightSyntax(text string, functions map[string]bool) string {
+	tokenStyles := map[tokenKind]lipgloss.Style{
+		tokenNumber:   lipgloss.NewStyle().Foreground(m.Theme.numberColor),
+		tokenOperator: lipgloss.NewStyle().Foreground(m.Theme.operatorColor),
+		tokenFunction: lipgloss.NewStyle().Foreground(m.Theme.functionColor),
+	}
+
+	styles := make(map[int]lipgloss.Style)
+	for _, token := range tokenizeInput(stripANSIEscapeCodes(text), functions) {
+		for i := token.start; i < token.end; i++ {
+			styles[i] = tokenStyles[token.kind]
+		}
+	}
+	return styleRunes(text, styles, false)
+}
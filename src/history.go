@@ -0,0 +1,52 @@
+package main
+
+import (
+	"slices"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	"github.com/charmbracelet/bubbletea"
+)
+
+// resultHistorySize is the number of recent results kept for recall
+const resultHistorySize = 30
+
+// recordResult adds a completed result to the history of recent results.
+// Results of a line being typed replace each other, so typing "123" keeps
+// 123 but not 1 and 12.
+func (m *Model) recordResult(index int, result string) {
+	if result == "" || isErrorResult(result) || isAbortedResult(result) {
+		return
+	}
+
+	if len(m.ResultHistory) > 0 && m.ResultHistoryLine == index {
+		m.ResultHistory = m.ResultHistory[1:]
+	}
+	m.ResultHistory = slices.DeleteFunc(m.ResultHistory, func(old string) bool {
+		return old == result
+	})
+	m.ResultHistory = slices.Insert(m.ResultHistory, 0, result)
+	if len(m.ResultHistory) > resultHistorySize {
+		m.ResultHistory = m.ResultHistory[:resultHistorySize]
+	}
+	m.ResultHistoryLine = index
+}
+
+// openResultHistory lists the recent results, newest first, to insert one at
+// the cursor
+func (m *Model) openResultHistory() (tea.Model, tea.Cmd) {
+	if len(m.ResultHistory) == 0 {
+		return *m, textinput.Blink
+	}
+
+	m.Completions = slices.Clone(m.ResultHistory)
+	m.SelectedCompletion = 0
+	m.ShowCompletions = true
+	m.ActiveMenu = MenuResultHistory
+	m.updateViewports()
+	return *m, textinput.Blink
+}
+
+// insertHistoryResult inserts a recent result at the cursor
+func (m *Model) insertHistoryResult(result string) {
+	m.insertAtCursor(result)
+}
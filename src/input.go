@@ -1,13 +1,18 @@
 package main
 
 import (
+	"fmt"
+	"math"
+	"regexp"
 	"slices"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 
-	"github.com/atotto/clipboard"
 	"github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/bubbles/textinput"
+	"github.com/charmbracelet/bubbles/viewport"
+	"github.com/charmbracelet/lipgloss"
 )
 
 // insertCompletion inserts a completion at the current cursor position
@@ -31,24 +36,130 @@ func (m *Model) insertCompletion(completion string) {
 
 // insertSymbol inserts a symbol at the current cursor position
 func (m *Model) insertSymbol(symbol string) (tea.Model, tea.Cmd) {
-	// Save state before inserting symbol
+	m.insertAtCursor(symbol)
+
+	// Trigger calculation
+	return *m, tea.Batch(m.triggerCalculationIfNeeded()...)
+}
+
+// insertAtCursor inserts text at the cursor of the focused line as one undo step
+func (m *Model) insertAtCursor(text string) {
+	// Save state before inserting the text
 	m.saveState()
-	
-	var cmds []tea.Cmd
 
-	currentValue := m.Inputs[m.Focused].Value()
+	// Symbols like π aren't ASCII, so insert by rune position
+	currentValue := []rune(m.Inputs[m.Focused].Value())
 	cursorPos := m.Inputs[m.Focused].Position()
-	newValue := currentValue[:cursorPos] + symbol + currentValue[cursorPos:]
+	newValue := string(currentValue[:cursorPos]) + text + string(currentValue[cursorPos:])
 	m.Inputs[m.Focused].SetValue(newValue)
-	m.Inputs[m.Focused].SetCursor(cursorPos + len(symbol))
+	m.Inputs[m.Focused].SetCursor(cursorPos + utf8.RuneCountInString(text))
+}
 
-	// Trigger calculation
-	if !m.Calculating[m.Focused] && newValue != "" {
-		m.Calculating[m.Focused] = true
-		cmds = append(cmds, CalculateCmd(newValue, m.Results, m.Focused))
+// MenuKind identifies what selecting an entry in the completion popup does
+type MenuKind int
+
+const (
+	MenuCompletions MenuKind = iota
+	MenuConditional
+	MenuClipboardTransform
+	MenuResultHistory
+	MenuSymbols
+)
+
+// conditionalComparisons lists the comparisons offered by the conditional menu
+var conditionalComparisons = []struct {
+	label    string
+	operator string
+}{
+	{"if(condition, then, else)", ""},
+	{"if(a = b, …)", "="},
+	{"if(a != b, …)", "!="},
+	{"if(a < b, …)", "<"},
+	{"if(a > b, …)", ">"},
+	{"if(a <= b, …)", "<="},
+	{"if(a >= b, …)", ">="},
+}
+
+// openConditionalMenu shows the comparisons available for an inserted conditional
+func (m *Model) openConditionalMenu() (tea.Model, tea.Cmd) {
+	labels := make([]string, len(conditionalComparisons))
+	for i, comparison := range conditionalComparisons {
+		labels[i] = comparison.label
 	}
 
-	return *m, tea.Batch(cmds...)
+	m.Completions = labels
+	m.SelectedCompletion = 0
+	m.ShowCompletions = true
+	m.ActiveMenu = MenuConditional
+	m.updateViewports()
+	return *m, textinput.Blink
+}
+
+// insertConditional inserts an if(condition, then, else) template for the chosen
+// comparison with the cursor placed at the condition
+func (m *Model) insertConditional(index int) {
+	if index < 0 || index >= len(conditionalComparisons) {
+		return
+	}
+
+	condition := ""
+	if operator := conditionalComparisons[index].operator; operator != "" {
+		condition = " " + operator + " "
+	}
+
+	// Leave the cursor on the condition
+	cursorPos := m.Inputs[m.Focused].Position()
+	m.insertAtCursor("if(" + condition + ", , )")
+	m.Inputs[m.Focused].SetCursor(cursorPos + len("if("))
+}
+
+// clipboardTransforms lists the calculations offered on a number in the clipboard
+var clipboardTransforms = []struct {
+	label    string
+	template string
+}{
+	{"1 / x    reciprocal", "1 / (%s)"},
+	{"x × 100  percent", "%s * 100"},
+	{"-x       negation", "-(%s)"},
+}
+
+// openClipboardTransformMenu shows the transforms available for the clipboard number
+func (m *Model) openClipboardTransformMenu() (tea.Model, tea.Cmd) {
+	labels := make([]string, len(clipboardTransforms))
+	for i, transform := range clipboardTransforms {
+		labels[i] = transform.label
+	}
+
+	m.Completions = labels
+	m.SelectedCompletion = 0
+	m.ShowCompletions = true
+	m.ActiveMenu = MenuClipboardTransform
+	m.updateViewports()
+	return *m, textinput.Blink
+}
+
+// insertClipboardTransform adds a focused line below the current one computing
+// the chosen transform of the number in the clipboard. The number is read and
+// written with the configured separators, like results are shown.
+func (m *Model) insertClipboardTransform(index int) error {
+	if index < 0 || index >= len(clipboardTransforms) {
+		return nil
+	}
+
+	content, err := readClipboard()
+	if err != nil {
+		return err
+	}
+	value, ok := parseCSVNumber(content)
+	if !ok {
+		return fmt.Errorf("clipboard holds no number: %q", strings.TrimSpace(content))
+	}
+
+	m.createNewLine()
+	value = groupThousands(localizeDecimal(value))
+	m.Inputs[m.Focused].SetValue(fmt.Sprintf(clipboardTransforms[index].template, value))
+	m.Inputs[m.Focused].CursorEnd()
+	return nil
 }
 
 // triggerCalculationIfNeeded triggers calculation if input is non-empty
@@ -56,9 +167,9 @@ func (m *Model) triggerCalculationIfNeeded() []tea.Cmd {
 	var cmds []tea.Cmd
 
 	currentExpr := m.Inputs[m.Focused].Value()
-	if !m.Calculating[m.Focused] && currentExpr != "" {
+	if currentExpr != "" {
 		m.Calculating[m.Focused] = true
-		cmds = append(cmds, CalculateCmd(currentExpr, m.Results, m.Focused))
+		cmds = append(cmds, m.calculateLineCmd(currentExpr, m.Focused))
 	} else if currentExpr == "" {
 		// Clear result when input is empty
 		m.Results[m.Focused] = ""
@@ -68,24 +179,203 @@ func (m *Model) triggerCalculationIfNeeded() []tea.Cmd {
 	return cmds
 }
 
+// recalculateFrom calculates the lines from first on again in the background,
+// superseding their calculations in flight. Lines using a result that changes
+// are calculated again once it arrives.
+func (m *Model) recalculateFrom(first int) tea.Cmd {
+	// A line defining a function may be gone even if no line is left to calculate
+	syncUserFunctions(m.inputValues())
+
+	var cmds []tea.Cmd
+	for i := first; i < len(m.Inputs); i++ {
+		expr := m.Inputs[i].Value()
+		if expr == "" {
+			if m.Calculations != nil {
+				m.Calculations.CancelCalculation(i)
+			}
+			m.Calculating[i] = false
+			m.Results[i] = ""
+			continue
+		}
+		m.Calculating[i] = true
+		cmds = append(cmds, m.calculateLineCmd(expr, i))
+	}
+	return tea.Batch(cmds...)
+}
+
+// popupSize returns the content width and height for popups at the current terminal size
+func (m *Model) popupSize() (int, int) {
+	maxHeight := int(float64(m.Height) * 0.8)
+	height := min(maxHeight, m.Height-6)
+	if m.Height <= 10 {
+		height = m.Height - 3
+	}
+	width := min(80, m.Width-4)
+	if width < 30 {
+		width = 30
+	}
+	return width, height
+}
+
 // openHelp opens the help popup
 func (m *Model) openHelp() (tea.Model, tea.Cmd) {
 	m.ShowHelp = true
-	maxHelpHeight := int(float64(m.Height) * 0.8)
-	helpHeight := min(maxHelpHeight, m.Height-6)
-	if m.Height <= 10 {
-		helpHeight = m.Height - 3
+	m.HelpViewport.Width, m.HelpViewport.Height = m.popupSize()
+	m.HelpSearching, m.HelpQuery, m.HelpMatch = false, "", 0
+	m.updateHelpSearch()
+	m.HelpViewport.GotoTop()
+	return *m, textinput.Blink
+}
+
+// openPopup opens the info popup with the given title and content
+func (m *Model) openPopup(title string, content string) (tea.Model, tea.Cmd) {
+	m.ShowPopup = true
+	m.PopupTitle = title
+	m.PopupViewport = viewport.New(m.popupSize())
+	m.PopupViewport.SetContent(content)
+	return *m, textinput.Blink
+}
+
+// closePopup closes the info popup
+func (m *Model) closePopup() (tea.Model, tea.Cmd) {
+	m.ShowPopup = false
+	m.PopupGraph = false
+	return *m, textinput.Blink
+}
+
+// openGraphPrompt asks for the range to graph the focused line over
+func (m *Model) openGraphPrompt() (tea.Model, tea.Cmd) {
+	if _, _, ok := graphableExpression(m.Inputs[m.Focused].Value()); !ok {
+		return m.openPopup("Graph", "Write f(x) = ... or an expression in x to graph it")
 	}
-	helpWidth := min(80, m.Width-4)
-	if helpWidth < 30 {
-		helpWidth = 30
+	if m.GraphRange == "" {
+		m.GraphRange = defaultGraphRange
 	}
-	m.HelpViewport.Width = helpWidth
-	m.HelpViewport.Height = helpHeight
-	m.HelpViewport.SetContent(helpText)
+	m.openPrompt(PromptGraphRange)
+	m.PromptInput.SetValue(m.GraphRange)
+	m.PromptInput.CursorEnd()
 	return *m, textinput.Blink
 }
 
+// openGraph plots the focused line over [from, to] in the info popup
+func (m *Model) openGraph(from, to float64) (tea.Model, tea.Cmd) {
+	expr, variable, ok := graphableExpression(m.Inputs[m.Focused].Value())
+	if !ok {
+		return *m, textinput.Blink
+	}
+
+	return m.showGraph(expr, variable, from, to, m.Focused)
+}
+
+// showGraph plots expr of variable over [from, to] in the info popup, with
+// the results before line index available to it. The range can be changed
+// if it is the focused line's graph.
+func (m *Model) showGraph(expr, variable string, from, to float64, index int) (tea.Model, tea.Cmd) {
+	// One sample per column, leaving room for the y axis labels
+	width, height := m.popupSize()
+	samples := sampleExpression(expr, variable, from, to, max(2, width-12), m.Results, index)
+	title := "Graph of " + expr
+	if index == m.Focused {
+		title += " (r: range)"
+	}
+	m.openPopup(title, renderPlot(samples, max(2, height-1)))
+	m.PopupGraph = index == m.Focused
+	return *m, textinput.Blink
+}
+
+// enterPlotCall adds a new line below a plot call like "plot(sin(x), -10, 10)"
+// and draws the call in the info popup
+func (m *Model) enterPlotCall() (tea.Model, tea.Cmd) {
+	index := m.Focused
+	expr, from, to, ok := parsePlotCall(m.Inputs[index].Value())
+	m.createNewLine()
+	if !ok {
+		return m.openPopup("Graph", "Write plot(expression in x, from, to) with a non-empty range")
+	}
+	return m.showGraph(expr, "x", from, to, index)
+}
+
+// openResultDiff shows which results changed since the given number of undo steps ago
+func (m *Model) openResultDiff(steps int) (tea.Model, tea.Cmd) {
+	if m.UndoSystem == nil || len(m.UndoSystem.undoStack) == 0 {
+		return m.openPopup("Result changes", "No earlier state to compare with")
+	}
+
+	steps = max(1, min(steps, len(m.UndoSystem.undoStack)))
+	state := m.UndoSystem.undoStack[len(m.UndoSystem.undoStack)-steps]
+	diffs := diffResults(state.Results, m.Results)
+
+	title := fmt.Sprintf("Result changes since %d undo step(s) ago", steps)
+	return m.openPopup(title, m.renderResultDiff(diffs))
+}
+
+// openDependencyGraph shows which lines reference which other lines
+func (m *Model) openDependencyGraph() (tea.Model, tea.Cmd) {
+	inputs := m.inputValues()
+	deps := lineDependencies(inputs, m.Results)
+	return m.openPopup("Line dependencies", renderDependencyGraph(inputs, deps, findDependencyCycles(deps)))
+}
+
+// openConversionChain shows the intermediate results of the focused conversion
+// chain, or asks for units to chain onto the focused line
+func (m *Model) openConversionChain() (tea.Model, tea.Cmd) {
+	input := m.Inputs[m.Focused].Value()
+	if len(splitConversionChain(stripComment(input))) > 2 {
+		steps := conversionChainSteps(input, m.Results, m.Focused)
+		return m.openPopup("Conversion steps", renderConversionSteps(input, steps))
+	}
+	if strings.TrimSpace(stripComment(input)) == "" {
+		return *m, textinput.Blink
+	}
+	return m.openPrompt(PromptConversionChain)
+}
+
+// openUnitConversions shows the result of the focused line in the common
+// units of its dimension
+func (m *Model) openUnitConversions() (tea.Model, tea.Cmd) {
+	result := m.Results[m.Focused]
+	if result == "" || isErrorResult(result) {
+		return *m, textinput.Blink
+	}
+	title := fmt.Sprintf("Conversions of line %d", m.Focused+1)
+	conversions := unitConversions(m.Inputs[m.Focused].Value(), m.Results, m.Focused)
+	if len(conversions) == 0 {
+		return m.openPopup(title, "No common units to convert "+result+" to")
+	}
+	return m.openPopup(title, renderUnitConversions(result, conversions))
+}
+
+// convertToDefaultCurrency converts the focused line to the configured default
+// currency by appending "to EUR". Amounts without a currency are taken to be
+// in it instead, so "100" becomes "100 EUR".
+func (m *Model) convertToDefaultCurrency() (tea.Model, tea.Cmd) {
+	currency := config.DefaultCurrency
+	if currency == "" {
+		return m.openPopup("Currency", `Set "defaultCurrency" in the config, like "EUR", to convert to it`)
+	}
+
+	input := m.Inputs[m.Focused].Value()
+	parts := splitConversionChain(stripComment(input))
+	result := m.Results[m.Focused]
+	if parts[0] == "" || result == "" || isErrorResult(result) || parts[len(parts)-1] == currency {
+		return *m, textinput.Blink
+	}
+	m.saveState()
+
+	var converted string
+	switch _, plain := parseResultNumber(result); {
+	case !plain:
+		converted = buildConversionChain(input, currency)
+	case len(parts) == 1 && !strings.ContainsAny(parts[0], "+-*/^ "):
+		converted = parts[0] + " " + currency
+	default:
+		converted = "(" + strings.Join(parts, " to ") + ") " + currency
+	}
+	m.Inputs[m.Focused].SetValue(converted)
+	m.Inputs[m.Focused].CursorEnd()
+	return *m, tea.Batch(m.triggerCalculationIfNeeded()...)
+}
+
 // deleteLine deletes the current line or clears content if it's the only line
 func (m *Model) deleteLine() (tea.Model, tea.Cmd) {
 	// Save state before making changes
@@ -96,6 +386,15 @@ func (m *Model) deleteLine() (tea.Model, tea.Cmd) {
 		m.Inputs = append(m.Inputs[:m.Focused], m.Inputs[m.Focused+1:]...)
 		m.Results = append(m.Results[:m.Focused], m.Results[m.Focused+1:]...)
 		m.Calculating = append(m.Calculating[:m.Focused], m.Calculating[m.Focused+1:]...)
+		if m.Focused < len(m.HiddenResults) {
+			m.HiddenResults = slices.Delete(m.HiddenResults, m.Focused, m.Focused+1)
+		}
+		if m.Focused < len(m.Notes) {
+			m.Notes = slices.Delete(m.Notes, m.Focused, m.Focused+1)
+		}
+
+		// Lines below may use a function, variable or result of the deleted line
+		cmd := m.recalculateFrom(m.Focused)
 
 		// Adjust focus
 		if m.Focused >= len(m.Inputs) {
@@ -109,12 +408,13 @@ func (m *Model) deleteLine() (tea.Model, tea.Cmd) {
 			}
 		}
 		m.updateViewports()
-		return *m, textinput.Blink
+		return *m, tea.Batch(textinput.Blink, cmd)
 	} else {
 		// Clear the content of the only line
 		m.Inputs[m.Focused].SetValue("")
 		m.Inputs[m.Focused].SetCursor(0)
 		m.Results[m.Focused] = ""
+		syncUserFunctions(m.inputValues())
 		m.updateViewports()
 		return *m, textinput.Blink
 	}
@@ -134,7 +434,10 @@ func (m *Model) clearAll() (tea.Model, tea.Cmd) {
 	m.Inputs = []textinput.Model{ti}
 	m.Results = []string{""}
 	m.Calculating = []bool{false}
+	m.HiddenResults = nil
+	m.Notes = nil
 	m.Focused = 0
+	syncUserFunctions(nil)
 	m.updateViewports()
 	m.scrollToFocused()
 	return *m, textinput.Blink
@@ -174,18 +477,41 @@ func (m *Model) showCompletions() (tea.Model, tea.Cmd) {
 func (m *Model) createNewLine() (tea.Model, tea.Cmd) {
 	// Save state before making changes
 	m.saveState()
+
+	// Insert new line after the current focused line
+	m.insertEmptyLine(m.Focused + 1)
+	m.followLastLine()
+	return *m, textinput.Blink
+}
+
+// createLineAbove inserts an empty line above the focused line and focuses it
+func (m *Model) createLineAbove() (tea.Model, tea.Cmd) {
+	m.saveState()
+	m.insertEmptyLine(m.Focused)
+
+	// The lines below moved down, so their ans references now point elsewhere
+	cmd := m.recalculateFrom(m.Focused)
+	m.updateViewports()
+	return *m, tea.Batch(textinput.Blink, cmd)
+}
+
+// insertEmptyLine inserts an empty line at insertIndex and focuses it
+func (m *Model) insertEmptyLine(insertIndex int) {
 	newInput := textinput.New()
 	newInput.Placeholder = ""
 	newInput.Width = m.GetTextInputWidth() // Account for gutter width
 	newInput.Prompt = ""
-	
-	// Insert new line after the current focused line
-	insertIndex := m.Focused + 1
-	
+
 	// Insert at the specific position
 	m.Inputs = append(m.Inputs[:insertIndex], append([]textinput.Model{newInput}, m.Inputs[insertIndex:]...)...)
 	m.Results = append(m.Results[:insertIndex], append([]string{""}, m.Results[insertIndex:]...)...)
 	m.Calculating = append(m.Calculating[:insertIndex], append([]bool{false}, m.Calculating[insertIndex:]...)...)
+	if insertIndex < len(m.HiddenResults) {
+		m.HiddenResults = slices.Insert(m.HiddenResults, insertIndex, false)
+	}
+	if insertIndex < len(m.Notes) {
+		m.Notes = slices.Insert(m.Notes, insertIndex, "")
+	}
 
 	// Move focus to the newly inserted line
 	m.Focused = insertIndex
@@ -198,16 +524,93 @@ func (m *Model) createNewLine() (tea.Model, tea.Cmd) {
 	}
 	m.updateViewports()
 	m.scrollToFocused()
-	return *m, textinput.Blink
+}
+
+// duplicateLine inserts a copy of the focused line below it and focuses the copy
+func (m *Model) duplicateLine() (tea.Model, tea.Cmd) {
+	return m.insertLineBelow(m.Inputs[m.Focused].Value())
+}
+
+// insertLineBelow inserts a line holding value below the focused line and
+// focuses it
+func (m *Model) insertLineBelow(value string) (tea.Model, tea.Cmd) {
+	m.createNewLine()
+	m.Inputs[m.Focused].SetValue(value)
+	m.Inputs[m.Focused].CursorEnd()
+
+	// The line and the lines below may reference the lines above them by position
+	cmd := m.recalculateFrom(m.Focused)
+	m.updateViewports()
+	m.scrollToFocused()
+	return *m, tea.Batch(textinput.Blink, cmd)
+}
+
+// moveLine swaps the focused line with the line delta away, taking its note and
+// hidden state along, and keeps focus on it at its new position
+func (m *Model) moveLine(delta int) (tea.Model, tea.Cmd) {
+	from, to := m.Focused, m.Focused+delta
+	if to < 0 || to >= len(m.Inputs) {
+		return *m, textinput.Blink
+	}
+	m.saveState()
+
+	// Lines past the end of HiddenResults and Notes are visible and have no note
+	for len(m.HiddenResults) <= max(from, to) {
+		m.HiddenResults = append(m.HiddenResults, false)
+	}
+	for len(m.Notes) <= max(from, to) {
+		m.Notes = append(m.Notes, "")
+	}
+
+	m.Inputs[from], m.Inputs[to] = m.Inputs[to], m.Inputs[from]
+	m.Results[from], m.Results[to] = m.Results[to], m.Results[from]
+	m.Calculating[from], m.Calculating[to] = m.Calculating[to], m.Calculating[from]
+	m.HiddenResults[from], m.HiddenResults[to] = m.HiddenResults[to], m.HiddenResults[from]
+	m.Notes[from], m.Notes[to] = m.Notes[to], m.Notes[from]
+	m.Focused = to
+
+	// ans references shift with the lines, so recompute from the upper one down
+	cmd := m.recalculateFrom(min(from, to))
+	m.updateViewports()
+	m.scrollToFocused()
+	return *m, tea.Batch(textinput.Blink, cmd)
+}
+
+// toggleComment comments out the focused line, or restores a commented line.
+// A commented line has no result, so bare ans references skip it.
+func (m *Model) toggleComment() (tea.Model, tea.Cmd) {
+	value := m.Inputs[m.Focused].Value()
+	if value == "" {
+		return *m, textinput.Blink
+	}
+	m.saveState()
+
+	m.Inputs[m.Focused].SetValue(toggledComment(value))
+	m.Inputs[m.Focused].CursorEnd()
+
+	// Lines below may reference the line
+	cmd := m.recalculateFrom(m.Focused)
+	m.updateViewports()
+	return *m, tea.Batch(textinput.Blink, cmd)
+}
+
+// isCommented reports whether a line is commented out
+func isCommented(value string) bool {
+	return strings.HasPrefix(strings.TrimLeft(value, " "), "//")
+}
+
+// toggledComment returns a line commented out, or a commented line restored
+func toggledComment(value string) string {
+	if isCommented(value) {
+		return strings.TrimPrefix(strings.TrimPrefix(strings.TrimLeft(value, " "), "//"), " ")
+	}
+	return "// " + value
 }
 
 // focusPreviousLine moves focus to the previous line
 func (m *Model) focusPreviousLine() (tea.Model, tea.Cmd) {
 	if m.Focused > 0 {
-		m.Inputs[m.Focused].Blur()
-		m.Focused--
-		m.Inputs[m.Focused].Focus()
-		m.scrollToFocused()
+		m.focusVertically(m.Focused - 1)
 	}
 	return *m, textinput.Blink
 }
@@ -215,14 +618,28 @@ func (m *Model) focusPreviousLine() (tea.Model, tea.Cmd) {
 // focusNextLine moves focus to the next line
 func (m *Model) focusNextLine() (tea.Model, tea.Cmd) {
 	if m.Focused < len(m.Inputs)-1 {
-		m.Inputs[m.Focused].Blur()
-		m.Focused++
-		m.Inputs[m.Focused].Focus()
-		m.scrollToFocused()
+		m.focusVertically(m.Focused + 1)
 	}
 	return *m, textinput.Blink
 }
 
+// focusVertically moves focus to line with the cursor in the goal column,
+// clamped to the line's length. The goal column follows the cursor when it
+// has moved since the last vertical move, so the column of a long line is
+// kept while passing shorter ones.
+func (m *Model) focusVertically(line int) {
+	input := m.Inputs[m.Focused]
+	if position := input.Position(); position != min(m.GoalColumn, len([]rune(input.Value()))) {
+		m.GoalColumn = position
+	}
+
+	m.Inputs[m.Focused].Blur()
+	m.Focused = line
+	m.Inputs[m.Focused].Focus()
+	m.Inputs[m.Focused].SetCursor(m.GoalColumn)
+	m.scrollToFocused()
+}
+
 // focusFirstLine moves focus to the first line
 func (m *Model) focusFirstLine() (tea.Model, tea.Cmd) {
 	if m.Focused != 0 {
@@ -269,7 +686,7 @@ func (m *Model) handleBracketedPaste(pastedContent string) (tea.Model, tea.Cmd)
 		normalized := strings.ReplaceAll(pastedContent, "\r\n", "\n")
 		normalized = strings.ReplaceAll(normalized, "\r", "\n")
 
-		m.addMultipleInputs(normalized)
+		cmds = append(cmds, m.pasteMultipleInputs(normalized))
 		m.updateViewports()
 		m.scrollToFocused()
 		return *m, tea.Batch(cmds...)
@@ -286,7 +703,33 @@ func (m *Model) openGoToLine() (tea.Model, tea.Cmd) {
 	return *m, textinput.Blink
 }
 
-// goToLine jumps to the specified line number
+// goToLineRegex matches what can be typed in the go-to-line dialog: a line
+// number, a relative jump like +5 or -3, or a label
+var goToLineRegex = regexp.MustCompile(`^([+-]?\d*|[\p{L}_][\p{L}\d_]*)$`)
+
+// goToLineTarget returns the index of the line the go-to-line input names,
+// clamped to the worksheet. Line numbers start at 1, a leading sign jumps
+// relative to the focused line and a name jumps to the line with that label.
+func (m *Model) goToLineTarget(lineInput string) (int, bool) {
+	if line, exists := lineLabels(m.inputValues(), len(m.Inputs))[lineInput]; exists {
+		return line, true
+	}
+
+	lineNumber, err := strconv.Atoi(lineInput)
+	if err != nil {
+		return 0, false
+	}
+	if lineInput[0] == '+' || lineInput[0] == '-' {
+		return min(max(m.Focused+lineNumber, 0), len(m.Inputs)-1), true
+	}
+	if lineNumber < 1 {
+		return 0, false
+	}
+	// Jump to last line if target is beyond range
+	return min(lineNumber-1, len(m.Inputs)-1), true
+}
+
+// goToLine jumps to the line named in the go-to-line dialog
 func (m *Model) goToLine() (tea.Model, tea.Cmd) {
 	lineInput := strings.TrimSpace(m.GoToLineInput.Value())
 	
@@ -298,22 +741,12 @@ func (m *Model) goToLine() (tea.Model, tea.Cmd) {
 		return *m, textinput.Blink
 	}
 	
-	// Parse line number
-	lineNumber, err := strconv.Atoi(lineInput)
-	if err != nil || lineNumber < 1 {
-		// Invalid line number, do nothing
+	targetIndex, ok := m.goToLineTarget(lineInput)
+	if !ok {
+		// Invalid line number or unknown label, do nothing
 		return *m, textinput.Blink
 	}
 	
-	// Convert to 0-based index
-	targetIndex := lineNumber - 1
-	
-	// Ensure target line exists
-	if targetIndex >= len(m.Inputs) {
-		// Jump to last line if target is beyond range
-		targetIndex = len(m.Inputs) - 1
-	}
-	
 	// Change focus
 	m.Inputs[m.Focused].Blur()
 	m.Focused = targetIndex
@@ -337,11 +770,392 @@ func (m *Model) cancelGoToLine() (tea.Model, tea.Cmd) {
 // copyFocusedResult copies the result of the focused line to clipboard
 func (m *Model) copyFocusedResult() (tea.Model, tea.Cmd) {
 	if m.Focused >= 0 && m.Focused < len(m.Results) && m.Results[m.Focused] != "" {
-		err := clipboard.WriteAll(m.Results[m.Focused])
+		result := m.Results[m.Focused]
+		if config.CopyPlainResults {
+			result = plainResult(result)
+		}
+		err := writeClipboard(result)
 		if err != nil {
 			// Silently ignore clipboard errors
 			return *m, nil
 		}
 	}
 	return *m, nil
-}
\ No newline at end of file
+}
+
+// resultsText lists the non-empty results, one per line
+func (m *Model) resultsText() string {
+	var lines []string
+	for _, result := range m.Results {
+		if result != "" {
+			lines = append(lines, stripANSIEscapeCodes(result))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// worksheetPair is a non-empty line with its result as displayed, in plain text
+type worksheetPair struct {
+	expr, result string
+}
+
+// worksheetPairs returns the non-empty lines with their results
+func (m *Model) worksheetPairs() []worksheetPair {
+	var pairs []worksheetPair
+	for i, input := range m.Inputs {
+		if expr := strings.TrimSpace(input.Value()); expr != "" {
+			pairs = append(pairs, worksheetPair{expr, stripANSIEscapeCodes(m.exportResult(i))})
+		}
+	}
+	return pairs
+}
+
+// pairsText lists the non-empty lines as "expression = result", the results
+// aligned in one column, or as a Markdown table
+func (m *Model) pairsText(markdown bool) string {
+	pairs := m.worksheetPairs()
+	exprWidth := 0
+	for _, p := range pairs {
+		exprWidth = max(exprWidth, lipgloss.Width(p.expr))
+	}
+
+	var lines []string
+	if markdown {
+		escape := strings.NewReplacer("|", `\|`)
+		lines = append(lines, "| Expression | Result |", "|------------|--------|")
+		for _, p := range pairs {
+			lines = append(lines, fmt.Sprintf("| %s | %s |", escape.Replace(p.expr), escape.Replace(p.result)))
+		}
+		return strings.Join(lines, "\n")
+	}
+	for _, p := range pairs {
+		line := p.expr
+		if p.result != "" {
+			line += strings.Repeat(" ", exprWidth-lipgloss.Width(p.expr)) + " = " + p.result
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// copyText writes text to the clipboard, skipping an empty worksheet
+func (m *Model) copyText(text string) (tea.Model, tea.Cmd) {
+	if text != "" {
+		// Silently ignore clipboard errors
+		_ = writeClipboard(text)
+	}
+	return *m, nil
+}
+
+// isResultHidden reports whether the result of line i is hidden from the result pane
+func (m *Model) isResultHidden(i int) bool {
+	return i >= 0 && i < len(m.HiddenResults) && m.HiddenResults[i]
+}
+
+// toggleResultVisibility hides or shows the focused line's result cell. The
+// result is still computed and usable through ans references.
+func (m *Model) toggleResultVisibility() (tea.Model, tea.Cmd) {
+	// Lines past the end of HiddenResults are visible
+	for len(m.HiddenResults) <= m.Focused {
+		m.HiddenResults = append(m.HiddenResults, false)
+	}
+	m.HiddenResults[m.Focused] = !m.HiddenResults[m.Focused]
+	m.updateViewports()
+	return *m, textinput.Blink
+}
+
+// toggleResultLabels shows or hides the input labels in the result pane
+func (m *Model) toggleResultLabels() (tea.Model, tea.Cmd) {
+	m.ShowResultLabels = !m.ShowResultLabels
+	m.updateResultViewport()
+	return *m, textinput.Blink
+}
+
+// toggleResultWrapping switches between wrapping and truncating long results
+func (m *Model) toggleResultWrapping() (tea.Model, tea.Cmd) {
+	m.WrapResults = !m.WrapResults
+	m.updateViewports()
+	m.scrollToFocused()
+	return *m, textinput.Blink
+}
+
+// toggleInlineResults switches between showing results below their inputs
+// and in the result pane
+func (m *Model) toggleInlineResults() (tea.Model, tea.Cmd) {
+	m.InlineResults = !m.InlineResults
+	m.handleWindowResize(tea.WindowSizeMsg{Width: m.Width, Height: m.Height})
+	m.updateViewports()
+	m.scrollToFocused()
+	return *m, textinput.Blink
+}
+
+// evaluateSubExpression calculates the innermost bracketed part of the
+// focused line around the cursor, like the (b + c) of "a * (b + c)", and shows
+// its result in the status bar without changing the line
+func (m *Model) evaluateSubExpression() (tea.Model, tea.Cmd) {
+	value := []rune(m.Inputs[m.Focused].Value())
+	first, last, found := enclosingBrackets(value, m.Inputs[m.Focused].Position())
+	if !found {
+		m.SubResult = "no brackets at the cursor"
+		return *m, textinput.Blink
+	}
+
+	expr := string(value[first : last+1])
+	variables := assignedVariables(m.inputValues(), m.Results, m.Focused)
+	result := CalculateVariableExpression(expr, m.Results, m.Focused, variables)
+	m.SubResult = expr + " = " + displayString(result)
+	return *m, textinput.Blink
+}
+
+// toggleFollow switches following the newest line on or off. Following
+// focuses the last line and keeps it at the bottom of the panes.
+func (m *Model) toggleFollow() (tea.Model, tea.Cmd) {
+	m.Follow = !m.Follow
+	if m.Follow {
+		m.focusLastLine()
+		m.followLastLine()
+	}
+	return *m, textinput.Blink
+}
+
+// followLastLine scrolls both panes to the bottom while following the newest
+// line, as long as the last line is focused. Moving to an earlier line stops
+// pinning the panes until the last line is focused again.
+func (m *Model) followLastLine() {
+	if !m.Follow || m.Focused != len(m.Inputs)-1 {
+		return
+	}
+	m.updateViewports()
+	m.setScrollOffset(m.lineRow(len(m.Inputs)))
+}
+
+// toggleTotal shows or hides the sum of all numeric results
+func (m *Model) toggleTotal() (tea.Model, tea.Cmd) {
+	m.ShowTotal = !m.ShowTotal
+	return *m, textinput.Blink
+}
+
+// cyclePaneRatio switches to the next preset split between the panes
+func (m *Model) cyclePaneRatio() (tea.Model, tea.Cmd) {
+	next := paneRatioPresets[0]
+	for _, preset := range paneRatioPresets {
+		if preset > m.paneRatio()+1e-9 {
+			next = preset
+			break
+		}
+	}
+	m.PaneRatio = next
+	m.handleWindowResize(tea.WindowSizeMsg{Width: m.Width, Height: m.Height})
+	m.updateViewports()
+	m.scrollToFocused()
+	return *m, textinput.Blink
+}
+
+// recomputeFocused evaluates the focused line again although its text did not
+// change, ignoring its cached result to pick up new values of time or exchange
+// rate dependent expressions
+func (m *Model) recomputeFocused() (tea.Model, tea.Cmd) {
+	expr := m.Inputs[m.Focused].Value()
+	if expr == "" {
+		return *m, textinput.Blink
+	}
+	m.Calculating[m.Focused] = true
+	return *m, m.calculateLineCmdWithCache(expr, m.Focused, true)
+}
+
+// recalculateFromScratch blanks all results and calculates every line again
+// in order, without cached results, so ans references chain on fresh values.
+// It can be undone to get the previous results back.
+func (m *Model) recalculateFromScratch() (tea.Model, tea.Cmd) {
+	m.saveState()
+	resultCache.Clear()
+
+	var cmds []tea.Cmd
+	for i := range m.Inputs {
+		m.Results[i] = ""
+		m.Calculating[i] = false
+		if expr := m.Inputs[i].Value(); expr != "" {
+			m.Calculating[i] = true
+			cmds = append(cmds, m.calculateLineCmd(expr, i))
+		}
+	}
+	m.LastResultContent = ""
+	m.updateViewports()
+	return *m, tea.Batch(cmds...)
+}
+
+// refreshView forces a full re-render of both panes and re-syncs their scroll,
+// recovering from stale ans highlighting after structural edits
+func (m *Model) refreshView() (tea.Model, tea.Cmd) {
+	// Drop the cached result content so the result pane is rebuilt too
+	m.LastResultContent = ""
+	m.updateViewports()
+	m.scrollToFocused()
+	return *m, textinput.Blink
+}
+
+// PromptKind identifies the action a prompt dialog's value is submitted to
+type PromptKind int
+
+const (
+	PromptNone PromptKind = iota
+	PromptSequence
+	PromptResultDiff
+	PromptGraphRange
+	PromptConversionChain
+	PromptImportCSV
+	PromptNote
+	PromptExport
+	PromptExportWorksheet
+)
+
+// promptLabels holds the label shown in front of each prompt's input
+var promptLabels = map[PromptKind]string{
+	PromptSequence:        "Sequence (start step count): ",
+	PromptResultDiff:      "Diff against undo steps back: ",
+	PromptGraphRange:      "Graph range (from to): ",
+	PromptConversionChain: "Convert through units: ",
+	PromptImportCSV:       "Import CSV (path [column]): ",
+	PromptNote:            "Note: ",
+	PromptExport:          "Export pages (path [lines per page]): ",
+	PromptExportWorksheet: "Export worksheet (.txt, .md or .csv): ",
+}
+
+// maxSequenceLength caps how many lines a generated sequence may insert
+const maxSequenceLength = 100
+
+// openPrompt opens the prompt dialog for the given action
+func (m *Model) openPrompt(kind PromptKind) (tea.Model, tea.Cmd) {
+	m.ActivePrompt = kind
+	m.PromptInput = textinput.New()
+	m.PromptInput.Prompt = ""
+	m.PromptInput.Width = 20
+	m.PromptInput.Focus()
+	return *m, textinput.Blink
+}
+
+// cancelPrompt closes the prompt dialog without running its action
+func (m *Model) cancelPrompt() (tea.Model, tea.Cmd) {
+	m.ActivePrompt = PromptNone
+	m.PromptInput.Blur()
+	return *m, textinput.Blink
+}
+
+// submitPrompt closes the prompt dialog and runs its action with the entered value
+func (m *Model) submitPrompt() (tea.Model, tea.Cmd) {
+	kind := m.ActivePrompt
+	value := strings.TrimSpace(m.PromptInput.Value())
+
+	m.ActivePrompt = PromptNone
+	m.PromptInput.Blur()
+
+	// An empty note removes the note
+	if kind == PromptNote {
+		m.setNote(m.Focused, value)
+		m.updateInputViewport()
+		return *m, textinput.Blink
+	}
+
+	if value == "" {
+		return *m, textinput.Blink
+	}
+
+	switch kind {
+	case PromptSequence:
+		start, step, count, err := parseSequenceSpec(value)
+		if err != nil {
+			// Invalid sequence, do nothing
+			return *m, textinput.Blink
+		}
+		m.insertSequence(start, step, count)
+		m.updateViewports()
+		m.scrollToFocused()
+
+	case PromptResultDiff:
+		steps, err := strconv.Atoi(value)
+		if err != nil {
+			return *m, textinput.Blink
+		}
+		return m.openResultDiff(steps)
+
+	case PromptGraphRange:
+		from, to, err := parseGraphRange(value)
+		if err != nil {
+			return *m, textinput.Blink
+		}
+		m.GraphRange = value
+		return m.openGraph(from, to)
+
+	case PromptConversionChain:
+		m.saveState()
+		chain := buildConversionChain(m.Inputs[m.Focused].Value(), value)
+		m.Inputs[m.Focused].SetValue(chain)
+		m.Inputs[m.Focused].CursorEnd()
+		return *m, tea.Batch(m.triggerCalculationIfNeeded()...)
+
+	case PromptImportCSV:
+		skipped, err := m.importCSV(parseCSVImportSpec(value))
+		if err != nil {
+			return m.openPopup("CSV import", "Could not import: "+err.Error())
+		}
+		m.updateViewports()
+		m.scrollToFocused()
+		if len(skipped) > 0 {
+			return m.openPopup("CSV import", skippedRowsText(skipped))
+		}
+
+	case PromptExport:
+		path, pageHeight := parseExportSpec(value)
+		if err := m.exportPaged(path, pageHeight); err != nil {
+			return m.openPopup("Export", "Could not export: "+err.Error())
+		}
+
+	case PromptExportWorksheet:
+		if err := m.exportWorksheet(expandHome(value)); err != nil {
+			return m.openPopup("Export", "Could not export: "+err.Error())
+		}
+	}
+
+	return *m, textinput.Blink
+}
+
+// parseSequenceSpec parses "start step count" as entered in the sequence prompt
+func parseSequenceSpec(spec string) (float64, float64, int, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 3 {
+		return 0, 0, 0, fmt.Errorf("expected start, step and count")
+	}
+
+	start, err := strconv.ParseFloat(strings.ReplaceAll(fields[0], ",", "."), 64)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	step, err := strconv.ParseFloat(strings.ReplaceAll(fields[1], ",", "."), 64)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	count, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if count < 1 {
+		return 0, 0, 0, fmt.Errorf("count must be positive")
+	}
+
+	return start, step, min(count, maxSequenceLength), nil
+}
+
+// insertSequence appends count lines holding the arithmetic sequence start,
+// start+step, ... written with the configured decimal separator
+func (m *Model) insertSequence(start, step float64, count int) {
+	count = min(count, maxSequenceLength)
+	lines := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		// Round away float noise like 0.30000000000000004
+		value := math.Round((start+float64(i)*step)*1e9) / 1e9
+		lines = append(lines, localizeDecimal(strconv.FormatFloat(value, 'f', -1, 64)))
+	}
+
+	// addMultipleInputs saves a single undo state for all lines
+	m.addMultipleInputs(strings.Join(lines, "\n"))
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	"github.com/charmbracelet/bubbletea"
+)
+
+// Keymap holds the keys of the remappable actions, written like bubbletea
+// names keys, e.g. "ctrl+h" or "f1". An empty key leaves the action unbound.
+type Keymap struct {
+	Help               string `json:"help"`               // Show the help
+	Sqrt               string `json:"sqrt"`               // Insert √
+	Ans                string `json:"ans"`                // Insert the ans keyword
+	Template           string `json:"template"`           // Paste the input template
+	DeleteLine         string `json:"deleteLine"`         // Delete the focused line
+	ClearAll           string `json:"clearAll"`           // Clear the worksheet
+	GoToLine           string `json:"goToLine"`           // Open the go-to-line dialog
+	Undo               string `json:"undo"`               // Undo the last change
+	Redo               string `json:"redo"`               // Redo the last undone change
+	CopyResult         string `json:"copyResult"`         // Copy the result of the focused line
+	Search             string `json:"search"`             // Open the search dialog
+	Symbols            string `json:"symbols"`            // Open the symbol palette
+	ToggleComment      string `json:"toggleComment"`      // Comment out the focused line, terminals send Ctrl+/ as Ctrl+_
+	DuplicateLine      string `json:"duplicateLine"`      // Duplicate the focused line below it
+	CycleBase          string `json:"cycleBase"`          // Cycle the output base of all results
+	Refresh            string `json:"refresh"`            // Re-render both panes
+	Recompute          string `json:"recompute"`          // Calculate the focused line again
+	Sequence           string `json:"sequence"`           // Insert a sequence of lines
+	HideResult         string `json:"hideResult"`         // Hide the result of the focused line
+	Graph              string `json:"graph"`              // Graph an expression
+	Dependencies       string `json:"dependencies"`       // Show the line dependencies
+	RecalculateAll     string `json:"recalculateAll"`     // Recalculate all lines from scratch
+	ConversionChain    string `json:"conversionChain"`    // Open the unit conversion chain
+	UnitConversions    string `json:"unitConversions"`    // Show the result in compatible units
+	DefaultCurrency    string `json:"defaultCurrency"`    // Convert the focused line to the default currency
+	SubExpression      string `json:"subExpression"`      // Show the result of the bracketed sub-expression
+	ResultLabels       string `json:"resultLabels"`       // Label the results with their inputs
+	WrapResults        string `json:"wrapResults"`        // Wrap long results
+	InlineResults      string `json:"inlineResults"`      // Show the results below their inputs
+	Follow             string `json:"follow"`             // Keep the newest line at the bottom
+	Total              string `json:"total"`              // Show the total of the results
+	PaneRatio          string `json:"paneRatio"`          // Cycle the pane split
+	AngleUnit          string `json:"angleUnit"`          // Cycle the angle unit
+	ExchangeRates      string `json:"exchangeRates"`      // Update the exchange rates
+	Fractions          string `json:"fractions"`          // Toggle fraction results
+	Engineering        string `json:"engineering"`        // Toggle engineering notation
+	PlainResults       string `json:"plainResults"`       // Toggle ASCII exponents
+	CopyResults        string `json:"copyResults"`        // Copy all results
+	CopyWorksheet      string `json:"copyWorksheet"`      // Copy the lines with their results
+	CopyTable          string `json:"copyTable"`          // Copy the lines with their results as a Markdown table
+	ImportCSV          string `json:"importCSV"`          // Import a CSV column
+	Export             string `json:"export"`             // Export the worksheet as pages
+	ExportWorksheet    string `json:"exportWorksheet"`    // Export the lines and results
+	Note               string `json:"note"`               // Edit the note of the focused line
+	CloneTab           string `json:"cloneTab"`           // Clone the worksheet into a new tab
+	LineAbove          string `json:"lineAbove"`          // Insert a line above the focused line
+	MoveLineUp         string `json:"moveLineUp"`         // Move the focused line up
+	MoveLineDown       string `json:"moveLineDown"`       // Move the focused line down
+	PreviousTab        string `json:"previousTab"`        // Switch to the previous tab
+	NextTab            string `json:"nextTab"`            // Switch to the next tab
+	Conditional        string `json:"conditional"`        // Open the conditional templates
+	ExactMode          string `json:"exactMode"`          // Toggle exact results
+	Explain            string `json:"explain"`            // Explain the focused line
+	ResultHistory      string `json:"resultHistory"`      // Recall recent results
+	ClipboardTransform string `json:"clipboardTransform"` // Insert a transform of the clipboard number
+	ResultDiff         string `json:"resultDiff"`         // Diff the results against an earlier state
+}
+
+// DefaultKeymap returns the bindings used unless the config remaps them
+func DefaultKeymap() Keymap {
+	return Keymap{
+		Help:               "ctrl+h",
+		Sqrt:               "ctrl+r",
+		Ans:                "ctrl+a",
+		Template:           "ctrl+t",
+		DeleteLine:         "ctrl+d",
+		ClearAll:           "ctrl+n",
+		GoToLine:           "ctrl+l",
+		Undo:               "ctrl+z",
+		Redo:               "ctrl+y",
+		CopyResult:         "ctrl+s",
+		Search:             "ctrl+f",
+		Symbols:            "ctrl+g",
+		ToggleComment:      "ctrl+_",
+		DuplicateLine:      "ctrl+u",
+		CycleBase:          "ctrl+b",
+		Refresh:            "f5",
+		Recompute:          "alt+e",
+		Sequence:           "alt+n",
+		HideResult:         "alt+h",
+		Graph:              "alt+g",
+		Dependencies:       "alt+r",
+		RecalculateAll:     "alt+R",
+		ConversionChain:    "alt+t",
+		UnitConversions:    "alt+j",
+		DefaultCurrency:    "alt+$",
+		SubExpression:      "alt+(",
+		ResultLabels:       "alt+l",
+		WrapResults:        "alt+z",
+		InlineResults:      "alt+I",
+		Follow:             "alt+F",
+		Total:              "alt+T",
+		PaneRatio:          "alt+s",
+		AngleUnit:          "alt+u",
+		ExchangeRates:      "alt+U",
+		Fractions:          "alt+/",
+		Engineering:        "alt+E",
+		PlainResults:       "alt+S",
+		CopyResults:        "alt+c",
+		CopyWorksheet:      "alt+C",
+		CopyTable:          "alt+m",
+		ImportCSV:          "alt+o",
+		Export:             "alt+p",
+		ExportWorksheet:    "alt+P",
+		Note:               "alt+a",
+		CloneTab:           "alt+w",
+		LineAbove:          "alt+enter",
+		MoveLineUp:         "alt+up",
+		MoveLineDown:       "alt+down",
+		PreviousTab:        "alt+left",
+		NextTab:            "alt+right",
+		Conditional:        "alt+i",
+		ExactMode:          "alt+x",
+		Explain:            "alt+X",
+		ResultHistory:      "alt+y",
+		ClipboardTransform: "alt+v",
+		ResultDiff:         "alt+d",
+	}
+}
+
+// reservedKeys can't be remapped as they quit or close dialogs
+var reservedKeys = []string{"ctrl+c", "esc"}
+
+// actions returns the keys of the actions, named as in the config
+func (k Keymap) actions() map[string]string {
+	return map[string]string{
+		"help":               k.Help,
+		"sqrt":               k.Sqrt,
+		"ans":                k.Ans,
+		"template":           k.Template,
+		"deleteLine":         k.DeleteLine,
+		"clearAll":           k.ClearAll,
+		"goToLine":           k.GoToLine,
+		"undo":               k.Undo,
+		"redo":               k.Redo,
+		"copyResult":         k.CopyResult,
+		"search":             k.Search,
+		"symbols":            k.Symbols,
+		"toggleComment":      k.ToggleComment,
+		"duplicateLine":      k.DuplicateLine,
+		"cycleBase":          k.CycleBase,
+		"refresh":            k.Refresh,
+		"recompute":          k.Recompute,
+		"sequence":           k.Sequence,
+		"hideResult":         k.HideResult,
+		"graph":              k.Graph,
+		"dependencies":       k.Dependencies,
+		"recalculateAll":     k.RecalculateAll,
+		"conversionChain":    k.ConversionChain,
+		"unitConversions":    k.UnitConversions,
+		"defaultCurrency":    k.DefaultCurrency,
+		"subExpression":      k.SubExpression,
+		"resultLabels":       k.ResultLabels,
+		"wrapResults":        k.WrapResults,
+		"inlineResults":      k.InlineResults,
+		"follow":             k.Follow,
+		"total":              k.Total,
+		"paneRatio":          k.PaneRatio,
+		"angleUnit":          k.AngleUnit,
+		"exchangeRates":      k.ExchangeRates,
+		"fractions":          k.Fractions,
+		"engineering":        k.Engineering,
+		"plainResults":       k.PlainResults,
+		"copyResults":        k.CopyResults,
+		"copyWorksheet":      k.CopyWorksheet,
+		"copyTable":          k.CopyTable,
+		"importCSV":          k.ImportCSV,
+		"export":             k.Export,
+		"exportWorksheet":    k.ExportWorksheet,
+		"note":               k.Note,
+		"cloneTab":           k.CloneTab,
+		"lineAbove":          k.LineAbove,
+		"moveLineUp":         k.MoveLineUp,
+		"moveLineDown":       k.MoveLineDown,
+		"previousTab":        k.PreviousTab,
+		"nextTab":            k.NextTab,
+		"conditional":        k.Conditional,
+		"exactMode":          k.ExactMode,
+		"explain":            k.Explain,
+		"resultHistory":      k.ResultHistory,
+		"clipboardTransform": k.ClipboardTransform,
+		"resultDiff":         k.ResultDiff,
+	}
+}
+
+// bindings returns the actions by their key, named as in the config
+func (k Keymap) bindings() map[string]string {
+	bindings := make(map[string]string)
+	for action, key := range k.actions() {
+		if key != "" {
+			bindings[key] = action
+		}
+	}
+	return bindings
+}
+
+// validate checks that no key is bound twice or reserved
+func (k Keymap) validate() error {
+	actions := k.actions()
+	seen := make(map[string]bool)
+	for _, action := range slices.Sorted(maps.Keys(actions)) {
+		key := actions[action]
+		if key == "" {
+			continue
+		}
+		if slices.Contains(reservedKeys, key) {
+			return fmt.Errorf("key %q is reserved and can't be remapped", key)
+		}
+		if seen[key] {
+			return fmt.Errorf("key %q is bound to more than one action", key)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// runKeyAction runs the action bound to a key in the keymap
+func (m *Model) runKeyAction(action string) (tea.Model, tea.Cmd) {
+	switch action {
+	case "help":
+		return m.openHelp()
+	case "sqrt":
+		return m.insertSymbol("√")
+	case "ans":
+		return m.insertSymbol(ansKeyword())
+	case "template":
+		return m.pasteInputTemplate()
+	case "deleteLine":
+		return m.deleteLine()
+	case "clearAll":
+		return m.clearAll()
+	case "goToLine":
+		return m.openGoToLine()
+	case "undo":
+		m.undo()
+	case "redo":
+		m.redo()
+	case "copyResult":
+		return m.copyFocusedResult()
+	case "search":
+		return m.openSearch()
+	case "symbols":
+		return m.openSymbolPalette()
+	case "toggleComment":
+		return m.toggleComment()
+	case "duplicateLine":
+		return m.duplicateLine()
+	case "cycleBase":
+		return m.cycleOutputBase()
+	case "refresh":
+		return m.refreshView()
+	case "recompute":
+		return m.recomputeFocused()
+	case "sequence":
+		return m.openPrompt(PromptSequence)
+	case "hideResult":
+		return m.toggleResultVisibility()
+	case "graph":
+		return m.openGraphPrompt()
+	case "dependencies":
+		return m.openDependencyGraph()
+	case "recalculateAll":
+		return m.recalculateFromScratch()
+	case "conversionChain":
+		return m.openConversionChain()
+	case "unitConversions":
+		return m.openUnitConversions()
+	case "defaultCurrency":
+		return m.convertToDefaultCurrency()
+	case "subExpression":
+		return m.evaluateSubExpression()
+	case "resultLabels":
+		return m.toggleResultLabels()
+	case "wrapResults":
+		return m.toggleResultWrapping()
+	case "inlineResults":
+		return m.toggleInlineResults()
+	case "follow":
+		return m.toggleFollow()
+	case "total":
+		return m.toggleTotal()
+	case "paneRatio":
+		return m.cyclePaneRatio()
+	case "angleUnit":
+		return m.cycleAngleUnit()
+	case "exchangeRates":
+		return m.refreshExchangeRates()
+	case "fractions":
+		return m.toggleFractionMode()
+	case "engineering":
+		return m.toggleEngineeringMode()
+	case "plainResults":
+		return m.togglePlainResults()
+	case "copyResults":
+		return m.copyText(m.resultsText())
+	case "copyWorksheet":
+		return m.copyText(m.pairsText(false))
+	case "copyTable":
+		return m.copyText(m.pairsText(true))
+	case "importCSV":
+		return m.openPrompt(PromptImportCSV)
+	case "export":
+		return m.openPrompt(PromptExport)
+	case "exportWorksheet":
+		return m.openPrompt(PromptExportWorksheet)
+	case "note":
+		return m.openNoteEditor()
+	case "cloneTab":
+		return m.cloneTab()
+	case "lineAbove":
+		return m.createLineAbove()
+	case "moveLineUp":
+		return m.moveLine(-1)
+	case "moveLineDown":
+		return m.moveLine(1)
+	case "previousTab":
+		return m.switchTab(-1)
+	case "nextTab":
+		return m.switchTab(1)
+	case "conditional":
+		return m.openConditionalMenu()
+	case "exactMode":
+		return m.toggleExactMode()
+	case "explain":
+		return m.openExplanation()
+	case "resultHistory":
+		return m.openResultHistory()
+	case "clipboardTransform":
+		return m.openClipboardTransformMenu()
+	case "resultDiff":
+		m.openPrompt(PromptResultDiff)
+		m.PromptInput.SetValue("1")
+		return *m, textinput.Blink
+	}
+	return *m, nil
+}
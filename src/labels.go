@@ -0,0 +1,67 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// labelRegex matches a labeled line like "subtotal: 100 + 20", capturing the
+// label and the expression. "x := 5" is an assignment rather than a label.
+var labelRegex = regexp.MustCompile(`^\s*([\p{L}_][\p{L}\d_]*)\s*:\s*([^=\s].*)$`)
+
+// parseLabel splits a labeled line into the label and its expression. Names
+// of ans references can't be used as labels.
+func parseLabel(input string) (string, string, bool) {
+	parts := labelRegex.FindStringSubmatch(stripComment(input))
+	if parts == nil || ansKeywordRegex().MatchString(parts[1]) || ansReferenceRegex().MatchString(parts[1]) {
+		return "", "", false
+	}
+	return parts[1], strings.TrimSpace(parts[2]), true
+}
+
+// stripLabel removes the label of a line, keeping its comment so directives still apply
+func stripLabel(input string) string {
+	if _, value, ok := parseLabel(input); ok {
+		return value + input[len(stripComment(input)):]
+	}
+	return input
+}
+
+// splitLabel splits a line into its label prefix like "subtotal: " and the rest
+func splitLabel(input string) (string, string) {
+	if _, _, ok := parseLabel(input); !ok {
+		return "", input
+	}
+	loc := labelRegex.FindStringSubmatchIndex(stripComment(input))
+	return input[:loc[4]], input[loc[4]:]
+}
+
+// lineLabels returns the lines before index by their label. Labels follow
+// their line when lines are inserted or deleted, and a later line with the
+// same label replaces earlier ones.
+func lineLabels(inputs []string, index int) map[string]int {
+	labels := make(map[string]int)
+	for i := 0; i < index && i < len(inputs); i++ {
+		if label, _, ok := parseLabel(inputs[i]); ok {
+			labels[label] = i
+		}
+	}
+	return labels
+}
+
+// replaceIdentifiers replaces the names in text for which replace returns a value
+func replaceIdentifiers(text string, replace func(name string) (string, bool)) string {
+	var builder strings.Builder
+	last := 0
+	for _, loc := range identifierRegex.FindAllStringIndex(text, -1) {
+		value, ok := replace(text[loc[0]:loc[1]])
+		if !ok {
+			continue
+		}
+		builder.WriteString(text[last:loc[0]])
+		builder.WriteString(value)
+		last = loc[1]
+	}
+	builder.WriteString(text[last:])
+	return builder.String()
+}
@@ -7,7 +7,10 @@ import (
 	"io"
 	"log"
 	"os"
+	"slices"
 	"strings"
+	"time"
+	"unicode"
 
 	"github.com/charmbracelet/bubbles/textinput"
 	"github.com/charmbracelet/bubbles/viewport"
@@ -27,28 +30,79 @@ type Model struct {
 	ResultViewport      viewport.Model
 	Theme               Theme
 	Calculating         []bool
+	HiddenResults       []bool   // Lines whose result cell is hidden, may be shorter than Inputs
+	Notes               []string // Notes attached to lines, may be shorter than Inputs
 	ShowCompletions     bool
 	Completions         []string
 	SelectedCompletion  int
 	LastCompletionQuery string
+	ActiveMenu          MenuKind
 	ShowHelp            bool
 	HelpViewport        viewport.Model
+	HelpSearching       bool   // Typing a search in the help popup
+	HelpQuery           string // Text searched for in the help popup
+	HelpMatches         []int  // Help lines containing the query
+	HelpMatch           int    // Index into HelpMatches of the current match
 	UndoSystem          *UndoSystem
 	ShowGoToLine        bool
 	GoToLineInput       textinput.Model
+	ActivePrompt        PromptKind
+	PromptInput         textinput.Model
+	ShowPopup           bool
+	PopupTitle          string
+	PopupViewport       viewport.Model
+	PopupGraph          bool             // The info popup shows a graph whose range can be changed
+	GraphRange          string           // Last range entered for graphs
+	Session             SessionSettings  // Calculation defaults set by the worksheet header
+	ShowResultLabels    bool             // Prefix results with their shortened input
+	WrapResults         bool             // Wrap long results over several rows instead of truncating them
+	InlineResults       bool             // Show results below their inputs in a single pane
+	Follow              bool             // Keep the newest line focused and in view at the bottom
+	ShowTotal           bool             // Show the sum of all numeric results below the result pane
+	PaneRatio           float64          // Share of the width taken by the input pane
+	ExactMode           bool             // Keep results exact like 1/3 instead of approximating them
+	OutputBase          int              // Index into outputBases of the base results are shown in
+	FractionMode        bool             // Show rational results as fractions like 1/3 instead of decimals
+	PlainResults        bool             // Keep results ASCII like 1.23E-4 instead of superscripts
+	EngineeringMode     bool             // Show numeric results with SI prefixes like 4.7k
+	Separators          NumberSeparators // Decimal and thousands separators read from the config
+	LastEscape          time.Time        // When Esc was last pressed, for double-Esc to quit
+	RatesChecked        bool             // The exchange rates update has finished
+	RatesTime           time.Time        // When the loaded exchange rates were published, zero if none
+	RatesRefresh        string           // State of the last forced rates update, see RatesRefreshRunning
+	SubResult           string           // Result of the sub-expression at the cursor, shown until the next key
+	Tabs                []Worksheet      // All tabs, the active one is only stored when switching away
+	ActiveTab           int
+	TabID               int // ID of the active tab's worksheet
+	NextTabID           int
 	LastResultContent   string
+	Calculations        *CalculationManager // Cancels calculations superseded by newer ones of the same line
+	DefinedNames        map[int]string      // Name each line defined when last calculated, to notice renames
+	Mode                EditMode            // Vim mode of the worksheet, insert unless vimMode is configured
+	PendingKey          string              // First key of a normal mode command like dd
+	YankedLine          string              // Line copied with yy or dd, pasted with p
+	ShowSearch          bool                // The search dialog is open, highlighting matches
+	SearchInput         textinput.Model     // Query of the search dialog, kept for the next search
+	GoalColumn          int                 // Cursor column kept when moving up and down, see focusVertically
+	ResultHistory       []string            // Recent results, newest first, kept after their lines change
+	ResultHistoryLine   int                 // Line the newest result in ResultHistory came from
+	SpinnerFrame        int                 // Frame of the spinners shown for slow calculations
+	SpinnerTicking      bool                // The spinner tick runs while lines calculate
+	Selecting           bool                // Shift+↑/↓ selected the lines from SelectionAnchor to the focused line
+	SelectionAnchor     int                 // Line focused when the selection started
 }
 
 func (m Model) GetTextInputWidth() int {
-	width := int(float64(m.Width)*0.7) - 6 - 3 // -3 for early scrolling
+	width := m.inputPaneWidth() - m.gutterWidth() - 2 - 3 // -3 for early scrolling
 	if width < 1 {
 		return 1
 	}
 	return width
 }
 
-func GetTextInputWidth(width int) int {
-	calcWidth := int(float64(width)*0.7) - 6 - 3 // -3 for early scrolling
+func GetTextInputWidth(width int, ratio float64) int {
+	inputPaneWidth, _ := splitWidth(width, ratio)
+	calcWidth := inputPaneWidth - 6 - 3 // -3 for early scrolling
 	if calcWidth < 1 {
 		return 1
 	}
@@ -61,30 +115,49 @@ func InitialModel() Model {
 	ti := textinput.New()
 	ti.Placeholder = defaultPlaceholder
 	ti.Focus()
-	ti.Width = GetTextInputWidth(terminalWidth)
+	ti.Width = GetTextInputWidth(terminalWidth, config.PaneRatio)
 	ti.Prompt = ""
 	ti.CharLimit = 0
 
-	inputVp := viewport.New(int(float64(terminalWidth)*0.7)-2, terminalHeight-2)
-	resultVp := viewport.New(int(float64(terminalWidth)*0.3)-2, terminalHeight-2)
+	inputPaneWidth, resultPaneWidth := splitWidth(terminalWidth, config.PaneRatio)
+	inputVp := viewport.New(inputPaneWidth-2, terminalHeight-3)
+	resultVp := viewport.New(resultPaneWidth-2, terminalHeight-3)
 	helpVp := viewport.New(0, 0)
 
 	// Initialize go-to-line input
 	gotoInput := textinput.New()
 	gotoInput.Placeholder = ""
 	gotoInput.Width = 20
-	gotoInput.CharLimit = 5 // Max 5 digits should be enough
+	gotoInput.CharLimit = 32 // Long enough for labels
 	gotoInput.Validate = func(s string) error {
-		// Only allow digits
-		for _, r := range s {
-			if r < '0' || r > '9' {
-				return fmt.Errorf("only numbers allowed")
-			}
+		// Only allow line numbers, relative jumps and labels
+		if !goToLineRegex.MatchString(s) {
+			return fmt.Errorf("only line numbers, +/- jumps and labels allowed")
 		}
 		return nil
 	}
 
+	// The configured separators apply to all calculations
+	separators := config.Separators()
+	SetSeparators(separators)
+
+	// Trigonometric functions start in the configured angle unit
+	session := DefaultSessionSettings()
+	SetAngleUnit(session.AngleUnit)
+	SetPrettyPrint(!config.PlainResults)
+
+	theme, err := LoadTheme(themePath())
+	if err != nil {
+		log.Printf("Failed to load theme, using defaults for invalid colors: %v", err)
+	}
+
 	return Model{
+		Separators:     separators,
+		WrapResults:    config.WrapResults,
+		InlineResults:  config.InlineResults,
+		ShowTotal:      config.ShowTotal,
+		PaneRatio:      config.PaneRatio,
+		PlainResults:   config.PlainResults,
 		Inputs:         []textinput.Model{ti},
 		Results:        []string{""},
 		Calculating:    []bool{false},
@@ -94,15 +167,17 @@ func InitialModel() Model {
 		InputViewport:  inputVp,
 		ResultViewport: resultVp,
 		HelpViewport:   helpVp,
-		Theme:          newTheme(),
-		UndoSystem:     NewUndoSystem(),
+		Theme:          theme,
+		UndoSystem:     NewUndoSystemWithSize(config.UndoLimit),
+		Calculations:   NewCalculationManager(1),
+		Session:        session,
 		ShowGoToLine:   false,
 		GoToLineInput:  gotoInput,
 	}
 }
 
 func (m Model) Init() tea.Cmd {
-	return tea.Batch(textinput.Blink, func() tea.Msg { return tickMsg{} })
+	return tea.Batch(textinput.Blink, func() tea.Msg { return tickMsg{} }, updateExchangeRatesCmd())
 }
 
 func readStdin() string {
@@ -118,26 +193,36 @@ func readStdin() string {
 	return ""
 }
 
+// worksheetLines splits content into its lines, trimmed and without empty lines
+func worksheetLines(content string) []string {
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(content), "\n") {
+		// Trim whitespace but keep the line content
+		line = strings.TrimSpace(line)
+
+		// Skip empty lines
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
 // Add multiple inputs to existing ones
 func (m *Model) addMultipleInputs(content string) {
 	if content == "" {
 		return
 	}
+	m.addInputLines(worksheetLines(content))
+}
 
-	// Save state before making changes (only if we actually have content to add)
+// addInputLines appends a line for each of lines, including empty ones, and
+// focuses the last
+func (m *Model) addInputLines(lines []string) {
+	// Save state before making changes
 	m.saveState()
 
-	lines := strings.Split(strings.TrimSpace(content), "\n")
-
 	for _, line := range lines {
-		// Trim whitespace but keep the line content
-		line = strings.TrimSpace(line)
-
-		// Skip empty lines
-		if line == "" {
-			continue
-		}
-
 		newInput := textinput.New()
 		newInput.Placeholder = ""
 		newInput.Width = m.GetTextInputWidth()
@@ -150,7 +235,7 @@ func (m *Model) addMultipleInputs(content string) {
 		m.Calculating = append(m.Calculating, false)
 
 		index := len(m.Results) - 1
-		m.Results[index] = CalculateExpression(line, m.Results, index)
+		m.Results[index] = m.calculateLine(index)
 	}
 
 	// If no inputs were added and we have no existing inputs, create default
@@ -178,12 +263,114 @@ func (m *Model) addMultipleInputs(content string) {
 			}
 		}
 	}
+	m.updateViewports()
+	m.followLastLine()
+}
+
+// appendEmptyLine focuses a new empty line after the last one, so typing after
+// an import starts a fresh line instead of editing the last imported one
+func (m *Model) appendEmptyLine() {
+	m.Inputs[m.Focused].Blur()
+	m.Focused = len(m.Inputs) - 1
+	m.Inputs[m.Focused].Focus()
+	if m.Inputs[m.Focused].Value() != "" {
+		m.createNewLine()
+	}
+	m.updateViewports()
+	m.scrollToFocused()
+}
+
+// pasteMultipleInputs inserts pasted lines at the cursor, or adds them after
+// the last line if configured to, keeping focus on the line that was focused
+// before the paste if configured to
+func (m *Model) pasteMultipleInputs(content string) tea.Cmd {
+	var cmd tea.Cmd
+	previousFocus := m.Focused
+	if config.PasteAppends {
+		m.addMultipleInputs(content)
+	} else {
+		cmd = m.insertMultipleInputs(content)
+	}
+
+	if config.PasteKeepsFocus && previousFocus != m.Focused && previousFocus < len(m.Inputs) {
+		m.Inputs[m.Focused].Blur()
+		m.Focused = previousFocus
+		m.Inputs[m.Focused].Focus()
+	}
+	return cmd
+}
+
+// insertMultipleInputs inserts lines at the cursor like a text editor: the
+// text before the cursor stays on the focused line, the lines follow it and
+// the text after the cursor goes on a line of its own below them. The last
+// inserted line is focused. The returned command calculates the lines from
+// the focused one on.
+func (m *Model) insertMultipleInputs(content string) tea.Cmd {
+	lines := worksheetLines(content)
+	if len(lines) == 0 {
+		return nil
+	}
+	m.saveState()
+
+	value := []rune(m.Inputs[m.Focused].Value())
+	cursorPos := min(m.Inputs[m.Focused].Position(), len(value))
+	before := strings.TrimRightFunc(string(value[:cursorPos]), unicode.IsSpace)
+	after := strings.TrimLeftFunc(string(value[cursorPos:]), unicode.IsSpace)
+
+	var segments []string
+	if before != "" {
+		segments = append(segments, before)
+	}
+	last := m.Focused + len(segments) + len(lines) - 1
+	segments = append(segments, lines...)
+	if after != "" {
+		segments = append(segments, after)
+	}
+
+	// The focused line takes the first segment and the others go below it
+	first := m.Focused
+	m.Inputs[first].SetValue(segments[0])
+	for i, segment := range segments[1:] {
+		index := first + 1 + i
+		newInput := textinput.New()
+		newInput.Width = m.GetTextInputWidth()
+		newInput.Prompt = ""
+		newInput.SetValue(segment)
+
+		m.Inputs = slices.Insert(m.Inputs, index, newInput)
+		m.Results = slices.Insert(m.Results, index, "")
+		m.Calculating = slices.Insert(m.Calculating, index, false)
+		if index < len(m.HiddenResults) {
+			m.HiddenResults = slices.Insert(m.HiddenResults, index, false)
+		}
+		if index < len(m.Notes) {
+			m.Notes = slices.Insert(m.Notes, index, "")
+		}
+	}
+
+	// The lines below moved down, so their ans references now point elsewhere
+	cmd := m.recalculateFrom(first)
+
+	m.Focused = last
+	for i := range m.Inputs {
+		if i == m.Focused {
+			m.Inputs[i].Focus()
+			m.Inputs[i].CursorEnd()
+		} else {
+			m.Inputs[i].Blur()
+		}
+	}
+	return cmd
 }
 
 var version = "dev" // Will be set at build time
 
 func main() {
 	showVersion := flag.Bool("version", false, "Show version information")
+	noSession := flag.Bool("no-session", false, "Don't restore the last session and don't save this one")
+	var expressions expressionFlags
+	flag.Var(&expressions, "e", "Print the result of an expression and exit, repeat to chain them with ans")
+	jsonOutput := flag.Bool("json", false, "Print the results of -e or piped input as JSON and exit")
 	flag.Parse()
 
 	if *showVersion {
@@ -191,22 +378,75 @@ func main() {
 		return
 	}
 
-	go func() {
-		if UpdateExchangeRates() {
-			log.Println("Exchange rates updated successfully")
+	cfg, err := LoadConfig(configPath())
+	if err != nil {
+		log.Printf("Failed to load config, using defaults: %v", err)
+	}
+	config = cfg
+
+	// Expressions given as -e flags or after "--" are printed without the UI,
+	// as are piped lines for JSON output
+	expressions = append(expressions, flag.Args()...)
+	if *jsonOutput && len(expressions) == 0 {
+		content, _ := splitWorksheetNotes(readStdin(), false)
+		expressions = worksheetLines(content)
+	}
+	if len(expressions) > 0 || *jsonOutput {
+		SetSeparators(config.Separators())
+		SetAngleUnit(DefaultSessionSettings().AngleUnit)
+		SetPrettyPrint(!config.PlainResults)
+		if *jsonOutput {
+			os.Exit(evaluateExpressionsJSON(expressions, os.Stdout, os.Stderr))
 		}
-	}()
+		os.Exit(evaluateExpressions(expressions, os.Stdout, os.Stderr))
+	}
 
 	// Check for piped input
 	initialInput := readStdin()
+	piped := initialInput != ""
+
+	// Piped input takes precedence over the saved session, and isn't saved
+	keepSession := !*noSession && initialInput == ""
 
 	model := InitialModel()
+	restored := false
+	if keepSession {
+		saved, err := loadSavedSession(savedSessionPath())
+		if err != nil {
+			log.Printf("Failed to load the last session: %v", err)
+		}
+		initialInput = saved
+		restored = saved != ""
+	}
+	if initialInput == "" {
+		// Without input, start from the configured template if any
+		template, err := startupTemplate()
+		if err != nil {
+			log.Printf("Failed to load startup template: %v", err)
+		}
+		initialInput = template
+	}
 	if initialInput != "" {
-		model.addMultipleInputs(initialInput)
+		model.restoreWorksheet(initialInput)
+	}
+	if restored {
+		if err := model.restoreUndoHistory(savedSessionPath(), initialInput); err != nil {
+			log.Printf("Failed to load the undo history: %v", err)
+		}
+	}
+	if piped && config.StdinTrailingLine {
+		model.appendEmptyLine()
 	}
 
 	p := tea.NewProgram(model, tea.WithAltScreen(), tea.WithMouseCellMotion())
-	if err := p.Start(); err != nil {
+	finalModel, err := p.Run()
+	if err != nil {
 		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if final, ok := finalModel.(Model); ok && keepSession {
+		if err := final.saveSession(savedSessionPath()); err != nil {
+			log.Printf("Failed to save the session: %v", err)
+		}
 	}
 }
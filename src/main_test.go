@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"os"
+	"slices"
 	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/charmbracelet/bubbles/textinput"
 	"github.com/charmbracelet/bubbles/viewport"
 	"github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
 	"github.com/charmbracelet/x/exp/teatest"
 )
 
@@ -160,6 +166,59 @@ func TestStdinParsing(t *testing.T) {
 	}
 }
 
+func TestCommentIndex(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"10 * 2 // tax", "10 * 2 "},
+		{"// note", ""},
+		{"rate = 10 // from https://x.org/rates", "rate = 10 "},
+		{"http://1.2.3.4", "http://1.2.3.4"},
+		{"5 + https://x.org // 2 items", "5 + https://x.org "},
+		{"10 / 2", "10 / 2"},
+	}
+	for _, tt := range tests {
+		if result := stripComment(tt.input); result != tt.expected {
+			t.Errorf("stripComment(%q) = %q, expected %q", tt.input, result, tt.expected)
+		}
+	}
+}
+
+func TestDateVariables(t *testing.T) {
+	at := time.Date(2024, 5, 1, 14, 30, 0, 0, time.Local)
+	tests := []struct {
+		expr     string
+		expected string
+	}{
+		{"now + 3 days", `"2024-05-01T14:30:00" + 3 days`},
+		{"today - 1 week", `"2024-05-01" - 1 week`},
+		{"snow + nowhere", "snow + nowhere"},
+	}
+	for _, tt := range tests {
+		if result := replaceDateVariables(tt.expr, at); result != tt.expected {
+			t.Errorf("replaceDateVariables(%q) = %q, expected %q", tt.expr, result, tt.expected)
+		}
+	}
+
+	if !CheckForCalculation("now") || !CheckForCalculation("today") {
+		t.Error("Expected now and today to be calculated")
+	}
+	if result := formatDates("2024-05-04T14:30:00.5"); result != "2024-05-04 14:30:00" {
+		t.Errorf("Expected a readable date and time, got %q", result)
+	}
+	completions := GetCompletions("tod", nil)
+	if !slices.Contains(completions, "today") {
+		t.Errorf("Expected today among the completions, got %q", completions)
+	}
+
+	// Dates after today are calculated from the current date
+	expected := time.Now().AddDate(0, 0, 3).Format(time.DateOnly)
+	if result := CalculateExpression("today + 3 days", nil, 0); !strings.Contains(result, expected) {
+		t.Errorf("Expected %s for today + 3 days, got %q", expected, result)
+	}
+}
+
 func TestCheckForCalculation(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -170,6 +229,8 @@ func TestCheckForCalculation(t *testing.T) {
 		{"empty string", "", false},
 		{"whitespace only", "   ", false},
 		{"URL", "http://example.com", false},
+		{"URL with digits", "http://1.2.3.4", false},
+		{"https URL", "https://10.0.0.1:8080", false},
 		{"pure text", "hello world", false},
 		{"tutorial command", "tutorial()", false},
 		
@@ -177,6 +238,9 @@ func TestCheckForCalculation(t *testing.T) {
 		{"simple number", "42", true},
 		{"decimal", "3.14", true},
 		{"expression with digits", "2 + 2", true},
+		{"hexadecimal", "0xFF", true},
+		{"binary", "0b1010", true},
+		{"octal", "0o17", true},
 		
 		// Should return true - contains operators
 		{"addition", "a + b", true},
@@ -197,6 +261,7 @@ func TestCheckForCalculation(t *testing.T) {
 		
 		// Edge cases
 		{"mixed text and math", "result is 2+2", true},
+		{"URL in comment", "rate = 10 // from https://x.org", true},
 		{"function name without parentheses", "sin", false}, // Should be false without "("
 	}
 
@@ -813,6 +878,8 @@ func createTestModel() Model {
 		ResultViewport: viewport.New(30, 20),
 		Theme:          newTheme(),
 		UndoSystem:     NewUndoSystem(),
+		GoToLineInput:  textinput.New(),
+		Session:        DefaultSessionSettings(),
 	}
 }
 
@@ -836,4 +903,3603 @@ func TestBasicUndo(t *testing.T) {
 	if model.Inputs[0].Value() != "initial" {
 		t.Errorf("Expected 'initial' after undo, got '%s'", model.Inputs[0].Value())
 	}
-}
\ No newline at end of file
+}
+// TestAmbiguousUnitAssumptions tests that ambiguous unit tokens follow the configured unit system
+func TestAmbiguousUnitAssumptions(t *testing.T) {
+	defer func(old Config) { config = old }(config)
+
+	tests := []struct {
+		name       string
+		unitSystem string
+		input      string
+		expected   string
+	}{
+		{"t as tonne in metric", UnitSystemMetric, "2 t to kg", "2 tonne to kg"},
+		{"t as short ton in us", UnitSystemUS, "2 t to kg", "2 short_ton to kg"},
+		{"t as long ton in imperial", UnitSystemImperial, "2t to kg", "2long_ton to kg"},
+		{"per-line override", UnitSystemMetric, "2 t to kg //! units=us", "2 short_ton to kg "},
+		{"in after number is inch", UnitSystemMetric, "5 in to cm", "5 inch to cm"},
+		{"in between units converts", UnitSystemMetric, "5 m in ft", "5 m to ft"},
+		{"in after a reference converts", UnitSystemMetric, "ans1 in ft", "ans1 to ft"},
+		{"in after a decimal is inch", UnitSystemMetric, "2.5 in to cm", "2.5 inch to cm"},
+		{"in inside words untouched", UnitSystemMetric, "5 min + 2 t2", "5 min + 2 t2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.UnitSystem = tt.unitSystem
+			result := prepareString(tt.input)
+			if result != tt.expected {
+				t.Errorf("prepareString(%q) = %q, want %q", tt.input, result, tt.expected)
+			}
+		})
+	}
+
+	config.UnitSystem = UnitSystemMetric
+	result := CalculateExpression("1 t to kg", []string{""}, 0)
+	if result != "1000 kg" {
+		t.Errorf("Expected '1000 kg' for metric tonne, got %q", result)
+	}
+}
+
+// TestInsertSequence tests that a generated sequence is inserted as literal lines in one undo step
+func TestInsertSequence(t *testing.T) {
+	model := createTestModel()
+
+	start, step, count, err := parseSequenceSpec("10 2 5")
+	if err != nil {
+		t.Fatalf("parseSequenceSpec failed: %v", err)
+	}
+	model.insertSequence(start, step, count)
+
+	expected := []string{"10", "12", "14", "16", "18"}
+	if len(model.Inputs) != len(expected)+1 {
+		t.Fatalf("Expected %d inputs, got %d", len(expected)+1, len(model.Inputs))
+	}
+	for i, value := range expected {
+		if model.Inputs[i+1].Value() != value {
+			t.Errorf("Line %d: expected input %q, got %q", i+2, value, model.Inputs[i+1].Value())
+		}
+		if model.Results[i+1] != value {
+			t.Errorf("Line %d: expected result %q, got %q", i+2, value, model.Results[i+1])
+		}
+	}
+
+	// The whole sequence is undone at once
+	model.undo()
+	if len(model.Inputs) != 1 {
+		t.Errorf("Expected 1 input after undo, got %d", len(model.Inputs))
+	}
+
+	// Oversized sequences are capped
+	if _, _, count, _ := parseSequenceSpec("1 1 100000"); count != maxSequenceLength {
+		t.Errorf("Expected count capped at %d, got %d", maxSequenceLength, count)
+	}
+
+	// Values are written with the configured decimal separator
+	SetSeparators(NumberSeparators{Decimal: ",", Thousands: "."})
+	defer SetSeparators(DefaultConfig().Separators())
+	model = createTestModel()
+	model.insertSequence(0.5, 0.25, 3)
+	if !slices.Equal(model.inputValues(), []string{"", "0,5", "0,75", "1"}) {
+		t.Errorf("Expected values with a decimal comma, got %q", model.inputValues())
+	}
+}
+
+// TestCompactCurrency tests abbreviated display of large currency values
+func TestCompactCurrency(t *testing.T) {
+	defer func(old Config) { config = old }(config)
+	config.CompactCurrency = true
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"million scale", "1234567.89 $", "$1.2M"},
+		{"thousand scale", "3400 €", "€3.4K"},
+		{"symbol first", "£2500000", "£2.5M"},
+		{"negative value", "−2500000 £", "−£2.5M"},
+		{"ASCII minus", "-2500000 £", "-£2.5M"},
+		{"rounds up to next unit", "999950 $", "$1M"},
+		{"below threshold", "999.99 $", "999.99 $"},
+		{"not a currency", "1234567", "1234567"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := displayString(tt.input)
+			if result != tt.expected {
+				t.Errorf("displayString(%q) = %q, want %q", tt.input, result, tt.expected)
+			}
+		})
+	}
+
+	// Display is compact but chaining uses the full value
+	model := createTestModel()
+	model.Results[0] = "1234567.89 $"
+	model.updateResultViewport()
+	if !strings.Contains(model.ResultViewport.View(), "$1.2M") {
+		t.Errorf("Expected compact result in result pane, got %q", model.ResultViewport.View())
+	}
+	if model.Results[0] != "1234567.89 $" {
+		t.Errorf("Expected full value kept in results, got %q", model.Results[0])
+	}
+
+	result := CalculateExpression("ans1 * 2", []string{"1234567.89 $", ""}, 1)
+	if result != "2469135.78 $" {
+		t.Errorf("Expected chaining on full value '2469135.78 $', got %q", result)
+	}
+}
+
+// TestRefreshView tests that the refresh key re-renders all lines with current ans substitutions
+func TestRefreshView(t *testing.T) {
+	model := createTestModel()
+	model.addMultipleInputs("2\n3\nans2+ans3")
+	model.Results = []string{"", "2", "3", "5"}
+	model.Inputs[0].Focus()
+	model.Focused = 0
+
+	// Simulate a stale display
+	model.InputViewport.SetContent("stale")
+	model.ResultViewport.SetContent("stale")
+
+	newModel, _ := model.Update(tea.KeyMsg{Type: tea.KeyF5})
+	model = newModel.(Model)
+
+	inputView := stripANSIEscapeCodes(model.InputViewport.View())
+	if strings.Contains(inputView, "stale") {
+		t.Errorf("Expected input pane to be re-rendered, got %q", inputView)
+	}
+	if !strings.Contains(inputView, "2+3") {
+		t.Errorf("Expected ans references substituted with current values, got %q", inputView)
+	}
+
+	resultView := stripANSIEscapeCodes(model.ResultViewport.View())
+	if strings.Contains(resultView, "stale") || !strings.Contains(resultView, "5") {
+		t.Errorf("Expected result pane to be re-rendered, got %q", resultView)
+	}
+}
+
+// TestPendingTrailingOperator tests that an unfinished expression shows no result when enabled
+func TestPendingTrailingOperator(t *testing.T) {
+	defer func(old Config) { config = old }(config)
+	config.PendingTrailingOperator = true
+
+	pending := []string{"2 +", "2 * ", "10 / // comment", "5 m to"}
+	for _, expr := range pending {
+		if !hasTrailingOperator(prepareString(expr)) {
+			t.Errorf("Expected %q to be pending", expr)
+		}
+		if result := CalculateExpression(expr, []string{""}, 0); result != "" {
+			t.Errorf("Expected empty result for pending %q, got %q", expr, result)
+		}
+	}
+
+	if hasTrailingOperator(prepareString("50%")) {
+		t.Error("Expected postfix percent not to be pending")
+	}
+	if result := CalculateExpression("2 + 3", []string{""}, 0); result != "5" {
+		t.Errorf("Expected '5' for complete expression, got %q", result)
+	}
+}
+
+// TestNaturalLanguageQueries tests that filler words are stripped from query-like input
+func TestNaturalLanguageQueries(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		prepared string
+		expected string
+	}{
+		{"what is percent of", "what is 15% of 200", "15% * 200", "30"},
+		{"how much is with question mark", "How much is 2 + 2?", "2 + 2", "4"},
+		{"what's", "what's 3 * 4", "3 * 4", "12"},
+		{"calculate", "calculate sqrt(16)", "sqrt(16)", "4"},
+		{"convert units", "convert 5 km to m", "5 km to m", "5000 m"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !CheckForCalculation(tt.input) {
+				t.Errorf("CheckForCalculation(%q) should be true", tt.input)
+			}
+			if prepared := prepareString(tt.input); prepared != tt.prepared {
+				t.Errorf("prepareString(%q) = %q, want %q", tt.input, prepared, tt.prepared)
+			}
+			if result := CalculateExpression(tt.input, []string{""}, 0); result != tt.expected {
+				t.Errorf("CalculateExpression(%q) = %q, want %q", tt.input, result, tt.expected)
+			}
+		})
+	}
+
+	// Queries without math stay plain text
+	if CheckForCalculation("what is this") {
+		t.Error("CheckForCalculation(\"what is this\") should be false")
+	}
+}
+
+// TestPercentages tests that percentages are added, taken off and computed as users expect
+func TestPercentages(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		prepared string
+		expected string
+	}{
+		{"tax added", "120 + 15%", "(120) * (1 + 15 / 100)", "138"},
+		{"discount subtracted", "10 - 5%", "(10) * (1 - 5 / 100)", "9.5"},
+		{"percent off", "20% off 50", "(50) * (1 - 20 / 100)", "40"},
+		{"as percent of", "30 as % of 120", "(30) / (120) to %", "25%"},
+		{"percent of", "15% of 200", "15% * 200", "30"},
+		{"multiplied percent", "200 * 15%", "200 * 15%", "30"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if prepared := prepareString(tt.input); prepared != tt.prepared {
+				t.Errorf("prepareString(%q) = %q, want %q", tt.input, prepared, tt.prepared)
+			}
+			if result := CalculateExpression(tt.input, []string{""}, 0); result != tt.expected {
+				t.Errorf("CalculateExpression(%q) = %q, want %q", tt.input, result, tt.expected)
+			}
+		})
+	}
+
+	if hints := percentHints("15% o"); !slices.Equal(hints, []string{"of", "off"}) {
+		t.Errorf("Expected percentage phrases after a percentage, got %q", hints)
+	}
+	if hints := percentHints("30 "); !slices.Equal(hints, []string{"as % of"}) {
+		t.Errorf("Expected the share phrase after a number, got %q", hints)
+	}
+}
+
+// TestResultDiff tests that the diff between two snapshots lists the changed result lines
+func TestResultDiff(t *testing.T) {
+	model := createTestModel()
+	model.addMultipleInputs("2\n3\nans2+ans3")
+	model.Results = []string{"", "2", "3", "5"}
+	before := model.createSnapshot()
+
+	model.saveState()
+	model.Results = []string{"", "2", "4", "6", "1"}
+	after := model.createSnapshot()
+
+	diffs := diffResults(before.Results, after.Results)
+	expected := []ResultDiff{
+		{Line: 3, Before: "3", After: "4"},
+		{Line: 4, Before: "5", After: "6"},
+		{Line: 5, Before: "", After: "1"},
+	}
+	if len(diffs) != len(expected) {
+		t.Fatalf("Expected %d changed lines, got %d: %v", len(expected), len(diffs), diffs)
+	}
+	for i, diff := range diffs {
+		if diff != expected[i] {
+			t.Errorf("Diff %d: expected %+v, got %+v", i, expected[i], diff)
+		}
+	}
+
+	// The popup compares against the chosen undo state
+	model.openResultDiff(1)
+	if !model.ShowPopup {
+		t.Fatal("Expected diff popup to be showing")
+	}
+	content := stripANSIEscapeCodes(model.renderResultDiff(diffs))
+	if !strings.Contains(content, "3│ 3 → 4") {
+		t.Errorf("Expected changed line in diff popup, got %q", content)
+	}
+}
+
+// TestConditionalHelper tests inserting a conditional template and evaluating it
+func TestConditionalHelper(t *testing.T) {
+	model := createTestModel()
+
+	newModel, _ := model.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'i'}, Alt: true})
+	model = newModel.(Model)
+	if !model.ShowCompletions || model.ActiveMenu != MenuConditional {
+		t.Fatal("Expected conditional menu to be showing")
+	}
+
+	// Choose "a > b" and check the cursor lands at the condition
+	model.SelectedCompletion = 4
+	newModel, _ = model.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	model = newModel.(Model)
+	if model.Inputs[0].Value() != "if( > , , )" {
+		t.Errorf("Expected conditional template, got %q", model.Inputs[0].Value())
+	}
+	if model.Inputs[0].Position() != 3 {
+		t.Errorf("Expected cursor at condition (3), got %d", model.Inputs[0].Position())
+	}
+	if model.ShowCompletions {
+		t.Error("Expected menu to close after insertion")
+	}
+
+	// The template goes at the cursor after non-ASCII symbols too
+	model.Inputs[0].SetValue("2π × ")
+	model.Inputs[0].CursorEnd()
+	model.insertConditional(4)
+	if model.Inputs[0].Value() != "2π × if( > , , )" || model.Inputs[0].Position() != 8 {
+		t.Errorf("Expected the template after the symbols, got %q at %d", model.Inputs[0].Value(), model.Inputs[0].Position())
+	}
+
+	if !CheckForCalculation("if(a > b, a, b)") {
+		t.Error("CheckForCalculation should recognize conditionals")
+	}
+	if result := CalculateExpression("if(3 > 2, 10, 20)", []string{""}, 0); result != "10" {
+		t.Errorf("Expected '10' for true condition, got %q", result)
+	}
+	if result := CalculateExpression("if(3 < 2, 10, 20)", []string{""}, 0); result != "20" {
+		t.Errorf("Expected '20' for false condition, got %q", result)
+	}
+}
+
+// TestCompletionCategoryFiltering tests that configured category patterns filter completions
+func TestCompletionCategoryFiltering(t *testing.T) {
+	entries := []completionEntry{
+		{name: "sin", category: "Trigonometry"},
+		{name: "mean", category: "Statistics/Descriptive Statistics", advanced: true},
+		{name: "x", category: "Unknowns", advanced: true},
+		{name: "sqrt", category: "Exponents & Logarithms"},
+	}
+
+	names := func(entries []completionEntry) []string {
+		var result []string
+		for _, entry := range entries {
+			result = append(result, entry.name)
+		}
+		return result
+	}
+
+	defaults := DefaultConfig()
+	if got := names(filterCompletionEntries(entries, defaults.CompletionIncludeCategories, defaults.CompletionExcludeCategories)); !slices.Equal(got, []string{"sin", "mean", "sqrt"}) {
+		t.Errorf("Default filtering: got %v", got)
+	}
+	if got := names(filterCompletionEntries(entries, nil, []string{"Statistics", "Trig*"})); !slices.Equal(got, []string{"x", "sqrt"}) {
+		t.Errorf("Exclusion with subcategory and glob: got %v", got)
+	}
+	if got := names(filterCompletionEntries(entries, []string{"Exponents & Logarithms"}, nil)); !slices.Equal(got, []string{"sqrt"}) {
+		t.Errorf("Inclusion: got %v", got)
+	}
+
+	// A configured exclusion removes the matching functions from completions
+	defer func(old Config) { config = old }(config)
+	config.CompletionExcludeCategories = append(config.CompletionExcludeCategories, "Trigonometry")
+	if slices.Contains(GetCompletions("si", []string{""}), "sin") {
+		t.Error("Expected excluded trigonometry functions to be missing from completions")
+	}
+}
+
+// TestHiddenResult tests that a hidden result cell is blank but the value stays usable via ans
+func TestHiddenResult(t *testing.T) {
+	model := createTestModel()
+	model.Inputs[0].SetValue("21")
+	model.Results[0] = "21"
+	model.createNewLine()
+	model.Inputs[1].SetValue("ans1 * 2")
+
+	model.focusPreviousLine()
+	newModel, _ := model.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'h'}, Alt: true})
+	model = newModel.(Model)
+
+	if !model.isResultHidden(0) {
+		t.Fatal("Expected line 1 result to be hidden")
+	}
+	firstCell := strings.Split(stripANSIEscapeCodes(model.ResultViewport.View()), "\n")[0]
+	if strings.Contains(firstCell, "21") || !strings.Contains(firstCell, "hidden") {
+		t.Errorf("Expected hidden marker instead of value, got %q", firstCell)
+	}
+	if model.Results[0] != "21" {
+		t.Errorf("Expected hidden result to stay computed, got %q", model.Results[0])
+	}
+	if result := CalculateExpression(model.Inputs[1].Value(), model.Results, 1); result != "42" {
+		t.Errorf("Expected ans1 to use hidden value, got %q", result)
+	}
+
+	// Toggling again shows the value
+	model.toggleResultVisibility()
+	if model.isResultHidden(0) {
+		t.Error("Expected line 1 result to be visible again")
+	}
+
+	// Undoing a deletion brings back the hidden state of the deleted line
+	model.toggleResultVisibility()
+	model.deleteLine()
+	if model.isResultHidden(0) {
+		t.Error("Expected the line moving up not to take over the hidden state")
+	}
+	model.undo()
+	if !model.isResultHidden(0) || model.isResultHidden(1) {
+		t.Errorf("Expected undo to hide line 1 again, got %v", model.HiddenResults)
+	}
+}
+
+// TestAggregates tests aggregates over the numeric results of preceding lines
+func TestAggregates(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		results  []string
+		expected string
+	}{
+		{"product of small set", "product()", []string{"2", "3", "4", ""}, "24"},
+		{"product skips blank and text lines", "product()", []string{"2", "", "note", "3", "4", ""}, "24"},
+		{"product with zero", "product()", []string{"2", "0", "4", ""}, "0"},
+		{"product of empty set", "product()", []string{"", ""}, "1"},
+		{"product in expression", "product() * 2", []string{"2", "3", ""}, "6 * 2"},
+		{"geometric mean", "gmean()", []string{"2", "8", ""}, "4"},
+		{"total with negative", "total()", []string{"5", "−2", ""}, "3"},
+		{"average", "avg()", []string{"1", "2", "6", ""}, "3"},
+		{"pretty printed number", "total()", []string{"1.5 × 10²", ""}, "150"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := replaceAggregates(tt.expr, tt.results, len(tt.results)-1)
+			if err != nil {
+				t.Fatalf("replaceAggregates(%q) failed: %v", tt.expr, err)
+			}
+			if result != tt.expected {
+				t.Errorf("replaceAggregates(%q) = %q, want %q", tt.expr, result, tt.expected)
+			}
+		})
+	}
+
+	if _, err := replaceAggregates("gmean()", []string{"", ""}, 1); err == nil || err.Error() != ErrorNoValues {
+		t.Errorf("Expected %q for gmean of empty set, got %v", ErrorNoValues, err)
+	}
+
+	// Aggregates are recognized when calculating
+	if result := CalculateExpression("product()", []string{"2", "", "5", ""}, 3); result != "10" {
+		t.Errorf("Expected '10' for product(), got %q", result)
+	}
+}
+
+// TestGraphSampling tests sampling an expression of one variable and plotting it
+func TestGraphSampling(t *testing.T) {
+	expr, variable, ok := graphableExpression("f(x) = x^2 // parabola")
+	if !ok || expr != "x^2" || variable != "x" {
+		t.Fatalf("Expected x^2 in x, got %q in %q (ok=%v)", expr, variable, ok)
+	}
+	if _, _, ok := graphableExpression("2 + 2"); ok {
+		t.Error("Expected an expression without variable not to be graphable")
+	}
+
+	from, to, err := parseGraphRange("0 4")
+	if err != nil {
+		t.Fatalf("parseGraphRange failed: %v", err)
+	}
+
+	samples := sampleExpression(expr, variable, from, to, 5, []string{""}, 0)
+	expected := []float64{0, 1, 4, 9, 16}
+	for i, sample := range samples {
+		if !sample.ok || sample.y != expected[i] {
+			t.Errorf("Sample %d at x=%g: expected %g, got %g (ok=%v)", i, sample.x, expected[i], sample.y, sample.ok)
+		}
+		if i > 0 && sample.y <= samples[i-1].y {
+			t.Errorf("Expected increasing series, sample %d is %g after %g", i, sample.y, samples[i-1].y)
+		}
+	}
+
+	// Undefined points leave gaps and the plot has one row per height unit plus the x labels
+	plot := renderPlot([]graphSample{{0, 0, true}, {1, 0, false}, {2, 4, true}}, 5)
+	lines := strings.Split(plot, "\n")
+	if len(lines) != 6 {
+		t.Fatalf("Expected 6 plot lines, got %d:\n%s", len(lines), plot)
+	}
+	if !strings.HasSuffix(lines[0], "┤│ •") || !strings.HasSuffix(lines[4], "┤•──") {
+		t.Errorf("Unexpected plot:\n%s", plot)
+	}
+}
+
+func TestPlotCall(t *testing.T) {
+	tests := []struct {
+		input    string
+		expr     string
+		from, to float64
+		ok       bool
+	}{
+		{"plot(sin(x), -10, 10)", "sin(x)", -10, 10, true},
+		{"plot(atan2(x, 1), 5, -5) // swapped", "atan2(x, 1)", -5, 5, true},
+		{"plot(x^2; 0.5; 2)", "x^2", 0.5, 2, true},
+		{"plot(x, 1, 1)", "", 0, 0, false},
+		{"plot(x)", "", 0, 0, false},
+	}
+	for _, tt := range tests {
+		expr, from, to, ok := parsePlotCall(tt.input)
+		if ok != tt.ok || (ok && (expr != tt.expr || from != tt.from || to != tt.to)) {
+			t.Errorf("parsePlotCall(%q) = %q %g %g %v, expected %q %g %g %v", tt.input, expr, from, to, ok, tt.expr, tt.from, tt.to, tt.ok)
+		}
+	}
+	if result := CalculateExpression("plot(sin(x), -10, 10)", nil, 0); result != "" {
+		t.Errorf("Expected no result for a plot call, got %q", result)
+	}
+
+	// Entering the call draws it and moves on to a new line
+	m := createTestModel()
+	m.Inputs[0].SetValue("plot(1/x, -1, 1)")
+	m.handleKeyMessage(tea.KeyMsg{Type: tea.KeyEnter})
+	if !m.ShowPopup || !strings.Contains(m.PopupTitle, "1/x") || len(m.Inputs) != 2 || m.Focused != 1 {
+		t.Errorf("Expected the graph of 1/x above a new line, got popup %q with %d lines", m.PopupTitle, len(m.Inputs))
+	}
+}
+
+// TestConfigurableAnsKeyword tests referencing results with a configured keyword
+func TestConfigurableAnsKeyword(t *testing.T) {
+	defer func(old Config) { config = old }(config)
+	config.AnsKeyword = "prev"
+
+	results := []string{"5", "7", ""}
+	if result := CalculateExpression("prev1 * 2", results, 2); result != "10" {
+		t.Errorf("Expected prev1 * 2 = 10, got %q", result)
+	}
+	if result := CalculateExpression("prev2 + prev", results, 2); result != "14" {
+		t.Errorf("Expected prev2 + prev = 14, got %q", result)
+	}
+	if !CheckForCalculation("prev") {
+		t.Error("Expected a line with the keyword to be calculated")
+	}
+
+	m := createTestModel()
+	m.Results = results
+	styled := m.styleAnsTokens("prev2 + prev + ans")
+	if !strings.Contains(styled, "ans") || strings.Count(styled, "prev") != 2 {
+		t.Errorf("Unexpected styled tokens: %q", styled)
+	}
+	if ansKeywordRegex().MatchString("preview") {
+		t.Error("Expected the keyword not to match inside other words")
+	}
+
+	replaced := m.replaceAnsTokensWithValues("prev2 + 1", 2)
+	if strings.Contains(replaced, "prev2") || !strings.Contains(replaced, "7") {
+		t.Errorf("Expected prev2 to be replaced with its value, got %q", replaced)
+	}
+
+	completions := GetCompletions("pre", results)
+	if !slices.Contains(completions, "prev") || !slices.Contains(completions, "prev1") {
+		t.Errorf("Expected prev references in completions, got %v", completions)
+	}
+
+	// A keyword made of symbols still matches standalone
+	config.AnsKeyword = "#"
+	if !ansKeywordRegex().MatchString("# * 2") {
+		t.Error("Expected # to match as keyword")
+	}
+	if result := CalculateExpression("#1 * 2", results, 2); result != "10" {
+		t.Errorf("Expected #1 * 2 = 10, got %q", result)
+	}
+	if result := CalculateExpression("# + 1 // latest", results, 2); result != "8" {
+		t.Errorf("Expected # + 1 = 8, got %q", result)
+	}
+}
+
+// TestDependencyGraph tests listing line references and flagging cycles
+func TestDependencyGraph(t *testing.T) {
+	inputs := []string{"5", "ans1 * 2", "ans2 + ans1", "note", "ans // last result"}
+	results := []string{"5", "10", "15", "", ""}
+
+	deps := lineDependencies(inputs, results)
+	expected := [][]int{nil, {0}, {1, 0}, nil, {2}}
+	for i := range expected {
+		if !slices.Equal(deps[i], expected[i]) {
+			t.Errorf("Line %d: expected dependencies %v, got %v", i+1, expected[i], deps[i])
+		}
+	}
+
+	if slices.Contains(findDependencyCycles(deps), true) {
+		t.Error("Expected no cycles in a chain of backward references")
+	}
+	graph := renderDependencyGraph(inputs, deps, findDependencyCycles(deps))
+	if !strings.Contains(graph, "3│ ans2 + ans1\n   │   ← 2, 1") {
+		t.Errorf("Unexpected graph:\n%s", graph)
+	}
+
+	// Forward references can form a cycle
+	cyclic := lineDependencies([]string{"ans2 + 1", "ans1 * 2", "ans10"}, []string{"", "", ""})
+	cycles := findDependencyCycles(cyclic)
+	if !cycles[0] || !cycles[1] || cycles[2] {
+		t.Errorf("Expected lines 1 and 2 in a cycle, got %v", cycles)
+	}
+	if !strings.Contains(renderDependencyGraph([]string{"ans2 + 1", "ans1 * 2", "ans10"}, cyclic, cycles), "⟳ cycle") {
+		t.Error("Expected cycles to be flagged")
+	}
+}
+
+// TestPasteKeepsFocus tests the option to stay on the current line after a multi-line paste
+func TestPasteKeepsFocus(t *testing.T) {
+	defer func(old Config) { config = old }(config)
+
+	m := createTestModel()
+	m.Inputs[0].SetValue("1 + 1")
+	m.handleBracketedPaste("2 + 2\n3 + 3")
+	if m.Focused != 2 {
+		t.Errorf("Expected focus on the last pasted line by default, got %d", m.Focused)
+	}
+
+	config.PasteKeepsFocus = true
+	m = createTestModel()
+	m.Inputs[0].SetValue("1 + 1")
+	m.handleBracketedPaste("2 + 2\r\n3 + 3")
+	if len(m.Inputs) != 3 {
+		t.Fatalf("Expected 3 lines after paste, got %d", len(m.Inputs))
+	}
+	if m.Focused != 0 || !m.Inputs[0].Focused() || m.Inputs[2].Focused() {
+		t.Errorf("Expected focus to stay on the pre-paste line, got %d", m.Focused)
+	}
+	if m.InputViewport.YOffset != 0 {
+		t.Errorf("Expected the viewport to stay at the focused line, got offset %d", m.InputViewport.YOffset)
+	}
+}
+
+// TestPasteAtCursor tests that pasted lines are inserted at the cursor
+func TestPasteAtCursor(t *testing.T) {
+	defer func(old Config) { config = old }(config)
+
+	m := createTestModel()
+	m.loadWorksheet("10\nans * 2")
+	m.Inputs[m.Focused].Blur()
+	m.Focused = 1
+	m.Inputs[1].Focus()
+	m.Inputs[1].CursorEnd()
+	_, cmd := m.handleBracketedPaste("5\n6")
+	runCalculations(&m, cmd)
+	if !slices.Equal(m.inputValues(), []string{"", "10", "5", "6", "ans * 2"}) || m.Focused != 3 {
+		t.Fatalf("Expected the lines pasted below line 2, got %q with focus on %d", m.inputValues(), m.Focused)
+	}
+	if m.Results[4] != "12" {
+		t.Errorf("Expected the moved line to use the pasted line above it, got %q", m.Results[4])
+	}
+
+	// A line the cursor is in the middle of is split around the pasted lines
+	m.Inputs[2].SetValue("1 + 2")
+	m.Inputs[m.Focused].Blur()
+	m.Focused = 2
+	m.Inputs[2].Focus()
+	m.Inputs[2].SetCursor(3)
+	m.handleBracketedPaste("3\r\n4")
+	if !slices.Equal(m.inputValues(), []string{"", "10", "1 +", "3", "4", "2", "6", "ans * 2"}) || m.Focused != 4 {
+		t.Errorf("Expected the line split around the pasted lines, got %q with focus on %d", m.inputValues(), m.Focused)
+	}
+	if !m.undo() || !slices.Equal(m.inputValues(), []string{"", "10", "1 + 2", "6", "ans * 2"}) {
+		t.Errorf("Expected the paste to be undone in one step, got %q", m.inputValues())
+	}
+
+	// The pasted lines can go after the last line instead
+	config.PasteAppends = true
+	m = createTestModel()
+	m.loadWorksheet("1\n2")
+	m.Inputs[m.Focused].Blur()
+	m.Focused = 1
+	m.Inputs[1].Focus()
+	m.handleBracketedPaste("3\n4")
+	if !slices.Equal(m.inputValues(), []string{"", "1", "2", "3", "4"}) || m.Focused != 4 {
+		t.Errorf("Expected the pasted lines appended, got %q with focus on %d", m.inputValues(), m.Focused)
+	}
+}
+
+// TestInlineResults tests showing results below their inputs in a single pane
+func TestInlineResults(t *testing.T) {
+	m := createTestModel()
+	m.loadWorksheet("2+2\n// note\n3*3")
+	m.toggleInlineResults()
+	if m.inputPaneWidth() != m.Width {
+		t.Fatalf("Expected the input pane to take the whole width, got %d", m.inputPaneWidth())
+	}
+
+	view := m.View()
+	if first, _, _ := strings.Cut(view, "\n"); strings.Count(first, "╭") != 1 {
+		t.Errorf("Expected a single pane, got %q", first)
+	}
+	if !strings.Contains(view, "= 4") || !strings.Contains(view, "= 9") {
+		t.Errorf("Expected the results below their inputs, got:\n%s", view)
+	}
+
+	// Lines with a result take two rows and lines without one take one
+	if m.lineHeight(1) != 2 || m.lineHeight(2) != 1 || m.lineRow(3) != 4 {
+		t.Errorf("Unexpected rows: %d, %d, %d", m.lineHeight(1), m.lineHeight(2), m.lineRow(3))
+	}
+
+	// Clicks on the row below an input hit its result
+	if line := m.resultLineAt(10, 3); line != 1 {
+		t.Errorf("Expected the result of line 2 at row 3, got %d", line)
+	}
+	if line := m.resultLineAt(10, 2); line != -1 {
+		t.Errorf("Expected the input of line 2 at row 2, got %d", line)
+	}
+	m.handleMouseMessage(tea.MouseMsg{X: 10, Y: 4, Type: tea.MouseLeft})
+	if m.Focused != 2 {
+		t.Errorf("Expected a click on line 3's input to focus it, got %d", m.Focused)
+	}
+
+	m.toggleInlineResults()
+	if m.inputPaneWidth() != 56 || m.lineHeight(1) != 1 {
+		t.Errorf("Expected the result pane back, got an input pane %d wide", m.inputPaneWidth())
+	}
+}
+
+// TestConversionChain tests building and evaluating multi-step unit conversions
+func TestConversionChain(t *testing.T) {
+	parts := splitConversionChain("5 cups to mL -> L")
+	if !slices.Equal(parts, []string{"5 cups", "mL", "L"}) {
+		t.Errorf("Unexpected chain parts: %v", parts)
+	}
+	if chain := buildConversionChain("2 km // run", "m cm"); chain != "2 km to m to cm // run" {
+		t.Errorf("Unexpected chain: %q", chain)
+	}
+	if chain := buildConversionChain("2 km //! units=us", "ft"); chain != "2 km to ft //! units=us" {
+		t.Errorf("Expected the directive to be kept, got %q", chain)
+	}
+
+	// The final value of a two-step conversion is the value in the last unit
+	if result := CalculateExpression("2 km to m to cm", []string{""}, 0); result != "200000 cm" {
+		t.Errorf("Expected 200000 cm, got %q", result)
+	}
+
+	steps := conversionChainSteps("2 km to m to cm", []string{""}, 0)
+	if len(steps) != 2 || steps[0] != "2000 m" || steps[1] != "200000 cm" {
+		t.Errorf("Unexpected conversion steps: %v", steps)
+	}
+}
+
+// TestExplainLine tests the steps shown for how a line is calculated
+func TestExplainLine(t *testing.T) {
+	steps := explainLine("ans * 2 // double", []string{"21", ""}, 1)
+	labels := make([]string, len(steps))
+	for i, step := range steps {
+		labels[i] = step.label
+	}
+	if !slices.Equal(labels, []string{"Input", "Calculated", "Parsed", "Exact", "Decimal", "Factored"}) {
+		t.Fatalf("Unexpected explanation: %v", steps)
+	}
+	if steps[0].value != "ans * 2" || steps[1].value != "21 * 2" {
+		t.Errorf("Expected ans to be substituted, got %v", steps[:2])
+	}
+	if steps[4].value != "42" {
+		t.Errorf("Expected the decimal form 42, got %q", steps[4].value)
+	}
+
+	// Unchanged expressions don't repeat the input
+	if steps := explainLine("1 + 1", []string{""}, 0); len(steps) == 0 || steps[1].label != "Parsed" {
+		t.Errorf("Expected no calculated step, got %v", steps)
+	}
+	if steps := explainLine("// just a comment", []string{""}, 0); steps != nil {
+		t.Errorf("Expected nothing to explain, got %v", steps)
+	}
+
+	rendered := renderExplanation([]explanationStep{{"Input", "1/3"}, {"Decimal", "0.333333333"}})
+	if rendered != "Input    1/3\nDecimal  0.333333333" {
+		t.Errorf("Unexpected rendering: %q", rendered)
+	}
+}
+
+// TestUnitConversions tests listing a result in the common units of its dimension
+func TestUnitConversions(t *testing.T) {
+	for result, unit := range map[string]string{
+		"5000 m":         "m",
+		"1.2 × 10⁴ km/h": "km/h",
+		"100 °C":         "°C",
+		"42":             "",
+	} {
+		if got := resultUnit(result); got != unit {
+			t.Errorf("resultUnit(%q) = %q, expected %q", result, got, unit)
+		}
+	}
+
+	conversions := unitConversions("5 km // run", []string{"5 km"}, 0)
+	if len(conversions) != len(compatibleUnits("km"))-1 || conversions[0] != "5000 m" {
+		t.Fatalf("Expected 5 km in every other length unit, got %q", conversions)
+	}
+	if !strings.HasSuffix(conversions[3], " mi") {
+		t.Errorf("Expected 5 km in miles, got %q", conversions[3])
+	}
+	if conversions := unitConversions("42", []string{"42"}, 0); conversions != nil {
+		t.Errorf("Expected no conversions of a plain number, got %q", conversions)
+	}
+
+	m := createTestModel()
+	m.loadWorksheet("2 h")
+	m.openUnitConversions()
+	if !m.ShowPopup || !strings.Contains(m.PopupViewport.View(), "= 120 min") {
+		t.Errorf("Expected the conversions in a popup, got %q", m.PopupViewport.View())
+	}
+}
+
+// TestWorksheetHeader tests that a first-line directive sets the session defaults
+func TestWorksheetHeader(t *testing.T) {
+	settings, ok := parseSessionHeader("//! angle=deg precision=4")
+	if !ok || settings.AngleUnit != AngleUnitDegrees || settings.Precision != 4 {
+		t.Errorf("Unexpected header settings: %+v (ok=%v)", settings, ok)
+	}
+	if _, ok := parseSessionHeader("1 + 1 //! angle=deg"); ok {
+		t.Error("Expected a calculation line not to be a header")
+	}
+	if settings, _ := parseSessionHeader("//! angle=turns precision=99"); settings != DefaultSessionSettings() {
+		t.Errorf("Expected invalid values to keep defaults, got %+v", settings)
+	}
+
+	m := createTestModel()
+	defer m.applySessionSettings(DefaultSessionSettings())
+	m.loadWorksheet("//! angle=deg precision=4\nsin(30)\n1/3")
+
+	if m.Session.AngleUnit != AngleUnitDegrees || m.Session.Precision != 4 {
+		t.Errorf("Expected the header to apply, got %+v", m.Session)
+	}
+	if m.Results[1] != "" {
+		t.Errorf("Expected no result for the header line, got %q", m.Results[1])
+	}
+	if m.Results[2] != "0.5" {
+		t.Errorf("Expected sin(30) in degrees to be 0.5, got %q", m.Results[2])
+	}
+	if m.Results[3] != "0.3333" {
+		t.Errorf("Expected 1/3 with 4 decimals, got %q", m.Results[3])
+	}
+}
+
+// TestResultLabels tests prefixing results with their shortened input
+func TestResultLabels(t *testing.T) {
+	if label := resultLabel("price * quantity // total", 8); label != "price *…" {
+		t.Errorf("Expected truncated label, got %q", label)
+	}
+	if label := resultLabel("2+2", 6); label != "2+2   " {
+		t.Errorf("Expected padded label, got %q", label)
+	}
+
+	m := createTestModel()
+	m.Inputs[0].SetValue("1234 * 5678 + 91011")
+	m.Results[0] = "7097663"
+
+	m.updateResultViewport()
+	if strings.Contains(stripANSIEscapeCodes(m.LastResultContent), "1234") {
+		t.Error("Expected no label by default")
+	}
+
+	m.toggleResultLabels()
+	content := stripANSIEscapeCodes(m.LastResultContent)
+	if !strings.HasPrefix(content, "1234 * 56… ") || !strings.Contains(content, "7097663") {
+		t.Errorf("Expected the result cell to start with the truncated input, got %q", content)
+	}
+	if lipgloss.Width(strings.Split(m.LastResultContent, "\n")[0]) != m.ResultViewport.Width {
+		t.Errorf("Expected the labelled cell to fill the pane width")
+	}
+}
+
+// TestImportCSV tests inserting a CSV column as lines
+func TestImportCSV(t *testing.T) {
+	data := "name,amount\napples,12.5\nbroken\npears,\"3,5\"\nplums,n/a\ncherries,4\n"
+
+	values, skipped, err := readCSVColumn(strings.NewReader(data), "amount")
+	if err != nil {
+		t.Fatalf("readCSVColumn failed: %v", err)
+	}
+	if !slices.Equal(values, []string{"12.5", "3.5", "4"}) {
+		t.Errorf("Unexpected values: %v", values)
+	}
+	if !slices.Equal(skipped, []int{3, 5}) {
+		t.Errorf("Expected the rows without a number to be reported, got %v", skipped)
+	}
+	if values, _, _ := readCSVColumn(strings.NewReader("1\n2\n3"), ""); !slices.Equal(values, []string{"1", "2", "3"}) {
+		t.Errorf("Expected a headerless first column, got %v", values)
+	}
+	if _, _, err := readCSVColumn(strings.NewReader(data), "price"); err == nil {
+		t.Error("Expected an error for a missing column")
+	}
+
+	path := t.TempDir() + "/data.csv"
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if file, column := parseCSVImportSpec(path + " 2"); file != path || column != "2" {
+		t.Errorf("Unexpected import spec: %q %q", file, column)
+	}
+
+	m := createTestModel()
+	if skipped, err := m.importCSV(path, "2"); err != nil || !slices.Equal(skipped, []int{3, 5}) {
+		t.Fatalf("importCSV failed: %v (skipped %v)", err, skipped)
+	}
+	if len(m.Inputs) != 4 {
+		t.Fatalf("Expected 3 imported lines, got %d inputs", len(m.Inputs))
+	}
+	for i, expected := range []string{"12.5", "3.5", "4"} {
+		if m.Inputs[i+1].Value() != expected || m.Results[i+1] != expected {
+			t.Errorf("Line %d: expected %s, got %q = %q", i+2, expected, m.Inputs[i+1].Value(), m.Results[i+1])
+		}
+	}
+
+	// With a decimal comma, fields are separated by semicolons
+	SetSeparators(NumberSeparators{Decimal: ","})
+	defer SetSeparators(DefaultConfig().Separators())
+	values, _, err = readCSVColumn(strings.NewReader("name;amount\napples;12,5\npears;3\n"), "amount")
+	if err != nil || !slices.Equal(values, []string{"12.5", "3"}) {
+		t.Errorf("Expected semicolon separated values, got %v (%v)", values, err)
+	}
+
+	// Grouped numbers follow the configured separators and are inserted with them
+	SetSeparators(NumberSeparators{Decimal: ",", Thousands: "."})
+	grouped := t.TempDir() + "/grouped.csv"
+	if err := os.WriteFile(grouped, []byte("name;amount\na;1,500\nb;1.234,5\nc;x\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m = createTestModel()
+	skipped, err = m.importCSV(grouped, "amount")
+	if err != nil || !slices.Equal(skipped, []int{4}) {
+		t.Fatalf("Expected row 4 to be skipped, got %v (%v)", skipped, err)
+	}
+	if !slices.Equal(m.inputValues(), []string{"", "1,5", "1234,5"}) {
+		t.Errorf("Expected the values with a decimal comma, got %q", m.inputValues())
+	}
+}
+
+// TestLineNotes tests attaching notes to lines and keeping them through save and load
+func TestLineNotes(t *testing.T) {
+	m := createTestModel()
+	m.Inputs[0].SetValue("2 * 21")
+	m.Results[0] = CalculateExpression("2 * 21", m.Results, 0)
+
+	m.openNoteEditor()
+	m.PromptInput.SetValue("from the invoice")
+	m.submitPrompt()
+	if m.lineNote(0) != "from the invoice" {
+		t.Fatalf("Expected the note to attach to the line, got %q", m.lineNote(0))
+	}
+	if result := CalculateExpression(m.Inputs[0].Value(), m.Results, 0); result != m.Results[0] {
+		t.Errorf("Expected the note not to affect the result, got %q", result)
+	}
+
+	text := m.worksheetText()
+	if text != "//@ from the invoice\n2 * 21" {
+		t.Errorf("Unexpected worksheet text: %q", text)
+	}
+
+	loaded := createTestModel()
+	loaded.loadWorksheet(text + "\n1 + 1")
+	if len(loaded.Inputs) != 3 || loaded.Inputs[1].Value() != "2 * 21" {
+		t.Fatalf("Expected the note line not to become an input, got %d inputs", len(loaded.Inputs))
+	}
+	if loaded.lineNote(1) != "from the invoice" || loaded.lineNote(2) != "" {
+		t.Errorf("Expected the note to be restored on its line, got %q", loaded.Notes)
+	}
+	if loaded.Results[1] != m.Results[0] {
+		t.Errorf("Expected the same result after load, got %q", loaded.Results[1])
+	}
+
+	// Removing the line removes its note
+	loaded.Focused = 1
+	loaded.deleteLine()
+	if loaded.lineNote(1) != "" {
+		t.Errorf("Expected the note to go with its line, got %q", loaded.lineNote(1))
+	}
+
+	// Undoing the deletion brings the note back with its line
+	loaded.undo()
+	if loaded.lineNote(1) != "from the invoice" || loaded.lineNote(2) != "" {
+		t.Errorf("Expected undo to restore the note on its line, got %q", loaded.Notes)
+	}
+}
+
+// isQuitCmd reports whether cmd quits the program
+func isQuitCmd(cmd tea.Cmd) bool {
+	if cmd == nil {
+		return false
+	}
+	_, quit := cmd().(tea.QuitMsg)
+	return quit
+}
+
+// TestEscapeBehavior tests the configurable Esc key behavior
+func TestEscapeBehavior(t *testing.T) {
+	defer func(old Config) { config = old }(config)
+	esc := tea.KeyMsg{Type: tea.KeyEsc}
+
+	m := createTestModel()
+	if _, cmd := m.handleKeyMessage(esc); !isQuitCmd(cmd) {
+		t.Error("Expected a single Esc to quit by default")
+	}
+
+	config.EscapeBehavior = EscapeDoubleQuit
+	m = createTestModel()
+	if _, cmd := m.handleKeyMessage(esc); isQuitCmd(cmd) {
+		t.Error("Expected the first Esc not to quit")
+	}
+	if _, cmd := m.handleKeyMessage(esc); !isQuitCmd(cmd) {
+		t.Error("Expected a second Esc in quick succession to quit")
+	}
+
+	// A slow second Esc starts over
+	m.LastEscape = time.Now().Add(-2 * doubleEscapeWindow)
+	if _, cmd := m.handleKeyMessage(esc); isQuitCmd(cmd) {
+		t.Error("Expected a late second Esc not to quit")
+	}
+
+	// Popups still close on a single Esc without counting towards quitting
+	m = createTestModel()
+	m.openPopup("Info", "content")
+	if _, cmd := m.handleKeyMessage(esc); isQuitCmd(cmd) || m.ShowPopup {
+		t.Error("Expected Esc to close the popup without quitting")
+	}
+	if _, cmd := m.handleKeyMessage(esc); isQuitCmd(cmd) {
+		t.Error("Expected the Esc after closing a popup not to quit")
+	}
+
+	config.EscapeBehavior = EscapeNone
+	m = createTestModel()
+	for range 3 {
+		if _, cmd := m.handleKeyMessage(esc); isQuitCmd(cmd) {
+			t.Fatal("Expected Esc never to quit")
+		}
+	}
+	if _, cmd := m.handleKeyMessage(tea.KeyMsg{Type: tea.KeyCtrlC}); !isQuitCmd(cmd) {
+		t.Error("Expected Ctrl+C to quit")
+	}
+}
+
+// TestCloneTab tests that a cloned worksheet tab is independent of its source
+func TestCloneTab(t *testing.T) {
+	m := createTestModel()
+	m.Inputs[0].SetValue("6 * 7")
+	m.Results[0] = CalculateExpression("6 * 7", m.Results, 0)
+	m.saveState()
+
+	m.cloneTab()
+	if len(m.Tabs) != 2 || m.ActiveTab != 1 {
+		t.Fatalf("Expected the clone to become the second tab, got %d tabs at %d", len(m.Tabs), m.ActiveTab)
+	}
+	if m.Inputs[0].Value() != "6 * 7" || m.Results[0] != m.Tabs[0].Results[0] {
+		t.Errorf("Expected the clone to copy inputs and results, got %q = %q", m.Inputs[0].Value(), m.Results[0])
+	}
+	if len(m.UndoSystem.undoStack) != 0 {
+		t.Errorf("Expected the clone to start with its own undo history, got %d states", len(m.UndoSystem.undoStack))
+	}
+
+	// Editing the clone leaves the source untouched
+	m.saveState()
+	m.Inputs[0].SetValue("1 + 1")
+	m.Results[0] = CalculateExpression("1 + 1", m.Results, 0)
+	if m.Tabs[0].Inputs[0].Value() != "6 * 7" || m.Tabs[0].Results[0] == m.Results[0] {
+		t.Errorf("Expected the source tab to be unchanged, got %q = %q", m.Tabs[0].Inputs[0].Value(), m.Tabs[0].Results[0])
+	}
+	if len(m.Tabs[0].UndoSystem.undoStack) != 1 {
+		t.Errorf("Expected the source undo history to be unchanged, got %d states", len(m.Tabs[0].UndoSystem.undoStack))
+	}
+
+	m.switchTab(-1)
+	if m.ActiveTab != 0 || m.Inputs[0].Value() != "6 * 7" {
+		t.Errorf("Expected to switch back to the source, got %q", m.Inputs[0].Value())
+	}
+	m.switchTab(1)
+	if m.Inputs[0].Value() != "1 + 1" {
+		t.Errorf("Expected the clone to keep its edits, got %q", m.Inputs[0].Value())
+	}
+
+	// Results of a tab that is no longer active are dropped
+	m.handleCalculationMessage(CalculationMsg{Index: 0, Result: "stale", Tab: m.Tabs[0].ID})
+	if m.Results[0] == "stale" {
+		t.Error("Expected a result of another tab to be ignored")
+	}
+}
+
+// TestNumberFormat tests the configurable format template for numeric results
+func TestNumberFormat(t *testing.T) {
+	defer func(old Config) { config = old }(config)
+
+	tests := []struct {
+		name     string
+		format   string
+		input    string
+		expected string
+	}{
+		{"forced sign positive", "%+.2f", "3.14159", "+3.14"},
+		{"forced sign negative", "%+.2f", "-2", "-2.00"},
+		{"unicode minus", "%+.2f", "−2", "-2.00"},
+		{"scientific notation", "%.1f", "1.5 × 10³", "1500.0"},
+		{"padded positive", "%8.1f", "42", "    42.0"},
+		{"padded negative", "%8.1f", "-42.25", "   -42.2"},
+		{"zero padded with text", "%06.1f units", "-7.5", "-007.5 units"},
+		{"non-numeric result", "%+.2f", "5 m", "5 m"},
+		{"error message", "%+.2f", ErrorExpressionInvalid, ErrorExpressionInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.NumberFormat = tt.format
+			result := displayString(tt.input)
+			if result != tt.expected {
+				t.Errorf("displayString(%q) with %q = %q, want %q", tt.input, tt.format, result, tt.expected)
+			}
+		})
+	}
+
+	// Chaining uses the raw value rather than the formatted one
+	config.NumberFormat = "%+.2f"
+	result := CalculateExpression("ans1 * 2", []string{"2.125", ""}, 1)
+	if result != "4.25" {
+		t.Errorf("Expected chaining on raw value '4.25', got %q", result)
+	}
+
+	// Templates without exactly one float verb are rejected at load
+	for _, format := range []string{"%d", "%s", "%.2f %.2f", "plain"} {
+		path := t.TempDir() + "/config.json"
+		data := fmt.Sprintf(`{"numberFormat": %q, "compactCurrency": true}`, format)
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := LoadConfig(path)
+		if err == nil {
+			t.Errorf("Expected format %q to be rejected", format)
+		}
+		if cfg.NumberFormat != "" || !cfg.CompactCurrency {
+			t.Errorf("Expected only the number format to be dropped for %q, got %+v", format, cfg)
+		}
+	}
+}
+
+// TestRecomputeFocused tests that the focused line is evaluated again without a text change
+func TestRecomputeFocused(t *testing.T) {
+	m := createTestModel()
+	m.Inputs[0].SetValue("1 + 1")
+	m.Results[0] = "stale"
+
+	// A stale cached result is calculated anew
+	processed, _ := expandExpression("1 + 1", m.Results, 0)
+	resultCache.Put(processed, "3")
+	defer resultCache.Clear()
+
+	_, cmd := m.recomputeFocused()
+	if !m.Calculating[0] {
+		t.Error("Expected the focused line to be calculating")
+	}
+	msg, ok := cmd().(CalculationMsg)
+	if !ok || msg.Index != 0 || msg.Result != "2" {
+		t.Fatalf("Expected a fresh calculation of line 1, got %+v", msg)
+	}
+	m.handleCalculationMessage(msg)
+	if m.Results[0] != "2" {
+		t.Errorf("Expected the stale result to be replaced, got %q", m.Results[0])
+	}
+	if cached, _ := resultCache.Get(processed); cached != "2" {
+		t.Errorf("Expected the fresh result to replace the cached one, got %q", cached)
+	}
+
+	// Empty lines have nothing to recompute
+	m.Inputs[0].SetValue("")
+	m.recomputeFocused()
+	if m.Calculating[0] {
+		t.Error("Expected an empty line not to be calculated")
+	}
+}
+
+// TestRecalculateFromScratch tests that all results are blanked and rebuilt in order
+func TestRecalculateFromScratch(t *testing.T) {
+	m := createTestModel()
+	m.loadWorksheet("2\nans * 3")
+	m.Results[1], m.Results[2] = "stale", "stale"
+
+	_, cmd := m.recalculateFromScratch()
+	if m.Results[1] != "" || m.Results[2] != "" || !m.Calculating[1] || !m.Calculating[2] || m.Calculating[0] {
+		t.Fatalf("Expected blank results of calculating lines, got %q %v", m.Results, m.Calculating)
+	}
+	runCalculations(&m, cmd)
+	expected := []string{"", "2", "6"}
+	if !slices.Equal(m.Results, expected) {
+		t.Errorf("Expected results %q, got %q", expected, m.Results)
+	}
+
+	if !m.undo() || m.Results[2] != "stale" {
+		t.Errorf("Expected undo to restore the previous results, got %q", m.Results)
+	}
+}
+
+// TestCalculationSpinner tests that only slow calculations show an animated spinner
+func TestCalculationSpinner(t *testing.T) {
+	m := createTestModel()
+	m.Calculations = NewCalculationManager(1)
+	m.Inputs[0].SetValue("1 + 1")
+	m.Results[0] = "2"
+	m.Calculating[0] = true
+	m.Calculations.StartCalculation(0, "1 + 1")
+
+	updated, cmd := m.animateCalculations(nil)
+	m = updated.(Model)
+	if !m.SpinnerTicking || cmd == nil {
+		t.Fatal("Expected the spinner tick to start for a calculating line")
+	}
+	m.handleSpinnerTick()
+	if _, rows := m.resultRows(0); rows[0] != "2" {
+		t.Errorf("Expected no spinner for a fresh calculation, got %q", rows[0])
+	}
+
+	// A calculation running past the delay shows the next frame on each tick
+	m.Calculations.running[0] = runningCalculation{
+		ctx:     context.Background(),
+		cancel:  func() {},
+		started: time.Now().Add(-time.Second),
+	}
+	frame := m.SpinnerFrame
+	m.handleSpinnerTick()
+	if _, rows := m.resultRows(0); rows[0] != spinnerFrames[(frame+1)%len(spinnerFrames)] {
+		t.Errorf("Expected the next spinner frame, got %q", rows[0])
+	}
+
+	m.Calculating[0] = false
+	if _, cmd := m.handleSpinnerTick(); cmd != nil || m.SpinnerTicking {
+		t.Error("Expected the tick to stop once no line calculates")
+	}
+}
+
+// TestExportPages tests that long worksheets are split into pages with headers
+func TestExportPages(t *testing.T) {
+	m := createTestModel()
+	m.Inputs, m.Results = nil, nil
+	for i := range 30 {
+		input := textinput.New()
+		input.SetValue(fmt.Sprintf("%d + 1", i))
+		m.Inputs = append(m.Inputs, input)
+		m.Results = append(m.Results, fmt.Sprint(i+1))
+	}
+	m.setNote(15, "carried over")
+
+	// 20 rows leave 16 for lines, so the note of line 16 moves it to page 2
+	pages := m.exportPages(false, 20)
+	if len(pages) != 2 {
+		t.Fatalf("Expected 2 pages, got %d", len(pages))
+	}
+	for i, page := range pages {
+		rows := strings.Split(page, "\n")
+		if len(rows) > 20 {
+			t.Errorf("Expected page %d to fit 20 rows, got %d", i+1, len(rows))
+		}
+		if rows[0] != exportTitle {
+			t.Errorf("Expected page %d to start with the header, got %q", i+1, rows[0])
+		}
+		if footer := fmt.Sprintf("Page %d of 2", i+1); rows[len(rows)-1] != footer {
+			t.Errorf("Expected footer %q, got %q", footer, rows[len(rows)-1])
+		}
+	}
+	if !strings.Contains(pages[0], "15  14 + 1  = 15") || strings.Contains(pages[0], "carried over") {
+		t.Errorf("Expected page 1 to end before the noted line, got %q", pages[0])
+	}
+	if rows := strings.Split(pages[1], "\n"); !strings.Contains(rows[2], "//@ carried over") || !strings.HasPrefix(rows[3], "16  15 + 1") {
+		t.Errorf("Expected page 2 to start with the note and its line, got %q", rows[2:4])
+	}
+
+	// Markdown pages have a longer header holding the table head
+	path := t.TempDir() + "/sheet.md"
+	if err := m.exportPaged(path, 20); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := strings.Count(string(data), "| # | Input | Result | Note |"); count != 3 {
+		t.Errorf("Expected 3 Markdown pages with table headers, got %d", count)
+	}
+	if !strings.Contains(string(data), "## nasc worksheet, page 3 of 3") {
+		t.Errorf("Expected numbered Markdown page headers, got %q", data)
+	}
+	if !strings.Contains(string(data), "| 16 | 15 + 1 | 16 | carried over |") {
+		t.Errorf("Expected the note in the line's table row, got %q", data)
+	}
+}
+
+// TestClipboardTransform tests inserting a line computing a transform of the clipboard number
+func TestClipboardTransform(t *testing.T) {
+	defer func(old func() (string, error)) { readClipboard = old }(readClipboard)
+	readClipboard = func() (string, error) { return " 4\n", nil }
+
+	model := createTestModel()
+	model.Inputs[0].SetValue("1 + 1")
+	newModel, _ := model.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'v'}, Alt: true})
+	model = newModel.(Model)
+	if !model.ShowCompletions || model.ActiveMenu != MenuClipboardTransform {
+		t.Fatal("Expected clipboard transform menu to be showing")
+	}
+
+	newModel, _ = model.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	model = newModel.(Model)
+	if len(model.Inputs) != 2 || model.Focused != 1 {
+		t.Fatalf("Expected a focused line below the current one, got %d lines focused on %d", len(model.Inputs), model.Focused)
+	}
+	if model.Inputs[1].Value() != "1 / (4)" {
+		t.Errorf("Expected reciprocal expression, got %q", model.Inputs[1].Value())
+	}
+	if result := CalculateExpression(model.Inputs[1].Value(), model.Results, 1); result != "0.25" {
+		t.Errorf("Expected reciprocal '0.25', got %q", result)
+	}
+
+	model.insertClipboardTransform(2)
+	if model.Inputs[2].Value() != "-(4)" {
+		t.Errorf("Expected negation expression, got %q", model.Inputs[2].Value())
+	}
+
+	// Non-numeric clipboard content adds no line
+	readClipboard = func() (string, error) { return "hello", nil }
+	if err := model.insertClipboardTransform(0); err == nil {
+		t.Error("Expected an error for a non-numeric clipboard")
+	}
+	if len(model.Inputs) != 3 {
+		t.Errorf("Expected no line to be added, got %d lines", len(model.Inputs))
+	}
+
+	// Numbers follow the configured separators
+	SetSeparators(NumberSeparators{Decimal: ",", Thousands: "."})
+	defer SetSeparators(DefaultConfig().Separators())
+	readClipboard = func() (string, error) { return "1.234,5", nil }
+	if err := model.insertClipboardTransform(0); err != nil || model.Inputs[3].Value() != "1 / (1.234,5)" {
+		t.Errorf("Expected the number with the configured separators, got %q (%v)", model.Inputs[3].Value(), err)
+	}
+}
+
+// TestResultClickAction tests the configurable action of clicking a result
+func TestResultClickAction(t *testing.T) {
+	defer func(old Config) { config = old }(config)
+	defer func(old func(string) error) { writeClipboard = old }(writeClipboard)
+	var copied []string
+	writeClipboard = func(text string) error {
+		copied = append(copied, text)
+		return nil
+	}
+	// The result pane starts at 70% of the width
+	click := tea.MouseMsg{X: 60, Y: 1, Type: tea.MouseLeft}
+
+	m := createTestModel()
+	m.Results[0] = "42"
+	m.handleMouseMessage(click)
+	if m.Inputs[0].Value() != "ans1" || len(copied) != 0 {
+		t.Errorf("Expected a click to insert a reference by default, got %q", m.Inputs[0].Value())
+	}
+
+	config.ResultClickAction = ResultClickCopy
+	m = createTestModel()
+	m.Results[0] = "42"
+	m.handleMouseMessage(click)
+	if m.Inputs[0].Value() != "" {
+		t.Errorf("Expected no reference to be inserted, got %q", m.Inputs[0].Value())
+	}
+	if !slices.Equal(copied, []string{"42"}) {
+		t.Errorf("Expected the result to be copied, got %q", copied)
+	}
+
+	config.ResultClickAction = ResultClickPopup
+	m.handleMouseMessage(click)
+	if !m.ShowPopup || !strings.Contains(m.PopupViewport.View(), "42") {
+		t.Error("Expected the result to be shown in a popup")
+	}
+
+	// Right and Shift clicks insert the value whatever the configured action
+	m = createTestModel()
+	m.Results[0] = "12.5 €"
+	m.Inputs[0].SetValue("2 * ")
+	m.Inputs[0].CursorEnd()
+	m.handleMouseMessage(tea.MouseMsg{X: 60, Y: 1, Type: tea.MouseRight})
+	if m.Inputs[0].Value() != "2 * 12.5 €" || m.Inputs[0].Position() != 10 {
+		t.Errorf("Expected the value to be inserted, got %q", m.Inputs[0].Value())
+	}
+	m.Inputs[0].SetValue("")
+	m.handleMouseMessage(tea.MouseMsg{X: 60, Y: 1, Type: tea.MouseLeft, Shift: true})
+	if m.Inputs[0].Value() != "12.5 €" || m.ShowPopup {
+		t.Errorf("Expected a Shift click to insert the value, got %q", m.Inputs[0].Value())
+	}
+}
+
+// TestTemperatureScales tests that C, F and K in conversions are read as temperature scales
+func TestTemperatureScales(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"celsius to fahrenheit", "100 C to F", "100 °C to °F"},
+		{"kelvin in celsius", "300K in C", "300K to °C"},
+		{"unit name target", "-40 F to celsius", "-40 °F to celsius"},
+		{"electric override", "100 C to mC //! scales=electric", "100 C to mC "},
+		{"not a conversion", "5 C * 2", "5 C * 2"},
+		{"charge as conversion target", "2 A * 3 s to C", "2 A * 3 s to C"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := prepareString(tt.input)
+			if result != tt.expected {
+				t.Errorf("prepareString(%q) = %q, want %q", tt.input, result, tt.expected)
+			}
+		})
+	}
+
+	// postString keeps the scale, only dropping the space before the degree sign
+	if result := CalculateExpression("100 C to F", []string{""}, 0); result != "212°F" {
+		t.Errorf("Expected '212°F', got %q", result)
+	}
+	if result := CalculateExpression("1 C to mC //! scales=electric", []string{""}, 0); result != "1000 mC" {
+		t.Errorf("Expected '1000 mC' for coulomb, got %q", result)
+	}
+}
+
+// TestStartupTemplate tests that the configured template populates a fresh worksheet
+func TestStartupTemplate(t *testing.T) {
+	defer func(old Config) { config = old }(config)
+
+	template, err := startupTemplate()
+	if err != nil || template != "" {
+		t.Fatalf("Expected no template by default, got %q (%v)", template, err)
+	}
+
+	path := t.TempDir() + "/template.txt"
+	if err := os.WriteFile(path, []byte("//@ monthly rent\n1200\n\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config.StartupTemplate = path
+	config.StartupLines = []string{"ans * 12"}
+
+	template, err = startupTemplate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := createTestModel()
+	m.loadWorksheet(template)
+	if len(m.Inputs) != 3 || m.Inputs[1].Value() != "1200" || m.Inputs[2].Value() != "ans * 12" {
+		t.Fatalf("Expected the template lines after the blank first line, got %d lines", len(m.Inputs))
+	}
+	if m.lineNote(1) != "monthly rent" {
+		t.Errorf("Expected the template note to be kept, got %q", m.lineNote(1))
+	}
+	if m.Results[2] != "14400" {
+		t.Errorf("Expected the template lines to be calculated, got %q", m.Results[2])
+	}
+
+	config.StartupTemplate = path + ".missing"
+	if _, err := startupTemplate(); err == nil {
+		t.Error("Expected an error for a missing template file")
+	}
+}
+
+// TestExactMode tests switching the whole worksheet between exact and approximate results
+func TestExactMode(t *testing.T) {
+	defer SetExactMode(false)
+
+	m := createTestModel()
+	m.loadWorksheet("1/3\nans2 * 3\nans2^2")
+	approximate := []string{"", "0.333333333", "1", "0.111111111"}
+	if !slices.Equal(m.Results, approximate) {
+		t.Fatalf("Expected approximate results %q, got %q", approximate, m.Results)
+	}
+
+	m.toggleExactMode()
+	exact := []string{"", "1/3", "1", "1/9"}
+	if !m.ExactMode || !slices.Equal(m.Results, exact) {
+		t.Errorf("Expected exact results %q, got %q", exact, m.Results)
+	}
+
+	m.toggleExactMode()
+	if m.ExactMode || !slices.Equal(m.Results, approximate) {
+		t.Errorf("Expected approximate results again, got %q", m.Results)
+	}
+}
+
+// TestNumberSeparators tests reading and printing numbers with configured separators
+func TestNumberSeparators(t *testing.T) {
+	german := NumberSeparators{Decimal: ",", Thousands: "."}
+	SetSeparators(german)
+	defer SetSeparators(DefaultConfig().Separators())
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"decimal comma", "3,14 * 2", "3.14 * 2"},
+		{"grouped with decimals", "1.234,5 + 1", "1234.5 + 1"},
+		{"grouped integer", "2.000.000 / 4", "2000000 / 4"},
+		{"argument separator with space", "if(3 > 2, 10, 20)", "if(3 > 2, 10, 20)"},
+		{"malformed grouping kept", "1.2345", "1.2345"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := prepareString(tt.input); result != tt.expected {
+				t.Errorf("prepareString(%q) = %q, want %q", tt.input, result, tt.expected)
+			}
+		})
+	}
+
+	if result := postString("1234567,5"); result != "1.234.567,5" {
+		t.Errorf("Expected grouped result '1.234.567,5', got %q", result)
+	}
+	if result := postString("2026-10-15"); result != "2026-10-15" {
+		t.Errorf("Expected dates not to be grouped, got %q", result)
+	}
+
+	// Results with a decimal comma are substituted as numbers
+	if result := CalculateExpression("ans1 * 2", []string{"3,14", ""}, 1); result != "6,28" {
+		t.Errorf("Expected ans with decimal comma to give '6,28', got %q", result)
+	}
+	if result := CalculateExpression("ans + 1", []string{"1.234,5", ""}, 1); result != "1.235,5" {
+		t.Errorf("Expected grouped ans to give '1.235,5', got %q", result)
+	}
+
+	m := createTestModel()
+	m.Separators = german
+	if result := m.truncateResult("1.234.567", 6); result != "1.234…" {
+		t.Errorf("Expected truncation not to end on a separator, got %q", result)
+	}
+
+	// Separators that make numbers ambiguous are rejected at load
+	path := t.TempDir() + "/config.json"
+	if err := os.WriteFile(path, []byte(`{"decimalSeparator": ",", "thousandsSeparator": ","}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(path)
+	if err == nil || cfg.Separators() != DefaultConfig().Separators() {
+		t.Errorf("Expected equal separators to be rejected, got %+v (%v)", cfg.Separators(), err)
+	}
+}
+
+// runCalculations runs calculation commands one after another, handling each
+// result before the next calculation starts
+func runCalculations(m *Model, cmd tea.Cmd) {
+	if cmd == nil {
+		return
+	}
+	switch msg := cmd().(type) {
+	case tea.BatchMsg:
+		for _, c := range msg {
+			runCalculations(m, c)
+		}
+	case CalculationMsg:
+		_, next := m.handleCalculationMessage(msg)
+		runCalculations(m, next)
+	}
+}
+
+// TestSupersededCalculation tests that a calculation is dropped once a newer one of the line starts
+func TestSupersededCalculation(t *testing.T) {
+	m := createTestModel()
+	stale := m.calculateLineCmd("1 + 1", 0)
+	fresh := m.calculateLineCmd("2 + 2", 0)
+	if msg := stale(); msg != nil {
+		t.Errorf("Expected the superseded calculation to be dropped, got %+v", msg)
+	}
+	if msg, ok := fresh().(CalculationMsg); !ok || msg.Result != "4" {
+		t.Errorf("Expected the newer calculation to complete, got %+v", msg)
+	}
+
+	// A long-running calculation is cancelled when superseded while it runs
+	calculations := NewCalculationManager(1)
+	ctx := calculations.StartCalculation(0, "slow")
+	started := make(chan struct{})
+	done := make(chan bool)
+	go func() {
+		_, ok := calculations.Run(ctx, 0, func(ctx context.Context) string {
+			close(started)
+			<-ctx.Done()
+			return "stale"
+		})
+		done <- ok
+	}()
+	<-started
+	calculations.StartCalculation(0, "fast")
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("Expected the running calculation to report it was superseded")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the running calculation to be cancelled")
+	}
+	if !calculations.IsCalculating(0) {
+		t.Error("Expected the newer calculation to still be running")
+	}
+}
+
+// TestChangedDependents tests that only lines using a changed result are recalculated
+func TestChangedDependents(t *testing.T) {
+	m := createTestModel()
+	m.loadWorksheet("5\n10\nans2 * 2\nans4 + 1\n7")
+	inputs := m.inputValues()
+	if dependents := lineDependents(inputs, lineDependencies(inputs, m.Results), 1); !slices.Equal(dependents, []int{3}) {
+		t.Errorf("Expected only line 4 to use line 2 directly, got %v", dependents)
+	}
+
+	// The change reaches line 5 through line 4
+	m.Inputs[1].SetValue("6")
+	runCalculations(&m, m.calculateLineCmd("6", 1))
+	expected := []string{"", "6", "10", "12", "13", "7"}
+	if !slices.Equal(m.Results, expected) {
+		t.Errorf("Expected results %q, got %q", expected, m.Results)
+	}
+
+	// An unchanged result has nothing to recalculate
+	if dependents := m.changedDependents(1, "6"); dependents != nil {
+		t.Errorf("Expected no dependents of an unchanged result, got %v", dependents)
+	}
+
+	// Renaming a variable recalculates the lines that may have used the old name
+	m.Inputs[2].SetValue("x = 10")
+	m.changedDependents(2, "10")
+	m.Inputs[2].SetValue("y = 10")
+	if dependents := m.changedDependents(2, "10"); !slices.Equal(dependents, []int{3, 4, 5}) {
+		t.Errorf("Expected all following lines after a rename, got %v", dependents)
+	}
+}
+
+// TestLineVariables tests that variables assigned on a line are used by later lines
+func TestLineVariables(t *testing.T) {
+	m := createTestModel()
+	m.loadWorksheet("x = 5\ny := x * 2\nx * y + 1 // uses both\nx = 7\nx + y")
+	expected := []string{"", "5", "10", "51", "7", "17"}
+	if !slices.Equal(m.Results, expected) {
+		t.Fatalf("Expected results %q, got %q", expected, m.Results)
+	}
+
+	// Editing the assignment recomputes the lines using it
+	m.Inputs[1].SetValue("x = -2")
+	m.Calculating[1] = true
+	runCalculations(&m, m.calculateLineCmd(m.Inputs[1].Value(), 1))
+	expected = []string{"", "−2", "−4", "9", "7", "3"}
+	if !slices.Equal(m.Results, expected) {
+		t.Errorf("Expected results %q after the edit, got %q", expected, m.Results)
+	}
+
+	if _, _, ok := parseAssignment("x == 5"); ok {
+		t.Error("Expected a comparison not to be an assignment")
+	}
+	if _, _, ok := parseAssignment("f(x) = x^2"); ok {
+		t.Error("Expected a function definition not to be an assignment")
+	}
+	if _, _, ok := parseAssignment("ans2 = 4"); ok {
+		t.Error("Expected ans references not to be assignable")
+	}
+
+	deps := lineDependencies(m.inputValues(), m.Results)
+	if !slices.Equal(deps[3], []int{1, 2}) || !slices.Equal(deps[5], []int{4, 2}) {
+		t.Errorf("Expected variable references as dependencies, got %v", deps)
+	}
+}
+
+func TestUserFunctions(t *testing.T) {
+	defer syncUserFunctions(nil)
+
+	name, variable, body, ok := parseFunctionDefinition("area(r) = pi * r^2 // circle")
+	if !ok || name != "area" || variable != "r" || body != "pi * r^2" {
+		t.Fatalf("Expected definition of area(r), got %q %q %q %v", name, variable, body, ok)
+	}
+	if formula := functionFormula("r", "pi * r^2 + rate"); formula != `pi * \x^2 + rate` {
+		t.Errorf("Expected the variable to be replaced by \\x, got %q", formula)
+	}
+
+	m := createTestModel()
+	m.loadWorksheet("myf(x) = x^2 + 1\nmyf(3)")
+	if m.Results[1] != "" || m.Results[2] != "10" {
+		t.Fatalf("Expected no result for the definition and 10 for its use, got %q", m.Results)
+	}
+
+	basic, _ := getLibqalculateCompletions()
+	if !slices.Contains(basic, "myf") {
+		t.Error("Expected the user function in the completions")
+	}
+
+	// Deleting the definition unregisters the function and recomputes its uses
+	m.Focused = 1
+	_, cmd := m.deleteLine()
+	runCalculations(&m, cmd)
+	if len(userFunctionNames()) != 0 {
+		t.Errorf("Expected no user functions after deleting the definition, got %v", userFunctionNames())
+	}
+	if m.Results[1] == "10" {
+		t.Error("Expected the line using the deleted function to be recomputed")
+	}
+}
+
+func TestLineLabels(t *testing.T) {
+	m := createTestModel()
+	m.loadWorksheet("subtotal: 100 + 20 // before tax\nsubtotal * 2\ntax: subtotal * 0.25\nsubtotal + tax")
+	expected := []string{"", "120", "240", "30", "150"}
+	if !slices.Equal(m.Results, expected) {
+		t.Fatalf("Expected results %q, got %q", expected, m.Results)
+	}
+
+	if _, _, ok := parseLabel("x := 5"); ok {
+		t.Error("Expected an assignment not to be a label")
+	}
+	if _, _, ok := parseLabel("ans1: 5"); ok {
+		t.Error("Expected ans references not to be usable as labels")
+	}
+
+	// Labels aren't position based, so they survive deleting a line above
+	m.Focused = 0
+	_, cmd := m.deleteLine()
+	runCalculations(&m, cmd)
+	expected = []string{"120", "240", "30", "150"}
+	if !slices.Equal(m.Results, expected) {
+		t.Errorf("Expected results %q after deleting a line, got %q", expected, m.Results)
+	}
+	if line, exists := lineLabels(m.inputValues(), len(m.Inputs))["tax"]; !exists || line != 2 {
+		t.Errorf("Expected the tax label on line index 2, got %d", line)
+	}
+
+	display := stripANSIEscapeCodes(m.replaceAnsTokensWithValues(m.Inputs[2].Value(), 2))
+	if display != "tax: 120 * 0.25" {
+		t.Errorf("Expected the label reference to show its value, got %q", display)
+	}
+}
+
+func TestAnsReferencesAboveNine(t *testing.T) {
+	results := make([]string, 11)
+	for i := range results {
+		results[i] = fmt.Sprint(i + 1)
+	}
+	results[0] = "100"
+
+	if result := CalculateExpression("ans10 + ans1", results, 11); result != "110" {
+		t.Errorf("Expected ans10 + ans1 to be 110, got %q", result)
+	}
+	if result := CalculateExpression("ans11 * 2", results, 11); result != "22" {
+		t.Errorf("Expected ans11 * 2 to be 22, got %q", result)
+	}
+
+	m := createTestModel()
+	m.Results = results
+	display := stripANSIEscapeCodes(m.replaceAnsTokensWithValues("ans10 + ans1", 11))
+	if display != "10 + 100" {
+		t.Errorf("Expected ans10 to show its own value, got %q", display)
+	}
+	styled := stripANSIEscapeCodes(m.styleAnsTokens("ans10 + ans1"))
+	if styled != "ans10 + ans1" {
+		t.Errorf("Expected styling to keep the references intact, got %q", styled)
+	}
+}
+
+func TestTruncateMultibyteResult(t *testing.T) {
+	m := createTestModel()
+	for _, tc := range []struct {
+		result string
+		width  int
+	}{
+		{"€1234567.89", 6},
+		{"¥98765432", 5},
+		{"2.5×10⁻¹²", 7},
+		{"１２３４５", 5}, // full-width digits take two cells each
+	} {
+		truncated := m.truncateResult(tc.result, tc.width)
+		if !utf8.ValidString(truncated) || strings.ContainsRune(truncated, utf8.RuneError) {
+			t.Errorf("Expected %q to be cut between whole glyphs, got %q", tc.result, truncated)
+		}
+		if !strings.HasSuffix(truncated, "…") || lipgloss.Width(truncated) > tc.width {
+			t.Errorf("Expected %q to fit %d cells ending in …, got %q", tc.result, tc.width, truncated)
+		}
+	}
+
+	if result := m.truncateResult("€12", 5); result != "€12" {
+		t.Errorf("Expected a fitting result to be unchanged, got %q", result)
+	}
+}
+
+func TestWrapResults(t *testing.T) {
+	m := createTestModel()
+	m.ResultViewport.Width = 10
+	m.InputViewport.Height, m.ResultViewport.Height = 4, 4
+	m.loadWorksheet("factorial(20)\n2 + 2\n3 + 3")
+	m.Results[1] = "1234567890123456789012"
+
+	// Truncated results take a single row
+	if m.lineHeight(1) != 1 {
+		t.Errorf("Expected one row without wrapping, got %d", m.lineHeight(1))
+	}
+
+	m.toggleResultWrapping()
+	_, rows := m.resultRows(1)
+	if !slices.Equal(rows, []string{"1234567890", "1234567890", "12"}) {
+		t.Errorf("Expected the result wrapped over three rows, got %q", rows)
+	}
+
+	// Both panes have the same number of rows so lines stay aligned
+	inputRows, resultRows := m.InputViewport.TotalLineCount(), m.ResultViewport.TotalLineCount()
+	if inputRows != 6 || resultRows != 6 || m.lineRow(len(m.Inputs)) != 6 {
+		t.Errorf("Expected aligned panes of 6 rows, got %d input and %d result rows", inputRows, resultRows)
+	}
+	if m.lineAtRow(3) != 1 || m.lineAtRow(4) != 2 || m.lineAtRow(6) != -1 {
+		t.Errorf("Expected rows to map back to their lines, got %d %d %d", m.lineAtRow(3), m.lineAtRow(4), m.lineAtRow(6))
+	}
+
+	// Scrolling to the last line accounts for the wrapped rows above it
+	m.Focused = 3
+	m.scrollToFocused()
+	if m.InputViewport.YOffset != 2 || m.ResultViewport.YOffset != 2 {
+		t.Errorf("Expected both panes scrolled by 2 rows, got %d and %d", m.InputViewport.YOffset, m.ResultViewport.YOffset)
+	}
+}
+
+func TestPaneRatio(t *testing.T) {
+	m := createTestModel()
+	m.handleWindowResize(tea.WindowSizeMsg{Width: 100, Height: 24})
+	if m.InputViewport.Width != 68 || m.ResultViewport.Width != 28 {
+		t.Errorf("Expected the default 70/30 split, got %d and %d", m.InputViewport.Width, m.ResultViewport.Width)
+	}
+
+	// Cycling moves to the next preset and wraps around
+	m.cyclePaneRatio()
+	if m.PaneRatio != 0.8 || m.InputViewport.Width != 78 || m.ResultViewport.Width != 18 {
+		t.Errorf("Expected an 80/20 split, got %v with %d and %d", m.PaneRatio, m.InputViewport.Width, m.ResultViewport.Width)
+	}
+	m.cyclePaneRatio()
+	if m.PaneRatio != 0.5 || m.inputPaneWidth() != 50 || m.Inputs[0].Width != 50-2-4-3 {
+		t.Errorf("Expected a 50/50 split, got %v with input pane %d", m.PaneRatio, m.inputPaneWidth())
+	}
+
+	// Clicks right of the input pane hit the result pane
+	m.Results[0] = "42"
+	m.Inputs[0].SetValue("40 + 2")
+	m.handleMouseMessage(tea.MouseMsg{X: 55, Y: 1, Type: tea.MouseLeft})
+	if !strings.Contains(m.Inputs[0].Value(), "ans1") {
+		t.Errorf("Expected a click at column 55 to hit the result, got input %q", m.Inputs[0].Value())
+	}
+
+	path := t.TempDir() + "/config.json"
+	if err := os.WriteFile(path, []byte(`{"paneRatio": 1.5}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err := LoadConfig(path); err == nil || cfg.PaneRatio != DefaultPaneRatio {
+		t.Errorf("Expected an out of range ratio to be rejected, got %v (%v)", cfg.PaneRatio, err)
+	}
+}
+
+func TestCalculationTimeoutConfig(t *testing.T) {
+	defer func(old Config) { config = old }(config)
+
+	path := t.TempDir() + "/config.json"
+	if err := os.WriteFile(path, []byte(`{"calculationTimeout": 0.5}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil || cfg.CalculationTimeout != 0.5 {
+		t.Fatalf("Expected a half second timeout, got %v (%v)", cfg.CalculationTimeout, err)
+	}
+	config = cfg
+	if calculationTimeout() != 500*time.Millisecond {
+		t.Errorf("Expected calculations to time out after 500ms, got %v", calculationTimeout())
+	}
+
+	// Calculations waiting past the deadline report the timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	if result := CalculateExpressionWithContext(ctx, "1 + 1", nil, 0); result != ErrorTimeout {
+		t.Errorf("Expected %q, got %q", ErrorTimeout, result)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"calculationTimeout": -1}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err := LoadConfig(path); err == nil || cfg.CalculationTimeout != DefaultCalculationTimeout.Seconds() {
+		t.Errorf("Expected a negative timeout to be rejected, got %v (%v)", cfg.CalculationTimeout, err)
+	}
+}
+
+func TestLoadTheme(t *testing.T) {
+	dir := t.TempDir()
+	theme, err := LoadTheme(dir + "/missing.json")
+	if err != nil || theme != newTheme() {
+		t.Fatalf("Expected the default theme without a file, got %+v (%v)", theme, err)
+	}
+
+	path := dir + "/theme.json"
+	content := `{"focusedColor": "#ff8800", "ansColor": "205", "borderColor": "#12345", "resultBg": "300", "shadow": "1"}`
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	theme, err = LoadTheme(path)
+	if theme.focusedColor != "#ff8800" || theme.ansColor != "205" {
+		t.Errorf("Expected the configured colors, got %+v", theme)
+	}
+
+	// Absent and invalid colors keep their defaults
+	defaults := newTheme()
+	if theme.resultColor != defaults.resultColor || theme.borderColor != defaults.borderColor || theme.resultBg != defaults.resultBg {
+		t.Errorf("Expected default colors for absent and invalid fields, got %+v", theme)
+	}
+	for _, want := range []string{"borderColor", "resultBg", "shadow"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected an error mentioning %s, got %v", want, err)
+		}
+	}
+}
+
+func TestPlainResults(t *testing.T) {
+	defer SetPrettyPrint(true)
+	defer func(old Config) { config = old }(config)
+	defer func(old func(string) error) { writeClipboard = old }(writeClipboard)
+	var copied string
+	writeClipboard = func(text string) error {
+		copied = text
+		return nil
+	}
+
+	tests := []struct {
+		result   string
+		expected string
+	}{
+		{"1.23 × 10⁻⁴", "1.23E-4"},
+		{"1.5 × 10²", "1.5E2"},
+		{"x²", "x^2"},
+		{"5 m²/s⁻¹", "5 m^2/s^-1"},
+		{"42", "42"},
+	}
+	for _, tt := range tests {
+		if result := plainResult(tt.result); result != tt.expected {
+			t.Errorf("plainResult(%q) = %q, expected %q", tt.result, result, tt.expected)
+		}
+	}
+
+	m := createTestModel()
+	m.loadWorksheet("1.5E2 * 1000\nx^2")
+	pretty := slices.Clone(m.Results)
+	m.togglePlainResults()
+	if !m.PlainResults || m.Results[1] != plainResult(pretty[1]) || m.Results[2] != plainResult(pretty[2]) {
+		t.Errorf("Expected ASCII results for %q, got %q", pretty, m.Results)
+	}
+
+	// Copying can skip the superscripts while they are shown
+	m.togglePlainResults()
+	config.CopyPlainResults = true
+	m.Inputs[m.Focused].Blur()
+	m.Focused = 2
+	m.Inputs[m.Focused].Focus()
+	m.copyFocusedResult()
+	if copied != "x^2" {
+		t.Errorf("Expected the plain result to be copied, got %q", copied)
+	}
+}
+
+// TestBaseLiterals tests hexadecimal, binary and octal input
+func TestBaseLiterals(t *testing.T) {
+	if prepared := prepareString("0xFF + 0b1010 // mixed"); strings.TrimSpace(prepared) != "0xFF + 0b1010" {
+		t.Errorf("Expected the literals to pass through, got %q", prepared)
+	}
+	if prepared := prepareString("0XFF + 0B11 + 0O7"); prepared != "0xFF + 0b11 + 0o7" {
+		t.Errorf("Expected lower case prefixes, got %q", prepared)
+	}
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"0xFF", "255"},
+		{"0b1010", "10"},
+		{"0o17", "15"},
+		{"0xFF + 0b1010", "265"},
+		{"0x10 * 0b10 + 0o10", "40"},
+		{"0XFF", "255"},
+	}
+	for _, tt := range tests {
+		if result := CalculateExpression(tt.input, []string{""}, 0); result != tt.expected {
+			t.Errorf("CalculateExpression(%q) = %q, expected %q", tt.input, result, tt.expected)
+		}
+	}
+
+	// Results in the output base read back as literals
+	defer SetOutputBase(10)
+	m := createTestModel()
+	m.loadWorksheet("0b1010 + 0o2\nans + 0x1")
+	m.cycleOutputBase()
+	if m.Results[1] != "0xC" || m.Results[2] != "0xD" {
+		t.Errorf("Expected hex results chaining through ans, got %q", m.Results)
+	}
+}
+
+func TestOutputBase(t *testing.T) {
+	defer SetOutputBase(10)
+
+	if result := prettyPrint("0x1E5"); result != "0x1E5" {
+		t.Errorf("Expected a hex result to be kept, got %q", result)
+	}
+	if result := prettyPrint("0x1E5 + 2E5"); result != "0x1E5 + 2 × 10⁵" {
+		t.Errorf("Expected only the decimal to become scientific, got %q", result)
+	}
+
+	m := createTestModel()
+	m.loadWorksheet("255\nans + 1\n10 to dec")
+	m.cycleOutputBase()
+	if outputBases[m.OutputBase].name != "hex" {
+		t.Fatalf("Expected hex after one cycle, got %s", outputBases[m.OutputBase].name)
+	}
+	expected := []string{"", "0xFF", "0x100", "10"}
+	if !slices.Equal(m.Results, expected) {
+		t.Errorf("Expected results %q in hex, got %q", expected, m.Results)
+	}
+	if view := m.View(); !strings.Contains(view, " hex ") {
+		t.Error("Expected the output base in the status bar")
+	}
+
+	// Cycling through all bases returns to decimal
+	for range len(outputBases) - 1 {
+		m.cycleOutputBase()
+	}
+	expected = []string{"", "255", "256", "10"}
+	if m.OutputBase != 0 || !slices.Equal(m.Results, expected) {
+		t.Errorf("Expected decimal results %q, got %q", expected, m.Results)
+	}
+}
+
+func TestAngleUnitCycle(t *testing.T) {
+	defer SetAngleUnit(AngleUnitRadians)
+
+	m := createTestModel()
+	m.applySessionSettings(DefaultSessionSettings())
+	m.loadWorksheet("2 + 2\nsin(30)\nans * 2")
+	if m.Results[2] == "0.5" {
+		t.Fatalf("Expected sin(30) in radians, got %q", m.Results[2])
+	}
+
+	m.cycleAngleUnit()
+	if m.Session.AngleUnit != AngleUnitDegrees {
+		t.Fatalf("Expected degrees after one cycle, got %v", m.Session.AngleUnit)
+	}
+	expected := []string{"", "4", "0.5", "1"}
+	if !slices.Equal(m.Results, expected) {
+		t.Errorf("Expected results %q in degrees, got %q", expected, m.Results)
+	}
+	if !strings.Contains(m.View(), "DEG") {
+		t.Error("Expected the angle unit in the result pane border")
+	}
+
+	m.cycleAngleUnit()
+	m.cycleAngleUnit()
+	if m.Session.AngleUnit != AngleUnitRadians {
+		t.Errorf("Expected the cycle to return to radians, got %v", m.Session.AngleUnit)
+	}
+
+	path := t.TempDir() + "/config.json"
+	if err := os.WriteFile(path, []byte(`{"angleUnit": "turns"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err := LoadConfig(path); err == nil || cfg.AngleUnit != "rad" {
+		t.Errorf("Expected an unknown angle unit to be rejected, got %q (%v)", cfg.AngleUnit, err)
+	}
+}
+
+func TestFractionMode(t *testing.T) {
+	defer SetFractionMode(false)
+
+	m := createTestModel()
+	m.loadWorksheet("1/3\n0.25 + 0.5\nans2 * 3\n1/3 USD")
+	m.toggleFractionMode()
+	if !m.FractionMode || !strings.Contains(m.View(), "frac") {
+		t.Error("Expected fraction mode to be shown in the result pane border")
+	}
+	expected := []string{"", "1/3", "3/4", "1"}
+	if !slices.Equal(m.Results[:4], expected) {
+		t.Errorf("Expected fraction results %q, got %q", expected, m.Results[:4])
+	}
+	if strings.Contains(m.Results[4], "/") || !strings.Contains(m.Results[4], "0.33") {
+		t.Errorf("Expected the currency result in decimals, got %q", m.Results[4])
+	}
+
+	if result := decimalCurrency("1/3 $"); result != "0.33 $" {
+		t.Errorf("Expected 1/3 $ as 0.33 $, got %q", result)
+	}
+	if result := decimalCurrency("2/3 m"); result != "2/3 m" {
+		t.Errorf("Expected non-currency fractions to be kept, got %q", result)
+	}
+
+	m.toggleFractionMode()
+	if m.Results[1] != "0.333333333" {
+		t.Errorf("Expected decimal results again, got %q", m.Results[1])
+	}
+}
+
+func TestEngineeringMode(t *testing.T) {
+	defer func() { engineeringMode = false }()
+
+	tests := []struct {
+		result   string
+		expected string
+	}{
+		{"4700", "4.7k"},
+		{"2200000", "2.2M"},
+		{"0.0047", "4.7m"},
+		{"−1500", "−1.5k"},
+		{"47", "47"},
+		{"1.5 × 10⁻⁷", "150n"},
+		{"1 × 10⁴⁰", "1 × 10⁴⁰"},
+		{"0", "0"},
+		{"5 km", "5 km"},
+	}
+	for _, tt := range tests {
+		if result := formatEngineering(tt.result); result != tt.expected {
+			t.Errorf("formatEngineering(%q) = %q, expected %q", tt.result, result, tt.expected)
+		}
+	}
+
+	m := createTestModel()
+	m.loadWorksheet("4700\nans2 * 2")
+	m.toggleEngineeringMode()
+	view := m.View()
+	if !m.EngineeringMode || !strings.Contains(view, "eng") || !strings.Contains(view, "9.4k") {
+		t.Error("Expected engineering results and mode in the status bar")
+	}
+	// ans references chain on the full number
+	if m.Results[2] != "9400" {
+		t.Errorf("Expected the stored result to stay 9400, got %q", m.Results[2])
+	}
+
+	m.toggleEngineeringMode()
+	if strings.Contains(m.View(), "9.4k") {
+		t.Error("Expected plain results again")
+	}
+}
+
+func TestSavedSession(t *testing.T) {
+	path := t.TempDir() + "/nasc/session.txt"
+	if content, err := loadSavedSession(path); content != "" || err != nil {
+		t.Fatalf("Expected no session before one is saved, got %q (%v)", content, err)
+	}
+
+	m := createTestModel()
+	m.restoreWorksheet("price := 40\n//@ twice the price\nprice * 2 // doubled")
+	if err := m.saveSession(path); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := loadSavedSession(path)
+	if err != nil || content != "price := 40\n//@ twice the price\nprice * 2 // doubled" {
+		t.Fatalf("Expected the saved lines, got %q (%v)", content, err)
+	}
+
+	// Reloading recalculates the saved lines
+	restored := createTestModel()
+	restored.restoreWorksheet(content)
+	if !slices.Equal(restored.Results, []string{"40", "80"}) {
+		t.Errorf("Expected the restored lines to be calculated, got %q", restored.Results)
+	}
+	if restored.lineNote(1) != "twice the price" {
+		t.Errorf("Expected the note to be restored, got %q", restored.Notes)
+	}
+
+	// ans references count from the first restored line
+	restored = createTestModel()
+	restored.restoreWorksheet("40\nans1 * 2")
+	if !slices.Equal(restored.Results, []string{"40", "80"}) || restored.canUndo() {
+		t.Errorf("Expected ans1 to reference the first restored line, got %q", restored.Results)
+	}
+}
+
+// TestSavedUndoHistory tests that edits of a saved session can be undone after restoring it
+func TestSavedUndoHistory(t *testing.T) {
+	path := t.TempDir() + "/nasc/session.txt"
+
+	m := createTestModel()
+	m.restoreWorksheet("price := 40")
+	m.saveState()
+	m.Inputs[0].SetValue("price := 50")
+	if err := m.saveSession(path); err != nil {
+		t.Fatal(err)
+	}
+
+	content, _ := loadSavedSession(path)
+	restored := createTestModel()
+	restored.restoreWorksheet(content)
+	if err := restored.restoreUndoHistory(path, content); err != nil {
+		t.Fatal(err)
+	}
+	if !restored.undo() || restored.Inputs[0].Value() != "price := 40" {
+		t.Errorf("Expected to undo the edit made before saving, got %q", restored.inputValues())
+	}
+
+	// History of lines changed since it was saved is discarded
+	other := createTestModel()
+	other.restoreWorksheet("1 + 1")
+	if err := other.restoreUndoHistory(path, "1 + 1"); err != nil || other.canUndo() {
+		t.Errorf("Expected history of other lines to be discarded (%v)", err)
+	}
+
+	// So is history saved in another format
+	data := `{"version": 0, "worksheet": "price := 50", "undo": [{"inputs": ["x"]}]}`
+	if err := os.WriteFile(undoHistoryPath(path), []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	other = createTestModel()
+	if err := other.restoreUndoHistory(path, "price := 50"); err != nil || other.canUndo() {
+		t.Errorf("Expected history of another version to be discarded (%v)", err)
+	}
+
+	// Saved history keeps no more states than the undo limit
+	limited := createTestModel()
+	limited.UndoSystem = NewUndoSystemWithSize(2)
+	for range 5 {
+		limited.saveState()
+	}
+	if err := limited.saveSession(path); err != nil {
+		t.Fatal(err)
+	}
+	limited.UndoSystem = NewUndoSystemWithSize(1)
+	if err := limited.restoreUndoHistory(path, ""); err != nil || len(limited.UndoSystem.undoStack) != 1 {
+		t.Errorf("Expected the history to be trimmed to the undo limit, got %d states (%v)", len(limited.UndoSystem.undoStack), err)
+	}
+}
+
+func TestEvaluateExpressions(t *testing.T) {
+	var stdout, stderr strings.Builder
+	code := evaluateExpressions([]string{"2+2", "ans * 10", "rate := 0.5", "ans2 * rate"}, &stdout, &stderr)
+	if code != 0 || stdout.String() != "4\n40\n0.5\n20\n" || stderr.Len() != 0 {
+		t.Errorf("Expected chained results and exit code 0, got %q, %q and %d", stdout.String(), stderr.String(), code)
+	}
+
+	stdout.Reset()
+	code = evaluateExpressions([]string{"1 +* 2", "3 * 3"}, &stdout, &stderr)
+	if code == 0 || stderr.Len() == 0 {
+		t.Errorf("Expected a failed calculation to give a non-zero exit code, got %d", code)
+	}
+	if stdout.String() != "9\n" {
+		t.Errorf("Expected the other expressions to still be printed, got %q", stdout.String())
+	}
+}
+
+func TestEvaluateExpressionsJSON(t *testing.T) {
+	var stdout, stderr strings.Builder
+	code := evaluateExpressionsJSON(worksheetLines("2+2\n\n  ans * 3  \n1 +* 2\n"), &stdout, &stderr)
+	if code == 0 {
+		t.Error("Expected a non-zero exit code with a failed calculation")
+	}
+
+	var entries []jsonResult
+	if err := json.Unmarshal([]byte(stdout.String()), &entries); err != nil {
+		t.Fatalf("Expected a JSON array, got %q: %v", stdout.String(), err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Expected one entry per non-empty line, got %+v", entries)
+	}
+	if entries[0] != (jsonResult{Expression: "2+2", Result: "4"}) || entries[1] != (jsonResult{Expression: "ans * 3", Result: "12"}) {
+		t.Errorf("Expected chained results, got %+v", entries[:2])
+	}
+	if entries[2].Result != "" || entries[2].Error == "" {
+		t.Errorf("Expected an error field for the failed calculation, got %+v", entries[2])
+	}
+}
+
+func TestCopyWorksheet(t *testing.T) {
+	defer func(old func(string) error) { writeClipboard = old }(writeClipboard)
+	var copied string
+	writeClipboard = func(text string) error {
+		copied = text
+		return nil
+	}
+
+	m := createTestModel()
+	m.loadWorksheet("2 + 2\n// totals\n10 | 3\nans1 * 100")
+	m.Results[3], m.Results[4] = "11", "\x1b[1m400\x1b[0m"
+
+	m.handleKeyMessage(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("c"), Alt: true})
+	if copied != "4\n11\n400" {
+		t.Errorf("Expected all non-empty results as plain text, got %q", copied)
+	}
+
+	m.copyText(m.pairsText(false))
+	expected := "2 + 2      = 4\n// totals\n10 | 3     = 11\nans1 * 100 = 400"
+	if copied != expected {
+		t.Errorf("Expected aligned pairs %q, got %q", expected, copied)
+	}
+
+	m.copyText(m.pairsText(true))
+	if !strings.HasPrefix(copied, "| Expression | Result |") || !strings.Contains(copied, `| 10 \| 3 |`) {
+		t.Errorf("Expected a Markdown table with escaped pipes, got %q", copied)
+	}
+}
+
+func TestExportWorksheet(t *testing.T) {
+	m := createTestModel()
+	m.loadWorksheet("price := 1200 EUR\nprice * 1.19, rounded\n// notes")
+	m.Results[1], m.Results[2] = "1200 €", "\x1b[1m1428 €\x1b[0m"
+
+	dir := t.TempDir()
+	read := func(name string) string {
+		if err := m.exportWorksheet(dir + "/" + name); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(dir + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	text := "price := 1200 EUR     = 1200 €\nprice * 1.19, rounded = 1428 €\n// notes\n"
+	if content := read("sheet.txt"); content != text {
+		t.Errorf("Expected aligned text %q, got %q", text, content)
+	}
+	if content := read("sheet.md"); !strings.Contains(content, "| price * 1.19, rounded | 1428 € |") {
+		t.Errorf("Expected a Markdown table row, got %q", content)
+	}
+
+	csvText := "expression,result\nprice := 1200 EUR,1200 €\n\"price * 1.19, rounded\",1428 €\n// notes,\n"
+	if content := read("sheet.csv"); content != csvText {
+		t.Errorf("Expected CSV %q, got %q", csvText, content)
+	}
+}
+
+func TestDuplicateLine(t *testing.T) {
+	m := createTestModel()
+	m.loadWorksheet("5\nans * 2\n1 + 1")
+	m.Inputs[m.Focused].Blur()
+	m.Focused = 2
+	m.Inputs[m.Focused].Focus()
+
+	_, cmd := m.handleKeyMessage(tea.KeyMsg{Type: tea.KeyCtrlU})
+	runCalculations(&m, cmd)
+	if m.Focused != 3 || m.Inputs[3].Value() != "ans * 2" || m.Inputs[3].Position() != len("ans * 2") {
+		t.Fatalf("Expected the copy focused below the line, got line %d %q", m.Focused, m.Inputs[3].Value())
+	}
+	// The copy doubles the result above it
+	expected := []string{"", "5", "10", "20", "2"}
+	if !slices.Equal(m.Results, expected) {
+		t.Errorf("Expected results %q, got %q", expected, m.Results)
+	}
+
+	if !m.undo() || len(m.Inputs) != 4 {
+		t.Errorf("Expected the duplication to be undoable, got %d lines", len(m.Inputs))
+	}
+}
+
+func TestCreateLineAbove(t *testing.T) {
+	m := createTestModel()
+	m.loadWorksheet("2\n10\nans3 * 3")
+	m.setNote(1, "base")
+	m.Inputs[m.Focused].Blur()
+	m.Focused = 1
+	m.Inputs[m.Focused].Focus()
+
+	_, cmd := m.handleKeyMessage(tea.KeyMsg{Type: tea.KeyEnter, Alt: true})
+	runCalculations(&m, cmd)
+	if m.Focused != 1 || m.Inputs[1].Value() != "" || m.Inputs[2].Value() != "2" || m.lineNote(2) != "base" {
+		t.Fatalf("Expected an empty line focused above the line with its note, got line %d %q", m.Focused, m.Inputs[1].Value())
+	}
+	// ans3 now refers to the line holding 2
+	expected := []string{"", "", "2", "10", "6"}
+	if !slices.Equal(m.Results, expected) {
+		t.Errorf("Expected results %q, got %q", expected, m.Results)
+	}
+
+	if !m.undo() || len(m.Inputs) != 4 {
+		t.Errorf("Expected the insertion to be undoable, got %d lines", len(m.Inputs))
+	}
+}
+
+func TestToggleComment(t *testing.T) {
+	m := createTestModel()
+	m.loadWorksheet("5\n10\nans * 2")
+	m.Inputs[m.Focused].Blur()
+	m.Focused = 2
+	m.Inputs[m.Focused].Focus()
+
+	_, cmd := m.handleKeyMessage(tea.KeyMsg{Type: tea.KeyCtrlUnderscore})
+	runCalculations(&m, cmd)
+	if m.Inputs[2].Value() != "// 10" {
+		t.Fatalf("Expected the line commented out, got %q", m.Inputs[2].Value())
+	}
+	// ans skips the commented line
+	expected := []string{"", "5", "", "10"}
+	if !slices.Equal(m.Results, expected) {
+		t.Errorf("Expected results %q with the line commented, got %q", expected, m.Results)
+	}
+
+	_, cmd = m.handleKeyMessage(tea.KeyMsg{Type: tea.KeyCtrlUnderscore})
+	runCalculations(&m, cmd)
+	expected = []string{"", "5", "10", "20"}
+	if m.Inputs[2].Value() != "10" || !slices.Equal(m.Results, expected) {
+		t.Errorf("Expected the comment removed with results %q, got %q %q", expected, m.Inputs[2].Value(), m.Results)
+	}
+
+	if !m.undo() || m.Inputs[2].Value() != "// 10" {
+		t.Errorf("Expected toggling to be undoable, got %q", m.Inputs[2].Value())
+	}
+}
+
+func TestLineSelection(t *testing.T) {
+	defer func(old func(string) error) { writeClipboard = old }(writeClipboard)
+	var copied string
+	writeClipboard = func(text string) error {
+		copied = text
+		return nil
+	}
+
+	m := createTestModel()
+	m.loadWorksheet("1\n2\n3\n4")
+	m.Inputs[m.Focused].Blur()
+	m.Focused = 1
+	m.Inputs[m.Focused].Focus()
+
+	m.handleKeyMessage(tea.KeyMsg{Type: tea.KeyShiftDown})
+	m.handleKeyMessage(tea.KeyMsg{Type: tea.KeyShiftDown})
+	if first, last, selecting := m.selectedLines(); !selecting || first != 1 || last != 3 || !strings.Contains(m.statusText(), "3 selected") {
+		t.Fatalf("Expected lines 1 to 3 selected, got %d to %d (%v)", first, last, selecting)
+	}
+
+	m.handleKeyMessage(tea.KeyMsg{Type: tea.KeyCtrlS})
+	if copied != "1\n2\n3" {
+		t.Errorf("Expected the selected results copied, got %q", copied)
+	}
+
+	_, cmd := m.handleKeyMessage(tea.KeyMsg{Type: tea.KeyCtrlUnderscore})
+	runCalculations(&m, cmd)
+	for i := 1; i <= 3; i++ {
+		if !isCommented(m.Inputs[i].Value()) || m.Results[i] != "" {
+			t.Errorf("Expected line %d commented out, got %q = %q", i, m.Inputs[i].Value(), m.Results[i])
+		}
+	}
+	m.undo()
+	if m.Inputs[1].Value() != "1" || m.Inputs[3].Value() != "3" {
+		t.Errorf("Expected one undo to restore all lines, got %q and %q", m.Inputs[1].Value(), m.Inputs[3].Value())
+	}
+
+	m.handleKeyMessage(tea.KeyMsg{Type: tea.KeyCtrlD})
+	if len(m.Inputs) != 2 || m.Inputs[1].Value() != "4" || m.Focused != 1 || m.Selecting {
+		t.Fatalf("Expected the selected lines deleted, got %d lines focused on %d", len(m.Inputs), m.Focused)
+	}
+	m.undo()
+	if len(m.Inputs) != 5 {
+		t.Errorf("Expected one undo to restore the deleted lines, got %d lines", len(m.Inputs))
+	}
+
+	// Other keys end the selection
+	m.handleKeyMessage(tea.KeyMsg{Type: tea.KeyShiftUp})
+	m.handleKeyMessage(tea.KeyMsg{Type: tea.KeyDown})
+	if m.Selecting {
+		t.Error("Expected moving without Shift to end the selection")
+	}
+}
+
+func TestMoveLine(t *testing.T) {
+	m := createTestModel()
+	m.loadWorksheet("2\n10\nans * 3")
+	m.setNote(3, "triple")
+	m.Inputs[m.Focused].Blur()
+	m.Focused = 3
+	m.Inputs[m.Focused].Focus()
+
+	_, cmd := m.handleKeyMessage(tea.KeyMsg{Type: tea.KeyUp, Alt: true})
+	runCalculations(&m, cmd)
+	if m.Focused != 2 || m.Inputs[2].Value() != "ans * 3" || m.lineNote(2) != "triple" {
+		t.Fatalf("Expected the line with its note moved up and focused, got line %d %q", m.Focused, m.Inputs[2].Value())
+	}
+	expected := []string{"", "2", "6", "10"}
+	if !slices.Equal(m.Results, expected) {
+		t.Errorf("Expected results %q after moving up, got %q", expected, m.Results)
+	}
+
+	_, cmd = m.handleKeyMessage(tea.KeyMsg{Type: tea.KeyDown, Alt: true})
+	runCalculations(&m, cmd)
+	expected = []string{"", "2", "10", "30"}
+	if m.Focused != 3 || !slices.Equal(m.Results, expected) {
+		t.Errorf("Expected results %q after moving back down, got %q", expected, m.Results)
+	}
+
+	// The last line can't move further down
+	m.moveLine(1)
+	if m.Focused != 3 {
+		t.Errorf("Expected the last line to stay, got focus on %d", m.Focused)
+	}
+
+	m.undo()
+	if m.Inputs[2].Value() != "ans * 3" {
+		t.Errorf("Expected undo to restore the previous order, got %q", m.Inputs[2].Value())
+	}
+}
+
+func TestCurrencyCodesInWords(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"5 USD", "5 $"},
+		{"10 EUR + 2 GBP", "10 € + 2 £"},
+		{"EURO", "EURO"},
+		{"USDT", "USDT"},
+		{"my_JPY", "my_JPY"},
+	}
+	for _, tt := range tests {
+		if result := postString(tt.input); result != tt.expected {
+			t.Errorf("postString(%q) = %q, expected %q", tt.input, result, tt.expected)
+		}
+	}
+
+	// Symbols next to names stay apart from them
+	if result := replaceCurrencySymbols("$rate + 5$ + €10"); result != "USD rate + 5USD + EUR10" {
+		t.Errorf("Expected currency codes kept apart from names, got %q", result)
+	}
+}
+
+func TestCurrencySymbolConfig(t *testing.T) {
+	defer func(old Config) { config = old }(config)
+
+	// Longer symbols are read before the symbols they contain
+	if result := replaceCurrencySymbols("R$5 + ₹10"); result != "BRL5 + INR10" {
+		t.Errorf("Expected the built-in symbols replaced, got %q", result)
+	}
+
+	path := t.TempDir() + "/config.json"
+	if err := os.WriteFile(path, []byte(`{"currencySymbols": {"¥": "CNY", "kr": "SEK"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	config = cfg
+
+	if result := replaceCurrencySymbols("¥100 + 5 kr + kroner"); result != "CNY100 + 5 SEK + kroner" {
+		t.Errorf("Expected the configured symbols replaced, got %q", result)
+	}
+	if result := postString("100 CNY"); result != "100 ¥" {
+		t.Errorf("Expected yuan shown with ¥, got %q", result)
+	}
+	if result := postString("100 JPY"); result != "100 JPY" {
+		t.Errorf("Expected yen shown by its code once ¥ is yuan, got %q", result)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"currencySymbols": {"¥": "yuan"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err := LoadConfig(path); err == nil || cfg.CurrencySymbols != nil {
+		t.Errorf("Expected an invalid currency code to be rejected, got %v", cfg.CurrencySymbols)
+	}
+}
+
+// TestDefaultCurrency tests converting the focused line to the configured currency
+func TestDefaultCurrency(t *testing.T) {
+	defer func(old Config) { config = old }(config)
+
+	path := t.TempDir() + "/config.json"
+	if err := os.WriteFile(path, []byte(`{"defaultCurrency": "euro"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err := LoadConfig(path); err == nil || cfg.DefaultCurrency != "" {
+		t.Errorf("Expected an invalid currency code to be rejected, got %q", cfg.DefaultCurrency)
+	}
+
+	m := createTestModel()
+	m.Inputs[0].SetValue("100")
+	m.Results[0] = "100"
+	m.convertToDefaultCurrency()
+	if !m.ShowPopup || m.Inputs[0].Value() != "100" {
+		t.Fatal("Expected to be asked to configure the currency")
+	}
+	m.closePopup()
+
+	config.DefaultCurrency = "EUR"
+	for _, tt := range []struct {
+		input    string
+		result   string
+		expected string
+	}{
+		{"100", "100", "100 EUR"},
+		{"2 * 50 // total", "100", "(2 * 50) EUR"},
+		{"$5 + $3", "8 $", "$5 + $3 to EUR"},
+		{"$5 to EUR", "4.6 €", "$5 to EUR"},
+		{"1 +* 2", ErrorExpressionInvalid, "1 +* 2"},
+	} {
+		m.Inputs[0].SetValue(tt.input)
+		m.Results[0] = tt.result
+		m.convertToDefaultCurrency()
+		if value := m.Inputs[0].Value(); value != tt.expected {
+			t.Errorf("Expected %q to become %q, got %q", tt.input, tt.expected, value)
+		}
+	}
+}
+
+func TestResultTotals(t *testing.T) {
+	results := []string{"", "5", "2.5 €", "10 m", "−1.5", "$3", "1 €", "1.5 × 10²"}
+	expected := []string{"153.5", "3.5 €", "3 $"}
+	if totals := resultTotals(results); !slices.Equal(totals, expected) {
+		t.Errorf("Expected totals %q, got %q", expected, totals)
+	}
+
+	if value, symbol, ok := parseResultAmount("-R$ 12.5"); !ok || value != -12.5 || symbol != "R$" {
+		t.Errorf("Expected -12.5 R$, got %v %q %v", value, symbol, ok)
+	}
+	if _, _, ok := parseResultAmount("5 kg"); ok {
+		t.Error("Expected results with units not to be amounts")
+	}
+
+	m := createTestModel()
+	m.loadWorksheet("2\n3.5")
+	if strings.Contains(m.View(), "Σ") {
+		t.Error("Expected no total before it is shown")
+	}
+	m.handleKeyMessage(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("T"), Alt: true})
+	if !strings.Contains(m.View(), "Σ 5.5") {
+		t.Errorf("Expected the total in the result pane, got:\n%s", m.View())
+	}
+}
+
+func TestResultCache(t *testing.T) {
+	cache := newLRUCache(2)
+	cache.Put("a", "1")
+	cache.Put("b", "2")
+	cache.Get("a")
+	cache.Put("c", "3")
+	if _, exists := cache.Get("b"); exists {
+		t.Error("Expected the least recently used entry to be evicted")
+	}
+	if value, exists := cache.Get("a"); !exists || value != "1" {
+		t.Errorf("Expected the recently used entry to be kept, got %q", value)
+	}
+
+	resultCache.Clear()
+	if result := CalculateExpression("12 * 12", []string{""}, 0); result != "144" {
+		t.Fatalf("Expected 144, got %q", result)
+	}
+	if cached, exists := resultCache.Get("12 * 12"); !exists || cached != "144" {
+		t.Errorf("Expected the result to be cached, got %q", cached)
+	}
+	if result := CalculateExpression("12 * 12", []string{""}, 0); result != "144" {
+		t.Errorf("Expected the cached result 144, got %q", result)
+	}
+
+	// Changing how libqalculate calculates invalidates the cache
+	SetPrecision(DefaultSessionSettings().Precision)
+	if resultCache.Len() != 0 {
+		t.Errorf("Expected a precision change to clear the cache, got %d entries", resultCache.Len())
+	}
+
+	CalculateExpression("now()", []string{""}, 0)
+	if _, exists := resultCache.Get("now()"); exists {
+		t.Error("Expected values changing over time not to be cached")
+	}
+}
+
+func TestHelpSearch(t *testing.T) {
+	m := createTestModel()
+	m.openHelp()
+	m.HelpViewport.Height = 5
+
+	m.handleKeyMessage(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("/")})
+	for _, r := range "ALT+" {
+		m.handleKeyMessage(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{r}})
+	}
+	expected := helpMatchLines(helpText, "alt+")
+	if len(expected) < 2 || !slices.Equal(m.HelpMatches, expected) {
+		t.Fatalf("Expected the lines mentioning Alt+ to match case-insensitively, got %v", m.HelpMatches)
+	}
+	if m.HelpViewport.YOffset != expected[0] {
+		t.Errorf("Expected the help scrolled to line %d, got %d", expected[0], m.HelpViewport.YOffset)
+	}
+
+	// Enter ends typing, n and N jump between the matches
+	m.handleKeyMessage(tea.KeyMsg{Type: tea.KeyEnter})
+	m.handleKeyMessage(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("n")})
+	if m.HelpMatch != 1 || !strings.Contains(m.helpTitle(), fmt.Sprintf("2/%d", len(expected))) {
+		t.Errorf("Expected n to move to the second match, got %d in %q", m.HelpMatch, m.helpTitle())
+	}
+	m.handleKeyMessage(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("N")})
+	m.handleKeyMessage(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("N")})
+	if m.HelpMatch != len(expected)-1 {
+		t.Errorf("Expected N to wrap around to the last match, got %d", m.HelpMatch)
+	}
+	if !m.ShowHelp {
+		t.Error("Expected the help to stay open while searching")
+	}
+}
+
+func TestFuzzyCompletions(t *testing.T) {
+	ranked := rankCompletions([]string{"asin", "sqrt", "sinh", "snap", "sin"}, "sn")
+	expected := []string{"snap", "sinh", "sin", "asin"}
+	if !slices.Equal(ranked, expected) {
+		t.Errorf("Expected prefixes first, then fuzzy matches by score %q, got %q", expected, ranked)
+	}
+	if ranked := rankCompletions([]string{"asin", "sin"}, "s"); !slices.Equal(ranked, []string{"sin"}) {
+		t.Errorf("Expected a single letter to only match prefixes, got %q", ranked)
+	}
+
+	completions := GetCompletions("intg", []string{"", "5", ""})
+	if !slices.Contains(completions, "integrate") {
+		t.Errorf("Expected integrate for the abbreviation intg, got %v", completions)
+	}
+	if completions = GetCompletions("2 * a", []string{"", "5", ""}); len(completions) == 0 || completions[0] != ansKeyword() {
+		t.Errorf("Expected ans pinned at the top, got %v", completions)
+	}
+}
+
+func TestMouseWheelScroll(t *testing.T) {
+	m := createTestModel()
+	m.loadWorksheet(strings.Repeat("1\n", 29) + "1")
+	m.InputViewport.Height, m.ResultViewport.Height = 10, 10
+	m.updateViewports()
+	m.InputViewport.SetYOffset(0)
+	m.ResultViewport.SetYOffset(0)
+	focused := m.Focused
+
+	m.handleMouseMessage(tea.MouseMsg{Type: tea.MouseWheelDown})
+	if m.InputViewport.YOffset != 3 || m.ResultViewport.YOffset != 3 {
+		t.Errorf("Expected both panes scrolled to row 3, got %d and %d", m.InputViewport.YOffset, m.ResultViewport.YOffset)
+	}
+	if m.Focused != focused {
+		t.Errorf("Expected the focus to stay on line %d, got %d", focused, m.Focused)
+	}
+
+	// Scrolling stops at the content bounds
+	for range 20 {
+		m.handleMouseMessage(tea.MouseMsg{Type: tea.MouseWheelDown})
+	}
+	if m.InputViewport.YOffset != 21 || m.ResultViewport.YOffset != 21 {
+		t.Errorf("Expected the panes to stop at the last line, got %d and %d", m.InputViewport.YOffset, m.ResultViewport.YOffset)
+	}
+	for range 20 {
+		m.handleMouseMessage(tea.MouseMsg{Type: tea.MouseWheelUp})
+	}
+	if m.InputViewport.YOffset != 0 || m.ResultViewport.YOffset != 0 {
+		t.Errorf("Expected the panes to stop at the first line, got %d and %d", m.InputViewport.YOffset, m.ResultViewport.YOffset)
+	}
+}
+
+func TestWideGutter(t *testing.T) {
+	m := createTestModel()
+	m.loadWorksheet(strings.Repeat("1\n", 119) + "1")
+	if m.gutterWidth() != 5 {
+		t.Fatalf("Expected a 5 cell gutter for 121 lines, got %d", m.gutterWidth())
+	}
+
+	// The separators stay aligned past line 99
+	lines := strings.Split(stripANSIEscapeCodes(m.InputViewport.View()), "\n")
+	for _, line := range lines {
+		if line != "" && strings.IndexRune(line, '│') != 3 {
+			t.Fatalf("Expected the separator after three digits, got %q", line)
+		}
+	}
+
+	// Clicks account for the wider gutter
+	m.Inputs[50].SetValue("12345")
+	m.InputViewport.SetYOffset(50)
+	m.handleMouseMessage(tea.MouseMsg{Type: tea.MouseLeft, X: m.gutterWidth() + 2 + 3, Y: 1})
+	if m.Focused != 50 || m.Inputs[50].Position() != 3 {
+		t.Errorf("Expected the cursor at position 3 of line 51, got line %d position %d", m.Focused+1, m.Inputs[m.Focused].Position())
+	}
+}
+
+func TestKeymap(t *testing.T) {
+	defer func(old Config) { config = old }(config)
+
+	path := t.TempDir() + "/config.json"
+	if err := os.WriteFile(path, []byte(`{"keys": {"help": "f1", "sqrt": ""}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.Keys.Help != "f1" || cfg.Keys.Undo != "ctrl+z" {
+		t.Errorf("Expected help remapped and the other keys kept, got %+v", cfg.Keys)
+	}
+	config = cfg
+
+	m := createTestModel()
+	m.handleKeyMessage(tea.KeyMsg{Type: tea.KeyCtrlH})
+	if m.ShowHelp {
+		t.Error("Expected Ctrl+H to no longer open the help")
+	}
+	m.handleKeyMessage(tea.KeyMsg{Type: tea.KeyF1})
+	if !m.ShowHelp {
+		t.Error("Expected F1 to open the help")
+	}
+	m.ShowHelp = false
+	m.handleKeyMessage(tea.KeyMsg{Type: tea.KeyCtrlR})
+	if m.Inputs[0].Value() != "" {
+		t.Errorf("Expected the unbound √ key to insert nothing, got %q", m.Inputs[0].Value())
+	}
+
+	if err := os.WriteFile(path, []byte(`{"keys": {"help": "ctrl+z"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err := LoadConfig(path); err == nil || cfg.Keys != DefaultKeymap() {
+		t.Errorf("Expected a key bound twice to reset the keymap, got %+v", cfg.Keys)
+	}
+}
+
+func TestStatusBar(t *testing.T) {
+	m := createTestModel()
+	m.handleWindowResize(tea.WindowSizeMsg{Width: 80, Height: 24})
+	if m.InputViewport.Height != 21 || m.ResultViewport.Height != 21 {
+		t.Fatalf("Expected a row reserved for the status bar, got heights %d and %d", m.InputViewport.Height, m.ResultViewport.Height)
+	}
+
+	status := m.statusText()
+	for _, part := range []string{"RAD", "dec", "precision 9", "1 line", "rates loading"} {
+		if !strings.Contains(status, part) {
+			t.Errorf("Expected %q in the status %q", part, status)
+		}
+	}
+
+	// The bar follows the modes and the loaded exchange rates
+	updated, _ := m.Update(exchangeRatesMsg(time.Date(2026, 10, 10, 12, 0, 0, 0, time.Local)))
+	m = updated.(Model)
+	m.OutputBase = 1
+	m.Inputs = append(m.Inputs, textinput.New())
+	status = m.statusText()
+	for _, part := range []string{"hex", "2 lines", "rates 2026-10-10"} {
+		if !strings.Contains(status, part) {
+			t.Errorf("Expected %q in the status %q", part, status)
+		}
+	}
+
+	lines := strings.Split(m.View(), "\n")
+	if len(lines) != m.Height {
+		t.Fatalf("Expected the view to fill %d rows, got %d", m.Height, len(lines))
+	}
+	if !strings.Contains(stripANSIEscapeCodes(lines[len(lines)-1]), "precision 9") {
+		t.Errorf("Expected the status bar on the last row, got %q", lines[len(lines)-1])
+	}
+}
+
+func TestRatesRefresh(t *testing.T) {
+	m := createTestModel()
+	m.loadWorksheet("2 + 2\n10 USD to USD\nans2 * 2")
+	m.Results[1], m.Results[2], m.Results[3] = "stale", "stale", "stale"
+
+	m.refreshExchangeRates()
+	if !strings.Contains(m.statusText(), "(updating)") {
+		t.Errorf("Expected the update in the status %q", m.statusText())
+	}
+
+	published := time.Date(2026, 10, 10, 12, 0, 0, 0, time.Local)
+	m.handleRatesRefreshMessage(ratesRefreshMsg{updated: false, time: published})
+	if !strings.Contains(m.statusText(), "rates 2026-10-10 (update failed)") || m.Results[2] != "stale" {
+		t.Errorf("Expected a failed update to keep the results, got status %q", m.statusText())
+	}
+
+	// Lines from the first one using a currency are recalculated
+	m.handleRatesRefreshMessage(ratesRefreshMsg{updated: true, time: published})
+	if !strings.Contains(m.statusText(), "(updated)") {
+		t.Errorf("Expected the update in the status %q", m.statusText())
+	}
+	if m.Results[1] != "stale" || m.Results[2] == "stale" || m.Results[3] == "stale" {
+		t.Errorf("Expected only the currency line and the lines below recalculated, got %q", m.Results)
+	}
+}
+
+func TestBracketHighlights(t *testing.T) {
+	value := []rune("((a+b)*(c-d))")
+	tests := []struct {
+		pos     int
+		matched []int
+	}{
+		{0, []int{0, 12}},  // Under the cursor
+		{6, []int{1, 5}},   // Right before the cursor
+		{1, []int{1, 5}},   // Under the cursor wins over before it
+		{13, []int{0, 12}}, // At the end
+		{3, nil},           // Not next to a bracket
+	}
+	for _, tt := range tests {
+		matched, unbalanced := bracketHighlights(value, tt.pos)
+		if !slices.Equal(matched, tt.matched) || len(unbalanced) != 0 {
+			t.Errorf("At %d expected matched %v, got %v and unbalanced %v", tt.pos, tt.matched, matched, unbalanced)
+		}
+	}
+
+	// Unclosed and mismatched brackets are flagged
+	matched, unbalanced := bracketHighlights([]rune("(1+2] * sin(30"), 0)
+	slices.Sort(unbalanced)
+	if matched != nil || !slices.Equal(unbalanced, []int{0, 4, 11}) {
+		t.Errorf("Expected brackets 0, 4 and 11 unbalanced, got matched %v and unbalanced %v", matched, unbalanced)
+	}
+}
+
+func TestInputOffset(t *testing.T) {
+	input := textinput.New()
+	input.Width = 5
+	input.SetValue("0123456789")
+	if offset := inputOffset(input); offset != 5 {
+		t.Errorf("Expected the end of the value shown from 5, got %d", offset)
+	}
+	input.SetCursor(2)
+	if offset := inputOffset(input); offset != 2 {
+		t.Errorf("Expected the value shown from the cursor at 2, got %d", offset)
+	}
+
+	// Moving right again scrolls only as far as the cursor needs
+	input.SetCursor(8)
+	if offset := inputOffset(input); offset != 3 {
+		t.Errorf("Expected the value shown from 3 with the cursor at 8, got %d", offset)
+	}
+
+	// Repeated text doesn't make the offset ambiguous
+	input.SetValue("(1)(1)(1)(1)")
+	input.CursorEnd()
+	input.SetCursor(4)
+	if offset := inputOffset(input); offset != 4 {
+		t.Errorf("Expected the repeated value shown from 4, got %d", offset)
+	}
+
+	// Short values aren't scrolled
+	input.SetValue("(1)")
+	if offset := inputOffset(input); offset != 0 {
+		t.Errorf("Expected no offset for a short value, got %d", offset)
+	}
+}
+
+func TestTokenizeInput(t *testing.T) {
+	functions := map[string]bool{"sqrt": true}
+	tokens := tokenizeInput("sqrt(16) + ans1 * 2.5e3 - 0xFF // 3 + x", functions)
+	expected := []inputToken{
+		{0, 4, tokenFunction},
+		{4, 5, tokenOperator},
+		{5, 7, tokenNumber},
+		{7, 8, tokenOperator},
+		{9, 10, tokenOperator},
+		{16, 17, tokenOperator}, // ans1 is neither a function nor a number
+		{18, 23, tokenNumber},
+		{24, 25, tokenOperator},
+		{26, 30, tokenNumber},
+	}
+	if !slices.Equal(tokens, expected) {
+		t.Errorf("Expected tokens %v, got %v", expected, tokens)
+	}
+
+	// Unknown names and non-ASCII input keep their rune positions
+	tokens = tokenizeInput("größe × 3", functions)
+	if !slices.Equal(tokens, []inputToken{{8, 9, tokenNumber}}) {
+		t.Errorf("Expected only the number at rune 8, got %v", tokens)
+	}
+}
+
+func TestVimMode(t *testing.T) {
+	defer func(old Config) { config = old }(config)
+	config.VimMode = true
+
+	m := createTestModel()
+	m.loadWorksheet("1+1\n2+2")
+	key := func(keys string) {
+		for _, r := range keys {
+			updated, _ := m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{r}})
+			m = updated.(Model)
+		}
+	}
+
+	// Esc enters normal mode instead of quitting
+	_, cmd := m.handleKeyMessage(tea.KeyMsg{Type: tea.KeyEsc})
+	if m.Mode != ModeNormal || cmd == nil {
+		t.Fatalf("Expected Esc to enter normal mode, got mode %d", m.Mode)
+	}
+	if _, quit := cmd().(tea.QuitMsg); quit {
+		t.Fatal("Expected Esc not to quit in vim mode")
+	}
+	if !strings.Contains(m.statusText(), "NORMAL") {
+		t.Errorf("Expected the mode in the status, got %q", m.statusText())
+	}
+
+	// Typed keys navigate instead of editing
+	m.Focused = 0
+	key("jx")
+	if m.Focused != 1 || m.Inputs[1].Value() != "1+1" {
+		t.Errorf("Expected j to move to line 2 unchanged, got line %d with %q", m.Focused+1, m.Inputs[1].Value())
+	}
+
+	// yy and p copy the line below, dd deletes it
+	key("yyp")
+	if len(m.Inputs) != 4 || m.Focused != 2 || m.Inputs[2].Value() != "1+1" {
+		t.Fatalf("Expected the copied line pasted as line 3, got %q", m.inputValues())
+	}
+	key("jdd")
+	if !slices.Equal(m.inputValues(), []string{"", "1+1", "1+1"}) || m.YankedLine != "2+2" {
+		t.Errorf("Expected the last line deleted and yanked, got %q and %q", m.inputValues(), m.YankedLine)
+	}
+
+	// i returns to typing
+	key("i5")
+	if m.Mode != ModeInsert || !strings.Contains(m.Inputs[m.Focused].Value(), "5") {
+		t.Errorf("Expected typing after i, got mode %d and %q", m.Mode, m.Inputs[m.Focused].Value())
+	}
+}
+
+func TestWorksheetSearch(t *testing.T) {
+	m := createTestModel()
+	m.loadWorksheet("price = 5\n2+2\nprice * 3")
+	m.Inputs[m.Focused].Blur()
+	m.Focused = 0
+	m.Inputs[0].Focus()
+
+	m.openSearch()
+	for _, r := range "PRICE" {
+		m.handleSearchKeys(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{r}})
+	}
+	if m.Focused != 1 || m.Inputs[1].Value() != "price = 5" {
+		t.Fatalf("Expected typing to jump to the first match, got line %d", m.Focused)
+	}
+
+	// Enter moves to the next match, wrapping around, and ↑ back
+	m.handleSearchKeys(tea.KeyMsg{Type: tea.KeyEnter})
+	if m.Focused != 3 {
+		t.Errorf("Expected Enter to jump to line 3, got %d", m.Focused)
+	}
+	m.handleSearchKeys(tea.KeyMsg{Type: tea.KeyEnter})
+	if m.Focused != 1 {
+		t.Errorf("Expected Enter to wrap around to line 1, got %d", m.Focused)
+	}
+	m.handleSearchKeys(tea.KeyMsg{Type: tea.KeyUp})
+	if m.Focused != 3 {
+		t.Errorf("Expected ↑ to wrap back to line 3, got %d", m.Focused)
+	}
+
+	// Esc keeps the focus on the match and the query for the next search
+	m.handleSearchKeys(tea.KeyMsg{Type: tea.KeyEsc})
+	if m.ShowSearch || m.Focused != 3 {
+		t.Errorf("Expected the dialog closed on line 3, got %v and line %d", m.ShowSearch, m.Focused)
+	}
+	m.openSearch()
+	if m.SearchInput.Value() != "PRICE" {
+		t.Errorf("Expected the last query kept, got %q", m.SearchInput.Value())
+	}
+
+	covered := searchRuneMatches("a Price of price", "price")
+	if !slices.Equal(covered, []int{2, 3, 4, 5, 6, 11, 12, 13, 14, 15}) {
+		t.Errorf("Expected both matches covered, got %v", covered)
+	}
+}
+
+func TestGoalColumn(t *testing.T) {
+	m := createTestModel()
+	m.loadWorksheet("123456789\n12\n1234567")
+	m.Inputs[m.Focused].Blur()
+	m.Focused = 1
+	m.Inputs[1].Focus()
+	m.Inputs[1].SetCursor(7)
+
+	// A shorter line clamps the cursor, a longer one restores the column
+	m.focusNextLine()
+	if m.Focused != 2 || m.Inputs[2].Position() != 2 {
+		t.Fatalf("Expected the cursor at the end of line 2, got line %d position %d", m.Focused, m.Inputs[m.Focused].Position())
+	}
+	m.focusNextLine()
+	if m.Inputs[3].Position() != 7 {
+		t.Errorf("Expected the cursor back in column 7, got %d", m.Inputs[3].Position())
+	}
+
+	// Moving the cursor sideways sets a new goal column
+	m.Inputs[3].SetCursor(3)
+	m.focusPreviousLine()
+	m.focusPreviousLine()
+	if m.Focused != 1 || m.Inputs[1].Position() != 3 {
+		t.Errorf("Expected column 3 on line 1, got line %d position %d", m.Focused, m.Inputs[m.Focused].Position())
+	}
+}
+
+func TestUndoCoalescing(t *testing.T) {
+	m := createTestModel()
+	typeText := func(text string) {
+		for _, r := range text {
+			msg := tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{r}}
+			if r == ' ' {
+				msg = tea.KeyMsg{Type: tea.KeySpace, Runes: []rune{r}}
+			}
+			updated, _ := m.Update(msg)
+			m = updated.(Model)
+		}
+	}
+
+	// Words and operators are undone as a whole
+	typeText("12+34 ")
+	if len(m.UndoSystem.undoStack) != 2 {
+		t.Fatalf("Expected an undo entry each for \"12+\" and \"34 \", got %d", len(m.UndoSystem.undoStack))
+	}
+	m.undo()
+	if m.Inputs[0].Value() != "12+" {
+		t.Errorf("Expected the last word undone, got %q", m.Inputs[0].Value())
+	}
+	m.undo()
+	if m.Inputs[0].Value() != "" {
+		t.Errorf("Expected all typing undone, got %q", m.Inputs[0].Value())
+	}
+
+	// A pause starts a new entry within a word
+	typeText("ab")
+	m.UndoSystem.lastTyped = time.Now().Add(-typingPause)
+	typeText("cd")
+	m.undo()
+	if m.Inputs[0].Value() != "ab" {
+		t.Errorf("Expected the typing after the pause undone, got %q", m.Inputs[0].Value())
+	}
+
+	// Discrete operations end the typing run
+	typeText("c")
+	entries := len(m.UndoSystem.undoStack)
+	m.saveState()
+	typeText("d")
+	if len(m.UndoSystem.undoStack) != entries+2 {
+		t.Errorf("Expected typing after saveState to start a new entry, got %d entries instead of %d", len(m.UndoSystem.undoStack), entries+2)
+	}
+}
+
+func TestStackSizeLimit(t *testing.T) {
+	for _, size := range []int{1, 5, DefaultUndoLimit} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			m := createTestModel()
+			m.UndoSystem = NewUndoSystemWithSize(size)
+			for i := range size + 3 {
+				m.Inputs[0].SetValue(fmt.Sprint(i))
+				m.saveState()
+			}
+			if len(m.UndoSystem.undoStack) != size {
+				t.Fatalf("Expected %d undo states, got %d", size, len(m.UndoSystem.undoStack))
+			}
+			// The oldest states are dropped
+			if oldest := m.UndoSystem.undoStack[0].InputValues[0]; oldest != fmt.Sprint(3) {
+				t.Errorf("Expected the oldest kept state to be 3, got %q", oldest)
+			}
+
+			// Undoing everything fills the redo stack up to the same size
+			for m.undo() {
+			}
+			if len(m.UndoSystem.redoStack) != size {
+				t.Errorf("Expected %d redo states, got %d", size, len(m.UndoSystem.redoStack))
+			}
+		})
+	}
+
+	if NewUndoSystemWithSize(0).maxSize != DefaultUndoLimit {
+		t.Error("Expected the default size for a size below 1")
+	}
+}
+
+func TestResultHistory(t *testing.T) {
+	m := createTestModel()
+	m.createNewLine()
+
+	// Results of a line being typed replace each other
+	for _, result := range []string{"1", "12", "123"} {
+		m.handleCalculationMessage(CalculationMsg{Index: 0, Result: result})
+	}
+	m.handleCalculationMessage(CalculationMsg{Index: 1, Result: "€5"})
+	m.handleCalculationMessage(CalculationMsg{Index: 0, Result: ErrorExpressionInvalid})
+	if !slices.Equal(m.ResultHistory, []string{"€5", "123"}) {
+		t.Fatalf("Expected the last result of each edit, newest first, got %q", m.ResultHistory)
+	}
+
+	// The history outlives the lines and inserts at the cursor
+	m.deleteLine()
+	m.Inputs[0].SetValue("2 * ")
+	m.Inputs[0].CursorEnd()
+	m.openResultHistory()
+	if !m.ShowCompletions || m.ActiveMenu != MenuResultHistory {
+		t.Fatal("Expected the history in the completion popup")
+	}
+	m.handleCompletionKeys(tea.KeyMsg{Type: tea.KeyEnter})
+	if m.Inputs[0].Value() != "2 * €5" || m.Inputs[0].Position() != 6 {
+		t.Errorf("Expected €5 inserted at the cursor, got %q at %d", m.Inputs[0].Value(), m.Inputs[0].Position())
+	}
+}
+
+// TestSymbolPalette tests inserting a symbol picked from the palette
+func TestSymbolPalette(t *testing.T) {
+	m := createTestModel()
+	m.Inputs[0].SetValue("2 ")
+	m.Inputs[0].CursorEnd()
+	m.handleKeyMessage(tea.KeyMsg{Type: tea.KeyCtrlG})
+	if !m.ShowCompletions || m.ActiveMenu != MenuSymbols || m.Completions[0] != "π  pi" {
+		t.Fatalf("Expected the symbol palette in the completion popup, got %q", m.Completions)
+	}
+
+	m.handleCompletionKeys(tea.KeyMsg{Type: tea.KeyEnter})
+	if m.Inputs[0].Value() != "2 π" || m.Inputs[0].Position() != 3 || m.ShowCompletions {
+		t.Fatalf("Expected π inserted at the cursor, got %q at %d", m.Inputs[0].Value(), m.Inputs[0].Position())
+	}
+
+	// Inserting after a symbol counts runes, not bytes
+	m.insertSymbol("×")
+	if m.Inputs[0].Value() != "2 π×" || m.Inputs[0].Position() != 4 {
+		t.Errorf("Expected × after π, got %q at %d", m.Inputs[0].Value(), m.Inputs[0].Position())
+	}
+	if !m.undo() || m.Inputs[0].Value() != "2 π" {
+		t.Errorf("Expected each insertion to be undone on its own, got %q", m.Inputs[0].Value())
+	}
+}
+
+func TestAppendEmptyLine(t *testing.T) {
+	m := createTestModel()
+	m.loadWorksheet(strings.Repeat("1+1\n", 30))
+	m.Inputs[m.Focused].Blur()
+	m.Focused = 0
+	m.Inputs[0].Focus()
+
+	m.appendEmptyLine()
+	if len(m.Inputs) != 32 || m.Focused != 31 || m.Inputs[31].Value() != "" || !m.Inputs[31].Focused() {
+		t.Fatalf("Expected a focused empty line 32, got %d lines focused on %d", len(m.Inputs), m.Focused+1)
+	}
+	if row := m.lineRow(m.Focused); row < m.InputViewport.YOffset || row >= m.InputViewport.YOffset+m.InputViewport.Height {
+		t.Errorf("Expected the empty line scrolled into view, got row %d at offset %d", row, m.InputViewport.YOffset)
+	}
+
+	// An empty last line is reused
+	m.appendEmptyLine()
+	if len(m.Inputs) != 32 {
+		t.Errorf("Expected no second empty line, got %d lines", len(m.Inputs))
+	}
+}
+
+// TestGoToLine tests line numbers, relative jumps and labels in the go-to-line dialog
+func TestGoToLine(t *testing.T) {
+	m := createTestModel()
+	m.loadWorksheet("1\nsubtotal: 2 + 3\n4\n5\n6")
+	undoStates := len(m.UndoSystem.undoStack)
+
+	tests := []struct {
+		from   int
+		input  string
+		target int
+	}{
+		{0, "3", 2},        // Absolute
+		{0, "99", 5},       // Past the end goes to the last line
+		{3, "0", 3},        // No line 0
+		{1, "+3", 4},       // Down
+		{4, "-2", 2},       // Up
+		{4, "+9", 5},       // Clamped to the last line
+		{4, "-9", 0},       // Clamped to the first line
+		{5, "subtotal", 2}, // Label
+		{5, "unknown", 5},  // Unknown label
+		{5, "-", 5},        // Sign without a number
+	}
+	for _, tt := range tests {
+		m.Focused = tt.from
+		m.openGoToLine()
+		m.GoToLineInput.SetValue(tt.input)
+		m.goToLine()
+		if m.Focused != tt.target || m.ShowGoToLine {
+			t.Errorf("Going to %q from %d expected line %d, got %d", tt.input, tt.from, tt.target, m.Focused)
+		}
+	}
+	if len(m.UndoSystem.undoStack) != undoStates {
+		t.Errorf("Expected jumps not to be undo steps, got %d states instead of %d", len(m.UndoSystem.undoStack), undoStates)
+	}
+
+	// The dialog takes signs and labels but not expressions
+	for input, valid := range map[string]bool{"12": true, "+": true, "-3": true, "subtotal": true, "3+": false, "a b": false} {
+		if goToLineRegex.MatchString(input) != valid {
+			t.Errorf("Expected %q valid: %v", input, valid)
+		}
+	}
+}
+
+// TestCompletionPopupAlignment tests that result rows stay aligned with the completion popup while scrolling
+func TestCompletionPopupAlignment(t *testing.T) {
+	m := createTestModel()
+	m.InputViewport.Height, m.ResultViewport.Height = 8, 8
+	m.loadWorksheet("1 + 1\n2 + 2\n3 + 3")
+	m.Focused = 1
+	for i := range 15 {
+		m.Completions = append(m.Completions, fmt.Sprintf("item%d", i))
+	}
+	m.ShowCompletions = true
+	m.updateViewports()
+
+	// The popup shows 10 of the completions, and the result pane leaves as
+	// many rows blank as the popup takes rather than one per completion
+	popup := len(m.renderCompletionPopup())
+	if m.popupRows(1) != popup || m.popupRows(0) != 0 {
+		t.Errorf("Expected the popup rows below the focused line only, got %d and %d", m.popupRows(1), m.popupRows(0))
+	}
+	inputRows, resultRows := m.InputViewport.TotalLineCount(), m.ResultViewport.TotalLineCount()
+	if inputRows != 4+popup || resultRows != inputRows {
+		t.Errorf("Expected aligned panes of %d rows, got %d input and %d result rows", 4+popup, inputRows, resultRows)
+	}
+
+	// Lines below the popup keep their rows, and the popup isn't a line
+	if m.lineRow(2) != 2+popup || m.lineAtRow(2+popup) != 2 || m.lineAtRow(2) != -1 {
+		t.Errorf("Expected line 2 below the popup, got row %d", m.lineRow(2))
+	}
+
+	// Scrolling shows as much of the popup as fits below the focused line,
+	// with both panes on the same row
+	m.scrollToFocused()
+	if m.InputViewport.YOffset != 1 || m.ResultViewport.YOffset != 1 {
+		t.Errorf("Expected both panes scrolled to the focused line, got %d and %d", m.InputViewport.YOffset, m.ResultViewport.YOffset)
+	}
+	m.scrollViewports(100)
+	if m.InputViewport.YOffset != m.ResultViewport.YOffset || m.InputViewport.YOffset != inputRows-8 {
+		t.Errorf("Expected scrolling to stop at the last row, got %d and %d", m.InputViewport.YOffset, m.ResultViewport.YOffset)
+	}
+}
+
+// TestFollowNewestLine tests keeping the newest line focused at the bottom in follow mode
+func TestFollowNewestLine(t *testing.T) {
+	m := createTestModel()
+	m.InputViewport.Height, m.ResultViewport.Height = 4, 4
+	m.loadWorksheet("1\n2\n3\n4\n5\n6\n7\n8")
+	m.focusFirstLine()
+
+	// Following focuses the last line and pins it to the bottom
+	m.toggleFollow()
+	if m.Focused != 8 || m.InputViewport.YOffset != 5 || m.ResultViewport.YOffset != 5 {
+		t.Errorf("Expected the last line focused at the bottom, got line %d at offsets %d and %d", m.Focused, m.InputViewport.YOffset, m.ResultViewport.YOffset)
+	}
+	if !strings.Contains(m.statusText(), "follow") {
+		t.Errorf("Expected follow in the status %q", m.statusText())
+	}
+
+	// New lines scroll into view
+	m.createNewLine()
+	m.addMultipleInputs("9\n10")
+	if m.Focused != 11 || m.InputViewport.YOffset != 8 || m.ResultViewport.YOffset != 8 {
+		t.Errorf("Expected the newest line at the bottom, got line %d at offset %d", m.Focused, m.InputViewport.YOffset)
+	}
+
+	// Resizing keeps the panes pinned
+	m.handleWindowResize(tea.WindowSizeMsg{Width: 80, Height: 9})
+	if m.InputViewport.YOffset != 6 || m.ResultViewport.YOffset != 6 {
+		t.Errorf("Expected the panes pinned after resizing, got %d and %d", m.InputViewport.YOffset, m.ResultViewport.YOffset)
+	}
+
+	// An earlier line isn't pulled back to the bottom
+	m.focusFirstLine()
+	m.handleWindowResize(tea.WindowSizeMsg{Width: 80, Height: 7})
+	if m.Focused != 0 || m.InputViewport.YOffset != 0 {
+		t.Errorf("Expected the first line to stay in view, got line %d at offset %d", m.Focused, m.InputViewport.YOffset)
+	}
+
+	m.toggleFollow()
+	if strings.Contains(m.statusText(), "follow") {
+		t.Errorf("Expected no follow in the status %q", m.statusText())
+	}
+}
+
+// TestEvaluateSubExpression tests finding and evaluating the bracketed sub-expression at the cursor
+func TestEvaluateSubExpression(t *testing.T) {
+	value := []rune("2 * (3 + (4 - 1))")
+	tests := []struct {
+		pos         int
+		first, last int
+	}{
+		{6, 4, 16},  // Inside the outer brackets
+		{10, 9, 15}, // Inside the inner brackets
+		{9, 9, 15},  // Right before the inner opening bracket
+		{16, 9, 15}, // Right after the inner closing bracket
+		{17, 4, 16}, // At the end
+		{0, -1, -1}, // Outside any brackets
+	}
+	for _, tt := range tests {
+		first, last, found := enclosingBrackets(value, tt.pos)
+		if first != tt.first || last != tt.last || found != (tt.first >= 0) {
+			t.Errorf("At %d expected brackets %d and %d, got %d and %d", tt.pos, tt.first, tt.last, first, last)
+		}
+	}
+
+	m := createTestModel()
+	m.loadWorksheet("2 * (3 + (4 - 1))")
+	m.Focused = 1
+	m.Inputs[1].SetCursor(10)
+	m.evaluateSubExpression()
+	if m.SubResult != "(4 - 1) = 3" || !strings.HasPrefix(m.statusText(), "(4 - 1) = 3") {
+		t.Errorf("Expected the inner brackets calculated in the status, got %q", m.statusText())
+	}
+	if m.Inputs[1].Value() != "2 * (3 + (4 - 1))" {
+		t.Errorf("Expected the line unchanged, got %q", m.Inputs[1].Value())
+	}
+
+	// The result only shows until the next key
+	updated, _ := m.Update(tea.KeyMsg{Type: tea.KeyRight})
+	if sub := updated.(Model).SubResult; sub != "" {
+		t.Errorf("Expected the result cleared by the next key, got %q", sub)
+	}
+
+	m.Inputs[1].SetCursor(0)
+	m.evaluateSubExpression()
+	if m.SubResult != "no brackets at the cursor" {
+		t.Errorf("Expected a note without brackets, got %q", m.SubResult)
+	}
+}
+
+// TestUnbalancedBrackets tests reporting unbalanced parentheses instead of calculating them
+func TestUnbalancedBrackets(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"2 * (3 + 4)", "14"},
+		{"(1 + 2", ErrorUnbalancedBrackets},
+		{"(1 + 2))", ErrorUnbalancedBrackets},
+		{"(1 + 2]", ErrorUnbalancedBrackets},
+		{"(1 + 2) // see (note", "3"},
+		{"(1 + 2) # :)", "3"},
+	}
+	for _, tt := range tests {
+		if result := CalculateExpression(tt.input, []string{""}, 0); result != tt.expected {
+			t.Errorf("CalculateExpression(%q) = %q, expected %q", tt.input, result, tt.expected)
+		}
+	}
+	if !isErrorResult(ErrorUnbalancedBrackets) {
+		t.Error("Expected unbalanced brackets to be an error result")
+	}
+}
+
+// TestCompletionTiers tests reading the advanced completion categories and functions from the config
+func TestCompletionTiers(t *testing.T) {
+	defer func(old Config) { config = old }(config)
+	config = DefaultConfig()
+	tests := []struct {
+		name, category string
+		advanced       bool
+	}{
+		{"sin", "Trigonometry", false},
+		{"mean", "Statistics/Descriptive Statistics", true},
+		{"sqrt", "Exponents & Logarithms", false},
+		{"pow", "Exponents & Logarithms", true},
+		{"gcd", "Number Theory/Arithmetics", true},
+	}
+	for _, tt := range tests {
+		if isAdvancedFunction(tt.name, tt.category) != tt.advanced {
+			t.Errorf("Expected %s in %s advanced: %v", tt.name, tt.category, tt.advanced)
+		}
+	}
+
+	// Configured tiers replace the default ones
+	config.CompletionAdvancedCategories = []string{"Trigonometry"}
+	config.CompletionAdvancedFunctions = nil
+	if !isAdvancedFunction("sin", "Trigonometry") || isAdvancedFunction("mean", "Statistics/Descriptive Statistics") || isAdvancedFunction("pow", "Exponents & Logarithms") {
+		t.Error("Expected only trigonometry to be advanced")
+	}
+	basic, advanced := getLibqalculateCompletions()
+	if slices.Contains(basic, "sin") || !slices.Contains(advanced, "sin") {
+		t.Error("Expected sin completed after the basic functions")
+	}
+}
+
+// TestWideGlyphWidths tests measuring labels, popups and dialogs with wide glyphs in display cells
+func TestWideGlyphWidths(t *testing.T) {
+	tests := []struct {
+		text     string
+		from, to int
+		expected string
+	}{
+		{"a日本b", 0, 2, "a "},                           // 日 split at the end
+		{"a日本b", 1, 5, "日本"},                           // Whole glyphs
+		{"a日本b", 2, 6, " 本b"},                          // 日 split at the start
+		{"\x1b[1m日本\x1b[0m", 1, 4, "\x1b[1m 本\x1b[0m"}, // Escape codes are kept
+	}
+	for _, tt := range tests {
+		if cut := cutCells(tt.text, tt.from, tt.to); cut != tt.expected {
+			t.Errorf("cutCells(%q, %d, %d) = %q, expected %q", tt.text, tt.from, tt.to, cut, tt.expected)
+		}
+	}
+	if label := resultLabel("日本円 * 2", 5); label != "日本…" {
+		t.Errorf("Expected the label truncated to 5 cells, got %q", label)
+	}
+	if index := runeAtCell("日本b", 3); index != 1 {
+		t.Errorf("Expected cell 3 to show the second rune, got %d", index)
+	}
+
+	// The go-to-line dialog over wide glyphs keeps every row as wide
+	m := createTestModel()
+	rows := make([]string, m.Height)
+	for i := range rows {
+		rows[i] = strings.Repeat("日本", m.Width/4)
+	}
+	m.GoToLineInput = textinput.New()
+	for i, row := range strings.Split(m.renderGoToLineDialog(strings.Join(rows, "\n")), "\n") {
+		if width := lipgloss.Width(row); width != m.Width {
+			t.Errorf("Expected row %d to stay %d cells wide, got %d", i, m.Width, width)
+		}
+	}
+}
+
+// TestApproximateResults tests marking approximate results and showing exact mode in the status bar
+func TestApproximateResults(t *testing.T) {
+	defer SetExactMode(false)
+
+	m := createTestModel()
+	m.loadWorksheet("1/3\n1/4\nsqrt(2)")
+	for i, approximate := range []bool{false, true, false, true} {
+		if isApproximateResult(m.Inputs[i].Value(), m.Results[i]) != approximate {
+			t.Errorf("Expected line %d (%q = %q) approximate: %v", i, m.Inputs[i].Value(), m.Results[i], approximate)
+		}
+	}
+
+	// Cached results stay approximate
+	for range 2 {
+		if result, approximate := calculateExpression("1/3", []string{""}, 0, false); result != "0.333333333" || !approximate {
+			t.Errorf("Expected an approximate 0.333333333, got %q and %v", result, approximate)
+		}
+	}
+
+	// The result pane marks approximate results only
+	if _, rows := m.resultRows(1); rows[0] != "≈ 0.333333333" {
+		t.Errorf("Expected the approximate result marked, got %q", rows[0])
+	}
+	if _, rows := m.resultRows(2); rows[0] != "0.25" {
+		t.Errorf("Expected the exact result unmarked, got %q", rows[0])
+	}
+	m.InlineResults = true
+	if rows := m.inlineResultRows(1); !strings.HasSuffix(stripANSIEscapeCodes(rows[0]), "│ ≈ 0.333333333") {
+		t.Errorf("Expected the mark in place of the inline prefix, got %q", rows)
+	}
+	m.InlineResults = false
+
+	// Exact results aren't approximated
+	m.toggleExactMode()
+	if isApproximateResult(m.Inputs[1].Value(), m.Results[1]) || !strings.Contains(m.statusText(), "exact") {
+		t.Errorf("Expected an exact %q in exact mode, status %q", m.Results[1], m.statusText())
+	}
+}
+
+// TestSessionEmptyLines tests that restoring a session keeps empty lines so ans references stay on their lines
+func TestSessionEmptyLines(t *testing.T) {
+	path := t.TempDir() + "/nasc/session.txt"
+
+	m := createTestModel()
+	m.restoreWorksheet("5\n//@ spacer\n\n7\nans3 * 2")
+	if err := m.saveSession(path); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := loadSavedSession(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := createTestModel()
+	restored.restoreWorksheet(content)
+	if !slices.Equal(restored.inputValues(), []string{"5", "", "7", "ans3 * 2"}) {
+		t.Fatalf("Expected the empty line to be restored, got %q", restored.inputValues())
+	}
+	if restored.Results[3] != "14" {
+		t.Errorf("Expected ans3 to reference line 3, got %q", restored.Results[3])
+	}
+	if restored.lineNote(1) != "spacer" || restored.lineNote(2) != "" {
+		t.Errorf("Expected the note to stay on the empty line, got %q", restored.Notes)
+	}
+}
+
+// TestKeymapLineKeys tests remapping the line and Alt keys like the Ctrl keys
+func TestKeymapLineKeys(t *testing.T) {
+	defer func(old Config) { config = old }(config)
+
+	if err := DefaultKeymap().validate(); err != nil {
+		t.Fatalf("Expected the default keys not to conflict, got %v", err)
+	}
+
+	path := t.TempDir() + "/config.json"
+	if err := os.WriteFile(path, []byte(`{"keys": {"help": "alt+e"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err := LoadConfig(path); err == nil || cfg.Keys != DefaultKeymap() {
+		t.Errorf("Expected a key taken from an Alt action to reset the keymap, got %+v", cfg.Keys)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"keys": {"duplicateLine": "f2", "toggleComment": "alt+k"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	config = cfg
+
+	m := createTestModel()
+	m.Inputs[0].SetValue("5")
+	m.handleKeyMessage(tea.KeyMsg{Type: tea.KeyCtrlU})
+	if len(m.Inputs) != 1 {
+		t.Errorf("Expected Ctrl+U to no longer duplicate the line, got %d lines", len(m.Inputs))
+	}
+	m.handleKeyMessage(tea.KeyMsg{Type: tea.KeyF2})
+	if len(m.Inputs) != 2 {
+		t.Errorf("Expected F2 to duplicate the line, got %d lines", len(m.Inputs))
+	}
+	m.handleKeyMessage(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("k"), Alt: true})
+	if m.Inputs[m.Focused].Value() != "// 5" {
+		t.Errorf("Expected Alt+K to comment out the line, got %q", m.Inputs[m.Focused].Value())
+	}
+}
+
+// TestUndoCursorMoves tests that moving the cursor adds no undo entry and that
+// undoing typing restores the cursor it started at
+func TestUndoCursorMoves(t *testing.T) {
+	m := createTestModel()
+	for _, msg := range []tea.KeyMsg{
+		{Type: tea.KeyRunes, Runes: []rune("a")},
+		{Type: tea.KeySpace, Runes: []rune(" ")},
+		{Type: tea.KeyLeft},
+	} {
+		updated, _ := m.Update(msg)
+		m = updated.(Model)
+	}
+	if len(m.UndoSystem.undoStack) != 1 {
+		t.Fatalf("Expected moving the cursor to add no undo entry, got %d entries", len(m.UndoSystem.undoStack))
+	}
+
+	updated, _ := m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("b")})
+	m = updated.(Model)
+	m.undo()
+	if m.Inputs[0].Value() != "a " || m.Inputs[0].Position() != 1 {
+		t.Errorf("Expected \"a \" with the cursor at 1, got %q at %d", m.Inputs[0].Value(), m.Inputs[0].Position())
+	}
+}
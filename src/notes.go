@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	"github.com/charmbracelet/bubbletea"
+)
+
+// noteMarker starts a worksheet line holding the note of the line below it
+const noteMarker = "//@"
+
+// lineNote returns the note attached to line i, if any
+func (m *Model) lineNote(i int) string {
+	if i >= 0 && i < len(m.Notes) {
+		return m.Notes[i]
+	}
+	return ""
+}
+
+// setNote attaches a note to line i, an empty note removes it
+func (m *Model) setNote(i int, note string) {
+	// Lines past the end of Notes have no note
+	for len(m.Notes) <= i {
+		m.Notes = append(m.Notes, "")
+	}
+	m.Notes[i] = strings.TrimSpace(note)
+}
+
+// openNoteEditor edits the note of the focused line
+func (m *Model) openNoteEditor() (tea.Model, tea.Cmd) {
+	m.openPrompt(PromptNote)
+	m.PromptInput.SetValue(m.lineNote(m.Focused))
+	m.PromptInput.CursorEnd()
+	return *m, textinput.Blink
+}
+
+// splitWorksheetNotes separates note lines from worksheet content, returning
+// the remaining content and the notes keyed by the index of their line. Empty
+// lines are dropped and not counted unless keepEmpty is set.
+func splitWorksheetNotes(content string, keepEmpty bool) (string, map[int]string) {
+	var lines []string
+	notes := make(map[int]string)
+	pending := ""
+	for _, line := range strings.Split(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if note, found := strings.CutPrefix(trimmed, noteMarker); found {
+			pending = strings.TrimSpace(note)
+			continue
+		}
+		if trimmed == "" && !keepEmpty {
+			continue
+		}
+		if pending != "" {
+			notes[len(lines)] = pending
+			pending = ""
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n"), notes
+}
+
+// worksheetText serializes the worksheet, writing each note above its line
+func (m *Model) worksheetText() string {
+	var lines []string
+	for i, input := range m.Inputs {
+		if note := m.lineNote(i); note != "" {
+			lines = append(lines, noteMarker+" "+note)
+		}
+		lines = append(lines, input.Value())
+	}
+	return strings.Join(lines, "\n")
+}
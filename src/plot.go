@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// defaultGraphRange is offered when a graph is opened for the first time
+const defaultGraphRange = "-10 10"
+
+// functionDefinitionRegex matches definitions like "f(x) = x^2 + 1", capturing
+// the function name, its variable and the expression
+var functionDefinitionRegex = regexp.MustCompile(`^\s*([\p{L}_][\p{L}\d_]*)\(\s*([\p{L}_][\p{L}\d_]*)\s*\)\s*:?=\s*(.+)$`)
+
+// plotCallRegex matches a call like "plot(sin(x), -10, 10)", capturing the
+// expression and the bounds of x, which may be separated by ";" as well
+var plotCallRegex = regexp.MustCompile(`^\s*plot\(\s*(.+?)\s*[,;]\s*([^,;()]+?)\s*[,;]\s*([^,;()]+?)\s*\)\s*$`)
+
+// graphSample is the value of a graphed expression at one point
+type graphSample struct {
+	x  float64
+	y  float64
+	ok bool // false where the expression is undefined or not numeric
+}
+
+// graphableExpression extracts the expression and its free variable from an
+// input like "f(x) = x^2" or "x^2 + 1", reporting false if nothing can be graphed
+func graphableExpression(input string) (string, string, bool) {
+	expr := input
+	if commentPos := commentIndex(expr); commentPos != -1 {
+		expr = expr[:commentPos]
+	}
+	expr = strings.TrimSpace(expr)
+
+	if plotted, _, _, ok := parsePlotCall(expr); ok {
+		return plotted, "x", true
+	}
+	if parts := functionDefinitionRegex.FindStringSubmatch(expr); parts != nil {
+		return strings.TrimSpace(parts[3]), parts[2], true
+	}
+
+	if regexp.MustCompile(`\bx\b`).MatchString(expr) {
+		return expr, "x", true
+	}
+	return "", "", false
+}
+
+// isPlotCall reports whether input is a plot call, which is drawn rather
+// than calculated
+func isPlotCall(input string) bool {
+	return plotCallRegex.MatchString(stripComment(input))
+}
+
+// parsePlotCall extracts the expression and the range of x from a plot call
+// like "plot(sin(x), -pi, pi)", reporting false for other inputs or an
+// empty range
+func parsePlotCall(input string) (string, float64, float64, bool) {
+	parts := plotCallRegex.FindStringSubmatch(stripComment(input))
+	if parts == nil {
+		return "", 0, 0, false
+	}
+	from, fromOK := plotBound(parts[2])
+	to, toOK := plotBound(parts[3])
+	if !fromOK || !toOK || from == to {
+		return "", 0, 0, false
+	}
+	return parts[1], math.Min(from, to), math.Max(from, to), true
+}
+
+// plotBound reads a bound of a plot call, which may be an expression like -pi
+func plotBound(text string) (float64, bool) {
+	if value, err := strconv.ParseFloat(text, 64); err == nil {
+		return value, true
+	}
+	return parseResultNumber(CalculateExpression(text, nil, 0))
+}
+
+// parseGraphRange parses a "from to" range as entered in the graph prompt
+func parseGraphRange(spec string) (float64, float64, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("expected from and to")
+	}
+	from, err := strconv.ParseFloat(strings.ReplaceAll(fields[0], ",", "."), 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	to, err := strconv.ParseFloat(strings.ReplaceAll(fields[1], ",", "."), 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	if from == to {
+		return 0, 0, fmt.Errorf("empty range")
+	}
+	if from > to {
+		from, to = to, from
+	}
+	return from, to, nil
+}
+
+// sampleExpression evaluates expr at count evenly spaced values of variable in [from, to]
+func sampleExpression(expr string, variable string, from, to float64, count int, results []string, index int) []graphSample {
+	variableRegex := regexp.MustCompile(`\b` + regexp.QuoteMeta(variable) + `\b`)
+	samples := make([]graphSample, count)
+	for i := range samples {
+		x := from
+		if count > 1 {
+			x = from + (to-from)*float64(i)/float64(count-1)
+		}
+		value := "(" + strconv.FormatFloat(x, 'g', 10, 64) + ")"
+		result := CalculateExpression(variableRegex.ReplaceAllString(expr, value), results, index)
+		y, ok := parseResultNumber(result)
+		samples[i] = graphSample{x: x, y: y, ok: ok}
+	}
+	return samples
+}
+
+// formatAxisValue formats an axis label compactly
+func formatAxisValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', 4, 64)
+}
+
+// renderPlot draws the samples as a character plot, one column per sample
+func renderPlot(samples []graphSample, height int) string {
+	if len(samples) == 0 || height < 2 {
+		return "Nothing to plot"
+	}
+
+	// Scale the y axis to the defined samples
+	yMin, yMax := math.Inf(1), math.Inf(-1)
+	for _, sample := range samples {
+		if sample.ok {
+			yMin = math.Min(yMin, sample.y)
+			yMax = math.Max(yMax, sample.y)
+		}
+	}
+	if math.IsInf(yMin, 1) {
+		return "The expression is undefined over this range"
+	}
+	if yMin == yMax {
+		yMin, yMax = yMin-1, yMax+1
+	}
+
+	rowOf := func(y float64) int {
+		return int(math.Round((yMax - y) / (yMax - yMin) * float64(height-1)))
+	}
+
+	grid := make([][]rune, height)
+	for row := range grid {
+		grid[row] = []rune(strings.Repeat(" ", len(samples)))
+	}
+
+	// Draw the axes where they fall inside the range
+	if yMin <= 0 && yMax >= 0 {
+		zeroRow := rowOf(0)
+		for col := range grid[zeroRow] {
+			grid[zeroRow][col] = '─'
+		}
+	}
+	from, to := samples[0].x, samples[len(samples)-1].x
+	if from <= 0 && to >= 0 && len(samples) > 1 {
+		zeroCol := int(math.Round(-from / (to - from) * float64(len(samples)-1)))
+		for row := range grid {
+			if grid[row][zeroCol] == '─' {
+				grid[row][zeroCol] = '┼'
+			} else {
+				grid[row][zeroCol] = '│'
+			}
+		}
+	}
+
+	// Undefined samples leave a gap
+	for col, sample := range samples {
+		if sample.ok {
+			grid[rowOf(sample.y)][col] = '•'
+		}
+	}
+
+	// Label the top and bottom rows with the y range
+	topLabel, bottomLabel := formatAxisValue(yMax), formatAxisValue(yMin)
+	labelWidth := max(len(topLabel), len(bottomLabel))
+	var lines []string
+	for row := range grid {
+		label := ""
+		if row == 0 {
+			label = topLabel
+		} else if row == height-1 {
+			label = bottomLabel
+		}
+		lines = append(lines, fmt.Sprintf("%*s ┤%s", labelWidth, label, string(grid[row])))
+	}
+
+	// Label the x range below the plot
+	fromLabel, toLabel := formatAxisValue(from), formatAxisValue(to)
+	gap := max(1, len(samples)-len(fromLabel)-len(toLabel))
+	lines = append(lines, strings.Repeat(" ", labelWidth+2)+fromLabel+strings.Repeat(" ", gap)+toLabel)
+
+	return strings.Join(lines, "\n")
+}
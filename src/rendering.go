@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+	"unicode/utf8"
 
+	"github.com/charmbracelet/bubbles/viewport"
 	"github.com/charmbracelet/lipgloss"
 )
 
@@ -12,30 +14,54 @@ import (
 // styleAnsTokens applies styling to ans tokens in text
 func (m Model) styleAnsTokens(text string) string {
 	// Style ans1, ans2, etc. with highlight color
-	for i := 1; i <= len(m.Results); i++ {
-		ansToken := fmt.Sprintf("ans%d", i)
-		if strings.Contains(text, ansToken) {
-			styledToken := lipgloss.NewStyle().
-				Foreground(m.Theme.ansColor).
-				Bold(true).
-				Render(ansToken)
-			text = strings.ReplaceAll(text, ansToken, styledToken)
+	text = replaceAnsReferences(text, func(ref string, line int) (string, bool) {
+		if line >= len(m.Results) {
+			return "", false
 		}
-	}
+		return lipgloss.NewStyle().
+			Foreground(m.Theme.ansColor).
+			Bold(true).
+			Render(ref), true
+	})
 
 	// Style standalone 'ans' with highlight color using word boundary
-	ansRegex := regexp.MustCompile(`\bans\b`)
+	ansRegex := ansKeywordRegex()
 	if ansRegex.MatchString(text) {
 		styledAns := lipgloss.NewStyle().
 			Foreground(m.Theme.ansColor).
 			Bold(true).
-			Render("ans")
+			Render(ansKeyword())
 		text = ansRegex.ReplaceAllString(text, styledAns)
 	}
 
+	// Style labels of lines like ans tokens
+	labels := lineLabels(m.inputValues(), len(m.Inputs))
+	if len(labels) > 0 {
+		labelStyle := lipgloss.NewStyle().Foreground(m.Theme.ansColor).Bold(true)
+		text = replaceIdentifiers(text, func(name string) (string, bool) {
+			_, exists := labels[name]
+			return labelStyle.Render(name), exists
+		})
+	}
+
 	return text
 }
 
+// maxResultLabelWidth limits the input label shown in front of results
+const maxResultLabelWidth = 12
+
+// resultLabel shortens an input expression to a label of exactly width cells
+func resultLabel(input string, width int) string {
+	if width <= 0 {
+		return ""
+	}
+	label := strings.Join(strings.Fields(stripComment(input)), " ")
+	if lipgloss.Width(label) > width {
+		label = cutCells(label, 0, width-1) + "…"
+	}
+	return label + strings.Repeat(" ", width-lipgloss.Width(label))
+}
+
 // updateViewports updates both input and result viewport content
 func (m *Model) updateViewports() {
 	m.updateInputViewport()
@@ -44,6 +70,13 @@ func (m *Model) updateViewports() {
 
 // updateInputViewport updates the input pane content with line number gutter
 func (m *Model) updateInputViewport() {
+	// The gutter widens at 100 lines, narrowing the inputs
+	digits := lineNumberDigits(len(m.Inputs))
+	for i := range m.Inputs {
+		m.Inputs[i].Width = m.GetTextInputWidth()
+	}
+
+	functions := functionNames()
 	var inputLines []string
 	for i, input := range m.Inputs {
 		line := input.Value()
@@ -51,23 +84,39 @@ func (m *Model) updateInputViewport() {
 			line = input.Placeholder
 		}
 
-		// Create gutter with line number and separator
-		gutter := fmt.Sprintf("%2d│", i+1)
+		// Create gutter with line number and separator, marking lines with a note
+		separator := "│"
+		if m.lineNote(i) != "" {
+			separator = "✎"
+		}
+		gutter := fmt.Sprintf("%*d%s", digits, i+1, separator)
+
+		// Selected lines show their gutter reversed
+		gutterStyle := lipgloss.NewStyle().Reverse(m.isSelected(i))
+		if i != m.Focused && m.isSelected(i) {
+			gutter = gutterStyle.Render(gutter)
+		}
 		if i == m.Focused {
-			gutter = lipgloss.NewStyle().
+			gutter = gutterStyle.
 				Foreground(m.Theme.focusedColor).
 				Bold(true).
 				Render(gutter)
 
-			// Style ans/res tokens with boxes and let textinput handle its own width
+			// Style ans/res tokens, syntax and brackets, letting textinput handle its own width
 			inputView := input.View()
 			inputView = m.styleAnsTokens(inputView)
+			if input.Value() != "" {
+				inputView = m.highlightSyntax(inputView, functions)
+			}
+			inputView = m.highlightBrackets(inputView, input)
+			inputView = m.highlightSearch(inputView)
 			
 			// Don't constrain the input view - let it handle its own scrolling
 			combined := lipgloss.JoinHorizontal(lipgloss.Top, gutter, " ", inputView)
 
 			// Add completion popup after focused line if showing completions
 			inputLines = append(inputLines, combined)
+			inputLines = append(inputLines, m.continuationRows(i)...)
 			if m.ShowCompletions && len(m.Completions) > 0 {
 				completionLines := m.renderCompletionPopup()
 				inputLines = append(inputLines, completionLines...)
@@ -80,67 +129,267 @@ func (m *Model) updateInputViewport() {
 			maxDisplayWidth := m.GetTextInputWidth()
 			if lipgloss.Width(displayLine) > maxDisplayWidth {
 				plainText := stripANSIEscapeCodes(displayLine)
-				if len(plainText) > maxDisplayWidth-3 {
-					displayLine = plainText[:maxDisplayWidth-3] + "..."
-				}
+				displayLine = cutCells(plainText, 0, maxDisplayWidth-3) + "..."
 			}
+			displayLine = m.highlightSyntax(displayLine, functions)
+			displayLine = m.highlightSearch(displayLine)
 			
 			// Don't style non-focused gutters - use default colors
 			combined := lipgloss.JoinHorizontal(lipgloss.Top, gutter, " ", displayLine)
 			inputLines = append(inputLines, combined)
+			inputLines = append(inputLines, m.continuationRows(i)...)
 		}
 	}
 	m.InputViewport.SetContent(strings.Join(inputLines, "\n"))
 }
 
+// resultRows returns the label and the rows of line i's result in the result
+// pane. A result wider than the pane is wrapped over several rows when
+// WrapResults is set and truncated otherwise.
+func (m *Model) resultRows(i int) (string, []string) {
+	result := displayString(m.Results[i])
+	if isApproximateResult(m.Inputs[i].Value(), m.Results[i]) {
+		result = approximateMark + " " + result
+	}
+	if m.isSlowCalculation(i) {
+		result = spinnerFrames[m.SpinnerFrame]
+	}
+	if m.isResultHidden(i) {
+		// Keep a subtle marker so the line doesn't look empty
+		result = lipgloss.NewStyle().Faint(true).Render("‹hidden›")
+	}
+
+	maxResultWidth := m.resultWidth()
+
+	// Label results with their shortened input, leaving most of the width to
+	// the result. Inline results are right below their input.
+	label := ""
+	if m.ShowResultLabels && !m.InlineResults && result != "" {
+		labelWidth := min(maxResultLabelWidth, maxResultWidth/3)
+		label = resultLabel(m.Inputs[i].Value(), labelWidth)
+		maxResultWidth = max(1, maxResultWidth-labelWidth-1)
+	}
+
+	// First strip any existing ANSI codes to get plain text for length calculation
+	plainResult := stripANSIEscapeCodes(result)
+	if lipgloss.Width(plainResult) <= maxResultWidth {
+		return label, []string{result}
+	}
+	if m.WrapResults {
+		return label, wrapCells(plainResult, maxResultWidth)
+	}
+	return label, []string{m.truncateResult(plainResult, maxResultWidth)}
+}
+
+// inlineResultPrefix leads the first row of a result shown below its input
+const inlineResultPrefix = "= "
+
+// resultWidth returns the cells available to a row of a result: the width of
+// the result pane, or of the input pane after the gutter and the prefix when
+// results are shown inline
+func (m *Model) resultWidth() int {
+	width := m.ResultViewport.Width
+	if m.InlineResults {
+		width = m.InputViewport.Width - m.gutterWidth() - len(inlineResultPrefix)
+	}
+	if width <= 0 {
+		width = 20 // Fallback width
+	}
+	return width
+}
+
+// cutCells returns the part of text shown in the cells from from to to,
+// keeping all of its escape codes so styles still start and end. A wide glyph
+// split by either end is replaced by spaces, so the part takes to-from cells.
+func cutCells(text string, from, to int) string {
+	var builder strings.Builder
+	cell := 0
+	for i := 0; i < len(text); {
+		if escape := ansiEscapeAt(text, i); escape != "" {
+			builder.WriteString(escape)
+			i += len(escape)
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(text[i:])
+		cells := lipgloss.Width(string(r))
+		if cell >= from && cell+cells <= to {
+			builder.WriteString(text[i : i+size])
+		} else if cell < to && cell+cells > from {
+			builder.WriteString(strings.Repeat(" ", min(cell+cells, to)-max(cell, from)))
+		}
+		cell += cells
+		i += size
+	}
+	return builder.String()
+}
+
+// runeAtCell returns the index of the rune of text shown in cell, counting
+// from 0, or the number of runes for a cell past the end
+func runeAtCell(text string, cell int) int {
+	used := 0
+	for i, r := range []rune(text) {
+		used += lipgloss.Width(string(r))
+		if used > cell {
+			return i
+		}
+	}
+	return utf8.RuneCountInString(text)
+}
+
+// wrapCells splits text into rows of at most width cells, never splitting a glyph
+func wrapCells(text string, width int) []string {
+	var rows []string
+	var row strings.Builder
+	used := 0
+	for _, r := range text {
+		cells := lipgloss.Width(string(r))
+		if used > 0 && used+cells > width {
+			rows = append(rows, row.String())
+			row.Reset()
+			used = 0
+		}
+		row.WriteRune(r)
+		used += cells
+	}
+	return append(rows, row.String())
+}
+
+// lineHeight returns the number of rows line i takes in both panes. Results
+// shown inline take the rows below their input.
+func (m *Model) lineHeight(i int) int {
+	if m.InlineResults {
+		_, rows := m.resultRows(i)
+		if len(rows) == 1 && rows[0] == "" {
+			return 1
+		}
+		return 1 + len(rows)
+	}
+	if !m.WrapResults {
+		return 1
+	}
+	_, rows := m.resultRows(i)
+	return len(rows)
+}
+
+// popupRows returns the rows the completion popup takes below line i in both
+// panes: the popup itself in the input pane and as many blank rows next to it
+// in the result pane
+func (m *Model) popupRows(i int) int {
+	if i != m.Focused || !m.ShowCompletions || len(m.Completions) == 0 {
+		return 0
+	}
+	return len(m.renderCompletionPopup())
+}
+
+// lineRow returns the first row of line in the panes
+func (m *Model) lineRow(line int) int {
+	row := 0
+	for i := 0; i < line && i < len(m.Inputs); i++ {
+		row += m.lineHeight(i) + m.popupRows(i)
+	}
+	return row
+}
+
+// lineAtRow returns the line shown at row of the panes, or -1 for the rows of
+// the completion popup and below the last line
+func (m *Model) lineAtRow(row int) int {
+	for i := range m.Inputs {
+		if row < m.lineHeight(i) {
+			return i
+		}
+		row -= m.lineHeight(i) + m.popupRows(i)
+		if row < 0 {
+			return -1
+		}
+	}
+	return -1
+}
+
+// continuationRows returns the input pane rows next to the wrapped rows of
+// line i's result, keeping the following lines aligned with their results, or
+// the rows of the result itself when results are shown inline
+func (m *Model) continuationRows(i int) []string {
+	if m.InlineResults {
+		return m.inlineResultRows(i)
+	}
+	var rows []string
+	for r := 1; r < m.lineHeight(i); r++ {
+		rows = append(rows, strings.Repeat(" ", lineNumberDigits(len(m.Inputs)))+"│")
+	}
+	return rows
+}
+
+// inlineResultRows returns the rows below line i's input showing its result,
+// dim unless the line is focused
+func (m *Model) inlineResultRows(i int) []string {
+	if m.lineHeight(i) == 1 {
+		return nil
+	}
+	style := lipgloss.NewStyle().Faint(true)
+	if i == m.Focused {
+		style = lipgloss.NewStyle().Foreground(m.Theme.focusedColor).Bold(true)
+	}
+
+	_, results := m.resultRows(i)
+	gutter := strings.Repeat(" ", lineNumberDigits(len(m.Inputs))) + "│ "
+	rows := make([]string, len(results))
+	for r, result := range results {
+		// Wrapped rows are indented below the prefix, which an approximate
+		// result's mark replaces
+		prefix := inlineResultPrefix
+		if r > 0 {
+			prefix = strings.Repeat(" ", len(inlineResultPrefix))
+		} else if strings.HasPrefix(result, approximateMark+" ") {
+			prefix = ""
+		}
+		rows[r] = gutter + style.Render(prefix+result)
+	}
+	return rows
+}
+
 // updateResultViewport updates the results pane content
 func (m *Model) updateResultViewport() {
 	var resultLines []string
 	for i := range m.Inputs {
-		result := m.Results[i]
-		
-		// Simple truncation for results to prevent layout issues (same as input lines)
-		maxResultWidth := m.ResultViewport.Width
-		if maxResultWidth <= 0 {
-			maxResultWidth = 20 // Fallback width
-		}
-		
-		// First strip any existing ANSI codes to get plain text for length calculation
-		plainResult := stripANSIEscapeCodes(result)
-		if len(plainResult) > maxResultWidth {
-			result = plainResult[:maxResultWidth] + "…"
-		}
+		label, rows := m.resultRows(i)
 
 		// Get result width for padding
 		resultWidth := m.ResultViewport.Width
 		if resultWidth <= 0 {
 			resultWidth = 20 // Minimum fallback width
 		}
-		
-		if i == m.Focused {
-			result = lipgloss.NewStyle().
-				Foreground(m.Theme.focusedColor).
-				Bold(true).
-				Render(result)
-		} else {
-			result = lipgloss.NewStyle().
-				Render(result)
-		}
-		
-		// Pad with spaces to fill viewport width and maintain layout
-		resultVisualWidth := lipgloss.Width(result)
-		if resultVisualWidth < resultWidth {
-			result += strings.Repeat(" ", resultWidth-resultVisualWidth)
+
+		for r, result := range rows {
+			if i == m.Focused {
+				result = lipgloss.NewStyle().
+					Foreground(m.Theme.focusedColor).
+					Bold(true).
+					Render(result)
+			} else {
+				result = lipgloss.NewStyle().
+					Render(result)
+			}
+			if label != "" {
+				// Wrapped rows are indented below the label
+				if r == 0 {
+					result = lipgloss.NewStyle().Faint(true).Render(label) + " " + result
+				} else {
+					result = strings.Repeat(" ", lipgloss.Width(label)+1) + result
+				}
+			}
+
+			// Pad with spaces to fill viewport width and maintain layout
+			resultVisualWidth := lipgloss.Width(result)
+			if resultVisualWidth < resultWidth {
+				result += strings.Repeat(" ", resultWidth-resultVisualWidth)
+			}
+
+			resultLines = append(resultLines, result)
 		}
-		
-		resultLines = append(resultLines, result)
 
 		// Add empty lines to match completion popup height
-		if i == m.Focused && m.ShowCompletions && len(m.Completions) > 0 {
-			popupHeight := len(m.Completions) + 2 // Account for border
-			for j := 0; j < popupHeight; j++ {
-				resultLines = append(resultLines, "")
-			}
+		for j := 0; j < m.popupRows(i); j++ {
+			resultLines = append(resultLines, "")
 		}
 	}
 	
@@ -182,8 +431,8 @@ func (m *Model) renderCompletionPopup() []string {
 	displayCompletions := m.Completions[startIdx:endIdx]
 
 	for j, completion := range displayCompletions {
-		if len(completion) > maxWidth {
-			maxWidth = len(completion)
+		if lipgloss.Width(completion) > maxWidth {
+			maxWidth = lipgloss.Width(completion)
 		}
 
 		// Adjust index for scrolled window
@@ -229,26 +478,37 @@ func (m *Model) replaceAnsTokensWithValues(line string, currentIndex int) string
 	var commentPart string
 
 	// Split at comment boundary
-	if commentPos := strings.Index(displayLine, "//"); commentPos != -1 {
+	if commentPos := commentIndex(displayLine); commentPos != -1 {
 		commentPart = displayLine[commentPos:]
 		displayLine = displayLine[:commentPos]
 	}
 
-	for j := 0; j < currentIndex && j < len(m.Results); j++ {
-		if m.Results[j] != "" {
-			ansPattern := fmt.Sprintf("ans%d", j+1)
-			if strings.Contains(displayLine, ansPattern) {
-				styledValue := lipgloss.NewStyle().
-					Foreground(m.Theme.ansColor).
-					Bold(true).
-					Render(m.Results[j])
-				displayLine = strings.ReplaceAll(displayLine, ansPattern, styledValue)
-			}
+	// Replace references to labels of earlier lines, but not the line's own label
+	labelPrefix, displayLine := splitLabel(displayLine)
+	labels := lineLabels(m.inputValues(), currentIndex)
+	displayLine = replaceIdentifiers(displayLine, func(name string) (string, bool) {
+		j, exists := labels[name]
+		if !exists || j >= len(m.Results) || m.Results[j] == "" {
+			return "", false
 		}
-	}
+		return lipgloss.NewStyle().
+			Foreground(m.Theme.ansColor).
+			Bold(true).
+			Render(m.Results[j]), true
+	})
+
+	displayLine = replaceAnsReferences(displayLine, func(ref string, j int) (string, bool) {
+		if j >= currentIndex || j >= len(m.Results) || m.Results[j] == "" {
+			return "", false
+		}
+		return lipgloss.NewStyle().
+			Foreground(m.Theme.ansColor).
+			Bold(true).
+			Render(m.Results[j]), true
+	})
 
 	// Replace standalone 'ans' with highlighted last result
-	ansRegex := regexp.MustCompile(`\bans\b`)
+	ansRegex := ansKeywordRegex()
 	if ansRegex.MatchString(displayLine) {
 		for j := currentIndex - 1; j >= 0; j-- {
 			if m.Results[j] != "" {
@@ -262,8 +522,8 @@ func (m *Model) replaceAnsTokensWithValues(line string, currentIndex int) string
 		}
 	}
 
-	// Rejoin with comment part
-	return displayLine + commentPart
+	// Rejoin with label and comment part
+	return labelPrefix + displayLine + commentPart
 }
 
 
@@ -277,76 +537,160 @@ func stripANSIEscapeCodes(text string) string {
 // View renders the main UI view
 func (m Model) View() string {
 	baseStyle := lipgloss.NewStyle().
-		Height(m.Height - 2).
+		Height(m.Height - 3).
 		Border(lipgloss.RoundedBorder()).
 		Padding(0, 1)
 
+	inputPaneWidth, resultPaneWidth := splitWidth(m.Width, m.paneRatio())
 	inputStyle := baseStyle.Copy().
-		Width(int(float64(m.Width)*0.7) - 2)
+		Width(inputPaneWidth - 2)
 
 	resultStyle := baseStyle.Copy().
-		Width(int(float64(m.Width)*0.3) - 2)
+		Width(resultPaneWidth - 2)
 
 	// Force fixed widths to prevent layout shifts
   	inputPane := inputStyle.Render(m.InputViewport.View())
-    resultPane := resultStyle.Render(m.ResultViewport.View())
-
-	baseView := lipgloss.JoinHorizontal(lipgloss.Top, inputPane, resultPane)
+	if len(m.Tabs) > 1 {
+		// List the tabs in the top border of the input pane
+		inputPane = inputStyle.BorderTop(false).Render(m.InputViewport.View())
+		inputPane = m.renderTabBorder(lipgloss.Width(inputPane)) + "\n" + inputPane
+	}
+	var panes string
+	if m.InlineResults {
+		// Results are shown below their inputs, leaving the input pane alone
+		panes = m.withTotalBorder(inputPane)
+	} else {
+		resultPane := resultStyle.Render(m.ResultViewport.View())
+		panes = lipgloss.JoinHorizontal(lipgloss.Top, inputPane, m.withTotalBorder(resultPane))
+	}
+	baseView := panes + "\n" + m.renderStatusBar()
 
 	if m.ShowHelp {
 		return m.renderHelpPopup()
 	}
 
+	if m.ShowPopup {
+		return m.renderInfoPopup()
+	}
+
 	if m.ShowGoToLine {
 		return m.renderGoToLineDialog(baseView)
 	}
 
+	if m.ShowSearch {
+		return m.renderSearchDialog(baseView)
+	}
+
+	if m.ActivePrompt != PromptNone {
+		return m.renderPromptDialog(baseView)
+	}
+
 	return baseView
 }
 
+// renderStatusBar draws the bar below the panes showing the modes and
+// worksheet state
+func (m Model) renderStatusBar() string {
+	return lipgloss.NewStyle().
+		Foreground(m.Theme.focusedColor).
+		Padding(0, 1).
+		MaxWidth(m.Width).
+		Render(m.statusText())
+}
+
+// totalText returns the sums of the numeric results when the total is shown
+func (m Model) totalText() string {
+	if !m.ShowTotal {
+		return ""
+	}
+	totals := resultTotals(m.Results)
+	if len(totals) == 0 {
+		return ""
+	}
+	return "Σ " + strings.Join(totals, " · ")
+}
+
+// withTotalBorder shows the total in the bottom border of a pane when the
+// total is shown
+func (m Model) withTotalBorder(pane string) string {
+	total := m.totalText()
+	if total == "" {
+		return pane
+	}
+	lines := strings.Split(pane, "\n")
+	lines[len(lines)-1] = m.renderTotalBorder(lipgloss.Width(pane), total)
+	return strings.Join(lines, "\n")
+}
+
+// renderTotalBorder draws the bottom border of a pane showing the total
+func (m Model) renderTotalBorder(width int, total string) string {
+	border := lipgloss.RoundedBorder()
+	total = m.truncateResult(total, max(1, width-5))
+	title := lipgloss.NewStyle().Foreground(m.Theme.focusedColor).Bold(true).Render(" "+total+" ") + border.Bottom
+	fill := max(0, width-2-lipgloss.Width(title))
+	return border.BottomLeft + strings.Repeat(border.Bottom, fill) + title + border.BottomRight
+}
+
 // renderHelpPopup renders the help popup overlay
 func (m Model) renderHelpPopup() string {
-	// Use the scrollable viewport for help content
-	helpContent := m.HelpViewport.View()
+	return m.renderOverlayPopup(m.helpTitle(), m.HelpViewport)
+}
+
+// renderInfoPopup renders the info popup overlay
+func (m Model) renderInfoPopup() string {
+	return m.renderOverlayPopup(m.PopupTitle+" (Esc to close)", m.PopupViewport)
+}
+
+// renderOverlayPopup renders a scrollable viewport as a centered popup with a title
+func (m Model) renderOverlayPopup(title string, vp viewport.Model) string {
+	// Use the scrollable viewport for popup content
+	popupContent := vp.View()
 
-	helpStyle := lipgloss.NewStyle().
+	popupStyle := lipgloss.NewStyle().
 		Border(lipgloss.RoundedBorder()).
 		BorderForeground(m.Theme.borderColor).
 		Padding(1, 2).
 		Background(lipgloss.Color("0")).
 		Foreground(lipgloss.Color("7")).
-		Width(m.HelpViewport.Width + 4).  // Account for padding
-		Height(m.HelpViewport.Height + 4) // Account for padding
+		Width(vp.Width + 4).  // Account for padding
+		Height(vp.Height + 4) // Account for padding
 
-	// Add title with scroll info
-	title := "NaSC (↑↓ to scroll, Esc to close)"
 	titleStyle := lipgloss.NewStyle().
 		Bold(true).
 		Foreground(m.Theme.focusedColor).
-		Width(m.HelpViewport.Width)
+		Width(vp.Width)
 
-	helpWithTitle := titleStyle.Render(title) + "\n\n" + helpContent
-	helpBox := helpStyle.Render(helpWithTitle)
+	popupWithTitle := titleStyle.Render(title) + "\n\n" + popupContent
+	popupBox := popupStyle.Render(popupWithTitle)
 
-	// Center the help popup
+	// Center the popup
 	overlayStyle := lipgloss.NewStyle().
 		Width(m.Width).
 		Height(m.Height).
 		Align(lipgloss.Center, lipgloss.Center)
 
-	return overlayStyle.Render(helpBox)
+	return overlayStyle.Render(popupBox)
 }
 
 // renderGoToLineDialog renders the go-to-line dialog overlay
 func (m Model) renderGoToLineDialog(baseView string) string {
-	// Create the go-to-line input dialog
-	dialogContent := "Go to line: " + m.GoToLineInput.View()
+	return m.renderInputDialog(baseView, "Go to line: "+m.GoToLineInput.View(), 30)
+}
+
+// renderPromptDialog renders the active prompt dialog overlay
+func (m Model) renderPromptDialog(baseView string) string {
+	label := promptLabels[m.ActivePrompt]
+	return m.renderInputDialog(baseView, label+m.PromptInput.View(), lipgloss.Width(label)+m.PromptInput.Width+4)
+}
+
+// renderInputDialog renders a single-line input dialog near the bottom of the input pane
+func (m Model) renderInputDialog(baseView string, dialogContent string, dialogWidth int) string {
 	dialogBox := lipgloss.NewStyle().
 		Border(lipgloss.RoundedBorder()).
 		BorderForeground(m.Theme.borderColor).
 		Padding(0, 1).
 		Background(lipgloss.Color("0")).
-		Width(30).
+		Width(dialogWidth).
 		Render(dialogContent)
 
 	// Split the base view into lines
@@ -358,9 +702,9 @@ func (m Model) renderGoToLineDialog(baseView string) string {
 	}
 	
 	// Calculate position for dialog (bottom center of input pane)
-	inputPaneWidth := int(float64(m.Width) * 0.7)
-	dialogY := m.Height - 6 // Position near bottom
-	dialogX := inputPaneWidth/2 - 15 + 2 // Center in input pane
+	inputPaneWidth := m.inputPaneWidth()
+	dialogY := m.Height - 7 // Position near bottom, above the status bar
+	dialogX := inputPaneWidth/2 - dialogWidth/2 + 2 // Center in input pane
 	
 	// Create the dialog lines
 	dialogLines := strings.Split(dialogBox, "\n")
@@ -378,10 +722,11 @@ func (m Model) renderGoToLineDialog(baseView string) string {
 			prefix := ""
 			suffix := ""
 			
-			// Extract prefix (content before dialog position)
-			if dialogX > 0 && len(existingLine) > dialogX {
+			// Extract prefix (content before dialog position), by cells as
+			// wide glyphs like CJK take two
+			if dialogX > 0 && lipgloss.Width(existingLine) > dialogX {
 				// Get visual characters up to dialog position, preserving ANSI codes
-				prefix = existingLine[:min(len(existingLine), dialogX)]
+				prefix = cutCells(existingLine, 0, dialogX)
 			} else if dialogX > 0 {
 				// Pad if line is shorter than dialog position
 				prefix = existingLine + strings.Repeat(" ", dialogX-lipgloss.Width(existingLine))
@@ -389,10 +734,9 @@ func (m Model) renderGoToLineDialog(baseView string) string {
 			
 			// Extract suffix (content after dialog)
 			suffixStart := dialogX + dialogVisualWidth
-			if suffixStart < lipgloss.Width(existingLine) {
+			if lineWidth := lipgloss.Width(existingLine); suffixStart < lineWidth {
 				// Get remaining visual characters after dialog, preserving ANSI codes
-				remaining := existingLine[min(len(existingLine), suffixStart):]
-				suffix = remaining
+				suffix = cutCells(existingLine, suffixStart, lineWidth)
 			}
 			
 			// Reconstruct line: prefix + dialog + suffix
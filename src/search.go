@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	"github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// searchLabel is shown in front of the search dialog's input
+const searchLabel = "Find: "
+
+// openSearch opens the search dialog, keeping the last query
+func (m *Model) openSearch() (tea.Model, tea.Cmd) {
+	query := m.SearchInput.Value()
+	m.SearchInput = textinput.New()
+	m.SearchInput.Prompt = ""
+	m.SearchInput.Width = 20
+	m.SearchInput.SetValue(query)
+	m.SearchInput.Focus()
+	m.ShowSearch = true
+	m.updateInputViewport()
+	return *m, textinput.Blink
+}
+
+// closeSearch closes the search dialog, leaving the focus on the last match
+func (m *Model) closeSearch() (tea.Model, tea.Cmd) {
+	m.ShowSearch = false
+	m.SearchInput.Blur()
+	m.updateInputViewport()
+	return *m, textinput.Blink
+}
+
+// searchMatches returns the lines whose input contains query, ignoring case
+func (m Model) searchMatches(query string) []int {
+	if query == "" {
+		return nil
+	}
+	query = strings.ToLower(query)
+	var lines []int
+	for i, input := range m.Inputs {
+		if strings.Contains(strings.ToLower(input.Value()), query) {
+			lines = append(lines, i)
+		}
+	}
+	return lines
+}
+
+// jumpToSearchMatch focuses the next line matching the query, or for a
+// negative delta the previous one, wrapping around the worksheet. With a zero
+// delta the focused line is kept if it matches.
+func (m *Model) jumpToSearchMatch(delta int) {
+	matches := m.searchMatches(m.SearchInput.Value())
+	if len(matches) == 0 {
+		return
+	}
+
+	start := 1
+	if delta == 0 {
+		start, delta = 0, 1
+	}
+	target := -1
+	for offset := start; offset < len(m.Inputs); offset++ {
+		line := ((m.Focused+offset*delta)%len(m.Inputs) + len(m.Inputs)) % len(m.Inputs)
+		if slices.Contains(matches, line) {
+			target = line
+			break
+		}
+	}
+	if target < 0 || target == m.Focused {
+		return
+	}
+
+	m.Inputs[m.Focused].Blur()
+	m.Focused = target
+	m.Inputs[m.Focused].Focus()
+	m.updateViewports()
+	m.scrollToFocused()
+}
+
+// handleSearchKeys handles keyboard input while the search dialog is open.
+// Enter and ↓ jump to the next match, ↑ to the previous one.
+func (m *Model) handleSearchKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.Type {
+	case tea.KeyCtrlC:
+		return *m, tea.Quit
+
+	case tea.KeyEsc:
+		return m.closeSearch()
+
+	case tea.KeyEnter, tea.KeyDown:
+		m.jumpToSearchMatch(1)
+		return *m, textinput.Blink
+
+	case tea.KeyUp:
+		m.jumpToSearchMatch(-1)
+		return *m, textinput.Blink
+	}
+
+	// Typing searches from the focused line on
+	previous := m.SearchInput.Value()
+	var cmd tea.Cmd
+	m.SearchInput, cmd = m.SearchInput.Update(msg)
+	if m.SearchInput.Value() != previous {
+		m.jumpToSearchMatch(0)
+		m.updateInputViewport()
+	}
+	if cmd == nil {
+		// Don't let the key fall through to the focused input
+		cmd = func() tea.Msg { return nil }
+	}
+	return *m, cmd
+}
+
+// searchRuneMatches returns the rune indices of text covered by matches of
+// query, ignoring case
+func searchRuneMatches(text, query string) []int {
+	runes, queryRunes := []rune(text), []rune(query)
+	if len(queryRunes) == 0 {
+		return nil
+	}
+
+	var covered []int
+	for start := 0; start+len(queryRunes) <= len(runes); start++ {
+		matches := true
+		for i, r := range queryRunes {
+			if unicode.ToLower(runes[start+i]) != unicode.ToLower(r) {
+				matches = false
+				break
+			}
+		}
+		if !matches {
+			continue
+		}
+		for i := range queryRunes {
+			covered = append(covered, start+i)
+		}
+		start += len(queryRunes) - 1
+	}
+	return covered
+}
+
+// highlightSearch marks the matches of the search query in a rendered input
+// while the search dialog is open
+func (m Model) highlightSearch(text string) string {
+	if !m.ShowSearch {
+		return text
+	}
+	covered := searchRuneMatches(stripANSIEscapeCodes(text), m.SearchInput.Value())
+	if len(covered) == 0 {
+		return text
+	}
+
+	matchStyle := lipgloss.NewStyle().Reverse(true)
+	styles := make(map[int]lipgloss.Style, len(covered))
+	for _, i := range covered {
+		styles[i] = matchStyle
+	}
+	return styleRunes(text, styles, true)
+}
+
+// renderSearchDialog renders the search dialog with the position of the
+// focused line among the matches
+func (m Model) renderSearchDialog(baseView string) string {
+	content := searchLabel + m.SearchInput.View()
+	if query := m.SearchInput.Value(); query != "" {
+		matches := m.searchMatches(query)
+		switch index := slices.Index(matches, m.Focused); {
+		case len(matches) == 0:
+			content += " (no matches)"
+		case index >= 0:
+			content += fmt.Sprintf(" (%d/%d)", index+1, len(matches))
+		default:
+			content += fmt.Sprintf(" (%d matches)", len(matches))
+		}
+	}
+	return m.renderInputDialog(baseView, content, len(searchLabel)+m.SearchInput.Width+16)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	"github.com/charmbracelet/bubbletea"
+)
+
+// selectedLines returns the first and last selected line, from the anchor to
+// the focused line, or the focused line and false without a selection
+func (m Model) selectedLines() (int, int, bool) {
+	if !m.Selecting {
+		return m.Focused, m.Focused, false
+	}
+	anchor := min(m.SelectionAnchor, len(m.Inputs)-1)
+	return min(anchor, m.Focused), max(anchor, m.Focused), true
+}
+
+// isSelected reports whether line i is part of the selection
+func (m Model) isSelected(i int) bool {
+	first, last, selecting := m.selectedLines()
+	return selecting && i >= first && i <= last
+}
+
+// extendSelection moves the focus delta lines, selecting the lines from the
+// one focused when the selection started
+func (m *Model) extendSelection(delta int) (tea.Model, tea.Cmd) {
+	if !m.Selecting {
+		m.Selecting = true
+		m.SelectionAnchor = m.Focused
+	}
+	if line := m.Focused + delta; line >= 0 && line < len(m.Inputs) {
+		m.focusVertically(line)
+	}
+	m.updateViewports()
+	return *m, textinput.Blink
+}
+
+// clearSelection ends the selection, keeping the focus on its last moved line
+func (m *Model) clearSelection() {
+	m.Selecting = false
+	m.updateViewports()
+}
+
+// handleSelectionKeys runs the line operations of the keys deleting, copying
+// or commenting on all selected lines, reporting whether it handled the key.
+// Esc only ends the selection, and other keys end it too but are left to be
+// handled as usual.
+func (m *Model) handleSelectionKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd, bool) {
+	var result tea.Model
+	var cmd tea.Cmd
+	switch action := config.Keys.bindings()[msg.String()]; {
+	case msg.Type == tea.KeyEsc:
+		m.clearSelection()
+		return *m, textinput.Blink, true
+	case action == "deleteLine":
+		result, cmd = m.deleteSelection()
+	case action == "copyResult":
+		result, cmd = m.copySelection()
+	case action == "toggleComment":
+		result, cmd = m.toggleSelectionComment()
+	default:
+		m.clearSelection()
+		return *m, nil, false
+	}
+	return result, cmd, true
+}
+
+// deleteSelection deletes the selected lines as one undo step and focuses the
+// line taking their place
+func (m *Model) deleteSelection() (tea.Model, tea.Cmd) {
+	first, last, _ := m.selectedLines()
+	m.Selecting = false
+	if first == 0 && last == len(m.Inputs)-1 {
+		return m.clearAll()
+	}
+	m.saveState()
+
+	m.Inputs = slices.Delete(m.Inputs, first, last+1)
+	m.Results = slices.Delete(m.Results, first, last+1)
+	m.Calculating = slices.Delete(m.Calculating, first, last+1)
+	if first < len(m.HiddenResults) {
+		m.HiddenResults = slices.Delete(m.HiddenResults, first, min(last+1, len(m.HiddenResults)))
+	}
+	if first < len(m.Notes) {
+		m.Notes = slices.Delete(m.Notes, first, min(last+1, len(m.Notes)))
+	}
+
+	// Lines below may use a function, variable or result of the deleted lines
+	cmd := m.recalculateFrom(first)
+
+	m.Focused = min(first, len(m.Inputs)-1)
+	for i := range m.Inputs {
+		if i == m.Focused {
+			m.Inputs[i].Focus()
+		} else {
+			m.Inputs[i].Blur()
+		}
+	}
+	m.updateViewports()
+	m.scrollToFocused()
+	return *m, tea.Batch(textinput.Blink, cmd)
+}
+
+// copySelection copies the results of the selected lines, one per line, and
+// keeps the selection
+func (m *Model) copySelection() (tea.Model, tea.Cmd) {
+	first, last, _ := m.selectedLines()
+	var lines []string
+	for _, result := range m.Results[first : last+1] {
+		if result == "" {
+			continue
+		}
+		if config.CopyPlainResults {
+			result = plainResult(result)
+		}
+		lines = append(lines, result)
+	}
+	if len(lines) == 0 {
+		return *m, textinput.Blink
+	}
+	return m.copyText(strings.Join(lines, "\n"))
+}
+
+// toggleSelectionComment comments out the selected lines as one undo step, or
+// restores them if all of them are commented. Empty lines are left alone.
+func (m *Model) toggleSelectionComment() (tea.Model, tea.Cmd) {
+	first, last, _ := m.selectedLines()
+	commented := true
+	for i := first; i <= last; i++ {
+		if value := m.Inputs[i].Value(); value != "" && !isCommented(value) {
+			commented = false
+		}
+	}
+	m.saveState()
+
+	for i := first; i <= last; i++ {
+		value := m.Inputs[i].Value()
+		if value == "" || isCommented(value) != commented {
+			continue
+		}
+		m.Inputs[i].SetValue(toggledComment(value))
+		m.Inputs[i].CursorEnd()
+	}
+
+	// Lines below may reference the selected lines
+	cmd := m.recalculateFrom(first)
+	m.updateViewports()
+	return *m, tea.Batch(textinput.Blink, cmd)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+// NumberSeparators are the decimal and thousands separators of numbers in
+// inputs and results
+type NumberSeparators struct {
+	Decimal   string
+	Thousands string // Empty if digits aren't grouped
+}
+
+// separators are the active separators, set with SetSeparators
+var separators = NumberSeparators{Decimal: "."}
+
+// decimal returns the decimal separator, a dot unless configured otherwise
+func (s NumberSeparators) decimal() string {
+	if s.Decimal == "" {
+		return "."
+	}
+	return s.Decimal
+}
+
+// numberRegex matches numbers written with the separators: grouped numbers
+// like "1.234,5" and, for a decimal comma, plain decimals like "3,14"
+func (s NumberSeparators) numberRegex() *regexp.Regexp {
+	decimal := regexp.QuoteMeta(s.decimal())
+	var patterns []string
+	if s.Thousands != "" {
+		patterns = append(patterns, `\d{1,3}(?:`+regexp.QuoteMeta(s.Thousands)+`\d{3})+(?:`+decimal+`\d+)?`)
+	}
+	if s.decimal() != "." {
+		patterns = append(patterns, `\d+`+decimal+`\d+`)
+	}
+	if len(patterns) == 0 {
+		return nil
+	}
+	return regexp.MustCompile(strings.Join(patterns, "|"))
+}
+
+// isSeparatorRune reports whether r is a dot or one of the separators
+func (s NumberSeparators) isSeparatorRune(r rune) bool {
+	return r == '.' || strings.ContainsRune(s.decimal()+s.Thousands, r)
+}
+
+// continuesNumber reports whether the number ending at end or starting at
+// start continues with more digits, possibly after a separator
+func (s NumberSeparators) continuesNumber(text string, start, end int) bool {
+	isDigit := func(r rune) bool { return r >= '0' && r <= '9' }
+
+	before, size := utf8.DecodeLastRuneInString(text[:start])
+	if isDigit(before) {
+		return true
+	}
+	if s.isSeparatorRune(before) {
+		if r, _ := utf8.DecodeLastRuneInString(text[:start-size]); isDigit(r) {
+			return true
+		}
+	}
+
+	after, size := utf8.DecodeRuneInString(text[end:])
+	if isDigit(after) {
+		return true
+	}
+	if s.isSeparatorRune(after) {
+		if r, _ := utf8.DecodeRuneInString(text[end+size:]); isDigit(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeNumbers rewrites numbers written with the configured separators to
+// the plain form libqalculate and strconv read, like "1.234,5" to "1234.5".
+// Matches that are part of a longer run of digits and separators are kept.
+func normalizeNumbers(text string) string {
+	regex := separators.numberRegex()
+	if regex == nil {
+		return text
+	}
+
+	var builder strings.Builder
+	last := 0
+	for _, loc := range regex.FindAllStringIndex(text, -1) {
+		if separators.continuesNumber(text, loc[0], loc[1]) {
+			continue
+		}
+
+		number := text[loc[0]:loc[1]]
+		if separators.Thousands != "" {
+			number = strings.ReplaceAll(number, separators.Thousands, "")
+		}
+		number = strings.Replace(number, separators.decimal(), ".", 1)
+
+		builder.WriteString(text[last:loc[0]])
+		builder.WriteString(number)
+		last = loc[1]
+	}
+	builder.WriteString(text[last:])
+	return builder.String()
+}
+
+// localizeDecimal writes the decimal points of numbers formatted by Go with
+// the configured decimal separator
+func localizeDecimal(text string) string {
+	if separators.decimal() == "." {
+		return text
+	}
+	return decimalPointRegex.ReplaceAllString(text, "${1}"+separators.decimal()+"${2}")
+}
+
+// decimalPointRegex matches a decimal point between digits
+var decimalPointRegex = regexp.MustCompile(`(\d)\.(\d)`)
+
+// groupThousands inserts the thousands separator into the integer part of a
+// result that is a plain number, optionally followed by a unit like "1234.5 m".
+// Dates, times and numbers in other bases are left alone.
+func groupThousands(result string) string {
+	if separators.Thousands == "" {
+		return result
+	}
+
+	regex := regexp.MustCompile(`^([−-]?)(\d{4,})((?:` + regexp.QuoteMeta(separators.decimal()) + `\d+)?(?:\s.*)?)$`)
+	parts := regex.FindStringSubmatch(result)
+	if parts == nil {
+		return result
+	}
+
+	digits := parts[2]
+	var grouped strings.Builder
+	for i, digit := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			grouped.WriteString(separators.Thousands)
+		}
+		grouped.WriteRune(digit)
+	}
+	return parts[1] + grouped.String() + parts[3]
+}
+
+// truncateResult shortens a result to fit width cells including a trailing
+// "…". It cuts between whole glyphs, so wide characters and multibyte symbols
+// like € stay intact, and drops separators left dangling like in "1.234.…".
+func (m *Model) truncateResult(result string, width int) string {
+	if lipgloss.Width(result) <= width {
+		return result
+	}
+
+	var kept strings.Builder
+	used := 0
+	for _, r := range result {
+		cells := lipgloss.Width(string(r))
+		if used+cells > width-1 {
+			break
+		}
+		kept.WriteRune(r)
+		used += cells
+	}
+	return strings.TrimRight(kept.String(), m.Separators.decimal()+m.Separators.Thousands+" ") + "…"
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	"github.com/charmbracelet/bubbletea"
+)
+
+// AngleUnit mirrors libqalculate's AngleUnit enum
+type AngleUnit int
+
+const (
+	AngleUnitNone AngleUnit = iota
+	AngleUnitRadians
+	AngleUnitDegrees
+	AngleUnitGradians
+)
+
+// DefaultPrecision is the number of decimals shown unless a worksheet sets it
+const DefaultPrecision = 9
+
+// maxPrecision limits the decimals a worksheet can request
+const maxPrecision = 20
+
+// angleUnitNames maps the values accepted by the angle directive
+var angleUnitNames = map[string]AngleUnit{
+	"rad":      AngleUnitRadians,
+	"radians":  AngleUnitRadians,
+	"deg":      AngleUnitDegrees,
+	"degrees":  AngleUnitDegrees,
+	"gra":      AngleUnitGradians,
+	"grad":     AngleUnitGradians,
+	"gradians": AngleUnitGradians,
+}
+
+// angleUnitTags name the angle units in the status bar
+var angleUnitTags = map[AngleUnit]string{
+	AngleUnitRadians:  "RAD",
+	AngleUnitDegrees:  "DEG",
+	AngleUnitGradians: "GRA",
+}
+
+// angleUnitCycle is the order Alt+U switches through the angle units in
+var angleUnitCycle = []AngleUnit{AngleUnitRadians, AngleUnitDegrees, AngleUnitGradians}
+
+// trigFunctionRegex matches calls of functions whose result depends on the angle unit
+var trigFunctionRegex = regexp.MustCompile(`\b(?:a|arc)?(?:sin|cos|tan|sec|csc|cot)\s*\(|\batan2\s*\(`)
+
+// SessionSettings are calculation defaults for the loaded worksheet
+type SessionSettings struct {
+	AngleUnit AngleUnit
+	Precision int
+}
+
+// DefaultSessionSettings returns the settings used without a worksheet header,
+// starting in the configured angle unit
+func DefaultSessionSettings() SessionSettings {
+	unit, exists := angleUnitNames[config.AngleUnit]
+	if !exists {
+		unit = AngleUnitRadians
+	}
+	return SessionSettings{
+		AngleUnit: unit,
+		Precision: DefaultPrecision,
+	}
+}
+
+// parseSessionHeader reads settings from a header line like
+// "//! angle=deg precision=4", reporting false if the line is no header.
+// Unknown keys and invalid values keep their defaults.
+func parseSessionHeader(line string) (SessionSettings, bool) {
+	settings := DefaultSessionSettings()
+	if !strings.HasPrefix(strings.TrimSpace(line), "//!") {
+		return settings, false
+	}
+
+	directives := parseLineDirectives(line)
+	if unit, exists := angleUnitNames[directives["angle"]]; exists {
+		settings.AngleUnit = unit
+	}
+	if precision, err := strconv.Atoi(directives["precision"]); err == nil && precision >= 0 && precision <= maxPrecision {
+		settings.Precision = precision
+	}
+	return settings, true
+}
+
+// applySessionSettings makes settings the active calculation defaults
+func (m *Model) applySessionSettings(settings SessionSettings) {
+	m.Session = settings
+	SetAngleUnit(settings.AngleUnit)
+	SetPrecision(settings.Precision)
+}
+
+// recalculateAll calculates every line again from the top, so lines pick up
+// changed calculation settings and the new results of the lines they reference
+func (m *Model) recalculateAll() {
+	for i := range m.Inputs {
+		m.Results[i] = m.calculateLine(i)
+		m.Calculating[i] = false
+	}
+	m.LastResultContent = ""
+	m.updateViewports()
+}
+
+// toggleExactMode switches all lines between exact and approximate results
+func (m *Model) toggleExactMode() (tea.Model, tea.Cmd) {
+	m.ExactMode = !m.ExactMode
+	SetExactMode(m.ExactMode)
+	m.recalculateAll()
+	return *m, textinput.Blink
+}
+
+// cycleAngleUnit switches trigonometric functions to the next angle unit and
+// recalculates from the first line using one, so lines referencing it follow
+func (m *Model) cycleAngleUnit() (tea.Model, tea.Cmd) {
+	next := 0
+	for i, unit := range angleUnitCycle {
+		if unit == m.Session.AngleUnit {
+			next = (i + 1) % len(angleUnitCycle)
+		}
+	}
+	m.Session.AngleUnit = angleUnitCycle[next]
+	SetAngleUnit(m.Session.AngleUnit)
+
+	for i := range m.Inputs {
+		if trigFunctionRegex.MatchString(stripComment(m.Inputs[i].Value())) {
+			for j := i; j < len(m.Inputs); j++ {
+				m.Results[j] = m.calculateLine(j)
+			}
+			break
+		}
+	}
+	m.LastResultContent = ""
+	m.updateViewports()
+	return *m, textinput.Blink
+}
+
+// statusText lists the modes and worksheet state shown in the status bar
+func (m Model) statusText() string {
+	var status []string
+	if m.SubResult != "" {
+		status = append(status, m.SubResult)
+	}
+	if config.VimMode {
+		status = append(status, editModeTags[m.Mode])
+	}
+	if tag := angleUnitTags[m.Session.AngleUnit]; tag != "" {
+		status = append(status, tag)
+	}
+	if m.ExactMode {
+		status = append(status, "exact")
+	}
+	if m.FractionMode {
+		status = append(status, "frac")
+	}
+	if m.EngineeringMode {
+		status = append(status, "eng")
+	}
+	status = append(status, outputBases[m.OutputBase].name)
+	status = append(status, fmt.Sprintf("precision %d", m.Session.Precision))
+
+	lines := fmt.Sprintf("%d lines", len(m.Inputs))
+	if len(m.Inputs) == 1 {
+		lines = "1 line"
+	}
+	status = append(status, lines)
+	if m.Follow {
+		status = append(status, "follow")
+	}
+	if first, last, selecting := m.selectedLines(); selecting {
+		status = append(status, fmt.Sprintf("%d selected", last-first+1))
+	}
+
+	rates := "rates " + m.RatesTime.Format(time.DateOnly)
+	switch {
+	case !m.RatesChecked:
+		rates = "rates loading"
+	case m.RatesTime.IsZero():
+		rates = "no rates"
+	}
+	if m.RatesRefresh != "" {
+		rates += " (" + m.RatesRefresh + ")"
+	}
+	status = append(status, rates)
+	return strings.Join(status, " · ")
+}
+
+// States of a forced exchange rates update shown in the status bar
+const (
+	RatesRefreshRunning = "updating"
+	RatesRefreshDone    = "updated"
+	RatesRefreshFailed  = "update failed"
+)
+
+// refreshExchangeRates fetches the exchange rates now, however recent they
+// are, showing the progress in the status bar
+func (m *Model) refreshExchangeRates() (tea.Model, tea.Cmd) {
+	if m.RatesRefresh == RatesRefreshRunning {
+		return *m, textinput.Blink
+	}
+	m.RatesRefresh = RatesRefreshRunning
+	m.updateViewports()
+	return *m, refreshExchangeRatesCmd()
+}
+
+// handleRatesRefreshMessage shows the outcome of a forced rates update and
+// recalculates from the first line using a currency, so lines referencing it
+// follow
+func (m *Model) handleRatesRefreshMessage(msg ratesRefreshMsg) (tea.Model, tea.Cmd) {
+	m.RatesChecked = true
+	m.RatesTime = msg.time
+	if !msg.updated {
+		m.RatesRefresh = RatesRefreshFailed
+		m.updateViewports()
+		return *m, nil
+	}
+
+	m.RatesRefresh = RatesRefreshDone
+	currency := currencyRegex()
+	for i := range m.Inputs {
+		input := replaceCurrencySymbols(stripComment(m.Inputs[i].Value()))
+		if currency.MatchString(input) || currency.MatchString(m.Results[i]) {
+			for j := i; j < len(m.Inputs); j++ {
+				m.Results[j] = m.calculateLine(j)
+			}
+			break
+		}
+	}
+	m.LastResultContent = ""
+	m.updateViewports()
+	return *m, nil
+}
+
+// outputBases are the bases cycled through with Ctrl+B, named as in the status bar
+var outputBases = []struct {
+	base int
+	name string
+}{
+	{10, "dec"},
+	{16, "hex"},
+	{2, "bin"},
+	{8, "oct"},
+}
+
+// cycleOutputBase shows all results in the next output base
+func (m *Model) cycleOutputBase() (tea.Model, tea.Cmd) {
+	m.OutputBase = (m.OutputBase + 1) % len(outputBases)
+	SetOutputBase(outputBases[m.OutputBase].base)
+	m.recalculateAll()
+	return *m, textinput.Blink
+}
+
+// toggleFractionMode switches all lines between fractions and decimals
+func (m *Model) toggleFractionMode() (tea.Model, tea.Cmd) {
+	m.FractionMode = !m.FractionMode
+	SetFractionMode(m.FractionMode)
+	m.recalculateAll()
+	return *m, textinput.Blink
+}
+
+// toggleEngineeringMode switches all lines between engineering notation with
+// SI prefixes like 4.7k and plain numbers
+func (m *Model) toggleEngineeringMode() (tea.Model, tea.Cmd) {
+	m.EngineeringMode = !m.EngineeringMode
+	engineeringMode = m.EngineeringMode
+	m.recalculateAll()
+	return *m, textinput.Blink
+}
+
+// togglePlainResults switches all lines between superscript exponents like
+// 1.23 × 10⁻⁴ and ASCII ones like 1.23E-4
+func (m *Model) togglePlainResults() (tea.Model, tea.Cmd) {
+	m.PlainResults = !m.PlainResults
+	SetPrettyPrint(!m.PlainResults)
+	m.recalculateAll()
+	return *m, textinput.Blink
+}
+
+// loadWorksheet adds the non-empty lines of a worksheet, first applying the
+// session settings of its header line so the remaining lines compute accordingly
+func (m *Model) loadWorksheet(content string) {
+	m.addWorksheet(content, false)
+}
+
+// addWorksheet adds the lines of a worksheet like loadWorksheet, keeping its
+// empty lines if keepEmpty is set
+func (m *Model) addWorksheet(content string, keepEmpty bool) {
+	content, notes := splitWorksheetNotes(content, keepEmpty)
+	firstLine, _, _ := strings.Cut(strings.TrimSpace(content), "\n")
+	if settings, ok := parseSessionHeader(firstLine); ok {
+		m.applySessionSettings(settings)
+	}
+
+	start := len(m.Inputs)
+	if keepEmpty {
+		lines := strings.Split(content, "\n")
+		for i := range lines {
+			lines[i] = strings.TrimSpace(lines[i])
+		}
+		m.addInputLines(lines)
+	} else {
+		m.addMultipleInputs(content)
+	}
+	for i, note := range notes {
+		m.setNote(start+i, note)
+	}
+}
+
+// restoreWorksheet loads a worksheet into a fresh model, replacing its empty
+// first line and keeping empty lines so ans references count lines as saved
+func (m *Model) restoreWorksheet(content string) {
+	if len(m.Inputs) == 1 && m.Inputs[0].Value() == "" {
+		// There is nothing to undo back to before the worksheet
+		undo := m.UndoSystem
+		m.UndoSystem = nil
+		defer func() { m.UndoSystem = undo }()
+
+		m.Inputs, m.Results, m.Calculating = m.Inputs[:0], m.Results[:0], m.Calculating[:0]
+	}
+	m.addWorksheet(strings.TrimRightFunc(content, unicode.IsSpace), true)
+}
+
+// startupTemplate returns the worksheet configured for sessions started without
+// input: the template file followed by the inline startup lines
+func startupTemplate() (string, error) {
+	var parts []string
+	if config.StartupTemplate != "" {
+		data, err := os.ReadFile(expandHome(config.StartupTemplate))
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, strings.TrimSpace(string(data)))
+	}
+	parts = append(parts, config.StartupLines...)
+	return strings.TrimSpace(strings.Join(parts, "\n")), nil
+}
+
+// savedSessionPath returns the file the lines of the last session are kept in
+func savedSessionPath() string {
+	dir := os.Getenv("XDG_DATA_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(dir, "nasc", "session.txt")
+}
+
+// undoHistoryPath returns the file the undo history of the session saved to
+// sessionPath is kept in
+func undoHistoryPath(sessionPath string) string {
+	if sessionPath == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(sessionPath), "undo.json")
+}
+
+// loadSavedSession returns the lines saved by the last session, or nothing
+// if no session was saved yet
+func loadSavedSession(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	return strings.TrimRightFunc(string(data), unicode.IsSpace), err
+}
+
+// saveSession writes the lines and notes of the active worksheet to path so
+// the next launch continues with them, along with their undo history
+func (m *Model) saveSession(path string) error {
+	if path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// Leading empty lines are kept as ans references count them
+	content := strings.TrimRightFunc(m.worksheetText(), unicode.IsSpace)
+	if err := os.WriteFile(path, []byte(content+"\n"), 0o644); err != nil {
+		return err
+	}
+	if m.UndoSystem == nil {
+		return nil
+	}
+	return m.UndoSystem.saveHistory(undoHistoryPath(path), content)
+}
+
+// restoreUndoHistory restores the undo history saved with the session at
+// path, if it was saved for the restored lines
+func (m *Model) restoreUndoHistory(path string, content string) error {
+	if path == "" || m.UndoSystem == nil {
+		return nil
+	}
+	return m.UndoSystem.loadHistory(undoHistoryPath(path), content)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"slices"
+	"time"
+
+	"github.com/charmbracelet/bubbletea"
+)
+
+// spinnerFrames animate the result of a slow calculation
+var spinnerFrames = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+
+// spinnerInterval is the time between two spinner frames
+const spinnerInterval = 100 * time.Millisecond
+
+// spinnerDelay is how long a calculation runs before its spinner shows, so
+// results don't flash a spinner while typing
+const spinnerDelay = 300 * time.Millisecond
+
+// spinnerTickMsg advances the spinners of slow calculations
+type spinnerTickMsg struct{}
+
+// spinnerTick schedules the next spinner frame
+func spinnerTick() tea.Cmd {
+	return tea.Tick(spinnerInterval, func(time.Time) tea.Msg {
+		return spinnerTickMsg{}
+	})
+}
+
+// isSlowCalculation reports whether line i has calculated long enough to show
+// a spinner instead of its result
+func (m Model) isSlowCalculation(i int) bool {
+	return i < len(m.Calculating) && m.Calculating[i] &&
+		m.Calculations != nil && m.Calculations.RunningFor(i) >= spinnerDelay
+}
+
+// animateCalculations starts the spinner tick once a line calculates
+func (m Model) animateCalculations(cmd tea.Cmd) (tea.Model, tea.Cmd) {
+	if m.SpinnerTicking || !slices.Contains(m.Calculating, true) {
+		return m, cmd
+	}
+	m.SpinnerTicking = true
+	return m, tea.Batch(cmd, spinnerTick())
+}
+
+// handleSpinnerTick shows the next spinner frame, stopping the tick when no
+// line calculates anymore. Only the result pane is rendered again, and only
+// while a spinner shows.
+func (m *Model) handleSpinnerTick() (tea.Model, tea.Cmd) {
+	if !slices.Contains(m.Calculating, true) {
+		m.SpinnerTicking = false
+		return *m, nil
+	}
+
+	m.SpinnerFrame = (m.SpinnerFrame + 1) % len(spinnerFrames)
+	for i := range m.Calculating {
+		if m.isSlowCalculation(i) {
+			m.updateResultViewport()
+			break
+		}
+	}
+	return *m, spinnerTick()
+}
@@ -1,6 +1,16 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+
 	"github.com/charmbracelet/lipgloss"
 )
 
@@ -13,6 +23,11 @@ type Theme struct {
 	resultBg       lipgloss.Color
 	gutterColor    lipgloss.Color
 	ansColor       lipgloss.Color
+	bracketColor   lipgloss.Color
+	errorColor     lipgloss.Color
+	numberColor    lipgloss.Color
+	operatorColor  lipgloss.Color
+	functionColor  lipgloss.Color
 }
 
 func newTheme() Theme {
@@ -25,5 +40,93 @@ func newTheme() Theme {
 		resultBg:       lipgloss.Color("0"),
 		gutterColor:    lipgloss.Color(""),   
 		ansColor:       lipgloss.Color("2"),   
+		bracketColor:   lipgloss.Color("6"),
+		errorColor:     lipgloss.Color("1"),
+		numberColor:    lipgloss.Color("3"),
+		operatorColor:  lipgloss.Color("5"),
+		functionColor:  lipgloss.Color("12"),
+	}
+}
+
+// fields maps the keys of the theme file to the colors they set
+func (t *Theme) fields() map[string]*lipgloss.Color {
+	return map[string]*lipgloss.Color{
+		"focusedColor":   &t.focusedColor,
+		"unfocusedColor": &t.unfocusedColor,
+		"resultColor":    &t.resultColor,
+		"borderColor":    &t.borderColor,
+		"inputBg":        &t.inputBg,
+		"resultBg":       &t.resultBg,
+		"gutterColor":    &t.gutterColor,
+		"ansColor":       &t.ansColor,
+		"bracketColor":   &t.bracketColor,
+		"errorColor":     &t.errorColor,
+		"numberColor":    &t.numberColor,
+		"operatorColor":  &t.operatorColor,
+		"functionColor":  &t.functionColor,
+	}
+}
+
+// themePath returns the path of the theme file
+func themePath() string {
+	dir := configDir()
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, "theme.json")
+}
+
+// colorRegex matches hex colors like "#f80" and "#ff8800" and ANSI palette indices
+var colorRegex = regexp.MustCompile(`^(?:#[0-9a-fA-F]{3}|#[0-9a-fA-F]{6}|\d{1,3})$`)
+
+// validateColor checks that color is empty, a hex color or an ANSI palette index
+func validateColor(color string) error {
+	if color == "" {
+		return nil
+	}
+	if colorRegex.MatchString(color) {
+		if index, err := strconv.Atoi(color); err != nil || index <= 255 {
+			return nil
+		}
 	}
-}
\ No newline at end of file
+	return fmt.Errorf("invalid color %q: use a hex color like \"#ff8800\" or an ANSI index from 0 to 255", color)
+}
+
+// LoadTheme reads the theme file at path, falling back to the default colors
+// for a missing file, absent fields and invalid colors
+func LoadTheme(path string) (Theme, error) {
+	theme := newTheme()
+	if path == "" {
+		return theme, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return theme, nil
+	}
+	if err != nil {
+		return theme, err
+	}
+
+	var colors map[string]string
+	if err := json.Unmarshal(data, &colors); err != nil {
+		return theme, err
+	}
+
+	// Keep the default of unusable colors but apply the other ones
+	var errs []error
+	fields := theme.fields()
+	for _, key := range slices.Sorted(maps.Keys(colors)) {
+		field, exists := fields[key]
+		if !exists {
+			errs = append(errs, fmt.Errorf("unknown theme color %q", key))
+			continue
+		}
+		if err := validateColor(colors[key]); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+			continue
+		}
+		*field = lipgloss.Color(colors[key])
+	}
+	return theme, errors.Join(errs...)
+}
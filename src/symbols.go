@@ -0,0 +1,60 @@
+package main
+
+import (
+	"github.com/charmbracelet/bubbles/textinput"
+	"github.com/charmbracelet/bubbletea"
+)
+
+// paletteSymbols lists the symbols offered by the symbol palette
+var paletteSymbols = []struct {
+	symbol string
+	name   string
+}{
+	{"π", "pi"},
+	{"e", "Euler's number"},
+	{"√", "square root"},
+	{"∞", "infinity"},
+	{"°", "degree"},
+	{"×", "times"},
+	{"÷", "divided by"},
+	{"€", "euro"},
+	{"$", "dollar"},
+	{"£", "pound"},
+	{"¥", "yen"},
+	{"₹", "rupee"},
+	{"α", "alpha"},
+	{"β", "beta"},
+	{"γ", "gamma"},
+	{"δ", "delta"},
+	{"θ", "theta"},
+	{"λ", "lambda"},
+	{"μ", "mu, micro"},
+	{"σ", "sigma"},
+	{"φ", "phi"},
+	{"ω", "omega"},
+	{"Δ", "Delta"},
+	{"Ω", "Omega, ohm"},
+}
+
+// openSymbolPalette lists the palette symbols to insert one at the cursor
+func (m *Model) openSymbolPalette() (tea.Model, tea.Cmd) {
+	labels := make([]string, len(paletteSymbols))
+	for i, entry := range paletteSymbols {
+		labels[i] = entry.symbol + "  " + entry.name
+	}
+
+	m.Completions = labels
+	m.SelectedCompletion = 0
+	m.ShowCompletions = true
+	m.ActiveMenu = MenuSymbols
+	m.updateViewports()
+	return *m, textinput.Blink
+}
+
+// insertPaletteSymbol inserts the chosen palette symbol at the cursor
+func (m *Model) insertPaletteSymbol(index int) {
+	if index < 0 || index >= len(paletteSymbols) {
+		return
+	}
+	m.insertAtCursor(paletteSymbols[index].symbol)
+}
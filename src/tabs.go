@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	"github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// Worksheet holds the state of a tab while another tab is active
+type Worksheet struct {
+	ID            int
+	Inputs        []textinput.Model
+	Results       []string
+	HiddenResults []bool
+	Notes         []string
+	Focused       int
+	UndoSystem    *UndoSystem
+}
+
+// calculateLineCmd calculates a line of the active tab, superseding a
+// calculation of the line still in flight. The result is tagged with the tab
+// so it is dropped if another tab became active meanwhile.
+func (m *Model) calculateLineCmd(expr string, index int) tea.Cmd {
+	return m.calculateLineCmdWithCache(expr, index, false)
+}
+
+// calculateLineCmdWithCache is calculateLineCmd that calculates the line anew
+// even if its result is cached when bypassCache is set
+func (m *Model) calculateLineCmdWithCache(expr string, index int, bypassCache bool) tea.Cmd {
+	if m.Calculations == nil {
+		m.Calculations = NewCalculationManager(len(m.Inputs))
+	}
+	calculations := m.Calculations
+	ctx := calculations.StartCalculation(index, expr)
+
+	tab := m.TabID
+	inputs, results := m.inputValues(), m.Results
+	syncUserFunctions(inputs)
+	return func() tea.Msg {
+		result, ok := calculations.Run(ctx, index, func(ctx context.Context) string {
+			// Like ans references, variables take the results current when the calculation runs
+			variables := assignedVariables(inputs, results, index)
+			return calculateVariableExpression(ctx, expr, results, index, variables, bypassCache)
+		})
+		if !ok {
+			// A newer calculation of the line replaces this one
+			return nil
+		}
+		return CalculationMsg{Index: index, Result: result, Tab: tab}
+	}
+}
+
+// currentWorksheet captures the state of the active tab
+func (m *Model) currentWorksheet() Worksheet {
+	return Worksheet{
+		ID:            m.TabID,
+		Inputs:        m.Inputs,
+		Results:       m.Results,
+		HiddenResults: m.HiddenResults,
+		Notes:         m.Notes,
+		Focused:       m.Focused,
+		UndoSystem:    m.UndoSystem,
+	}
+}
+
+// cloneWorksheet copies a worksheet with fresh inputs and its own empty undo history
+func cloneWorksheet(sheet Worksheet, id int) Worksheet {
+	// Recreate the inputs so the clone shares no text buffers with the source
+	inputs := make([]textinput.Model, len(sheet.Inputs))
+	for i, input := range sheet.Inputs {
+		clone := textinput.New()
+		clone.Placeholder = input.Placeholder
+		clone.Width = input.Width
+		clone.Prompt = ""
+		clone.SetValue(input.Value())
+		inputs[i] = clone
+	}
+
+	return Worksheet{
+		ID:            id,
+		Inputs:        inputs,
+		Results:       slices.Clone(sheet.Results),
+		HiddenResults: slices.Clone(sheet.HiddenResults),
+		Notes:         slices.Clone(sheet.Notes),
+		Focused:       sheet.Focused,
+		UndoSystem:    NewUndoSystemWithSize(config.UndoLimit),
+	}
+}
+
+// showWorksheet makes a worksheet the active tab and recalculates it, as
+// results of calculations still running when it was left were dropped
+func (m *Model) showWorksheet(sheet Worksheet) {
+	m.TabID = sheet.ID
+	m.Inputs = sheet.Inputs
+	m.Results = sheet.Results
+	m.HiddenResults = sheet.HiddenResults
+	m.Notes = sheet.Notes
+	m.Focused = min(sheet.Focused, len(sheet.Inputs)-1)
+	m.UndoSystem = sheet.UndoSystem
+	m.Calculating = make([]bool, len(m.Inputs))
+	m.DefinedNames = nil
+
+	for i := range m.Inputs {
+		if i == m.Focused {
+			m.Inputs[i].Focus()
+		} else {
+			m.Inputs[i].Blur()
+		}
+	}
+
+	m.recalculateAll()
+	m.scrollToFocused()
+}
+
+// cloneTab copies the active worksheet into a new tab and switches to it
+func (m *Model) cloneTab() (tea.Model, tea.Cmd) {
+	// The first clone turns the single worksheet into the first tab
+	if len(m.Tabs) == 0 {
+		m.Tabs = []Worksheet{m.currentWorksheet()}
+		m.ActiveTab = 0
+	}
+	m.Tabs[m.ActiveTab] = m.currentWorksheet()
+
+	m.NextTabID++
+	clone := cloneWorksheet(m.Tabs[m.ActiveTab], m.NextTabID)
+	m.Tabs = slices.Insert(m.Tabs, m.ActiveTab+1, clone)
+	m.ActiveTab++
+	m.showWorksheet(clone)
+	return *m, textinput.Blink
+}
+
+// switchTab activates the tab delta positions away, wrapping around
+func (m *Model) switchTab(delta int) (tea.Model, tea.Cmd) {
+	if len(m.Tabs) < 2 {
+		return *m, textinput.Blink
+	}
+	m.Tabs[m.ActiveTab] = m.currentWorksheet()
+	m.ActiveTab = (m.ActiveTab + delta + len(m.Tabs)) % len(m.Tabs)
+	m.showWorksheet(m.Tabs[m.ActiveTab])
+	return *m, textinput.Blink
+}
+
+// renderTabBorder draws the top border of the input pane listing the tabs
+func (m Model) renderTabBorder(width int) string {
+	border := lipgloss.RoundedBorder()
+	var tabs []string
+	for i := range m.Tabs {
+		tab := fmt.Sprintf(" %d ", i+1)
+		if i == m.ActiveTab {
+			tab = lipgloss.NewStyle().Foreground(m.Theme.focusedColor).Bold(true).Render(fmt.Sprintf("[%d]", i+1))
+		}
+		tabs = append(tabs, tab)
+	}
+	title := border.Top + strings.Join(tabs, border.Top)
+	fill := max(0, width-2-lipgloss.Width(title))
+	return border.TopLeft + title + strings.Repeat(border.Top, fill) + border.TopRight
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
-	"github.com/charmbracelet/bubbletea"
 	_ "embed"
+	"time"
+
+	"github.com/charmbracelet/bubbletea"
 )
 
 //go:embed help.txt
@@ -11,8 +13,17 @@ var helpText string
 //go:embed input.txt
 var inputTemplate string
 
-// Update handles all UI state updates and message routing
+// Update handles all UI state updates and message routing, animating the
+// results of slow calculations the update started
 func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	updated, cmd := m.update(msg)
+	if model, ok := updated.(Model); ok {
+		return model.animateCalculations(cmd)
+	}
+	return updated, cmd
+}
+
+func (m Model) update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	var cmds []tea.Cmd
 
 	switch msg := msg.(type) {
@@ -28,6 +39,17 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		// Check for terminal size changes
 		return m.handleTickMessage()
 
+	case spinnerTickMsg:
+		return m.handleSpinnerTick()
+
+	case exchangeRatesMsg:
+		m.RatesChecked = true
+		m.RatesTime = time.Time(msg)
+		return m, nil
+
+	case ratesRefreshMsg:
+		return m.handleRatesRefreshMessage(msg)
+
 	case CalculationMsg:
 		return m.handleCalculationMessage(msg)
 
@@ -41,6 +63,8 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		return m.handleMouseMessage(msg)
 
 	case tea.KeyMsg:
+		m.SubResult = ""
+
 		// Check for bracketed paste before textinput processes it
 		if msg.Paste {
 			pastedContent := string(msg.Runes)
@@ -62,14 +86,21 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	// Only update textinput if we're not showing completions (to avoid double updates)
 	if !m.ShowCompletions {
 		var cmd tea.Cmd
+		previousExpr := m.Inputs[m.Focused].Value()
+		previousCursor := m.Inputs[m.Focused].Position()
 		m.Inputs[m.Focused], cmd = m.Inputs[m.Focused].Update(msg)
 		cmds = append(cmds, cmd)
+		if key, isKey := msg.(tea.KeyMsg); isKey && m.Inputs[m.Focused].Value() != previousExpr {
+			// Typing is undone a word at a time
+			m.recordTyping(previousExpr, previousCursor, key)
+		}
 
-		// Only trigger calculation if not already calculating and input is non-empty
+		// Calculate a non-empty input unless it is already being calculated.
+		// An edit supersedes the calculation of the previous text.
 		currentExpr := m.Inputs[m.Focused].Value()
-		if !m.Calculating[m.Focused] && currentExpr != "" {
+		if currentExpr != "" && (currentExpr != previousExpr || !m.Calculating[m.Focused]) {
 			m.Calculating[m.Focused] = true
-			cmds = append(cmds, CalculateCmd(currentExpr, m.Results, m.Focused))
+			cmds = append(cmds, m.calculateLineCmd(currentExpr, m.Focused))
 		} else if currentExpr == "" {
 			// Clear result when input is empty
 			m.Results[m.Focused] = ""
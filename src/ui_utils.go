@@ -1,7 +1,9 @@
 package main
 
 import (
+	"log"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/atotto/clipboard"
@@ -15,10 +17,26 @@ type pasteErrMsg struct{ err error }
 type tickMsg time.Time
 type processPasteMsg struct{}
 
+// exchangeRatesMsg reports when the exchange rates in use were published
+type exchangeRatesMsg time.Time
+
+// ratesRefreshMsg reports the outcome of an exchange rates update forced with
+// Alt+Shift+U and when the rates in use were published
+type ratesRefreshMsg struct {
+	updated bool
+	time    time.Time
+}
+
+// readClipboard and writeClipboard access the clipboard, replaced in tests
+var (
+	readClipboard  = clipboard.ReadAll
+	writeClipboard = clipboard.WriteAll
+)
+
 // Paste command - reads clipboard content (fallback for manual paste trigger)
 func PasteCmd() tea.Cmd {
 	return func() tea.Msg {
-		str, err := clipboard.ReadAll()
+		str, err := readClipboard()
 		if err != nil {
 			return pasteErrMsg{err}
 		}
@@ -26,6 +44,24 @@ func PasteCmd() tea.Cmd {
 	}
 }
 
+// updateExchangeRatesCmd fetches the exchange rates if they are outdated
+func updateExchangeRatesCmd() tea.Cmd {
+	return func() tea.Msg {
+		if UpdateExchangeRates() {
+			log.Println("Exchange rates updated successfully")
+		}
+		return exchangeRatesMsg(ExchangeRatesTime())
+	}
+}
+
+// refreshExchangeRatesCmd fetches the exchange rates however recent they are
+func refreshExchangeRatesCmd() tea.Cmd {
+	return func() tea.Msg {
+		updated := RefreshExchangeRates()
+		return ratesRefreshMsg{updated: updated, time: ExchangeRatesTime()}
+	}
+}
+
 // tick generates periodic tick messages for terminal size checking
 func tick() tea.Cmd {
 	return tea.Tick(time.Second*2, func(t time.Time) tea.Msg {
@@ -42,34 +78,77 @@ func processPasteCmd() tea.Cmd {
 
 // scrollToFocused scrolls viewports to show the focused line
 func (m *Model) scrollToFocused() {
-	focusedLine := m.Focused
-
 	// Ensure viewport heights are positive to prevent division by zero or negative calculations
 	if m.InputViewport.Height <= 0 || m.ResultViewport.Height <= 0 {
 		return
 	}
 
-	// Calculate safe scroll offset that doesn't exceed content bounds
-	if focusedLine >= m.InputViewport.Height {
-		newOffset := focusedLine - m.InputViewport.Height + 1
-		// Ensure offset doesn't go beyond available content
-		maxOffset := len(m.Inputs) - m.InputViewport.Height
-		if maxOffset < 0 {
-			maxOffset = 0
-		}
-		if newOffset > maxOffset {
-			newOffset = maxOffset
-		}
-		if newOffset < 0 {
-			newOffset = 0
-		}
+	// Lines with wrapped results take several rows, so scroll by rows, keeping
+	// the completion popup below the focused line in view but not the line
+	// itself out of it
+	start := m.lineRow(m.Focused)
+	end := start + m.lineHeight(m.Focused) + m.popupRows(m.Focused)
+	m.setScrollOffset(min(max(0, end-m.InputViewport.Height), start))
+}
 
-		m.InputViewport.SetYOffset(newOffset)
-		m.ResultViewport.SetYOffset(newOffset)
-	} else {
-		m.InputViewport.SetYOffset(0)
-		m.ResultViewport.SetYOffset(0)
+// lineNumberDigits returns the width of the line numbers in the gutter,
+// fitting the largest one but at least two digits
+func lineNumberDigits(lines int) int {
+	return max(2, len(strconv.Itoa(lines)))
+}
+
+// gutterWidth returns the width of the gutter: the line number, the separator
+// and a space
+func (m Model) gutterWidth() int {
+	return lineNumberDigits(len(m.Inputs)) + 2
+}
+
+// scrollViewports scrolls both panes by delta rows, keeping them aligned and
+// within the content, without moving the focus
+func (m *Model) scrollViewports(delta int) {
+	m.setScrollOffset(m.InputViewport.YOffset + delta)
+}
+
+// setScrollOffset scrolls both panes to the same row, within the content.
+// Every line takes as many rows in the result pane as in the input pane, so
+// the same offset keeps each result next to its input.
+func (m *Model) setScrollOffset(offset int) {
+	maxOffset := max(0, m.lineRow(len(m.Inputs))-m.InputViewport.Height)
+	offset = min(max(offset, 0), maxOffset)
+	m.InputViewport.SetYOffset(offset)
+	m.ResultViewport.SetYOffset(offset)
+}
+
+// paneRatioPresets are the input pane shares cycled through with Alt+S
+var paneRatioPresets = []float64{0.5, 0.6, 0.7, 0.8}
+
+// splitWidth divides the terminal width between the input and result panes,
+// giving ratio of it to the input pane and the rest to the result pane
+func splitWidth(width int, ratio float64) (int, int) {
+	if ratio <= 0 {
+		ratio = DefaultPaneRatio
+	}
+	input := int(float64(width) * ratio)
+	return input, width - input
+}
+
+// paneRatio returns the share of the width taken by the input pane, all of it
+// when results are shown inline
+func (m Model) paneRatio() float64 {
+	if m.InlineResults {
+		return 1
+	}
+	if m.PaneRatio <= 0 {
+		return DefaultPaneRatio
 	}
+	return m.PaneRatio
+}
+
+// inputPaneWidth returns the width of the input pane including its border,
+// which is also where the result pane starts
+func (m Model) inputPaneWidth() int {
+	width, _ := splitWidth(m.Width, m.paneRatio())
+	return width
 }
 
 // handleWindowResize handles terminal window resize events
@@ -78,20 +157,22 @@ func (m *Model) handleWindowResize(msg tea.WindowSizeMsg) {
 	m.Height = msg.Height
 	
 	// Ensure minimum viable viewport widths
-	inputWidth := int(float64(m.Width)*0.7) - 2
+	inputPaneWidth, resultPaneWidth := splitWidth(m.Width, m.paneRatio())
+	inputWidth := inputPaneWidth - 2
 	if inputWidth < 1 {
 		inputWidth = 1
 	}
 	m.InputViewport.Width = inputWidth
 	
-	resultWidth := int(float64(m.Width)*0.3) - 2
+	resultWidth := resultPaneWidth - 2
 	if resultWidth < 1 {
 		resultWidth = 1
 	}
 	m.ResultViewport.Width = resultWidth
 	
 	// Ensure minimum viable viewport heights
-	viewportHeight := m.Height - 2
+	// Leave a row for the status bar below the panes
+	viewportHeight := m.Height - 3
 	if viewportHeight < 1 {
 		viewportHeight = 1
 	}
@@ -101,12 +182,13 @@ func (m *Model) handleWindowResize(msg tea.WindowSizeMsg) {
 	// Update input widths with safety check
 	// Reduce width by 3 chars to start scrolling before hitting the edge
 	for i := range m.Inputs {
-		inputFieldWidth := m.InputViewport.Width - 6 - 3  // -3 for early scrolling
+		inputFieldWidth := m.InputViewport.Width - m.gutterWidth() - 2 - 3  // -3 for early scrolling
 		if inputFieldWidth < 1 {
 			inputFieldWidth = 1
 		}
 		m.Inputs[i].Width = inputFieldWidth
 	}
+	m.followLastLine()
 }
 
 // handleTickMessage handles periodic tick messages for terminal size checking
@@ -119,13 +201,14 @@ func (m *Model) handleTickMessage() (tea.Model, tea.Cmd) {
 			return tea.WindowSizeMsg{Width: w, Height: h}
 		})
 	}
+	m.followLastLine()
 	return *m, tick()
 }
 
-// CalculateCmd creates a command to calculate an expression
-func CalculateCmd(expr string, results []string, index int) tea.Cmd {
+// CalculateCmd creates a command to calculate an expression with the variables assigned before it
+func CalculateCmd(expr string, results []string, index int, variables map[string]string) tea.Cmd {
 	return func() tea.Msg {
-		result := CalculateExpression(expr, results, index)
+		result := CalculateVariableExpression(expr, results, index, variables)
 		return CalculationMsg{Index: index, Result: result}
 	}
 }
@@ -1,15 +1,27 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
 	"github.com/charmbracelet/bubbles/textinput"
+	"github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
 )
 
 // UndoState represents a snapshot of the calculator state for undo/redo
 type UndoState struct {
-	InputValues []string // Store the actual text values
-	Results     []string
-	Focused     int
-	CursorPos   int // Store cursor position of focused input
+	InputValues   []string `json:"inputs"` // Store the actual text values
+	Results       []string `json:"results"`
+	Focused       int      `json:"focused"`
+	CursorPos     int      `json:"cursor"`                  // Store cursor position of focused input
+	HiddenResults []bool   `json:"hiddenResults,omitempty"` // Lines whose result cell is hidden
+	Notes         []string `json:"notes,omitempty"`         // Notes attached to lines
 }
 
 // UndoSystem manages undo/redo functionality
@@ -17,17 +29,45 @@ type UndoSystem struct {
 	undoStack []UndoState
 	redoStack []UndoState
 	maxSize   int
+
+	// Typing extends the latest entry while a typing run is open
+	typing     bool      // A typing run is open
+	typingLine int       // Line the typing run edits
+	lastTyped  time.Time // When the typing run was last extended
 }
 
-// NewUndoSystem creates a new undo system with specified max size
+// typingPause is how long typing may pause before it starts a new undo entry
+const typingPause = time.Second
+
+// DefaultUndoLimit is how many states are kept for undo unless configured
+const DefaultUndoLimit = 50
+
+// NewUndoSystem creates a new undo system keeping the default number of states
 func NewUndoSystem() *UndoSystem {
+	return NewUndoSystemWithSize(DefaultUndoLimit)
+}
+
+// NewUndoSystemWithSize creates a new undo system keeping the last maxSize
+// states, or the default number for a size below 1
+func NewUndoSystemWithSize(maxSize int) *UndoSystem {
+	if maxSize < 1 {
+		maxSize = DefaultUndoLimit
+	}
 	return &UndoSystem{
 		undoStack: make([]UndoState, 0),
 		redoStack: make([]UndoState, 0),
-		maxSize:   50, // Keep last 50 states
+		maxSize:   maxSize,
 	}
 }
 
+// trimStack drops the oldest states of stack beyond the max size
+func (u *UndoSystem) trimStack(stack []UndoState) []UndoState {
+	if len(stack) > u.maxSize {
+		return stack[len(stack)-u.maxSize:]
+	}
+	return stack
+}
+
 // createSnapshot creates a snapshot of the current model state
 func (m *Model) createSnapshot() UndoState {
 	inputValues := make([]string, len(m.Inputs))
@@ -44,10 +84,12 @@ func (m *Model) createSnapshot() UndoState {
 	}
 	
 	return UndoState{
-		InputValues: inputValues,
-		Results:     results,
-		Focused:     m.Focused,
-		CursorPos:   cursorPos,
+		InputValues:   inputValues,
+		Results:       results,
+		Focused:       m.Focused,
+		CursorPos:     cursorPos,
+		HiddenResults: slices.Clone(m.HiddenResults),
+		Notes:         slices.Clone(m.Notes),
 	}
 }
 
@@ -57,20 +99,52 @@ func (m *Model) saveState() {
 		return
 	}
 	
-	snapshot := m.createSnapshot()
-	
+	m.pushUndoState(m.createSnapshot())
+}
+
+// pushUndoState adds a snapshot to the undo stack, ending the typing run
+func (m *Model) pushUndoState(snapshot UndoState) {
+	m.UndoSystem.typing = false
+
 	// Add to undo stack
 	m.UndoSystem.undoStack = append(m.UndoSystem.undoStack, snapshot)
 	
 	// Limit stack size
-	if len(m.UndoSystem.undoStack) > m.UndoSystem.maxSize {
-		m.UndoSystem.undoStack = m.UndoSystem.undoStack[1:]
-	}
+	m.UndoSystem.undoStack = m.UndoSystem.trimStack(m.UndoSystem.undoStack)
 	
 	// Clear redo stack when new action is performed
 	m.UndoSystem.redoStack = m.UndoSystem.redoStack[:0]
 }
 
+// recordTyping records an edit typed into the focused line, given its value
+// and cursor before it. Typing on the same line is coalesced into one undo
+// entry until a pause, or until a space or operator ends the word, so the
+// state is only saved when an entry starts.
+func (m *Model) recordTyping(previousValue string, previousCursor int, key tea.KeyMsg) {
+	undo := m.UndoSystem
+	if undo == nil {
+		return
+	}
+
+	now := time.Now()
+	if !undo.typing || undo.typingLine != m.Focused || now.Sub(undo.lastTyped) >= typingPause {
+		// Only the focused line changed since the state before the edit
+		before := m.createSnapshot()
+		before.InputValues[m.Focused] = previousValue
+		before.CursorPos = previousCursor
+		m.pushUndoState(before)
+		undo.typing = true
+		undo.typingLine = m.Focused
+	}
+	undo.lastTyped = now
+
+	// The next key starts a new entry after a word or a paste
+	typed := string(key.Runes)
+	if key.Paste || key.Type == tea.KeySpace || typed == " " || slices.Contains(operators, typed) {
+		undo.typing = false
+	}
+}
+
 // restoreState restores a snapshot to the model
 func (m *Model) restoreState(state UndoState) {
 	// Recreate inputs with proper configuration
@@ -100,9 +174,14 @@ func (m *Model) restoreState(state UndoState) {
 	// Restore results
 	m.Results = make([]string, len(state.Results))
 	copy(m.Results, state.Results)
+	syncUserFunctions(state.InputValues)
 	
 	// Restore calculating state (reset to false for all)
 	m.Calculating = make([]bool, len(m.Inputs))
+
+	// Restore hidden result cells and notes
+	m.HiddenResults = slices.Clone(state.HiddenResults)
+	m.Notes = slices.Clone(state.Notes)
 	
 	// Restore focus
 	m.Focused = state.Focused
@@ -124,14 +203,13 @@ func (m *Model) undo() bool {
 		return false
 	}
 	
-	// Save current state to redo stack
+	// Save current state to redo stack, typing after the undo starts a new entry
+	m.UndoSystem.typing = false
 	currentState := m.createSnapshot()
 	m.UndoSystem.redoStack = append(m.UndoSystem.redoStack, currentState)
 	
 	// Limit redo stack size
-	if len(m.UndoSystem.redoStack) > m.UndoSystem.maxSize {
-		m.UndoSystem.redoStack = m.UndoSystem.redoStack[1:]
-	}
+	m.UndoSystem.redoStack = m.UndoSystem.trimStack(m.UndoSystem.redoStack)
 	
 	// Pop from undo stack and restore
 	lastIndex := len(m.UndoSystem.undoStack) - 1
@@ -149,13 +227,12 @@ func (m *Model) redo() bool {
 	}
 	
 	// Save current state to undo stack
+	m.UndoSystem.typing = false
 	currentState := m.createSnapshot()
 	m.UndoSystem.undoStack = append(m.UndoSystem.undoStack, currentState)
 	
 	// Limit undo stack size
-	if len(m.UndoSystem.undoStack) > m.UndoSystem.maxSize {
-		m.UndoSystem.undoStack = m.UndoSystem.undoStack[1:]
-	}
+	m.UndoSystem.undoStack = m.UndoSystem.trimStack(m.UndoSystem.undoStack)
 	
 	// Pop from redo stack and restore
 	lastIndex := len(m.UndoSystem.redoStack) - 1
@@ -174,4 +251,103 @@ func (m *Model) canUndo() bool {
 // canRedo returns true if redo is possible
 func (m *Model) canRedo() bool {
 	return m.UndoSystem != nil && len(m.UndoSystem.redoStack) > 0
-}
\ No newline at end of file
+}
+
+// undoHistoryVersion is the format of saved undo history. History saved in
+// another format is discarded when loading.
+const undoHistoryVersion = 1
+
+// savedUndoHistory is the undo history kept with the saved session
+type savedUndoHistory struct {
+	Version   int         `json:"version"`
+	Worksheet string      `json:"worksheet"` // Saved lines the history leads up to
+	Undo      []UndoState `json:"undo"`
+	Redo      []UndoState `json:"redo"`
+}
+
+// saveHistory writes the undo and redo stacks to path, recording the
+// worksheet they lead up to
+func (u *UndoSystem) saveHistory(path string, worksheet string) error {
+	data, err := json.Marshal(savedUndoHistory{
+		Version:   undoHistoryVersion,
+		Worksheet: worksheet,
+		Undo:      u.trimStack(u.undoStack),
+		Redo:      u.trimStack(u.redoStack),
+	})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// loadHistory restores the undo and redo stacks saved to path. History saved
+// in another format or for other lines than worksheet is discarded, as undoing
+// it would restore lines unrelated to the worksheet.
+func (u *UndoSystem) loadHistory(path string, worksheet string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var history savedUndoHistory
+	if err := json.Unmarshal(data, &history); err != nil {
+		return err
+	}
+	if history.Version != undoHistoryVersion || history.Worksheet != worksheet {
+		return nil
+	}
+
+	u.typing = false
+	u.undoStack = u.trimStack(history.Undo)
+	u.redoStack = u.trimStack(history.Redo)
+	return nil
+}
+
+// ResultDiff describes a line whose result differs between two snapshots
+type ResultDiff struct {
+	Line   int // 1-based line number
+	Before string
+	After  string
+}
+
+// diffResults compares two result lists line by line and returns the lines that changed
+func diffResults(before, after []string) []ResultDiff {
+	var diffs []ResultDiff
+	for i := 0; i < max(len(before), len(after)); i++ {
+		var oldResult, newResult string
+		if i < len(before) {
+			oldResult = before[i]
+		}
+		if i < len(after) {
+			newResult = after[i]
+		}
+		if oldResult != newResult {
+			diffs = append(diffs, ResultDiff{Line: i + 1, Before: oldResult, After: newResult})
+		}
+	}
+	return diffs
+}
+
+// renderResultDiff renders changed result lines for the diff popup
+func (m *Model) renderResultDiff(diffs []ResultDiff) string {
+	if len(diffs) == 0 {
+		return "No result changes"
+	}
+
+	changedStyle := lipgloss.NewStyle().Foreground(m.Theme.ansColor).Bold(true)
+	var lines []string
+	for _, diff := range diffs {
+		before, after := diff.Before, diff.After
+		if before == "" {
+			before = "(empty)"
+		}
+		if after == "" {
+			after = "(empty)"
+		}
+		lines = append(lines, fmt.Sprintf("%3d│ %s → %s", diff.Line, before, changedStyle.Render(after)))
+	}
+	return strings.Join(lines, "\n")
+}
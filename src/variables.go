@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+)
+
+// assignmentRegex matches variable assignments like "x = 5" or "rate := 0.19",
+// but not comparisons like "x == 5" or function definitions like "f(x) = x^2"
+var assignmentRegex = regexp.MustCompile(`^\s*([\p{L}_][\p{L}\d_]*)\s*:?=\s*([^=\s].*)$`)
+
+// identifierRegex matches names that may refer to a variable
+var identifierRegex = regexp.MustCompile(`[\p{L}_][\p{L}\d_]*`)
+
+// parseAssignment splits an assignment into the variable name and the
+// expression of its value. Names of ans references can't be assigned.
+func parseAssignment(input string) (string, string, bool) {
+	parts := assignmentRegex.FindStringSubmatch(stripComment(input))
+	if parts == nil || ansKeywordRegex().MatchString(parts[1]) || ansReferenceRegex().MatchString(parts[1]) {
+		return "", "", false
+	}
+	return parts[1], strings.TrimSpace(parts[2]), true
+}
+
+// substituteVariables replaces the names of variables by their values in the
+// expression part of input, leaving comments and directives untouched
+func substituteVariables(input string, variables map[string]string) string {
+	if len(variables) == 0 {
+		return input
+	}
+
+	expr := stripComment(input)
+	return replaceIdentifiers(expr, func(name string) (string, bool) {
+		value, exists := variables[name]
+		return "(" + ansValue(value) + ")", exists
+	}) + input[len(expr):]
+}
+
+// CalculateVariableExpression calculates a line that may assign a variable or
+// use the variables and labels of earlier lines. An assignment's result is the
+// value of its expression, a function definition has no result.
+func CalculateVariableExpression(expr string, results []string, currentIndex int, variables map[string]string) string {
+	return CalculateVariableExpressionWithContext(context.Background(), expr, results, currentIndex, variables)
+}
+
+// CalculateVariableExpressionWithContext is CalculateVariableExpression for a
+// calculation that may be superseded
+func CalculateVariableExpressionWithContext(ctx context.Context, expr string, results []string, currentIndex int, variables map[string]string) string {
+	return calculateVariableExpression(ctx, expr, results, currentIndex, variables, false)
+}
+
+// calculateVariableExpression is CalculateVariableExpressionWithContext
+// optionally ignoring cached results
+func calculateVariableExpression(ctx context.Context, expr string, results []string, currentIndex int, variables map[string]string, bypassCache bool) string {
+	if _, _, _, ok := parseFunctionDefinition(expr); ok {
+		return ""
+	}
+	line := expr
+	if _, value, ok := parseAssignment(expr); ok {
+		// Keep the comment so directives still apply
+		expr = value + expr[len(stripComment(expr)):]
+	} else {
+		expr = stripLabel(expr)
+	}
+	result, approximate := calculateExpressionWithContext(ctx, substituteVariables(expr, variables), results, currentIndex, bypassCache)
+	recordApproximation(line, result, approximate)
+	return result
+}
+
+// assignedVariables returns the variables assigned and the labels of lines
+// before index with their current values. A later assignment to a name or
+// line with the label replaces earlier ones.
+func assignedVariables(inputs []string, results []string, index int) map[string]string {
+	variables := make(map[string]string)
+	for i := 0; i < index && i < len(inputs) && i < len(results); i++ {
+		if results[i] == "" {
+			continue
+		}
+		if name, _, ok := parseAssignment(inputs[i]); ok {
+			variables[name] = results[i]
+		} else if label, _, ok := parseLabel(inputs[i]); ok {
+			variables[label] = results[i]
+		}
+	}
+	return variables
+}
+
+// inputValues returns the text of every line
+func (m *Model) inputValues() []string {
+	values := make([]string, len(m.Inputs))
+	for i, input := range m.Inputs {
+		values[i] = input.Value()
+	}
+	return values
+}
+
+// calculateLine calculates line index with the variables assigned before it
+// and the functions defined in the worksheet
+func (m *Model) calculateLine(index int) string {
+	syncUserFunctions(m.inputValues())
+	variables := assignedVariables(m.inputValues(), m.Results, index)
+	return CalculateVariableExpression(m.Inputs[index].Value(), m.Results, index, variables)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"github.com/charmbracelet/bubbles/textinput"
+	"github.com/charmbracelet/bubbletea"
+)
+
+// EditMode is the vim mode of the worksheet when vimMode is configured
+type EditMode int
+
+const (
+	ModeInsert EditMode = iota // Keys edit the focused line
+	ModeNormal                 // Keys navigate and edit whole lines
+)
+
+// editModeTags name the modes in the status bar
+var editModeTags = map[EditMode]string{
+	ModeInsert: "INSERT",
+	ModeNormal: "NORMAL",
+}
+
+// enterNormalMode switches to normal mode, which Esc does instead of quitting
+// in vim mode
+func (m *Model) enterNormalMode() (tea.Model, tea.Cmd) {
+	m.Mode = ModeNormal
+	m.PendingKey = ""
+	return *m, textinput.Blink
+}
+
+// handleNormalKeys handles the keys of normal mode. Keys that aren't typed,
+// like arrows, Ctrl and Alt shortcuts, get a nil command to be handled as in
+// insert mode, while typed keys never reach the input.
+func (m *Model) handleNormalKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	if msg.Alt || (msg.Type != tea.KeyRunes && msg.Type != tea.KeySpace && msg.Type != tea.KeyBackspace && msg.Type != tea.KeyDelete) {
+		m.PendingKey = ""
+		return *m, nil
+	}
+
+	// Operators like dd take the key twice
+	key := msg.String()
+	pending := m.PendingKey
+	m.PendingKey = ""
+	switch pending + key {
+	case "dd":
+		m.YankedLine = m.Inputs[m.Focused].Value()
+		return m.deleteLine()
+	case "yy":
+		m.YankedLine = m.Inputs[m.Focused].Value()
+		return *m, textinput.Blink
+	}
+
+	input := &m.Inputs[m.Focused]
+	switch key {
+	case "d", "y":
+		m.PendingKey = key
+	case "h":
+		input.SetCursor(max(0, input.Position()-1))
+	case "l":
+		input.SetCursor(input.Position() + 1)
+	case "j":
+		return m.focusNextLine()
+	case "k":
+		return m.focusPreviousLine()
+	case "p":
+		return m.insertLineBelow(m.YankedLine)
+	case "n":
+		m.jumpToSearchMatch(1)
+	case "N":
+		m.jumpToSearchMatch(-1)
+	case "i":
+		m.Mode = ModeInsert
+	}
+	m.updateInputViewport()
+	return *m, textinput.Blink
+}